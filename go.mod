@@ -3,6 +3,8 @@ module github.com/robertlestak/stratus
 go 1.16
 
 require (
+	filippo.io/age v1.1.1
+	github.com/ProtonMail/go-crypto v0.0.0-20210428141323-04723f9f07d7
 	github.com/aws/aws-sdk-go v1.41.14
 	github.com/go-git/go-git/v5 v5.4.2
 	github.com/google/uuid v1.3.0
@@ -10,6 +12,8 @@ require (
 	github.com/hashicorp/vault/api v1.3.0
 	github.com/mitchellh/mapstructure v1.4.2
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/crypto v0.4.0
 	gopkg.in/yaml.v2 v2.4.0
 	k8s.io/api v0.22.3
+	k8s.io/apimachinery v0.22.3
 )
@@ -0,0 +1,282 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pod annotations which request credential injection
+const (
+	AnnotationAWSRole           = "stratus.io/aws-role"
+	AnnotationAWSRegion         = "stratus.io/aws-region"
+	AnnotationGCPServiceAccount = "stratus.io/gcp-service-account"
+)
+
+const (
+	// agentName is the name of the injected agent sidecar and init container
+	agentName = "stratus-agent"
+	// tokenVolume is the projected service account token volume
+	tokenVolume = "stratus-token"
+	tokenDir    = "/var/run/secrets/stratus"
+	// credsVolume holds credential files written by the agent
+	credsVolume = "stratus-creds"
+	credsDir    = "/var/run/stratus"
+	// gcpCredentialsPath is the GCP credentials file written by the agent
+	gcpCredentialsPath = credsDir + "/gcp/credentials.json"
+	// agentPort is the port the agent serves AWS container credentials on
+	agentPort = "8099"
+	// defaultFSGroup is the pod fsGroup set for GCP injection if the pod has none
+	defaultFSGroup = 2000
+)
+
+// Config configures the injected agent
+type Config struct {
+	// Image is the stratus image the agent runs from
+	Image string
+	// StratusURL is the URL of the stratus server the agent exchanges tokens with
+	StratusURL string
+	// Audience is the audience of the projected service account token
+	Audience string
+	// ClusterName is sent by the agent as the source cluster, if set
+	ClusterName string
+	// TokenExpirationSeconds is the lifetime of the projected token
+	TokenExpirationSeconds int64
+	// FSGroup is set as the pod fsGroup when injecting GCP credentials into a
+	// pod without one, so app containers running as any user can read the
+	// group readable key file
+	FSGroup int64
+}
+
+// ConfigFromEnv returns the injection config from the environment
+func ConfigFromEnv() Config {
+	c := Config{
+		Image:                  os.Getenv("STRATUS_AGENT_IMAGE"),
+		StratusURL:             os.Getenv("STRATUS_URL"),
+		Audience:               os.Getenv("K8S_TOKEN_AUDIENCE"),
+		ClusterName:            os.Getenv("STRATUS_CLUSTER_NAME"),
+		TokenExpirationSeconds: 3600,
+		FSGroup:                defaultFSGroup,
+	}
+	if c.Audience == "" {
+		c.Audience = "stratus"
+	}
+	if v := os.Getenv("STRATUS_AGENT_FS_GROUP"); v != "" {
+		if g, err := strconv.ParseInt(v, 10, 64); err == nil && g > 0 {
+			c.FSGroup = g
+		} else {
+			log.WithField("action", "admission.ConfigFromEnv").Warnf("invalid STRATUS_AGENT_FS_GROUP %q, using %d", v, c.FSGroup)
+		}
+	}
+	return c
+}
+
+// patchOp is a single JSON patch operation
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Review handles an AdmissionReview, returning the review response. Pods with
+// stratus annotations are patched to run the agent; all other requests are
+// allowed unchanged.
+func Review(in *admissionv1.AdmissionReview, cfg Config) *admissionv1.AdmissionReview {
+	out := &admissionv1.AdmissionReview{TypeMeta: in.TypeMeta}
+	if in.Request == nil {
+		return out
+	}
+	l := log.WithFields(log.Fields{
+		"action":    "admission.Review",
+		"uid":       in.Request.UID,
+		"namespace": in.Request.Namespace,
+	})
+	res := &admissionv1.AdmissionResponse{UID: in.Request.UID, Allowed: true}
+	out.Response = res
+	var pod corev1.Pod
+	if err := json.Unmarshal(in.Request.Object.Raw, &pod); err != nil {
+		l.WithError(err).Error("failed to decode pod")
+		res.Allowed = false
+		res.Result = &metav1.Status{Message: err.Error()}
+		return out
+	}
+	patch := Mutate(&pod, in.Request.Namespace, cfg)
+	if len(patch) == 0 {
+		return out
+	}
+	pd, err := json.Marshal(patch)
+	if err != nil {
+		l.WithError(err).Error("failed to encode patch")
+		res.Allowed = false
+		res.Result = &metav1.Status{Message: err.Error()}
+		return out
+	}
+	pt := admissionv1.PatchTypeJSONPatch
+	res.Patch = pd
+	res.PatchType = &pt
+	l.WithField("pod", pod.GenerateName+pod.Name).Info("injected stratus agent")
+	return out
+}
+
+// Mutate returns the JSON patch which injects the agent into pod, or nil if
+// the pod does not request credentials or already has the agent
+func Mutate(pod *corev1.Pod, namespace string, cfg Config) []patchOp {
+	a := pod.Annotations
+	role, gsa := a[AnnotationAWSRole], a[AnnotationGCPServiceAccount]
+	if role == "" && gsa == "" {
+		return nil
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == agentName {
+			return nil
+		}
+	}
+	sa := pod.Spec.ServiceAccountName
+	if sa == "" {
+		sa = "default"
+	}
+	if namespace == "" {
+		namespace = pod.Namespace
+	}
+	agentEnv := []corev1.EnvVar{
+		{Name: "STRATUS_URL", Value: cfg.StratusURL},
+		{Name: "STRATUS_SOURCE_ID", Value: fmt.Sprintf("system:serviceaccount:%s:%s", namespace, sa)},
+		{Name: "STRATUS_TOKEN_PATH", Value: tokenDir + "/token"},
+	}
+	if cfg.ClusterName != "" {
+		agentEnv = append(agentEnv, corev1.EnvVar{Name: "STRATUS_CLUSTER_NAME", Value: cfg.ClusterName})
+	}
+	var appEnv []corev1.EnvVar
+	if role != "" {
+		agentEnv = append(agentEnv,
+			corev1.EnvVar{Name: "STRATUS_AWS_ROLE", Value: role},
+			corev1.EnvVar{Name: "STRATUS_AWS_REGION", Value: a[AnnotationAWSRegion]},
+			corev1.EnvVar{Name: "STRATUS_AGENT_ADDR", Value: "127.0.0.1:" + agentPort},
+		)
+		appEnv = append(appEnv, corev1.EnvVar{
+			Name:  "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+			Value: "http://127.0.0.1:" + agentPort + "/credentials",
+		})
+	}
+	if gsa != "" {
+		agentEnv = append(agentEnv,
+			corev1.EnvVar{Name: "STRATUS_GCP_SERVICE_ACCOUNT", Value: gsa},
+			corev1.EnvVar{Name: "STRATUS_GCP_CREDENTIALS_PATH", Value: gcpCredentialsPath},
+		)
+		appEnv = append(appEnv, corev1.EnvVar{
+			Name:  "GOOGLE_APPLICATION_CREDENTIALS",
+			Value: gcpCredentialsPath,
+		})
+	}
+	exp := cfg.TokenExpirationSeconds
+	volumes := []corev1.Volume{
+		{
+			Name: tokenVolume,
+			VolumeSource: corev1.VolumeSource{
+				Projected: &corev1.ProjectedVolumeSource{
+					Sources: []corev1.VolumeProjection{{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          cfg.Audience,
+							ExpirationSeconds: &exp,
+							Path:              "token",
+						},
+					}},
+				},
+			},
+		},
+		{
+			Name:         credsVolume,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+		},
+	}
+	agentMounts := []corev1.VolumeMount{
+		{Name: tokenVolume, MountPath: tokenDir, ReadOnly: true},
+		{Name: credsVolume, MountPath: credsDir},
+	}
+	agent := corev1.Container{
+		Name:         agentName,
+		Image:        cfg.Image,
+		Args:         []string{"agent"},
+		Env:          agentEnv,
+		VolumeMounts: agentMounts,
+	}
+	var patch []patchOp
+	patch = append(patch, appendOps("/spec/volumes", len(pod.Spec.Volumes), volumes)...)
+	if gsa != "" {
+		patch = append(patch, fsGroupOps(pod, cfg.FSGroup)...)
+		// write the GCP credentials before the app containers start
+		ic := agent
+		ic.Name = agentName + "-init"
+		ic.Env = append(append([]corev1.EnvVar{}, agentEnv...), corev1.EnvVar{Name: "STRATUS_AGENT_ONCE", Value: "true"})
+		patch = append(patch, appendOps("/spec/initContainers", len(pod.Spec.InitContainers), []corev1.Container{ic})...)
+	}
+	for i, c := range pod.Spec.Containers {
+		base := fmt.Sprintf("/spec/containers/%d", i)
+		var env []corev1.EnvVar
+		for _, e := range appEnv {
+			if !hasEnv(c.Env, e.Name) {
+				env = append(env, e)
+			}
+		}
+		patch = append(patch, appendOps(base+"/env", len(c.Env), env)...)
+		if gsa != "" {
+			patch = append(patch, appendOps(base+"/volumeMounts", len(c.VolumeMounts), []corev1.VolumeMount{
+				{Name: credsVolume, MountPath: credsDir, ReadOnly: true},
+			})...)
+		}
+	}
+	patch = append(patch, appendOps("/spec/containers", len(pod.Spec.Containers), []corev1.Container{agent})...)
+	return patch
+}
+
+// fsGroupOps returns the patch operations which set the pod fsGroup, so the
+// credentials volume and the key file the agent writes are owned by a group
+// every container is a member of. An existing fsGroup is kept.
+func fsGroupOps(pod *corev1.Pod, fsGroup int64) []patchOp {
+	if fsGroup <= 0 {
+		fsGroup = defaultFSGroup
+	}
+	sc := pod.Spec.SecurityContext
+	if sc == nil {
+		return []patchOp{{Op: "add", Path: "/spec/securityContext", Value: map[string]int64{"fsGroup": fsGroup}}}
+	}
+	if sc.FSGroup == nil {
+		return []patchOp{{Op: "add", Path: "/spec/securityContext/fsGroup", Value: fsGroup}}
+	}
+	return nil
+}
+
+// appendOps returns the patch operations which append values to the array at
+// path, creating the array if it has no elements
+func appendOps(path string, existing int, values interface{}) []patchOp {
+	var items []interface{}
+	b, _ := json.Marshal(values)
+	json.Unmarshal(b, &items)
+	if len(items) == 0 {
+		return nil
+	}
+	if existing == 0 {
+		return []patchOp{{Op: "add", Path: path, Value: items}}
+	}
+	ops := make([]patchOp, 0, len(items))
+	for _, it := range items {
+		ops = append(ops, patchOp{Op: "add", Path: path + "/-", Value: it})
+	}
+	return ops
+}
+
+// hasEnv returns true if name is set in env
+func hasEnv(env []corev1.EnvVar, name string) bool {
+	for _, e := range env {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
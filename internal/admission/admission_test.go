@@ -0,0 +1,318 @@
+package admission
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var testConfig = Config{
+	Image:                  "stratus:latest",
+	StratusURL:             "https://stratus.stratus.svc",
+	Audience:               "stratus",
+	TokenExpirationSeconds: 3600,
+	FSGroup:                2000,
+}
+
+// readReview reads an AdmissionReview fixture from testdata
+func readReview(t *testing.T, name string) *admissionv1.AdmissionReview {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ar admissionv1.AdmissionReview
+	if err := json.Unmarshal(b, &ar); err != nil {
+		t.Fatal(err)
+	}
+	return &ar
+}
+
+// applyPatch applies the add operations of a JSON patch to doc
+func applyPatch(t *testing.T, doc []byte, patch []byte) []byte {
+	t.Helper()
+	var root interface{}
+	if err := json.Unmarshal(doc, &root); err != nil {
+		t.Fatal(err)
+	}
+	var ops []patchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		if op.Op != "add" {
+			t.Fatalf("unexpected %s operation on %s", op.Op, op.Path)
+		}
+		parts := strings.Split(strings.TrimPrefix(op.Path, "/"), "/")
+		root = addValue(t, root, parts, op.Value, op.Path)
+	}
+	b, err := json.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// addValue adds value at the path below node, returning the updated node
+func addValue(t *testing.T, node interface{}, parts []string, value interface{}, path string) interface{} {
+	t.Helper()
+	k := parts[0]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if len(parts) == 1 {
+			if _, ok := n[k]; ok {
+				t.Fatalf("add %s replaces an existing value", path)
+			}
+			n[k] = value
+			return n
+		}
+		child, ok := n[k]
+		if !ok {
+			t.Fatalf("add %s: %s does not exist", path, k)
+		}
+		n[k] = addValue(t, child, parts[1:], value, path)
+		return n
+	case []interface{}:
+		if len(parts) == 1 {
+			if k != "-" {
+				t.Fatalf("add %s inserts into an array", path)
+			}
+			return append(n, value)
+		}
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 || i >= len(n) {
+			t.Fatalf("add %s: invalid index %s", path, k)
+		}
+		n[i] = addValue(t, n[i], parts[1:], value, path)
+		return n
+	}
+	t.Fatalf("add %s: %s is not an object or array", path, k)
+	return nil
+}
+
+// envValue returns the value of name in env
+func envValue(env []corev1.EnvVar, name string) string {
+	for _, e := range env {
+		if e.Name == name {
+			return e.Value
+		}
+	}
+	return ""
+}
+
+// hasMount returns true if the container mounts the volume at path
+func hasMount(c corev1.Container, volume, path string) bool {
+	for _, m := range c.VolumeMounts {
+		if m.Name == volume && m.MountPath == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReview(t *testing.T) {
+	tests := []struct {
+		name string
+		// wantPatch is false if the pod is allowed unchanged
+		wantPatch bool
+		// wantEnv are the env values of each app container after the patch
+		wantEnv map[string]map[string]string
+		// wantInit are the init containers after the patch
+		wantInit []string
+		// wantAgentEnv are env values of the agent sidecar
+		wantAgentEnv map[string]string
+		// wantFSGroup is the pod fsGroup after the patch, 0 if unset
+		wantFSGroup int64
+	}{
+		{
+			name:      "aws",
+			wantPatch: true,
+			wantEnv: map[string]map[string]string{
+				"app":   {"LOG_LEVEL": "info", "AWS_CONTAINER_CREDENTIALS_FULL_URI": "http://127.0.0.1:8099/credentials"},
+				"proxy": {"AWS_CONTAINER_CREDENTIALS_FULL_URI": "http://127.0.0.1:9000/creds"},
+			},
+			wantAgentEnv: map[string]string{
+				"STRATUS_SOURCE_ID":  "system:serviceaccount:stratus-dev:stratus-example",
+				"STRATUS_AWS_ROLE":   "arn:aws:iam::123456789012:role/stratus-example",
+				"STRATUS_AWS_REGION": "us-east-1",
+				"STRATUS_AGENT_ADDR": "127.0.0.1:8099",
+				"STRATUS_TOKEN_PATH": "/var/run/secrets/stratus/token",
+				"STRATUS_URL":        "https://stratus.stratus.svc",
+			},
+		},
+		{
+			name:      "gcp",
+			wantPatch: true,
+			wantEnv: map[string]map[string]string{
+				"app": {"LOG_LEVEL": "info", "GOOGLE_APPLICATION_CREDENTIALS": "/var/run/stratus/gcp/credentials.json"},
+			},
+			wantInit: []string{"migrate", "stratus-agent-init"},
+			wantAgentEnv: map[string]string{
+				"STRATUS_SOURCE_ID":            "system:serviceaccount:stratus-dev:stratus-example",
+				"STRATUS_GCP_SERVICE_ACCOUNT":  "stratus-example@sandbox.iam.gserviceaccount.com",
+				"STRATUS_GCP_CREDENTIALS_PATH": "/var/run/stratus/gcp/credentials.json",
+				"STRATUS_AWS_ROLE":             "",
+			},
+			wantFSGroup: 2000,
+		},
+		{
+			name:      "nonroot",
+			wantPatch: true,
+			wantEnv: map[string]map[string]string{
+				"app": {"LOG_LEVEL": "info", "GOOGLE_APPLICATION_CREDENTIALS": "/var/run/stratus/gcp/credentials.json"},
+			},
+			wantInit:    []string{"migrate", "stratus-agent-init"},
+			wantFSGroup: 2000,
+		},
+		{
+			name:      "fsgroup",
+			wantPatch: true,
+			wantEnv: map[string]map[string]string{
+				"app": {"LOG_LEVEL": "info", "GOOGLE_APPLICATION_CREDENTIALS": "/var/run/stratus/gcp/credentials.json"},
+			},
+			wantInit:    []string{"migrate", "stratus-agent-init"},
+			wantFSGroup: 3000,
+		},
+		{
+			name:      "bare",
+			wantPatch: true,
+			wantEnv: map[string]map[string]string{
+				"app": {
+					"AWS_CONTAINER_CREDENTIALS_FULL_URI": "http://127.0.0.1:8099/credentials",
+					"GOOGLE_APPLICATION_CREDENTIALS":     "/var/run/stratus/gcp/credentials.json",
+				},
+			},
+			wantInit: []string{"stratus-agent-init"},
+			wantAgentEnv: map[string]string{
+				"STRATUS_SOURCE_ID": "system:serviceaccount:default:default",
+			},
+			wantFSGroup: 2000,
+		},
+		{name: "injected"},
+		{name: "unannotated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := readReview(t, tt.name)
+			out := Review(in, testConfig)
+			if out.Response == nil || out.Response.UID != in.Request.UID || !out.Response.Allowed {
+				t.Fatalf("Review() response = %+v", out.Response)
+			}
+			if out.Kind != "AdmissionReview" || out.APIVersion != "admission.k8s.io/v1" {
+				t.Errorf("Review() type = %+v", out.TypeMeta)
+			}
+			if !tt.wantPatch {
+				if out.Response.Patch != nil || out.Response.PatchType != nil {
+					t.Fatalf("Review() patched the pod: %s", out.Response.Patch)
+				}
+				return
+			}
+			if out.Response.PatchType == nil || *out.Response.PatchType != admissionv1.PatchTypeJSONPatch {
+				t.Fatalf("Review() patch type = %v", out.Response.PatchType)
+			}
+			golden, err := ioutil.ReadFile(filepath.Join("testdata", tt.name+".patch.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want interface{}
+			json.Unmarshal(out.Response.Patch, &got)
+			if err := json.Unmarshal(golden, &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Review() patch =\n%s\nwant\n%s", out.Response.Patch, golden)
+			}
+
+			var pod corev1.Pod
+			if err := json.Unmarshal(applyPatch(t, in.Request.Object.Raw, out.Response.Patch), &pod); err != nil {
+				t.Fatal(err)
+			}
+			var agent *corev1.Container
+			for i, c := range pod.Spec.Containers {
+				if c.Name == agentName {
+					if agent != nil {
+						t.Fatal("agent injected more than once")
+					}
+					agent = &pod.Spec.Containers[i]
+					continue
+				}
+				want := tt.wantEnv[c.Name]
+				if len(c.Env) != len(want) {
+					t.Errorf("container %s env = %+v, want %v", c.Name, c.Env, want)
+				}
+				for k, v := range want {
+					if got := envValue(c.Env, k); got != v {
+						t.Errorf("container %s %s = %q, want %q", c.Name, k, got, v)
+					}
+				}
+				if gcp := len(tt.wantInit) > 0; hasMount(c, credsVolume, credsDir) != gcp {
+					t.Errorf("container %s mounts credentials = %v, want %v", c.Name, !gcp, gcp)
+				}
+			}
+			if agent == nil {
+				t.Fatal("agent not injected")
+			}
+			if agent.Image != testConfig.Image || !hasMount(*agent, tokenVolume, tokenDir) || !hasMount(*agent, credsVolume, credsDir) {
+				t.Errorf("agent = %+v", agent)
+			}
+			for k, v := range tt.wantAgentEnv {
+				if got := envValue(agent.Env, k); got != v {
+					t.Errorf("agent %s = %q, want %q", k, got, v)
+				}
+			}
+			var inits []string
+			for _, c := range pod.Spec.InitContainers {
+				inits = append(inits, c.Name)
+				if c.Name == agentName+"-init" && envValue(c.Env, "STRATUS_AGENT_ONCE") != "true" {
+					t.Errorf("init container does not run once: %+v", c.Env)
+				}
+			}
+			if strings.Join(inits, ",") != strings.Join(tt.wantInit, ",") {
+				t.Errorf("init containers = %v, want %v", inits, tt.wantInit)
+			}
+			vols := map[string]corev1.Volume{}
+			for _, v := range pod.Spec.Volumes {
+				vols[v.Name] = v
+			}
+			if v := vols[tokenVolume]; v.Projected == nil || v.Projected.Sources[0].ServiceAccountToken.Audience != testConfig.Audience {
+				t.Errorf("token volume = %+v", v)
+			}
+			if v := vols[credsVolume]; v.EmptyDir == nil || v.EmptyDir.Medium != corev1.StorageMediumMemory {
+				t.Errorf("credentials volume = %+v", v)
+			}
+			// app containers running as another user read the key file
+			// through the fsGroup the credentials volume is owned by
+			var fsGroup int64
+			if sc := pod.Spec.SecurityContext; sc != nil && sc.FSGroup != nil {
+				fsGroup = *sc.FSGroup
+			}
+			if fsGroup != tt.wantFSGroup {
+				t.Errorf("fsGroup = %d, want %d", fsGroup, tt.wantFSGroup)
+			}
+
+			// the patched pod is left unchanged if it is reviewed again
+			if p := Mutate(&pod, in.Request.Namespace, testConfig); p != nil {
+				t.Errorf("Mutate() of the patched pod = %+v, want no patch", p)
+			}
+		})
+	}
+}
+
+func TestReviewInvalidPod(t *testing.T) {
+	in := readReview(t, "aws")
+	in.Request.Object.Raw = []byte(`{"spec":"invalid"}`)
+	out := Review(in, testConfig)
+	if out.Response == nil || out.Response.Allowed || out.Response.Result == nil {
+		t.Errorf("Review() of an invalid pod = %+v, want denied", out.Response)
+	}
+	if out := Review(&admissionv1.AdmissionReview{}, testConfig); out.Response != nil {
+		t.Errorf("Review() without a request = %+v, want no response", out.Response)
+	}
+}
@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/stratus/internal/identity"
+	log "github.com/sirupsen/logrus"
+)
+
+// Agent exchanges the pod's projected service account token with stratus for
+// target credentials, serving AWS credentials to the AWS SDK container
+// credential provider and writing GCP credentials to a file
+type Agent struct {
+	StratusURL  string
+	SourceID    string
+	ClusterName string
+	TokenPath   string
+	// AWSRole and AWSRegion are the AWS target, if any
+	AWSRole   string
+	AWSRegion string
+	// GCPServiceAccount is the GCP target, if any, written to GCPCredentialsPath
+	GCPServiceAccount  string
+	GCPCredentialsPath string
+	// Addr is the address AWS credentials are served on
+	Addr string
+	// Refresh is how often GCP credentials are rewritten
+	Refresh time.Duration
+
+	hc      *http.Client
+	mu      sync.Mutex
+	awsCred map[string]interface{}
+	awsExp  time.Time
+}
+
+// FromEnv returns an agent configured from the environment
+func FromEnv() *Agent {
+	a := &Agent{
+		StratusURL:         os.Getenv("STRATUS_URL"),
+		SourceID:           os.Getenv("STRATUS_SOURCE_ID"),
+		ClusterName:        os.Getenv("STRATUS_CLUSTER_NAME"),
+		TokenPath:          os.Getenv("STRATUS_TOKEN_PATH"),
+		AWSRole:            os.Getenv("STRATUS_AWS_ROLE"),
+		AWSRegion:          os.Getenv("STRATUS_AWS_REGION"),
+		GCPServiceAccount:  os.Getenv("STRATUS_GCP_SERVICE_ACCOUNT"),
+		GCPCredentialsPath: os.Getenv("STRATUS_GCP_CREDENTIALS_PATH"),
+		Addr:               os.Getenv("STRATUS_AGENT_ADDR"),
+		Refresh:            time.Hour,
+	}
+	if d, err := time.ParseDuration(os.Getenv("STRATUS_AGENT_REFRESH")); err == nil && d > 0 {
+		a.Refresh = d
+	}
+	if a.Addr == "" {
+		a.Addr = "127.0.0.1:8099"
+	}
+	return a
+}
+
+// Run runs the agent. When once is true the GCP credentials are written and
+// Run returns, as an init container.
+func (a *Agent) Run(once bool) error {
+	l := log.WithFields(log.Fields{
+		"action": "agent.Run",
+		"source": a.SourceID,
+	})
+	l.Info("start")
+	a.hc = &http.Client{Timeout: 30 * time.Second}
+	if a.StratusURL == "" || a.SourceID == "" || a.TokenPath == "" {
+		return errors.New("STRATUS_URL, STRATUS_SOURCE_ID and STRATUS_TOKEN_PATH required")
+	}
+	if a.AWSRole == "" && a.GCPServiceAccount == "" {
+		return errors.New("STRATUS_AWS_ROLE or STRATUS_GCP_SERVICE_ACCOUNT required")
+	}
+	if a.GCPServiceAccount != "" {
+		if err := a.writeGCP(); err != nil {
+			return err
+		}
+	}
+	if once {
+		return nil
+	}
+	if a.GCPServiceAccount != "" {
+		go func() {
+			for range time.Tick(a.Refresh) {
+				if err := a.writeGCP(); err != nil {
+					l.WithError(err).Error("failed to refresh gcp credentials")
+				}
+			}
+		}()
+	}
+	if a.AWSRole == "" {
+		select {}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/credentials", a.handleAWS)
+	l.WithField("addr", a.Addr).Info("serving aws credentials")
+	return http.ListenAndServe(a.Addr, mux)
+}
+
+// exchange requests the credentials of a target from stratus, authenticating
+// with the projected service account token
+func (a *Agent) exchange(provider identity.ProviderName, id string, region string) (map[string]interface{}, error) {
+	tok, err := ioutil.ReadFile(a.TokenPath)
+	if err != nil {
+		return nil, err
+	}
+	creds := map[string]interface{}{"jwt": strings.TrimSpace(string(tok))}
+	if a.ClusterName != "" {
+		creds["clusterName"] = a.ClusterName
+	}
+	req := identity.IAMMap{
+		Source: identity.Identity{ID: a.SourceID, Provider: identity.ProviderK8S, Credentials: creds},
+		Target: identity.Identity{ID: id, Provider: provider, Region: region},
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	hr, err := http.NewRequest(http.MethodPost, a.StratusURL, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	hr.Header.Set("Accept", "application/json")
+	res, err := a.hc.Do(hr)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("stratus returned %d (request %s)", res.StatusCode, res.Header.Get("x-request-id"))
+	}
+	var out map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// writeGCP writes the GCP target credentials, replacing the file atomically
+func (a *Agent) writeGCP() error {
+	c, err := a.exchange(identity.ProviderGCP, a.GCPServiceAccount, "")
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.GCPCredentialsPath), 0755); err != nil {
+		return err
+	}
+	// the key is readable by the pod fsGroup the injected volume is owned by
+	tmp := a.GCPCredentialsPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.GCPCredentialsPath)
+}
+
+// awsCredentials returns the cached AWS credentials, exchanging for new
+// credentials when they expire within five minutes
+func (a *Agent) awsCredentials() (map[string]interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.awsCred != nil && time.Now().Add(5*time.Minute).Before(a.awsExp) {
+		return a.awsCred, nil
+	}
+	c, err := a.exchange(identity.ProviderAWS, a.AWSRole, a.AWSRegion)
+	if err != nil {
+		return nil, err
+	}
+	exp, _ := c["Expiration"].(string)
+	a.awsExp, _ = time.Parse(time.RFC3339, exp)
+	// the container credential provider expects Token rather than SessionToken
+	a.awsCred = map[string]interface{}{
+		"AccessKeyId":     c["AccessKeyId"],
+		"SecretAccessKey": c["SecretAccessKey"],
+		"Token":           c["SessionToken"],
+		"Expiration":      exp,
+	}
+	return a.awsCred, nil
+}
+
+// handleAWS serves AWS credentials in the container credential provider format
+func (a *Agent) handleAWS(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"func": "handleAWS",
+	})
+	c, err := a.awsCredentials()
+	if err != nil {
+		l.WithError(err).Error("failed to get aws credentials")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
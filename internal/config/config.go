@@ -1,25 +1,45 @@
 package config
 
 import (
+	"errors"
 	"io/ioutil"
-	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync/atomic"
 	"time"
 
 	git "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/robertlestak/stratus/internal/identity"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
 )
 
 var (
-	IdMaps []identity.IAMMap
+	// lastAcceptedCommit is the most recent config repo commit which passed
+	// signature verification
+	lastAcceptedCommit plumbing.Hash
+	// idMaps holds the current *identity.MapTable. It is replaced wholesale on
+	// every reload so readers never observe a partially updated table.
+	idMaps atomic.Value
 )
 
+func init() {
+	idMaps.Store(identity.NewMapTable(nil))
+}
+
+// Table returns the currently active identity mapping table
+func Table() *identity.MapTable {
+	return idMaps.Load().(*identity.MapTable)
+}
+
+// setTable indexes the given IAMMaps and publishes them as the active table
+func setTable(sc []identity.IAMMap) {
+	idMaps.Store(identity.NewMapTable(sc))
+}
+
+// gitClone clones the config repo. When signatures are verified the worktree
+// is not checked out, so that no file of an unverified revision is written.
 func gitClone(p string, cd string) (*git.Repository, error) {
 	l := log.WithFields(
 		log.Fields{
@@ -28,19 +48,33 @@ func gitClone(p string, cd string) (*git.Repository, error) {
 		})
 
 	l.Info("Cloning git repository")
+	auth, err := gitAuth()
+	if err != nil {
+		l.WithError(err).Error("failed to configure git auth")
+		return nil, err
+	}
+	ca, err := gitCABundle()
+	if err != nil {
+		l.WithError(err).Error("failed to read git CA bundle")
+		return nil, err
+	}
+	tags := git.AllTags
+	if gitShallow() {
+		tags = git.NoTags
+	}
 	r, err := git.PlainClone(cd, false, &git.CloneOptions{
 		URL:               p,
-		Auth:              &http.BasicAuth{Username: "devops", Password: os.Getenv("GITHUB_TOKEN")},
+		Auth:              auth,
 		RemoteName:        "origin",
 		ReferenceName:     plumbing.ReferenceName(os.Getenv("REMOTE_GIT_REF")),
-		SingleBranch:      false,
-		NoCheckout:        false,
-		Depth:             0,
+		SingleBranch:      gitShallow(),
+		NoCheckout:        signatureVerificationEnabled(),
+		Depth:             gitDepth(),
 		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
 		Progress:          nil,
-		Tags:              0,
+		Tags:              tags,
 		InsecureSkipTLS:   false,
-		CABundle:          []byte{},
+		CABundle:          ca,
 	})
 	if err != nil {
 		l.WithError(err).Error("failed to pull remote config")
@@ -49,6 +83,70 @@ func gitClone(p string, cd string) (*git.Repository, error) {
 	return r, nil
 }
 
+// gitFetch fetches the config repo and returns the commit of the remote
+// branch, without updating the worktree
+func gitFetch(r *git.Repository) (*object.Commit, error) {
+	auth, err := gitAuth()
+	if err != nil {
+		return nil, err
+	}
+	ca, err := gitCABundle()
+	if err != nil {
+		return nil, err
+	}
+	err = r.Fetch(&git.FetchOptions{
+		RemoteName:      "origin",
+		Depth:           gitDepth(),
+		Auth:            auth,
+		Progress:        nil,
+		Force:           false,
+		InsecureSkipTLS: false,
+		CABundle:        ca,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, err
+	}
+	branch := plumbing.ReferenceName(os.Getenv("REMOTE_GIT_REF"))
+	if branch == "" {
+		head, err := r.Head()
+		if err != nil {
+			return nil, err
+		}
+		branch = head.Name()
+	}
+	ref, err := r.Reference(plumbing.NewRemoteReferenceName("origin", branch.Short()), true)
+	if err != nil {
+		return nil, err
+	}
+	return r.CommitObject(ref.Hash())
+}
+
+// checkoutCommit moves the worktree and current branch to commit. Like a pull,
+// only fast-forward updates are accepted once a revision has been checked out.
+func checkoutCommit(r *git.Repository, commit *object.Commit) error {
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	if head, err := r.Head(); err == nil && head.Hash() != commit.Hash {
+		if hc, err := r.CommitObject(head.Hash()); err == nil && !lastAcceptedCommit.IsZero() {
+			ff, err := hc.IsAncestor(commit)
+			if err != nil {
+				return err
+			}
+			if !ff {
+				return git.ErrNonFastForwardUpdate
+			}
+		}
+	}
+	return w.Reset(&git.ResetOptions{
+		Commit: commit.Hash,
+		Mode:   git.HardReset,
+	})
+}
+
+// pullRemoteConfig clones or fetches the config repo, verifies the signature
+// of the fetched revision if required, and only then checks it out
 func pullRemoteConfig(p string) error {
 	l := log.WithFields(
 		log.Fields{
@@ -57,9 +155,8 @@ func pullRemoteConfig(p string) error {
 		})
 	l.Info("pulling remote config")
 	cd := os.Getenv("GIT_CLONE_DIR")
-	l.Info("pulled remote config")
 	var r *git.Repository
-	var err error
+	var commit *object.Commit
 	if s, err := os.Stat(cd); os.IsNotExist(err) || !s.IsDir() {
 		l.Info("Cloning git repository")
 		r, err = gitClone(p, cd)
@@ -67,81 +164,67 @@ func pullRemoteConfig(p string) error {
 			l.WithError(err).Error("failed to pull remote config")
 			return err
 		}
-		l.Info("pulled remote config")
-	} else {
-		l.Info("pulling remote config")
-		r, err = git.PlainOpen(cd)
+		ref, err := r.Head()
 		if err != nil {
-			l.WithError(err).Error("failed to pull remote config")
+			l.WithError(err).Error("failed to get head")
 			return err
 		}
-		w, err := r.Worktree()
+		commit, err = r.CommitObject(ref.Hash())
+		if err != nil {
+			l.WithError(err).Error("failed to get commit")
+			return err
+		}
+	} else {
+		r, err = git.PlainOpen(cd)
 		if err != nil {
 			l.WithError(err).Error("failed to pull remote config")
 			return err
 		}
-		err = w.Pull(&git.PullOptions{
-			RemoteName:        "origin",
-			ReferenceName:     plumbing.ReferenceName(os.Getenv("REMOTE_GIT_REF")),
-			SingleBranch:      false,
-			Depth:             0,
-			Auth:              &http.BasicAuth{Username: "devops", Password: os.Getenv("GITHUB_TOKEN")},
-			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
-			Progress:          nil,
-			Force:             false,
-			InsecureSkipTLS:   false,
-			CABundle:          []byte{},
-		})
-		if err != nil && err != git.NoErrAlreadyUpToDate {
+		commit, err = gitFetch(r)
+		if err != nil {
 			l.WithError(err).Error("failed to pull remote config")
 			return err
 		}
-		l.Info("pulled remote config")
 	}
-	ref, err := r.Head()
-	if err != nil {
-		l.WithError(err).Error("failed to get head")
-		return err
+	l = l.WithField("commit", commit.Hash.String())
+	if signatureVerificationEnabled() && commit.Hash != lastAcceptedCommit {
+		if verr := verifyRevision(r, commit, lastAcceptedCommit); verr != nil {
+			l.WithError(verr).Error("config revision failed signature verification")
+			return verr
+		}
+		l.Info("verified commit signature")
 	}
-	commit, err := r.CommitObject(ref.Hash())
-	if err != nil {
-		l.WithError(err).Error("failed to get commit")
+	if err := checkoutCommit(r, commit); err != nil {
+		l.WithError(err).Error("failed to check out commit")
 		return err
 	}
-	l.WithField("commit", commit.Hash.String()).Info("got commit")
+	lastAcceptedCommit = commit.Hash
+	l.Info("pulled remote config")
 	return nil
 }
 
-func loadConfigPaths(cps []string) ([]identity.IAMMap, error) {
+func loadConfigPaths(cps []string, source string) ([]*document, error) {
 	l := log.WithFields(log.Fields{
 		"action": "loadConfigPaths",
 	})
 	l.Info("start")
-	var sc []identity.IAMMap
+	var docs []*document
 	for _, cp := range cps {
 		l.Infof("loading config from %s", cp)
-		var tsc []identity.IAMMap
 		fd, ferr := ioutil.ReadFile(cp)
 		if ferr != nil {
 			l.WithError(ferr).Error("failed to read config file")
-			return sc, ferr
+			return docs, ferr
 		}
-		err := yaml.Unmarshal(fd, &tsc)
+		d, err := parseDocument(fd, source+":"+cp)
 		if err != nil {
-			l.WithError(err).Error("failed to unmarshal config file")
-			return sc, err
-		}
-		l.Infof("cfg=%+v", tsc)
-		l.Infof("loaded %d sync configs", len(sc))
-		for _, v := range tsc {
-			l.WithFields(log.Fields{
-				"config": v,
-			}).Info("sync config")
+			return docs, err
 		}
-		sc = append(sc, tsc...)
+		docs = append(docs, d)
 	}
+	l.Infof("loaded %d config files", len(docs))
 	l.Info("end")
-	return sc, nil
+	return docs, nil
 }
 
 func getFilesInDirRecursive(dir string) ([]string, error) {
@@ -155,6 +238,10 @@ func getFilesInDirRecursive(dir string) ([]string, error) {
 			return err
 		}
 		if f.IsDir() {
+			// skip git metadata when loading from the root of a clone
+			if f.Name() == ".git" {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 		files = append(files, path)
@@ -164,14 +251,14 @@ func getFilesInDirRecursive(dir string) ([]string, error) {
 	return files, err
 }
 
-// loadLocalSyncConfigs loads SyncConfigs from the configuration location
-func loadLocalSyncConfigs() ([]identity.IAMMap, error) {
+// loadLocalSyncConfigs loads SyncConfigs from the local paths
+func loadLocalSyncConfigs(cps []string, source string) ([]identity.IAMMap, error) {
 	l := log.WithFields(log.Fields{
-		"action": "createSC",
+		"action": "loadLocalSyncConfigs",
+		"source": source,
 	})
 	l.Info("start")
 	var sc []identity.IAMMap
-	cps := strings.Split(os.Getenv("CONFIG_PATHS"), ",")
 	if len(cps) == 0 {
 		l.Error("no config paths found")
 		return sc, nil
@@ -188,7 +275,12 @@ func loadLocalSyncConfigs() ([]identity.IAMMap, error) {
 	}
 	cps = ncps
 	l.Infof("loading configs from: %v", cps)
-	sc, err := loadConfigPaths(cps)
+	docs, err := loadConfigPaths(cps, source)
+	if err != nil {
+		l.Error(err)
+		return sc, err
+	}
+	sc, err = expandDocuments(docs)
 	if err != nil {
 		l.Error(err)
 		return sc, err
@@ -197,37 +289,62 @@ func loadLocalSyncConfigs() ([]identity.IAMMap, error) {
 	return sc, nil
 }
 
-// loadSyncConfigs loads the sync configs from the determined configuration location
-func loadSyncConfigs() ([]identity.IAMMap, error) {
+// loadSyncConfigs loads the sync configs from each source, returning the
+// results of each source in order
+func loadSyncConfigs(sources []Source) ([][]identity.IAMMap, error) {
 	l := log.WithFields(log.Fields{
 		"action": "loadSyncConfigs",
 	})
 	l.Info("start")
-	var sc []identity.IAMMap
-
-	if _, err := url.ParseRequestURI(os.Getenv("REMOTE_CONFIG_REPO")); err == nil {
-		l.Info("loading remote configs")
-		err := pullRemoteConfig(os.Getenv("REMOTE_CONFIG_REPO"))
+	var results [][]identity.IAMMap
+	for _, s := range sources {
+		l.WithField("source", s.Name()).Info("loading configs")
+		sc, err := s.Load()
 		if err != nil {
-			l.Error(err)
-			return sc, err
+			l.WithField("source", s.Name()).Error(err)
+			return nil, err
 		}
-		l.Info("loaded remote configs")
+		l.WithFields(log.Fields{
+			"source":   s.Name(),
+			"mappings": len(sc),
+		}).Info("loaded configs")
+		results = append(results, sc)
 	}
-	if os.Getenv("CONFIG_PATHS") != "" {
-		l.Info("loading local configs")
-		sc, err := loadLocalSyncConfigs()
-		if err != nil {
-			l.Error(err)
-			return sc, err
+	return results, nil
+}
+
+// reloadLiveSources reloads only the live sources, reusing the previous
+// results of all other sources
+func reloadLiveSources(sources []Source, results [][]identity.IAMMap) [][]identity.IAMMap {
+	nr := make([][]identity.IAMMap, len(results))
+	copy(nr, results)
+	for i, s := range sources {
+		if _, ok := s.(liveSource); !ok {
+			continue
+		}
+		if sc, err := s.Load(); err == nil {
+			nr[i] = sc
 		}
-		l.Info("loaded local configs")
-		return sc, nil
 	}
-	return sc, nil
+	return nr
 }
 
-// RefreshSyncConfigs refreshes the SyncConfigs from the configured location
+// retryDelay returns the exponential backoff delay for the given number of
+// consecutive fetch failures, bounded by the configured maximum
+func retryDelay(failures int) time.Duration {
+	d := envDuration("CONFIG_RETRY_BACKOFF", 5*time.Second)
+	max := envDuration("CONFIG_RETRY_BACKOFF_MAX", 5*time.Minute)
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// RefreshSyncConfigs refreshes the SyncConfigs from the configured location.
+// If a reload fails the previously loaded config continues to be served.
 func RefreshSyncConfigs() error {
 	l := log.WithFields(log.Fields{
 		"action": "refreshSyncConfigs",
@@ -237,15 +354,71 @@ func RefreshSyncConfigs() error {
 		l.Fatal(perr)
 		return perr
 	}
+	statusMu.Lock()
+	maxStaleness = envDuration("CONFIG_MAX_STALENESS", 0)
+	statusMu.Unlock()
+	sources, serr := newSources()
+	if serr != nil {
+		l.Fatal(serr)
+		return serr
+	}
+	// live sources signal changes as they happen, which are applied without
+	// reloading the polled sources
+	rebuildCh := make(chan struct{}, 1)
+	for _, s := range sources {
+		if ls, ok := s.(liveSource); ok {
+			go ls.Run(func() {
+				select {
+				case rebuildCh <- struct{}{}:
+				default:
+				}
+			})
+		}
+	}
+	var results [][]identity.IAMMap
 	for {
 		l.Info("start")
-		sc, err := loadSyncConfigs()
+		wait := pt
+		r, err := loadSyncConfigs(sources)
 		if err != nil {
-			l.Fatal(err)
-			return err
+			failures := recordFailure(err)
+			var ferr *fetchError
+			if errors.As(err, &ferr) {
+				wait = retryDelay(failures)
+			}
+			l.WithError(err).WithFields(log.Fields{
+				"failures": failures,
+				"retry":    wait.String(),
+			}).Error("failed to reload config, continuing with last known good config")
+		} else {
+			results = r
+			sc := mergeSources(results)
+			setTable(sc)
+			recordSuccess(len(sc))
+			l.WithField("mappings", len(sc)).Info("end")
+		}
+		// wait for the next poll, or reload immediately when triggered by a webhook
+		timer := time.NewTimer(wait)
+	poll:
+		for {
+			select {
+			case <-timer.C:
+				break poll
+			case <-reloadCh:
+				timer.Stop()
+				l.Info("reload triggered")
+				break poll
+			case <-rebuildCh:
+				if results == nil {
+					// nothing to merge with until the first full load succeeds
+					continue
+				}
+				results = reloadLiveSources(sources, results)
+				sc := mergeSources(results)
+				setTable(sc)
+				recordMappings(len(sc))
+				l.WithField("mappings", len(sc)).Info("applied live source changes")
+			}
 		}
-		IdMaps = sc
-		l.Info("end")
-		time.Sleep(pt)
 	}
 }
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// originRepo is a local config repo which pullRemoteConfig clones
+type originRepo struct {
+	t   *testing.T
+	dir string
+	r   *git.Repository
+	key *openpgp.Entity
+}
+
+func newOriginRepo(t *testing.T) *originRepo {
+	t.Helper()
+	dir := t.TempDir()
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := openpgp.NewEntity("Config Bot", "", "config@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &originRepo{t: t, dir: dir, r: r, key: key}
+}
+
+// keyring writes the armored public key of the signing key
+func (o *originRepo) keyring() string {
+	var b bytes.Buffer
+	w, err := armor.Encode(&b, openpgp.PublicKeyType, nil)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	if err := o.key.Serialize(w); err != nil {
+		o.t.Fatal(err)
+	}
+	w.Close()
+	p := filepath.Join(o.t.TempDir(), "keyring.asc")
+	if err := ioutil.WriteFile(p, b.Bytes(), 0600); err != nil {
+		o.t.Fatal(err)
+	}
+	return p
+}
+
+// commit writes the mappings file and commits it, signed if signed is true
+func (o *originRepo) commit(content string, signed bool) plumbing.Hash {
+	if err := ioutil.WriteFile(filepath.Join(o.dir, "mappings.yaml"), []byte(content), 0644); err != nil {
+		o.t.Fatal(err)
+	}
+	w, err := o.r.Worktree()
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	if _, err := w.Add("mappings.yaml"); err != nil {
+		o.t.Fatal(err)
+	}
+	opts := &git.CommitOptions{Author: &object.Signature{Name: "Config Bot", Email: "config@example.com", When: time.Now()}}
+	if signed {
+		opts.SignKey = o.key
+	}
+	h, err := w.Commit(content, opts)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	return h
+}
+
+func TestPullRemoteConfigVerifiesBeforeCheckout(t *testing.T) {
+	origin := newOriginRepo(t)
+	clone := filepath.Join(t.TempDir(), "clone")
+	for k, v := range map[string]string{
+		"GIT_CLONE_DIR":          clone,
+		"GIT_VERIFY_SIGNATURES":  "true",
+		"GIT_VERIFY_ALL_COMMITS": "true",
+		"GIT_GPG_KEYRING":        origin.keyring(),
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	defer func() { lastAcceptedCommit = plumbing.ZeroHash }()
+	read := func() string {
+		b, err := ioutil.ReadFile(filepath.Join(clone, "mappings.yaml"))
+		if os.IsNotExist(err) {
+			return ""
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	origin.commit("unsigned", false)
+	if err := pullRemoteConfig(origin.dir); err == nil {
+		t.Fatal("cloned an unsigned revision")
+	}
+	if got := read(); got != "" {
+		t.Fatalf("unsigned revision checked out: %q", got)
+	}
+
+	first := origin.commit("first", true)
+	if err := pullRemoteConfig(origin.dir); err != nil {
+		t.Fatalf("pullRemoteConfig() error = %v", err)
+	}
+	if got := read(); got != "first" || lastAcceptedCommit != first {
+		t.Fatalf("got %q at %s, want first at %s", got, lastAcceptedCommit, first)
+	}
+
+	origin.commit("unsigned update", false)
+	if err := pullRemoteConfig(origin.dir); err == nil {
+		t.Fatal("pulled an unsigned revision")
+	}
+	if got := read(); got != "first" {
+		t.Fatalf("unsigned revision checked out: %q", got)
+	}
+
+	// a signed revision on top of an unsigned one is refused when all
+	// commits are verified
+	origin.commit("signed update", true)
+	if err := pullRemoteConfig(origin.dir); err == nil {
+		t.Fatal("pulled a revision with unsigned history")
+	}
+	if got := read(); got != "first" || lastAcceptedCommit != first {
+		t.Fatalf("got %q at %s, want first at %s", got, lastAcceptedCommit, first)
+	}
+
+	os.Setenv("GIT_VERIFY_ALL_COMMITS", "false")
+	if err := pullRemoteConfig(origin.dir); err != nil {
+		t.Fatalf("pullRemoteConfig() error = %v", err)
+	}
+	if got := read(); got != "signed update" {
+		t.Fatalf("got %q, want signed update", got)
+	}
+}
@@ -0,0 +1,362 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/stratus/internal/identity"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	crdGroupVersion = "stratus.io/v1alpha1"
+	crdResource     = "stratusmappings"
+
+	inClusterTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAPath    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// liveSource is a Source which is kept up to date in real time rather than
+// polled. Load must return quickly from an in-memory snapshot.
+type liveSource interface {
+	Source
+	// Run keeps the source up to date, calling changed whenever its mappings change
+	Run(changed func())
+}
+
+// StratusMappingSpec is the spec of a StratusMapping custom resource. It
+// accepts the same settings as a mapping in a config file.
+type StratusMappingSpec struct {
+	Source     StratusMappingIdentity `json:"source"`
+	Target     StratusMappingIdentity `json:"target"`
+	Conditions *identity.Conditions   `json:"conditions,omitempty"`
+	Session    *identity.AWSSession   `json:"session,omitempty"`
+}
+
+// StratusMappingIdentity is a source or target identity of a StratusMapping.
+// Credentials are never read from the resource.
+type StratusMappingIdentity struct {
+	ID          string                `json:"id"`
+	Provider    identity.ProviderName `json:"provider"`
+	Region      string                `json:"region,omitempty"`
+	SessionName string                `json:"sessionName,omitempty"`
+	AWS         *identity.AWSTarget   `json:"aws,omitempty"`
+	GCP         *identity.GCPTarget   `json:"gcp,omitempty"`
+	Secret      *identity.SecretRef   `json:"secret,omitempty"`
+}
+
+// identity returns the identity described by the resource
+func (i StratusMappingIdentity) identity() identity.Identity {
+	return identity.Identity{
+		ID:          i.ID,
+		Provider:    i.Provider,
+		Region:      i.Region,
+		SessionName: i.SessionName,
+		AWS:         i.AWS,
+		GCP:         i.GCP,
+		Secret:      i.Secret,
+	}
+}
+
+// StratusMappingStatus is the status of a StratusMapping custom resource
+type StratusMappingStatus struct {
+	Accepted           bool   `json:"accepted"`
+	Message            string `json:"message,omitempty"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+}
+
+// StratusMapping is a custom resource defining a single identity mapping
+type StratusMapping struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              StratusMappingSpec   `json:"spec"`
+	Status            StratusMappingStatus `json:"status,omitempty"`
+}
+
+// StratusMappingList is a list of StratusMapping resources
+type StratusMappingList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []StratusMapping `json:"items"`
+}
+
+// crdSource maintains mappings from StratusMapping resources using list/watch
+// against the Kubernetes API server
+type crdSource struct {
+	Host      string
+	Token     string
+	Namespace string
+	client    *http.Client
+
+	mu       sync.RWMutex
+	mappings map[string]identity.IAMMap
+}
+
+// newCRDSource creates a source for the API server at host. If host is empty,
+// the in-cluster API server and service account credentials are used.
+func newCRDSource(host, token string, client *http.Client, namespace string) (*crdSource, error) {
+	if host == "" {
+		host = "https://" + os.Getenv("KUBERNETES_SERVICE_HOST") + ":" + os.Getenv("KUBERNETES_SERVICE_PORT")
+		td, err := ioutil.ReadFile(inClusterTokenPath)
+		if err != nil {
+			return nil, err
+		}
+		token = string(td)
+		ca, err := ioutil.ReadFile(inClusterCAPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs: pool,
+				},
+			},
+		}
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &crdSource{
+		Host:      host,
+		Token:     token,
+		Namespace: namespace,
+		client:    client,
+		mappings:  make(map[string]identity.IAMMap),
+	}, nil
+}
+
+// Name returns the name of the source
+func (s *crdSource) Name() string {
+	return "crd"
+}
+
+// Load returns the currently accepted mappings
+func (s *crdSource) Load() ([]identity.IAMMap, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.mappings))
+	for k := range s.mappings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	sc := make([]identity.IAMMap, 0, len(keys))
+	for _, k := range keys {
+		sc = append(sc, s.mappings[k])
+	}
+	return sc, nil
+}
+
+// resourcePath returns the API path for the StratusMapping collection
+func (s *crdSource) resourcePath() string {
+	if s.Namespace != "" {
+		return fmt.Sprintf("/apis/%s/namespaces/%s/%s", crdGroupVersion, s.Namespace, crdResource)
+	}
+	return fmt.Sprintf("/apis/%s/%s", crdGroupVersion, crdResource)
+}
+
+// do sends an authenticated request to the API server
+func (s *crdSource) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.Host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	return s.client.Do(req)
+}
+
+// Run lists and then watches StratusMapping resources, re-listing whenever the
+// watch is closed or expires. Consecutive list and watch errors are retried
+// with exponential backoff. It does not return.
+func (s *crdSource) Run(changed func()) {
+	l := log.WithFields(log.Fields{
+		"action": "crdSource.Run",
+	})
+	var failures int
+	for {
+		rv, err := s.list()
+		if err != nil {
+			failures++
+			l.WithError(err).Error("failed to list mappings")
+			time.Sleep(retryDelay(failures))
+			continue
+		}
+		changed()
+		for rv != "" {
+			rv, err = s.watch(rv, changed)
+			if err != nil {
+				failures++
+				l.WithError(err).Error("watch failed")
+				time.Sleep(retryDelay(failures))
+				break
+			}
+			failures = 0
+		}
+	}
+}
+
+// list replaces all mappings with the current resources, returning the
+// resource version to watch from
+func (s *crdSource) list() (string, error) {
+	res, err := s.do("GET", s.resourcePath(), "", nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("list %s: %s", crdResource, res.Status)
+	}
+	var ml StratusMappingList
+	if err := json.NewDecoder(res.Body).Decode(&ml); err != nil {
+		return "", err
+	}
+	mappings := make(map[string]identity.IAMMap)
+	for i := range ml.Items {
+		if m, ok := s.accept(&ml.Items[i]); ok {
+			mappings[crdKey(&ml.Items[i])] = m
+		}
+	}
+	s.mu.Lock()
+	s.mappings = mappings
+	s.mu.Unlock()
+	return ml.ResourceVersion, nil
+}
+
+// watch applies watch events from the resource version until the watch is
+// closed, returning the last resource version seen. An empty resource version
+// is returned when the watch has expired and a re-list is required.
+func (s *crdSource) watch(rv string, changed func()) (string, error) {
+	l := log.WithFields(log.Fields{
+		"action":          "crdSource.watch",
+		"resourceVersion": rv,
+	})
+	l.Info("start")
+	res, err := s.do("GET", s.resourcePath()+"?watch=1&allowWatchBookmarks=true&resourceVersion="+rv, "", nil)
+	if err != nil {
+		return rv, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusGone {
+		return "", nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return rv, fmt.Errorf("watch %s: %s", crdResource, res.Status)
+	}
+	dec := json.NewDecoder(res.Body)
+	for {
+		var ev metav1.WatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) {
+				// the server closed the watch, resume from the last version
+				return rv, nil
+			}
+			return rv, err
+		}
+		if ev.Type == "ERROR" {
+			var st metav1.Status
+			json.Unmarshal(ev.Object.Raw, &st)
+			if st.Code == http.StatusGone {
+				return "", nil
+			}
+			return rv, fmt.Errorf("watch error: %s", st.Message)
+		}
+		var sm StratusMapping
+		if err := json.Unmarshal(ev.Object.Raw, &sm); err != nil {
+			return rv, err
+		}
+		rv = sm.ResourceVersion
+		k := crdKey(&sm)
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			m, ok := s.accept(&sm)
+			s.mu.Lock()
+			if ok {
+				s.mappings[k] = m
+			} else {
+				delete(s.mappings, k)
+			}
+			s.mu.Unlock()
+		case "DELETED":
+			s.mu.Lock()
+			delete(s.mappings, k)
+			s.mu.Unlock()
+		default:
+			continue
+		}
+		l.WithFields(log.Fields{
+			"event":   ev.Type,
+			"mapping": k,
+		}).Info("mapping changed")
+		changed()
+	}
+}
+
+// crdKey returns the namespace/name key of a resource
+func crdKey(sm *StratusMapping) string {
+	return sm.Namespace + "/" + sm.Name
+}
+
+// accept validates the resource, reporting the result in its status, and
+// returns the mapping if it is valid
+func (s *crdSource) accept(sm *StratusMapping) (identity.IAMMap, bool) {
+	m := identity.IAMMap{
+		Source:     sm.Spec.Source.identity(),
+		Target:     sm.Spec.Target.identity(),
+		Conditions: sm.Spec.Conditions,
+		Session:    sm.Spec.Session,
+		Origin:     "crd:" + crdKey(sm),
+	}
+	st := StratusMappingStatus{
+		Accepted:           true,
+		ObservedGeneration: sm.Generation,
+	}
+	verr := m.Validate()
+	if verr != nil {
+		st.Accepted = false
+		st.Message = verr.Error()
+	}
+	if st != sm.Status {
+		if err := s.updateStatus(sm, st); err != nil {
+			log.WithField("mapping", crdKey(sm)).WithError(err).Error("failed to update status")
+		}
+	}
+	return m, verr == nil
+}
+
+// updateStatus patches the status subresource of a resource
+func (s *crdSource) updateStatus(sm *StratusMapping, st StratusMappingStatus) error {
+	b, err := json.Marshal(map[string]interface{}{"status": st})
+	if err != nil {
+		return err
+	}
+	p := fmt.Sprintf("/apis/%s/namespaces/%s/%s/%s/status", crdGroupVersion, sm.Namespace, crdResource, sm.Name)
+	res, err := s.do("PATCH", p, "application/merge-patch+json", b)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("patch status: %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const crdTestPath = "/apis/stratus.io/v1alpha1/namespaces/stratus/stratusmappings"
+
+// crdStub is a stand-in API server serving a StratusMapping list and a queue
+// of watch responses, recording status patches
+type crdStub struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	list    string
+	watches []string
+	watched []string
+	patches map[string]StratusMappingStatus
+}
+
+func newCRDStub(t *testing.T) *crdStub {
+	t.Helper()
+	s := &crdStub{patches: make(map[string]StratusMappingStatus)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer sa-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == crdTestPath && r.URL.Query().Get("watch") == "":
+			w.Write([]byte(s.list))
+		case r.Method == http.MethodGet && r.URL.Path == crdTestPath:
+			s.watched = append(s.watched, r.URL.Query().Get("resourceVersion"))
+			if len(s.watches) == 0 {
+				w.WriteHeader(http.StatusGone)
+				return
+			}
+			body := s.watches[0]
+			s.watches = s.watches[1:]
+			w.Write([]byte(body))
+		case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, crdTestPath+"/") && strings.HasSuffix(r.URL.Path, "/status"):
+			if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+				http.Error(w, "unsupported patch", http.StatusUnsupportedMediaType)
+				return
+			}
+			var p struct {
+				Status StratusMappingStatus `json:"status"`
+			}
+			json.NewDecoder(r.Body).Decode(&p)
+			name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, crdTestPath+"/"), "/status")
+			s.patches[name] = p.Status
+			w.Write([]byte(`{}`))
+		default:
+			http.Error(w, "unsupported request", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newSource returns a source watching the stub
+func (s *crdStub) newSource(t *testing.T) *crdSource {
+	t.Helper()
+	cs, err := newCRDSource(s.URL, "sa-token", s.Client(), "stratus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs
+}
+
+// testMapping returns a StratusMapping resource with the given spec
+func testMapping(name, rv, spec string) string {
+	return fmt.Sprintf(`{"apiVersion":"stratus.io/v1alpha1","kind":"StratusMapping","metadata":{"name":%q,"namespace":"stratus","resourceVersion":%q,"generation":1},"spec":%s}`, name, rv, spec)
+}
+
+// watchEvent returns a watch event line for a resource
+func watchEvent(typ, object string) string {
+	return fmt.Sprintf(`{"type":%q,"object":%s}`+"\n", typ, object)
+}
+
+const (
+	awsSpec     = `{"source":{"id":"sa@stratus-test.iam.gserviceaccount.com","provider":"gcp"},"target":{"id":"arn:aws:iam::123456789012:role/stratus","provider":"aws","region":"us-east-1"}}`
+	gcpSpec     = `{"source":{"id":"arn:aws:iam::123456789012:role/stratus","provider":"aws"},"target":{"id":"sa@stratus-test.iam.gserviceaccount.com","provider":"gcp"}}`
+	invalidSpec = `{"source":{"id":"sa@stratus-test.iam.gserviceaccount.com","provider":"gcp"},"target":{"id":"arn:aws:iam::123456789012:role/stratus","provider":"azure"}}`
+)
+
+// loadedTargets returns the target ids of the mappings loaded from the source
+func loadedTargets(t *testing.T, cs *crdSource) string {
+	t.Helper()
+	ms, err := cs.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, m := range ms {
+		ids = append(ids, m.Origin+"="+m.Target.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestCRDSourceListWatch(t *testing.T) {
+	stub := newCRDStub(t)
+	stub.list = `{"apiVersion":"stratus.io/v1alpha1","kind":"StratusMappingList","metadata":{"resourceVersion":"10"},"items":[` +
+		testMapping("aws", "8", awsSpec) + "," + testMapping("invalid", "9", invalidSpec) + `]}`
+	stub.watches = []string{
+		watchEvent("ADDED", testMapping("gcp", "11", gcpSpec)) +
+			watchEvent("BOOKMARK", `{"kind":"StratusMapping","metadata":{"resourceVersion":"12"}}`) +
+			watchEvent("MODIFIED", testMapping("aws", "13", invalidSpec)),
+		watchEvent("DELETED", testMapping("gcp", "14", gcpSpec)),
+		watchEvent("ERROR", `{"kind":"Status","code":410,"message":"too old resource version"}`),
+	}
+	cs := stub.newSource(t)
+
+	rv, err := cs.list()
+	if err != nil {
+		t.Fatalf("list() error = %v", err)
+	}
+	if rv != "10" {
+		t.Errorf("list() resource version = %q, want 10", rv)
+	}
+	if got, want := loadedTargets(t, cs), "crd:stratus/aws=arn:aws:iam::123456789012:role/stratus"; got != want {
+		t.Errorf("listed mappings = %q, want %q", got, want)
+	}
+	if st := stub.patches["invalid"]; st.Accepted || !strings.Contains(st.Message, "azure") || st.ObservedGeneration != 1 {
+		t.Errorf("invalid status = %+v", st)
+	}
+	if st := stub.patches["aws"]; !st.Accepted {
+		t.Errorf("aws status = %+v", st)
+	}
+
+	var changes int
+	changed := func() { changes++ }
+	rv, err = cs.watch(rv, changed)
+	if err != nil || rv != "13" {
+		t.Fatalf("watch() = %q, %v, want 13", rv, err)
+	}
+	if changes != 2 {
+		t.Errorf("changed called %d times, want 2", changes)
+	}
+	if got, want := loadedTargets(t, cs), "crd:stratus/gcp=sa@stratus-test.iam.gserviceaccount.com"; got != want {
+		t.Errorf("watched mappings = %q, want %q", got, want)
+	}
+	if st := stub.patches["aws"]; st.Accepted {
+		t.Errorf("modified aws status = %+v, want rejected", st)
+	}
+
+	rv, err = cs.watch(rv, changed)
+	if err != nil || rv != "14" {
+		t.Fatalf("watch() = %q, %v, want 14", rv, err)
+	}
+	if got := loadedTargets(t, cs); got != "" {
+		t.Errorf("mappings after delete = %q, want none", got)
+	}
+
+	// an expired resource version requires a re-list, whether reported as an
+	// error event or by the watch request
+	for i := 0; i < 2; i++ {
+		if rv, err := cs.watch("14", changed); err != nil || rv != "" {
+			t.Errorf("expired watch() = %q, %v, want re-list", rv, err)
+		}
+	}
+	if got, want := strings.Join(stub.watched, ","), "10,13,14,14"; got != want {
+		t.Errorf("watched from %s, want %s", got, want)
+	}
+}
+
+func TestCRDSourceListError(t *testing.T) {
+	stub := newCRDStub(t)
+	cs := stub.newSource(t)
+	cs.Token = "wrong"
+	if _, err := cs.list(); err == nil {
+		t.Error("list() succeeded with an unauthorized token")
+	}
+	if _, err := cs.watch("1", func() {}); err == nil {
+		t.Error("watch() succeeded with an unauthorized token")
+	}
+}
+
+func TestCRDSourceWatchDecodeError(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantRV  string
+		wantErr bool
+	}{
+		{name: "closed watch", body: watchEvent("ADDED", testMapping("gcp", "11", gcpSpec)), wantRV: "11"},
+		{name: "empty watch", body: "", wantRV: "10"},
+		{name: "malformed event", body: watchEvent("ADDED", testMapping("gcp", "11", gcpSpec)) + "{not json}\n", wantRV: "11", wantErr: true},
+		{name: "truncated event", body: watchEvent("ADDED", testMapping("gcp", "11", gcpSpec)) + `{"type":"ADDED","object":{`, wantRV: "11", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newCRDStub(t)
+			stub.watches = []string{tt.body}
+			rv, err := stub.newSource(t).watch("10", func() {})
+			if (err != nil) != tt.wantErr || rv != tt.wantRV {
+				t.Errorf("watch() = %q, %v, want %q, wantErr %v", rv, err, tt.wantRV, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStratusMappingSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		check   func(t *testing.T, sm *StratusMapping)
+		wantErr bool
+	}{
+		{
+			name: "session and chain",
+			spec: `{"source":{"id":"arn:aws:iam::123456789012:role/ci","provider":"aws","sessionName":"deploy-*"},` +
+				`"target":{"id":"arn:aws:iam::210987654321:role/stratus","provider":"aws","aws":{"externalId":"ext","chain":["arn:aws:iam::123456789012:role/hop"],"stsEndpoint":"https://sts.us-east-1.amazonaws.com"}},` +
+				`"session":{"durationSeconds":1800,"policyArns":["arn:aws:iam::aws:policy/ReadOnlyAccess"],"tags":{"team":"stratus"},"policy":{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"*"}]}}}`,
+			check: func(t *testing.T, sm *StratusMapping) {
+				m := sm.Spec
+				if m.Source.SessionName != "deploy-*" {
+					t.Errorf("sessionName = %q", m.Source.SessionName)
+				}
+				if a := m.Target.AWS; a == nil || a.ExternalID != "ext" || len(a.Chain) != 1 || a.STSEndpoint == "" {
+					t.Errorf("aws = %+v", a)
+				}
+				if s := m.Session; s == nil || s.DurationSeconds != 1800 || len(s.PolicyArns) != 1 || s.Tags["team"] != "stratus" || s.Policy == nil {
+					t.Errorf("session = %+v", s)
+				}
+			},
+		},
+		{
+			name: "secret and rotation",
+			spec: `{"source":{"id":"system:serviceaccount:stratus:ci","provider":"k8s"},` +
+				`"target":{"id":"sa@stratus-test.iam.gserviceaccount.com","provider":"gcp","secret":{"path":"/shared/sa","version":3},"gcp":{"rotation":{"interval":"168h","gracePeriod":"12h"}}},` +
+				`"conditions":{"groups":["ci"],"notAfter":"2030-01-01T00:00:00Z"}}`,
+			check: func(t *testing.T, sm *StratusMapping) {
+				m := sm.Spec
+				if s := m.Target.Secret; s == nil || s.Path != "/shared/sa" || s.Version != 3 {
+					t.Errorf("secret = %+v", s)
+				}
+				if g := m.Target.GCP; g == nil || g.Rotation == nil || g.Rotation.Interval != "168h" || g.Rotation.GracePeriod != "12h" {
+					t.Errorf("gcp = %+v", g)
+				}
+				if c := m.Conditions; c == nil || len(c.Groups) != 1 || c.NotAfter == nil {
+					t.Errorf("conditions = %+v", c)
+				}
+			},
+		},
+		{
+			name: "credentials are ignored",
+			spec: `{"source":{"id":"sa@stratus-test.iam.gserviceaccount.com","provider":"gcp","credentials":{"token":"x"}},"target":{"id":"arn:aws:iam::123456789012:role/stratus","provider":"aws"}}`,
+			check: func(t *testing.T, sm *StratusMapping) {
+				if id := sm.Spec.Source.identity(); id.Credentials != nil {
+					t.Errorf("credentials = %v, want none", id.Credentials)
+				}
+			},
+		},
+		{
+			name:    "session for a gcp target",
+			spec:    `{"source":{"id":"arn:aws:iam::123456789012:role/ci","provider":"aws"},"target":{"id":"sa@stratus-test.iam.gserviceaccount.com","provider":"gcp"},"session":{"durationSeconds":1800}}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid secret version",
+			spec:    `{"source":{"id":"arn:aws:iam::123456789012:role/ci","provider":"aws"},"target":{"id":"sa@stratus-test.iam.gserviceaccount.com","provider":"gcp","secret":{"version":-1}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid session duration",
+			spec:    `{"source":{"id":"sa@stratus-test.iam.gserviceaccount.com","provider":"gcp"},"target":{"id":"arn:aws:iam::123456789012:role/stratus","provider":"aws"},"session":{"durationSeconds":60}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newCRDStub(t)
+			cs := stub.newSource(t)
+			var sm StratusMapping
+			if err := json.Unmarshal([]byte(testMapping("m", "1", tt.spec)), &sm); err != nil {
+				t.Fatal(err)
+			}
+			m, ok := cs.accept(&sm)
+			if ok == tt.wantErr {
+				t.Fatalf("accept() = %v, status %+v, wantErr %v", ok, stub.patches["m"], tt.wantErr)
+			}
+			if m.Session != sm.Spec.Session || m.Target.AWS != sm.Spec.Target.AWS || m.Target.Secret != sm.Spec.Target.Secret {
+				t.Errorf("accept() did not carry the spec settings into the mapping")
+			}
+			if tt.check != nil {
+				tt.check(t, &sm)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/robertlestak/stratus/internal/identity"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// document is a single config file. A document is either a plain list of
+// mappings, or contains named groups of source identities and roleSets of
+// target identities which its mappings can reference.
+type document struct {
+	Groups   map[string][]identity.Identity `yaml:"groups"`
+	RoleSets map[string][]identity.Identity `yaml:"roleSets"`
+	Mappings []identity.IAMMap              `yaml:"mappings"`
+	Origin   string                         `yaml:"-"`
+}
+
+// parseDocument parses a YAML config document, attributing it to origin
+func parseDocument(fd []byte, origin string) (*document, error) {
+	l := log.WithFields(log.Fields{
+		"action": "parseDocument",
+		"origin": origin,
+	})
+	d := &document{Origin: origin}
+	var probe interface{}
+	if err := yaml.Unmarshal(fd, &probe); err != nil {
+		l.WithError(err).Error("failed to unmarshal config file")
+		return nil, fmt.Errorf("%s: %w", origin, err)
+	}
+	var err error
+	switch probe.(type) {
+	case nil:
+		return d, nil
+	case []interface{}:
+		err = yaml.Unmarshal(fd, &d.Mappings)
+	default:
+		err = yaml.Unmarshal(fd, d)
+	}
+	if err != nil {
+		l.WithError(err).Error("failed to unmarshal config file")
+		return nil, fmt.Errorf("%s: %w", origin, err)
+	}
+	return d, nil
+}
+
+// expandDocuments resolves the group and roleSet references in the mappings
+// of the documents, returning one validated mapping per source and target
+// pair. Groups and roleSets are shared by all documents loaded from a source.
+func expandDocuments(docs []*document) ([]identity.IAMMap, error) {
+	l := log.WithFields(log.Fields{
+		"action": "expandDocuments",
+	})
+	groups := make(map[string][]identity.Identity)
+	roleSets := make(map[string][]identity.Identity)
+	defined := make(map[string]string)
+	for _, d := range docs {
+		for n, g := range d.Groups {
+			if o, ok := defined["group/"+n]; ok {
+				return nil, fmt.Errorf("%s: group %q already defined in %s", d.Origin, n, o)
+			}
+			defined["group/"+n] = d.Origin
+			groups[n] = g
+		}
+		for n, rs := range d.RoleSets {
+			if o, ok := defined["roleSet/"+n]; ok {
+				return nil, fmt.Errorf("%s: roleSet %q already defined in %s", d.Origin, n, o)
+			}
+			defined["roleSet/"+n] = d.Origin
+			roleSets[n] = rs
+		}
+	}
+	var sc []identity.IAMMap
+	for _, d := range docs {
+		for i, m := range d.Mappings {
+			m.Origin = d.Origin
+			sources := []identity.Identity{m.Source}
+			if m.SourceGroup != "" {
+				if m.Source.ID != "" {
+					return nil, fmt.Errorf("%s: mapping %d: source and sourceGroup are exclusive", d.Origin, i)
+				}
+				g, ok := groups[m.SourceGroup]
+				if !ok {
+					return nil, fmt.Errorf("%s: mapping %d: unknown group %q", d.Origin, i, m.SourceGroup)
+				}
+				sources = g
+			}
+			targets := []identity.Identity{m.Target}
+			if m.TargetRoleSet != "" {
+				if m.Target.ID != "" {
+					return nil, fmt.Errorf("%s: mapping %d: target and targetRoleSet are exclusive", d.Origin, i)
+				}
+				rs, ok := roleSets[m.TargetRoleSet]
+				if !ok {
+					return nil, fmt.Errorf("%s: mapping %d: unknown roleSet %q", d.Origin, i, m.TargetRoleSet)
+				}
+				targets = rs
+			}
+			for _, s := range sources {
+				for _, t := range targets {
+					em := m
+					em.Source = s
+					em.Target = t
+					if verr := em.Validate(); verr != nil {
+						l.WithError(verr).Error("invalid mapping")
+						return nil, fmt.Errorf("%s: mapping %d: %w", d.Origin, i, verr)
+					}
+					l.WithFields(log.Fields{
+						"config": em,
+					}).Info("sync config")
+					sc = append(sc, em)
+				}
+			}
+		}
+	}
+	return sc, nil
+}
@@ -0,0 +1,160 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDocument(t *testing.T) {
+	tests := []struct {
+		name         string
+		in           string
+		wantMappings int
+		wantGroups   []string
+		wantErr      string
+	}{
+		{name: "empty", in: ""},
+		{name: "comment only", in: "# no mappings yet\n"},
+		{name: "list", in: gcpToAWS + awsToGCP, wantMappings: 2},
+		{
+			name: "groups and roleSets",
+			in: `groups:
+  ci:
+  - id: "arn:aws:iam::123456789012:role/ci"
+    provider: "aws"
+roleSets:
+  deploy:
+  - id: "sa@stratus-test.iam.gserviceaccount.com"
+    provider: "gcp"
+mappings:
+- sourceGroup: ci
+  targetRoleSet: deploy
+`,
+			wantMappings: 1,
+			wantGroups:   []string{"ci"},
+		},
+		{name: "invalid yaml", in: "- source: [", wantErr: "s3://stratus-config/a.yaml"},
+		{name: "wrong type", in: "mappings: true\n", wantErr: "s3://stratus-config/a.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := parseDocument([]byte(tt.in), "s3://stratus-config/a.yaml")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseDocument() error = %v, want it to name %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDocument() error = %v", err)
+			}
+			if d.Origin != "s3://stratus-config/a.yaml" {
+				t.Errorf("origin = %q", d.Origin)
+			}
+			if len(d.Mappings) != tt.wantMappings {
+				t.Errorf("parseDocument() = %d mappings, want %d", len(d.Mappings), tt.wantMappings)
+			}
+			var groups []string
+			for g := range d.Groups {
+				groups = append(groups, g)
+			}
+			if !reflect.DeepEqual(groups, tt.wantGroups) {
+				t.Errorf("groups = %v, want %v", groups, tt.wantGroups)
+			}
+		})
+	}
+}
+
+func TestExpandDocuments(t *testing.T) {
+	const groups = `groups:
+  ci:
+  - id: "arn:aws:iam::123456789012:role/ci"
+    provider: "aws"
+  - id: "arn:aws:iam::123456789012:role/release"
+    provider: "aws"
+roleSets:
+  deploy:
+  - id: "deploy@stratus-test.iam.gserviceaccount.com"
+    provider: "gcp"
+  - id: "release@stratus-test.iam.gserviceaccount.com"
+    provider: "gcp"
+`
+	tests := []struct {
+		name    string
+		docs    []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "plain",
+			docs: []string{gcpToAWS, awsToGCP},
+			want: []string{"a=arn:aws:iam::123456789012:role/stratus", "b=sa@stratus-test.iam.gserviceaccount.com"},
+		},
+		{
+			name: "group and roleSet in another document",
+			docs: []string{groups, "mappings:\n- sourceGroup: ci\n  targetRoleSet: deploy\n"},
+			want: []string{
+				"b=deploy@stratus-test.iam.gserviceaccount.com",
+				"b=release@stratus-test.iam.gserviceaccount.com",
+				"b=deploy@stratus-test.iam.gserviceaccount.com",
+				"b=release@stratus-test.iam.gserviceaccount.com",
+			},
+		},
+		{
+			name:    "group defined twice",
+			docs:    []string{groups, groups},
+			wantErr: `b: group "ci" already defined in a`,
+		},
+		{
+			name:    "unknown group",
+			docs:    []string{"mappings:\n- sourceGroup: ops\n  target:\n    id: sa@stratus-test.iam.gserviceaccount.com\n    provider: gcp\n"},
+			wantErr: `a: mapping 0: unknown group "ops"`,
+		},
+		{
+			name:    "unknown roleSet",
+			docs:    []string{groups, "mappings:\n- sourceGroup: ci\n  targetRoleSet: admin\n"},
+			wantErr: `b: mapping 0: unknown roleSet "admin"`,
+		},
+		{
+			name:    "source and sourceGroup",
+			docs:    []string{groups + "mappings:\n- sourceGroup: ci\n  source:\n    id: x\n    provider: aws\n  targetRoleSet: deploy\n"},
+			wantErr: "source and sourceGroup are exclusive",
+		},
+		{
+			name:    "target and targetRoleSet",
+			docs:    []string{groups + "mappings:\n- sourceGroup: ci\n  targetRoleSet: deploy\n  target:\n    id: x\n    provider: gcp\n"},
+			wantErr: "target and targetRoleSet are exclusive",
+		},
+		{
+			name:    "invalid mapping",
+			docs:    []string{gcpToAWS, "- source:\n    id: x\n    provider: azure\n  target:\n    id: y\n    provider: aws\n"},
+			wantErr: "b: mapping 0: unsupported source provider",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var docs []*document
+			for i, in := range tt.docs {
+				d, err := parseDocument([]byte(in), string(rune('a'+i)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				docs = append(docs, d)
+			}
+			sc, err := expandDocuments(docs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expandDocuments() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandDocuments() error = %v", err)
+			}
+			if got := origins(sc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandDocuments() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/robertlestak/stratus/internal/jwt"
+	log "github.com/sirupsen/logrus"
+)
+
+// git auth methods selectable with GIT_AUTH_METHOD
+const (
+	gitAuthToken     = "token"
+	gitAuthSSH       = "ssh"
+	gitAuthGitHubApp = "github-app"
+)
+
+var (
+	appTokenMu     sync.Mutex
+	appToken       string
+	appTokenExpiry time.Time
+)
+
+// appTokenClaims are the claims of the JWT used to authenticate as a GitHub App
+type appTokenClaims struct {
+	Iss string `json:"iss"`
+	Iat int64  `json:"iat"`
+	Exp int64  `json:"exp"`
+}
+
+// envDefault returns the environment variable, or def if it is unset
+func envDefault(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// validRemote returns true if repo is a URL or an scp-like ssh remote
+// such as git@github.com:org/repo.git
+func validRemote(repo string) bool {
+	if _, err := url.ParseRequestURI(repo); err == nil {
+		return true
+	}
+	at := strings.Index(repo, "@")
+	colon := strings.Index(repo, ":")
+	return at > 0 && colon > at+1 && colon < len(repo)-1
+}
+
+// gitAuth returns the auth method for the config git remote
+func gitAuth() (transport.AuthMethod, error) {
+	l := log.WithFields(log.Fields{
+		"action": "gitAuth",
+		"method": os.Getenv("GIT_AUTH_METHOD"),
+	})
+	switch envDefault("GIT_AUTH_METHOD", gitAuthToken) {
+	case gitAuthToken:
+		return &githttp.BasicAuth{
+			Username: envDefault("GIT_USERNAME", "devops"),
+			Password: os.Getenv("GITHUB_TOKEN"),
+		}, nil
+	case gitAuthSSH:
+		a, err := gitssh.NewPublicKeysFromFile(
+			envDefault("GIT_USERNAME", "git"),
+			os.Getenv("GIT_SSH_KEY"),
+			os.Getenv("GIT_SSH_KEY_PASSWORD"),
+		)
+		if err != nil {
+			l.WithError(err).Error("failed to load ssh key")
+			return nil, err
+		}
+		// with no files specified, the default known_hosts locations are used
+		var khs []string
+		if kh := os.Getenv("GIT_SSH_KNOWN_HOSTS"); kh != "" {
+			khs = strings.Split(kh, ",")
+		}
+		a.HostKeyCallback, err = gitssh.NewKnownHostsCallback(khs...)
+		if err != nil {
+			l.WithError(err).Error("failed to load known hosts")
+			return nil, err
+		}
+		return a, nil
+	case gitAuthGitHubApp:
+		t, err := gitHubAppToken()
+		if err != nil {
+			l.WithError(err).Error("failed to get github app token")
+			return nil, err
+		}
+		return &githttp.BasicAuth{Username: "x-access-token", Password: t}, nil
+	}
+	return nil, fmt.Errorf("unsupported git auth method %q", os.Getenv("GIT_AUTH_METHOD"))
+}
+
+// gitHubAppToken returns a GitHub App installation token, reusing the
+// current token until shortly before it expires
+func gitHubAppToken() (string, error) {
+	l := log.WithFields(log.Fields{
+		"action": "gitHubAppToken",
+	})
+	appTokenMu.Lock()
+	defer appTokenMu.Unlock()
+	if appToken != "" && time.Until(appTokenExpiry) > 5*time.Minute {
+		return appToken, nil
+	}
+	l.Info("requesting installation token")
+	kd, err := ioutil.ReadFile(os.Getenv("GITHUB_APP_PRIVATE_KEY"))
+	if err != nil {
+		return "", err
+	}
+	key, err := jwt.ParseRSAPrivateKey(kd)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	// backdate the issued at time to allow for clock drift
+	at, err := jwt.SignRS256(appTokenClaims{
+		Iss: os.Getenv("GITHUB_APP_ID"),
+		Iat: now.Add(-60 * time.Second).Unix(),
+		Exp: now.Add(9 * time.Minute).Unix(),
+	}, key, "")
+	if err != nil {
+		return "", err
+	}
+	u := fmt.Sprintf("%s/app/installations/%s/access_tokens",
+		strings.TrimSuffix(envDefault("GITHUB_API_URL", "https://api.github.com"), "/"),
+		os.Getenv("GITHUB_APP_INSTALLATION_ID"),
+	)
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+at)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	hc := &http.Client{Timeout: 30 * time.Second}
+	res, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("github app token request failed: %s", res.Status)
+	}
+	var tr struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return "", err
+	}
+	if tr.Token == "" {
+		return "", errors.New("empty github app token")
+	}
+	appToken = tr.Token
+	appTokenExpiry = tr.ExpiresAt
+	return appToken, nil
+}
+
+// gitCABundle returns the CA bundle used to verify the git remote, if configured
+func gitCABundle() ([]byte, error) {
+	p := os.Getenv("GIT_CA_BUNDLE")
+	if p == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(p)
+}
+
+// gitShallow returns true if the config repo should be cloned with a
+// shallow, single branch clone
+func gitShallow() bool {
+	return os.Getenv("GIT_SHALLOW") == "true"
+}
+
+// gitDepth returns the clone depth for the config repo
+func gitDepth() int {
+	if gitShallow() {
+		return 1
+	}
+	return 0
+}
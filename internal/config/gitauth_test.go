@@ -0,0 +1,277 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/robertlestak/stratus/internal/jwt"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeRSAKey writes a new PEM encoded RSA private key to the test directory
+func writeRSAKey(t *testing.T) (string, *rsa.PrivateKey) {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "key.pem")
+	pd := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+	if err := ioutil.WriteFile(p, pd, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p, k
+}
+
+// writeKnownHosts writes a known_hosts file trusting the public key of k
+func writeKnownHosts(t *testing.T, k *rsa.PrivateKey) string {
+	t.Helper()
+	pub, err := ssh.NewPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "known_hosts")
+	if err := ioutil.WriteFile(p, []byte("github.com "+string(ssh.MarshalAuthorizedKey(pub))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// resetAppToken clears the cached GitHub App token for the test
+func resetAppToken(t *testing.T) {
+	appTokenMu.Lock()
+	appToken, appTokenExpiry = "", time.Time{}
+	appTokenMu.Unlock()
+	t.Cleanup(func() {
+		appTokenMu.Lock()
+		appToken, appTokenExpiry = "", time.Time{}
+		appTokenMu.Unlock()
+	})
+}
+
+// appStub is a stand-in GitHub API issuing installation tokens
+type appStub struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests int
+	claims   appTokenClaims
+}
+
+func newAppStub(t *testing.T, key *rsa.PrivateKey, expiresIn time.Duration) *appStub {
+	t.Helper()
+	s := &appStub{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests++
+		if r.Method != http.MethodPost || r.URL.Path != "/app/installations/42/access_tokens" {
+			http.NotFound(w, r)
+			return
+		}
+		at := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if err := jwt.VerifyRS256(at, &key.PublicKey, &s.claims); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":"ghs_%d","expires_at":%q}`, s.requests, time.Now().Add(expiresIn).Format(time.RFC3339))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestGitAuth(t *testing.T) {
+	keyFile, key := writeRSAKey(t)
+	knownHosts := writeKnownHosts(t, key)
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantType string
+		wantUser string
+		wantPass string
+		wantErr  bool
+	}{
+		{
+			name:     "default token",
+			env:      map[string]string{"GITHUB_TOKEN": "ghp_token"},
+			wantType: "http-basic-auth",
+			wantUser: "devops",
+			wantPass: "ghp_token",
+		},
+		{
+			name:     "token with username",
+			env:      map[string]string{"GIT_AUTH_METHOD": "token", "GIT_USERNAME": "ci", "GITHUB_TOKEN": "ghp_token"},
+			wantType: "http-basic-auth",
+			wantUser: "ci",
+			wantPass: "ghp_token",
+		},
+		{
+			name:     "ssh",
+			env:      map[string]string{"GIT_AUTH_METHOD": "ssh", "GIT_SSH_KEY": keyFile, "GIT_SSH_KNOWN_HOSTS": knownHosts},
+			wantType: gitssh.PublicKeysName,
+			wantUser: "git",
+		},
+		{
+			name:     "ssh with username",
+			env:      map[string]string{"GIT_AUTH_METHOD": "ssh", "GIT_USERNAME": "deploy", "GIT_SSH_KEY": keyFile, "GIT_SSH_KNOWN_HOSTS": knownHosts},
+			wantType: gitssh.PublicKeysName,
+			wantUser: "deploy",
+		},
+		{
+			name:    "ssh missing key",
+			env:     map[string]string{"GIT_AUTH_METHOD": "ssh", "GIT_SSH_KEY": filepath.Join(t.TempDir(), "missing"), "GIT_SSH_KNOWN_HOSTS": knownHosts},
+			wantErr: true,
+		},
+		{
+			name:    "ssh missing known hosts",
+			env:     map[string]string{"GIT_AUTH_METHOD": "ssh", "GIT_SSH_KEY": keyFile, "GIT_SSH_KNOWN_HOSTS": filepath.Join(t.TempDir(), "missing")},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported",
+			env:     map[string]string{"GIT_AUTH_METHOD": "password"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"GIT_AUTH_METHOD", "GIT_USERNAME", "GITHUB_TOKEN", "GIT_SSH_KEY", "GIT_SSH_KEY_PASSWORD", "GIT_SSH_KNOWN_HOSTS"} {
+				setenv(t, k, tt.env[k])
+			}
+			a, err := gitAuth()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gitAuth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if a.Name() != tt.wantType {
+				t.Fatalf("gitAuth() = %s, want %s", a.Name(), tt.wantType)
+			}
+			switch a := a.(type) {
+			case *githttp.BasicAuth:
+				if a.Username != tt.wantUser || a.Password != tt.wantPass {
+					t.Errorf("basic auth = %s:%s, want %s:%s", a.Username, a.Password, tt.wantUser, tt.wantPass)
+				}
+			case *gitssh.PublicKeys:
+				if a.User != tt.wantUser || a.HostKeyCallback == nil {
+					t.Errorf("ssh auth user = %s, host key callback set %v", a.User, a.HostKeyCallback != nil)
+				}
+			}
+		})
+	}
+}
+
+func TestGitAuthGitHubApp(t *testing.T) {
+	keyFile, key := writeRSAKey(t)
+	tests := []struct {
+		name         string
+		expiresIn    time.Duration
+		wantToken    string
+		wantRequests int
+	}{
+		{name: "token reused until shortly before expiry", expiresIn: time.Hour, wantToken: "ghs_1", wantRequests: 1},
+		{name: "token about to expire is replaced", expiresIn: 4 * time.Minute, wantToken: "ghs_2", wantRequests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetAppToken(t)
+			stub := newAppStub(t, key, tt.expiresIn)
+			setenv(t, "GIT_AUTH_METHOD", "github-app")
+			setenv(t, "GITHUB_APP_PRIVATE_KEY", keyFile)
+			setenv(t, "GITHUB_APP_ID", "1234")
+			setenv(t, "GITHUB_APP_INSTALLATION_ID", "42")
+			setenv(t, "GITHUB_API_URL", stub.URL+"/")
+			var a *githttp.BasicAuth
+			for i := 0; i < 2; i++ {
+				am, err := gitAuth()
+				if err != nil {
+					t.Fatalf("gitAuth() error = %v", err)
+				}
+				a = am.(*githttp.BasicAuth)
+			}
+			if a.Username != "x-access-token" || a.Password != tt.wantToken {
+				t.Errorf("basic auth = %s:%s, want x-access-token:%s", a.Username, a.Password, tt.wantToken)
+			}
+			if stub.requests != tt.wantRequests {
+				t.Errorf("got %d token requests, want %d", stub.requests, tt.wantRequests)
+			}
+			now := time.Now().Unix()
+			if c := stub.claims; c.Iss != "1234" || c.Iat > now-30 || c.Exp <= now || c.Exp > now+600 {
+				t.Errorf("app jwt claims = %+v", c)
+			}
+		})
+	}
+}
+
+func TestGitAuthGitHubAppErrors(t *testing.T) {
+	keyFile, key := writeRSAKey(t)
+	otherKey, _ := writeRSAKey(t)
+	tests := []struct {
+		name string
+		key  string
+		id   string
+	}{
+		{name: "missing key", key: filepath.Join(t.TempDir(), "missing"), id: "42"},
+		{name: "key not registered", key: otherKey, id: "42"},
+		{name: "unknown installation", key: keyFile, id: "7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetAppToken(t)
+			stub := newAppStub(t, key, time.Hour)
+			setenv(t, "GIT_AUTH_METHOD", "github-app")
+			setenv(t, "GITHUB_APP_PRIVATE_KEY", tt.key)
+			setenv(t, "GITHUB_APP_ID", "1234")
+			setenv(t, "GITHUB_APP_INSTALLATION_ID", tt.id)
+			setenv(t, "GITHUB_API_URL", stub.URL)
+			if _, err := gitAuth(); err == nil {
+				t.Error("gitAuth() error = nil")
+			}
+		})
+	}
+}
+
+func TestValidRemote(t *testing.T) {
+	tests := []struct {
+		repo string
+		want bool
+	}{
+		{"https://github.com/org/repo.git", true},
+		{"ssh://git@github.com/org/repo.git", true},
+		{"git@github.com:org/repo.git", true},
+		{"github.com/org/repo", false},
+		{"git@github.com:", false},
+		{"@github.com:org/repo", false},
+		{"git@:org/repo", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validRemote(tt.repo); got != tt.want {
+			t.Errorf("validRemote(%q) = %v, want %v", tt.repo, got, tt.want)
+		}
+	}
+}
+
+func TestGitDepth(t *testing.T) {
+	for v, want := range map[string]int{"": 0, "false": 0, "true": 1} {
+		setenv(t, "GIT_SHALLOW", v)
+		if got := gitDepth(); got != want {
+			t.Errorf("gitDepth() with GIT_SHALLOW=%q = %d, want %d", v, got, want)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sshSigArmorStart = "-----BEGIN SSH SIGNATURE-----"
+	sshSigArmorEnd   = "-----END SSH SIGNATURE-----"
+	sshSigMagic      = "SSHSIG"
+	sshSigNamespace  = "git"
+)
+
+// signatureError is returned when a revision of the config repo is not signed
+// by a trusted key. These are not retried with backoff as they will not
+// resolve until a trusted revision is pushed.
+type signatureError struct {
+	Commit string
+	Err    error
+}
+
+func (e *signatureError) Error() string {
+	return fmt.Sprintf("untrusted commit %s: %v", e.Commit, e.Err)
+}
+
+func (e *signatureError) Unwrap() error {
+	return e.Err
+}
+
+// allowedSigner is a single entry in an ssh allowed_signers file
+type allowedSigner struct {
+	Principals []string
+	Key        ssh.PublicKey
+	// Namespaces are the signature namespace patterns the key may sign, any
+	// namespace if empty
+	Namespaces []string
+	// ValidAfter and ValidBefore bound the signing time, if set
+	ValidAfter  time.Time
+	ValidBefore time.Time
+	// CertAuthority marks a key which only signs certificates
+	CertAuthority bool
+}
+
+// parseSignerTime parses an allowed_signers time of the form YYYYMMDD[HHMM[SS]],
+// which is UTC with a Z suffix and local time otherwise
+func parseSignerTime(v string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(v, "Z") {
+		v = strings.TrimSuffix(v, "Z")
+		loc = time.UTC
+	}
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(v) == len(layout) {
+			return time.ParseInLocation(layout, v, loc)
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", v)
+}
+
+// setOptions sets the allowed_signers options of the signer
+func (a *allowedSigner) setOptions(options []string) error {
+	for _, o := range options {
+		kv := strings.SplitN(o, "=", 2)
+		k := strings.ToLower(kv[0])
+		v := ""
+		if len(kv) == 2 {
+			v = strings.Trim(kv[1], `"`)
+		}
+		var err error
+		switch k {
+		case "cert-authority":
+			a.CertAuthority = true
+		case "namespaces":
+			a.Namespaces = strings.Split(v, ",")
+		case "valid-after":
+			a.ValidAfter, err = parseSignerTime(v)
+		case "valid-before":
+			a.ValidBefore, err = parseSignerTime(v)
+		default:
+			err = fmt.Errorf("unsupported option %q", k)
+		}
+		if err != nil {
+			return fmt.Errorf("allowed signers: %w", err)
+		}
+	}
+	return nil
+}
+
+// allows returns an error unless the signer may sign in namespace at time when
+func (a *allowedSigner) allows(namespace string, when time.Time) error {
+	if a.CertAuthority {
+		return errors.New("ssh certificate signatures are not supported")
+	}
+	if len(a.Namespaces) > 0 && !principalAllowed(a.Namespaces, namespace) {
+		return fmt.Errorf("ssh signing key not allowed for namespace %q", namespace)
+	}
+	if !a.ValidAfter.IsZero() && when.Before(a.ValidAfter) {
+		return errors.New("ssh signing key not yet valid")
+	}
+	if !a.ValidBefore.IsZero() && !when.Before(a.ValidBefore) {
+		return errors.New("ssh signing key expired")
+	}
+	return nil
+}
+
+// signatureVerificationEnabled returns true if commit signatures must be verified
+func signatureVerificationEnabled() bool {
+	return os.Getenv("GIT_VERIFY_SIGNATURES") == "true"
+}
+
+// loadAllowedSigners parses an ssh allowed_signers file
+func loadAllowedSigners(p string) ([]allowedSigner, error) {
+	fd, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var signers []allowedSigner
+	s := bufio.NewScanner(bytes.NewReader(fd))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid allowed signers line: %s", line)
+		}
+		// the remainder of the line matches the authorized_keys format,
+		// including any options preceding the key
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		signer := allowedSigner{
+			Principals: strings.Split(parts[0], ","),
+			Key:        key,
+		}
+		if err := signer.setOptions(options); err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, s.Err()
+}
+
+// readSSHString reads a length-prefixed string from an ssh wire format buffer
+func readSSHString(b []byte) ([]byte, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, errors.New("short ssh signature")
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return nil, nil, errors.New("short ssh signature")
+	}
+	return b[4 : 4+n], b[4+n:], nil
+}
+
+// sshString encodes b as a length-prefixed ssh wire format string
+func sshString(b []byte) []byte {
+	out := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(out, uint32(len(b)))
+	copy(out[4:], b)
+	return out
+}
+
+// verifySSHSignature verifies an armored ssh signature (as produced by
+// `ssh-keygen -Y sign`) of message by an allowed signer for the given email,
+// made at time when
+func verifySSHSignature(armored string, message []byte, email string, when time.Time, signers []allowedSigner) error {
+	armored = strings.TrimSpace(armored)
+	armored = strings.TrimPrefix(armored, sshSigArmorStart)
+	armored = strings.TrimSuffix(armored, sshSigArmorEnd)
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(armored), ""))
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(blob, []byte(sshSigMagic)) || len(blob) < len(sshSigMagic)+4 {
+		return errors.New("invalid ssh signature")
+	}
+	b := blob[len(sshSigMagic):]
+	if binary.BigEndian.Uint32(b) != 1 {
+		return errors.New("unsupported ssh signature version")
+	}
+	b = b[4:]
+	var pub, ns, reserved, hashAlg, sig []byte
+	for _, f := range []*[]byte{&pub, &ns, &reserved, &hashAlg, &sig} {
+		*f, b, err = readSSHString(b)
+		if err != nil {
+			return err
+		}
+	}
+	if string(ns) != sshSigNamespace {
+		return fmt.Errorf("unexpected ssh signature namespace %q", ns)
+	}
+	var digest []byte
+	switch string(hashAlg) {
+	case "sha256":
+		h := sha256.Sum256(message)
+		digest = h[:]
+	case "sha512":
+		h := sha512.Sum512(message)
+		digest = h[:]
+	default:
+		return fmt.Errorf("unsupported ssh signature hash %q", hashAlg)
+	}
+	format, sigBlob, err := readSSHString(sig)
+	if err != nil {
+		return err
+	}
+	sigBlob, _, err = readSSHString(sigBlob)
+	if err != nil {
+		return err
+	}
+	key, err := ssh.ParsePublicKey(pub)
+	if err != nil {
+		return err
+	}
+	var signed bytes.Buffer
+	signed.WriteString(sshSigMagic)
+	signed.Write(sshString(ns))
+	signed.Write(sshString(reserved))
+	signed.Write(sshString(hashAlg))
+	signed.Write(sshString(digest))
+	serr := errors.New("ssh signing key not in allowed signers")
+	for _, s := range signers {
+		if !bytes.Equal(s.Key.Marshal(), key.Marshal()) {
+			continue
+		}
+		if !principalAllowed(s.Principals, email) {
+			continue
+		}
+		if err := s.allows(string(ns), when); err != nil {
+			serr = err
+			continue
+		}
+		return key.Verify(signed.Bytes(), &ssh.Signature{Format: string(format), Blob: sigBlob})
+	}
+	return serr
+}
+
+// principalAllowed checks the email against allowed signer principal patterns
+func principalAllowed(principals []string, email string) bool {
+	for _, p := range principals {
+		if ok, _ := path.Match(p, email); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyCommit verifies a single commit is signed by a trusted GPG or ssh key
+func verifyCommit(c *object.Commit) error {
+	if c.PGPSignature == "" {
+		return errors.New("commit is not signed")
+	}
+	if strings.HasPrefix(strings.TrimSpace(c.PGPSignature), sshSigArmorStart) {
+		p := os.Getenv("GIT_SSH_ALLOWED_SIGNERS")
+		if p == "" {
+			return errors.New("ssh signature found but GIT_SSH_ALLOWED_SIGNERS not set")
+		}
+		signers, err := loadAllowedSigners(p)
+		if err != nil {
+			return err
+		}
+		encoded := &plumbing.MemoryObject{}
+		if err := c.EncodeWithoutSignature(encoded); err != nil {
+			return err
+		}
+		er, err := encoded.Reader()
+		if err != nil {
+			return err
+		}
+		msg, err := ioutil.ReadAll(er)
+		if err != nil {
+			return err
+		}
+		return verifySSHSignature(c.PGPSignature, msg, c.Committer.Email, c.Committer.When, signers)
+	}
+	p := os.Getenv("GIT_GPG_KEYRING")
+	if p == "" {
+		return errors.New("gpg signature found but GIT_GPG_KEYRING not set")
+	}
+	kr, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	_, err = c.Verify(string(kr))
+	return err
+}
+
+// verifyRevision verifies the signature on head. If GIT_VERIFY_ALL_COMMITS is
+// set, every commit reachable from head which is not reachable from the last
+// accepted commit is verified as well, including commits on merged branches.
+// The last accepted commit must be an ancestor of head, and the history
+// between them must be present, otherwise the revision is refused.
+func verifyRevision(r *git.Repository, head *object.Commit, lastAccepted plumbing.Hash) error {
+	l := log.WithFields(log.Fields{
+		"action": "verifyRevision",
+		"commit": head.Hash.String(),
+	})
+	l.Info("start")
+	if os.Getenv("GIT_VERIFY_ALL_COMMITS") != "true" || lastAccepted.IsZero() {
+		if err := verifyCommit(head); err != nil {
+			return &signatureError{Commit: head.Hash.String(), Err: err}
+		}
+		return nil
+	}
+	accepted, err := ancestors(r, lastAccepted)
+	if err != nil {
+		return err
+	}
+	reached := false
+	seen := map[plumbing.Hash]bool{head.Hash: true}
+	queue := []*object.Commit{head}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if err := verifyCommit(c); err != nil {
+			return &signatureError{Commit: c.Hash.String(), Err: err}
+		}
+		for _, p := range c.ParentHashes {
+			if p == lastAccepted {
+				reached = true
+			}
+			if accepted[p] || seen[p] {
+				continue
+			}
+			seen[p] = true
+			pc, err := r.CommitObject(p)
+			if err != nil {
+				// a shallow history can not show the commit is trusted
+				return &signatureError{Commit: p.String(), Err: fmt.Errorf("history incomplete: %w", err)}
+			}
+			queue = append(queue, pc)
+		}
+	}
+	if !reached {
+		return &signatureError{Commit: head.Hash.String(), Err: fmt.Errorf("last accepted commit %s is not an ancestor", lastAccepted)}
+	}
+	return nil
+}
+
+// ancestors returns the commits reachable from h, including h. The walk stops
+// at commits missing from a shallow history.
+func ancestors(r *git.Repository, h plumbing.Hash) (map[plumbing.Hash]bool, error) {
+	c, err := r.CommitObject(h)
+	if err != nil {
+		return nil, fmt.Errorf("last accepted commit: %w", err)
+	}
+	seen := map[plumbing.Hash]bool{h: true}
+	queue := []*object.Commit{c}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		for _, p := range c.ParentHashes {
+			if seen[p] {
+				continue
+			}
+			pc, err := r.CommitObject(p)
+			if err == plumbing.ErrObjectNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			seen[p] = true
+			queue = append(queue, pc)
+		}
+	}
+	return seen, nil
+}
@@ -0,0 +1,338 @@
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"golang.org/x/crypto/ssh"
+)
+
+// the testdata signatures were made with ssh-keygen -Y sign over commit.txt
+// by the key in allowed_signers
+var commitTime = time.Unix(1700000000, 0)
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// writeSigners writes an allowed_signers file with the testdata key and the
+// given options
+func writeSigners(t *testing.T, principals string, options string) string {
+	t.Helper()
+	key := bytes.SplitN(readTestdata(t, "allowed_signers"), []byte(" "), 2)[1]
+	line := principals + " "
+	if options != "" {
+		line += options + " "
+	}
+	p := filepath.Join(t.TempDir(), "allowed_signers")
+	if err := ioutil.WriteFile(p, append([]byte(line), key...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestVerifySSHSignature(t *testing.T) {
+	msg := readTestdata(t, "commit.txt")
+	tests := []struct {
+		name       string
+		sig        string
+		message    []byte
+		email      string
+		principals string
+		options    string
+		wantErr    bool
+	}{
+		{name: "valid", sig: "commit.txt.sig"},
+		{name: "valid sha256", sig: "commit.txt.sha256.sig"},
+		{name: "principal pattern", sig: "commit.txt.sig", principals: "*@example.com"},
+		{name: "tampered message", sig: "commit.txt.sig", message: append([]byte("x"), msg...), wantErr: true},
+		{name: "other namespace", sig: "commit.txt.file.sig", wantErr: true},
+		{name: "other committer", sig: "commit.txt.sig", email: "mallory@example.com", wantErr: true},
+		{name: "git namespace", sig: "commit.txt.sig", options: `namespaces="file,git"`},
+		{name: "file namespace only", sig: "commit.txt.sig", options: `namespaces="file"`, wantErr: true},
+		{name: "valid window", sig: "commit.txt.sig", options: `valid-after="20230101Z",valid-before="20240101Z"`},
+		{name: "not yet valid", sig: "commit.txt.sig", options: `valid-after="202401010000Z"`, wantErr: true},
+		{name: "expired", sig: "commit.txt.sig", options: `valid-before="20231114221320Z"`, wantErr: true},
+		{name: "cert authority", sig: "commit.txt.sig", options: "cert-authority", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principals := tt.principals
+			if principals == "" {
+				principals = "config@example.com"
+			}
+			signers, err := loadAllowedSigners(writeSigners(t, principals, tt.options))
+			if err != nil {
+				t.Fatal(err)
+			}
+			message := tt.message
+			if message == nil {
+				message = msg
+			}
+			email := tt.email
+			if email == "" {
+				email = "config@example.com"
+			}
+			err = verifySSHSignature(string(readTestdata(t, tt.sig)), message, email, commitTime, signers)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifySSHSignature() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadAllowedSigners(t *testing.T) {
+	tests := []struct {
+		options string
+		wantErr bool
+	}{
+		{"", false},
+		{`namespaces="git"`, false},
+		{`valid-after="20230101",valid-before="20240101123000"`, false},
+		{`valid-before="2024"`, true},
+		{`no-touch-required`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.options, func(t *testing.T) {
+			_, err := loadAllowedSigners(writeSigners(t, "config@example.com", tt.options))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadAllowedSigners() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseSignerTime(t *testing.T) {
+	tests := []struct {
+		v    string
+		want time.Time
+	}{
+		{"20240102Z", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"202401021504Z", time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC)},
+		{"20240102150405Z", time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{"20240102", time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		got, err := parseSignerTime(tt.v)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseSignerTime(%q) = %v, %v, want %v", tt.v, got, err, tt.want)
+		}
+	}
+}
+
+// testSigner signs commits with an ssh key in the format of ssh-keygen -Y sign
+type testSigner struct {
+	signer ssh.Signer
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{signer: s}
+}
+
+// allowedSigners writes an allowed_signers file trusting the key for email
+func (s *testSigner) allowedSigners(t *testing.T, email string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "allowed_signers")
+	line := email + " " + string(ssh.MarshalAuthorizedKey(s.signer.PublicKey()))
+	if err := ioutil.WriteFile(p, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// sign returns the armored ssh signature of message
+func (s *testSigner) sign(t *testing.T, message []byte) string {
+	t.Helper()
+	h := sha512.Sum512(message)
+	var signed bytes.Buffer
+	signed.WriteString(sshSigMagic)
+	signed.Write(sshString([]byte(sshSigNamespace)))
+	signed.Write(sshString(nil))
+	signed.Write(sshString([]byte("sha512")))
+	signed.Write(sshString(h[:]))
+	sig, err := s.signer.Sign(rand.Reader, signed.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blob bytes.Buffer
+	blob.WriteString(sshSigMagic)
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, 1)
+	blob.Write(v)
+	blob.Write(sshString(s.signer.PublicKey().Marshal()))
+	blob.Write(sshString([]byte(sshSigNamespace)))
+	blob.Write(sshString(nil))
+	blob.Write(sshString([]byte("sha512")))
+	blob.Write(sshString(append(sshString([]byte(sig.Format)), sshString(sig.Blob)...)))
+	return sshSigArmorStart + "\n" + base64.StdEncoding.EncodeToString(blob.Bytes()) + "\n" + sshSigArmorEnd + "\n"
+}
+
+// testRepo builds commit graphs in an in-memory repository
+type testRepo struct {
+	t      *testing.T
+	r      *git.Repository
+	tree   plumbing.Hash
+	signer *testSigner
+	n      int
+}
+
+func newTestRepo(t *testing.T, signer *testSigner) *testRepo {
+	t.Helper()
+	r, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &testRepo{t: t, r: r, signer: signer}
+	tr.tree = tr.store(&object.Tree{})
+	return tr
+}
+
+type encoder interface {
+	Encode(plumbing.EncodedObject) error
+}
+
+func (tr *testRepo) store(o encoder) plumbing.Hash {
+	obj := tr.r.Storer.NewEncodedObject()
+	if err := o.Encode(obj); err != nil {
+		tr.t.Fatal(err)
+	}
+	h, err := tr.r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	return h
+}
+
+// commit stores a commit with the given parents, signed if signed is true
+func (tr *testRepo) commit(signed bool, parents ...*object.Commit) *object.Commit {
+	tr.n++
+	sig := object.Signature{Name: "Config Bot", Email: "config@example.com", When: commitTime.Add(time.Duration(tr.n) * time.Minute)}
+	c := &object.Commit{
+		Author:    sig,
+		Committer: sig,
+		Message:   "commit " + string(rune('a'+tr.n)),
+		TreeHash:  tr.tree,
+	}
+	for _, p := range parents {
+		c.ParentHashes = append(c.ParentHashes, p.Hash)
+	}
+	if signed {
+		obj := &plumbing.MemoryObject{}
+		if err := c.EncodeWithoutSignature(obj); err != nil {
+			tr.t.Fatal(err)
+		}
+		rd, err := obj.Reader()
+		if err != nil {
+			tr.t.Fatal(err)
+		}
+		msg, err := ioutil.ReadAll(rd)
+		if err != nil {
+			tr.t.Fatal(err)
+		}
+		c.PGPSignature = tr.signer.sign(tr.t, msg)
+	}
+	h := tr.store(c)
+	out, err := tr.r.CommitObject(h)
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	return out
+}
+
+func TestVerifyRevision(t *testing.T) {
+	signer := newTestSigner(t)
+	os.Setenv("GIT_SSH_ALLOWED_SIGNERS", signer.allowedSigners(t, "config@example.com"))
+	defer os.Unsetenv("GIT_SSH_ALLOWED_SIGNERS")
+
+	tr := newTestRepo(t, signer)
+	root := tr.commit(false)
+	accepted := tr.commit(true, root)
+	signed := tr.commit(true, accepted)
+	unsigned := tr.commit(false, accepted)
+	signedOnUnsigned := tr.commit(true, unsigned)
+	// a signed merge of an unsigned side branch, which a pre-order walk
+	// reaches after the last accepted commit
+	side := tr.commit(false, accepted)
+	merge := tr.commit(true, signed, side)
+	// a signed merge of a side branch forked before the last accepted commit
+	old := tr.commit(true, root)
+	mergeOld := tr.commit(true, signed, old)
+	// a rewritten history which does not contain the last accepted commit
+	rewritten := tr.commit(true, tr.commit(true, root))
+	// a history whose parent is missing, as in a shallow clone
+	orphan := &object.Commit{Author: signed.Author, Committer: signed.Committer, TreeHash: tr.tree,
+		ParentHashes: []plumbing.Hash{plumbing.NewHash("0123456789012345678901234567890123456789")}}
+	shallow := tr.commit(true, tr.commitObject(tr.store(orphan)))
+
+	tests := []struct {
+		name     string
+		all      bool
+		head     *object.Commit
+		accepted plumbing.Hash
+		wantErr  bool
+	}{
+		{name: "signed head", head: signed, accepted: accepted.Hash},
+		{name: "unsigned head", head: unsigned, accepted: accepted.Hash, wantErr: true},
+		{name: "head only skips history", head: merge, accepted: accepted.Hash},
+		{name: "first revision", all: true, head: signed},
+		{name: "signed history", all: true, head: signed, accepted: accepted.Hash},
+		{name: "unsigned merged branch", all: true, head: merge, accepted: accepted.Hash, wantErr: true},
+		{name: "branch from accepted ancestor", all: true, head: mergeOld, accepted: accepted.Hash},
+		{name: "unsigned commit below head", all: true, head: signedOnUnsigned, accepted: accepted.Hash, wantErr: true},
+		{name: "rewritten history", all: true, head: rewritten, accepted: accepted.Hash, wantErr: true},
+		{name: "missing accepted commit", all: true, head: signed, accepted: plumbing.NewHash("9876543210987654321098765432109876543210"), wantErr: true},
+		{name: "incomplete history", all: true, head: shallow, accepted: accepted.Hash, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.all {
+				os.Setenv("GIT_VERIFY_ALL_COMMITS", "true")
+				defer os.Unsetenv("GIT_VERIFY_ALL_COMMITS")
+			}
+			err := verifyRevision(tr.r, tt.head, tt.accepted)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyRevision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var se *signatureError
+			if err != nil && tt.name != "missing accepted commit" && !errors.As(err, &se) {
+				t.Errorf("verifyRevision() error = %v, want a signatureError", err)
+			}
+		})
+	}
+}
+
+func (tr *testRepo) commitObject(h plumbing.Hash) *object.Commit {
+	c, err := tr.r.CommitObject(h)
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	return c
+}
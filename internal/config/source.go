@@ -0,0 +1,348 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/robertlestak/stratus/internal/identity"
+	"github.com/robertlestak/stratus/internal/vaultclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// Source is a location identity mappings are loaded from
+type Source interface {
+	// Name returns the name of the source, used for attribution in logs
+	Name() string
+	// Load returns all mappings currently held in the source
+	Load() ([]identity.IAMMap, error)
+}
+
+// gitSource loads mappings from local paths within a cloned git repo
+type gitSource struct {
+	Repo  string
+	Paths []string
+}
+
+// Name returns the name of the source
+func (s *gitSource) Name() string {
+	return "git"
+}
+
+// Load pulls the remote repo and loads the mappings in the configured paths
+func (s *gitSource) Load() ([]identity.IAMMap, error) {
+	l := log.WithFields(log.Fields{
+		"action": "gitSource.Load",
+		"repo":   s.Repo,
+	})
+	l.Info("start")
+	err := pullRemoteConfig(s.Repo)
+	var serr *signatureError
+	if errors.As(err, &serr) {
+		l.Error(err)
+		return nil, err
+	} else if err != nil {
+		l.Error(err)
+		return nil, &fetchError{Source: s.Name(), Err: err}
+	}
+	return loadLocalSyncConfigs(s.Paths, s.Name())
+}
+
+// fileSource loads mappings from local files and directories
+type fileSource struct {
+	Paths []string
+}
+
+// Name returns the name of the source
+func (s *fileSource) Name() string {
+	return "file"
+}
+
+// Load loads the mappings in the configured paths
+func (s *fileSource) Load() ([]identity.IAMMap, error) {
+	return loadLocalSyncConfigs(s.Paths, s.Name())
+}
+
+// s3Object caches the parsed document of a single object, keyed by its ETag
+type s3Object struct {
+	ETag string
+	Doc  *document
+}
+
+// s3Source loads mappings from all objects under a prefix in an S3-compatible bucket
+type s3Source struct {
+	Bucket  string
+	Prefix  string
+	client  *s3.S3
+	objects map[string]s3Object
+}
+
+// newS3Source creates an S3 source. If endpoint is set, path-style requests are
+// made to it, allowing S3-compatible stores such as MinIO or GCS interoperability.
+func newS3Source(bucket, prefix, region, endpoint string) (*s3Source, error) {
+	cfg := &aws.Config{
+		Region: aws.String(region),
+	}
+	if endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Source{
+		Bucket:  bucket,
+		Prefix:  prefix,
+		client:  s3.New(sess),
+		objects: make(map[string]s3Object),
+	}, nil
+}
+
+// Name returns the name of the source
+func (s *s3Source) Name() string {
+	return "s3"
+}
+
+// Load lists the objects under the prefix, fetching only those whose ETag has
+// changed since the last load
+func (s *s3Source) Load() ([]identity.IAMMap, error) {
+	l := log.WithFields(log.Fields{
+		"action": "s3Source.Load",
+		"bucket": s.Bucket,
+		"prefix": s.Prefix,
+	})
+	l.Info("start")
+	objects := make(map[string]s3Object)
+	var perr error
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.Prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			key := aws.StringValue(o.Key)
+			etag := aws.StringValue(o.ETag)
+			if strings.HasSuffix(key, "/") {
+				continue
+			}
+			if c, ok := s.objects[key]; ok && c.ETag == etag {
+				objects[key] = c
+				continue
+			}
+			l.WithField("key", key).Info("object changed")
+			d, err := s.getObject(key)
+			if err != nil {
+				perr = err
+				return false
+			}
+			objects[key] = s3Object{ETag: etag, Doc: d}
+		}
+		return true
+	})
+	if err != nil {
+		l.WithError(err).Error("failed to list objects")
+		return nil, &fetchError{Source: s.Name(), Err: err}
+	}
+	if perr != nil {
+		return nil, perr
+	}
+	keys := make([]string, 0, len(objects))
+	for k := range objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	docs := make([]*document, 0, len(keys))
+	for _, k := range keys {
+		docs = append(docs, objects[k].Doc)
+	}
+	sc, err := expandDocuments(docs)
+	if err != nil {
+		return nil, err
+	}
+	// only replace the cache once every object has been loaded
+	s.objects = objects
+	l.WithField("objects", len(objects)).Info("end")
+	return sc, nil
+}
+
+// getObject fetches and parses a single object
+func (s *s3Source) getObject(key string) (*document, error) {
+	res, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, &fetchError{Source: s.Name(), Err: err}
+	}
+	defer res.Body.Close()
+	fd, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, &fetchError{Source: s.Name(), Err: err}
+	}
+	return parseDocument(fd, fmt.Sprintf("s3://%s/%s", s.Bucket, key))
+}
+
+// vaultSource loads mappings from a tree of kv secrets in vault. Each secret
+// holds a YAML config document in its "mappings" key.
+type vaultSource struct {
+	Path string
+}
+
+// Name returns the name of the source
+func (s *vaultSource) Name() string {
+	return "vault"
+}
+
+// Load recursively loads the mappings from all secrets under the path
+func (s *vaultSource) Load() ([]identity.IAMMap, error) {
+	l := log.WithFields(log.Fields{
+		"action": "vaultSource.Load",
+		"path":   s.Path,
+	})
+	l.Info("start")
+	docs, err := s.loadPath(strings.TrimSuffix(s.Path, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	return expandDocuments(docs)
+}
+
+// loadPath loads the documents from all secrets under p
+func (s *vaultSource) loadPath(p string) ([]*document, error) {
+	keys, err := vaultclient.Client.ListKVSecretsRetry(p)
+	if err != nil {
+		return nil, &fetchError{Source: s.Name(), Err: err}
+	}
+	var docs []*document
+	for _, k := range keys {
+		if strings.HasSuffix(k, "/") {
+			td, err := s.loadPath(p + k)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, td...)
+			continue
+		}
+		sec, err := vaultclient.Client.GetKVSecretRetry(p + k)
+		if err != nil {
+			return nil, &fetchError{Source: s.Name(), Err: err}
+		}
+		m, ok := sec["mappings"].(string)
+		if !ok {
+			return nil, fmt.Errorf("vault secret %s has no mappings", p+k)
+		}
+		d, err := parseDocument([]byte(m), "vault:"+p+k)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, d)
+	}
+	return docs, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// newSources creates the config sources listed in CONFIG_SOURCES, in order of
+// precedence. If unset, the git repo is used if configured, otherwise CONFIG_PATHS.
+func newSources() ([]Source, error) {
+	names := splitList(os.Getenv("CONFIG_SOURCES"))
+	if len(names) == 0 {
+		if validRemote(os.Getenv("REMOTE_CONFIG_REPO")) {
+			names = []string{"git"}
+		} else if os.Getenv("CONFIG_PATHS") != "" {
+			return []Source{&fileSource{Paths: splitList(os.Getenv("CONFIG_PATHS"))}}, nil
+		}
+	}
+	var sources []Source
+	for _, n := range names {
+		switch n {
+		case "git":
+			if !validRemote(os.Getenv("REMOTE_CONFIG_REPO")) {
+				return nil, errors.New("git source requires REMOTE_CONFIG_REPO")
+			}
+			paths := splitList(os.Getenv("CONFIG_PATHS"))
+			if len(paths) == 0 {
+				paths = []string{os.Getenv("GIT_CLONE_DIR")}
+			}
+			sources = append(sources, &gitSource{
+				Repo:  os.Getenv("REMOTE_CONFIG_REPO"),
+				Paths: paths,
+			})
+		case "file":
+			sources = append(sources, &fileSource{Paths: splitList(os.Getenv("LOCAL_CONFIG_PATHS"))})
+		case "s3":
+			s, err := newS3Source(
+				os.Getenv("CONFIG_S3_BUCKET"),
+				os.Getenv("CONFIG_S3_PREFIX"),
+				os.Getenv("CONFIG_S3_REGION"),
+				os.Getenv("CONFIG_S3_ENDPOINT"),
+			)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, s)
+		case "vault":
+			sources = append(sources, &vaultSource{Path: os.Getenv("CONFIG_VAULT_PATH")})
+		case "crd":
+			s, err := newCRDSource(os.Getenv("K8S_API_HOST"), os.Getenv("K8S_API_TOKEN"), nil, os.Getenv("CRD_NAMESPACE"))
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, s)
+		default:
+			return nil, fmt.Errorf("unknown config source %q", n)
+		}
+	}
+	return sources, nil
+}
+
+// mapKeyString identifies a mapping by its source and target identities
+func mapKeyString(m identity.IAMMap) string {
+	return strings.Join([]string{
+		string(m.Source.Provider), m.Source.ID,
+		string(m.Target.Provider), m.Target.ID,
+	}, "\x00")
+}
+
+// mergeSources merges the mappings from each source. Sources are in order of
+// precedence, so when the same source and target are mapped by more than one
+// source, the mapping from the earlier source is kept.
+func mergeSources(results [][]identity.IAMMap) []identity.IAMMap {
+	l := log.WithFields(log.Fields{
+		"action": "mergeSources",
+	})
+	seen := make(map[string]string)
+	var sc []identity.IAMMap
+	for _, r := range results {
+		for _, m := range r {
+			k := mapKeyString(m)
+			if o, ok := seen[k]; ok {
+				l.WithFields(log.Fields{
+					"source":  m.Source.ID,
+					"target":  m.Target.ID,
+					"origin":  o,
+					"ignored": m.Origin,
+				}).Warn("mapping already defined by higher precedence source")
+				continue
+			}
+			seen[k] = m.Origin
+			sc = append(sc, m)
+		}
+	}
+	return sc
+}
@@ -0,0 +1,352 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/robertlestak/stratus/internal/identity"
+)
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, k, v string) {
+	t.Helper()
+	old, ok := os.LookupEnv(k)
+	os.Setenv(k, v)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(k, old)
+		} else {
+			os.Unsetenv(k)
+		}
+	})
+}
+
+const (
+	gcpToAWS = `- source:
+    id: "sa@stratus-test.iam.gserviceaccount.com"
+    provider: "gcp"
+  target:
+    id: "arn:aws:iam::123456789012:role/stratus"
+    provider: "aws"
+`
+	awsToGCP = `- source:
+    id: "arn:aws:iam::123456789012:role/stratus"
+    provider: "aws"
+  target:
+    id: "sa@stratus-test.iam.gserviceaccount.com"
+    provider: "gcp"
+`
+)
+
+// s3Stub is a stand-in S3-compatible store serving path-style requests for
+// a single bucket, recording the objects fetched
+type s3Stub struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]string
+	etags   map[string]string
+	fetched []string
+}
+
+func newS3Stub(t *testing.T) *s3Stub {
+	t.Helper()
+	s := &s3Stub{objects: make(map[string]string), etags: make(map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential=AKIDSTRATUS/") {
+			http.Error(w, "unsigned request", http.StatusForbidden)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/stratus-config" && r.URL.Query().Get("list-type") == "2":
+			prefix := r.URL.Query().Get("prefix")
+			var keys []string
+			for k := range s.objects {
+				if strings.HasPrefix(k, prefix) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			var contents strings.Builder
+			for _, k := range keys {
+				fmt.Fprintf(&contents, "<Contents><Key>%s</Key><ETag>&quot;%s&quot;</ETag></Contents>", k, s.etags[k])
+			}
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>stratus-config</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><IsTruncated>false</IsTruncated>%s</ListBucketResult>`, prefix, len(keys), contents.String())
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/stratus-config/"):
+			k := strings.TrimPrefix(r.URL.Path, "/stratus-config/")
+			o, ok := s.objects[k]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code></Error>`))
+				return
+			}
+			s.fetched = append(s.fetched, k)
+			w.Header().Set("ETag", `"`+s.etags[k]+`"`)
+			w.Write([]byte(o))
+		default:
+			http.Error(w, "unsupported request", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(s.Close)
+	setenv(t, "AWS_ACCESS_KEY_ID", "AKIDSTRATUS")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "secret")
+	setenv(t, "AWS_SESSION_TOKEN", "")
+	setenv(t, "AWS_PROFILE", "")
+	return s
+}
+
+// put stores an object with the given etag
+func (s *s3Stub) put(key, etag, content string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = content
+	s.etags[key] = etag
+}
+
+// takeFetched returns and resets the keys fetched since the last call
+func (s *s3Stub) takeFetched() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.fetched
+	s.fetched = nil
+	return f
+}
+
+// origins returns the origin and target of each mapping
+func origins(sc []identity.IAMMap) []string {
+	var out []string
+	for _, m := range sc {
+		out = append(out, m.Origin+"="+m.Target.ID)
+	}
+	return out
+}
+
+func TestS3SourceEndpoint(t *testing.T) {
+	stub := newS3Stub(t)
+	stub.put("mappings/a.yaml", "a1", gcpToAWS)
+	stub.put("mappings/b/c.yaml", "c1", awsToGCP)
+	stub.put("mappings/", "dir", "")
+	stub.put("other/d.yaml", "d1", "not: [valid")
+
+	s, err := newS3Source("stratus-config", "mappings/", "us-east-1", stub.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	want := []string{
+		"s3://stratus-config/mappings/a.yaml=arn:aws:iam::123456789012:role/stratus",
+		"s3://stratus-config/mappings/b/c.yaml=sa@stratus-test.iam.gserviceaccount.com",
+	}
+	if got := origins(sc); !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() = %v, want %v", got, want)
+	}
+	if got := stub.takeFetched(); !reflect.DeepEqual(got, []string{"mappings/a.yaml", "mappings/b/c.yaml"}) {
+		t.Errorf("fetched %v", got)
+	}
+
+	// only objects whose ETag changed are fetched again
+	stub.put("mappings/b/c.yaml", "c2", awsToGCP+gcpToAWS)
+	sc, err = s.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(sc) != 3 {
+		t.Errorf("Load() returned %d mappings, want 3", len(sc))
+	}
+	if got := stub.takeFetched(); !reflect.DeepEqual(got, []string{"mappings/b/c.yaml"}) {
+		t.Errorf("fetched %v, want only the changed object", got)
+	}
+
+	// an invalid object fails the load and keeps the cache of the last load
+	stub.put("mappings/a.yaml", "a2", "- source: [invalid")
+	if _, err := s.Load(); err == nil {
+		t.Error("Load() accepted an invalid object")
+	}
+	stub.put("mappings/a.yaml", "a1", gcpToAWS)
+	if _, err := s.Load(); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if got := stub.takeFetched(); !reflect.DeepEqual(got, []string{"mappings/a.yaml"}) {
+		t.Errorf("fetched %v, want the failed object only", got)
+	}
+}
+
+func TestS3SourceUnreachable(t *testing.T) {
+	stub := newS3Stub(t)
+	s, err := newS3Source("stratus-config", "", "us-east-1", stub.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.Close()
+	_, err = s.Load()
+	if _, ok := err.(*fetchError); !ok {
+		t.Errorf("Load() error = %v, want a fetch error", err)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"git", []string{"git"}},
+		{"git, s3 ,,crd", []string{"git", "s3", "crd"}},
+		{" , ", nil},
+	}
+	for _, tt := range tests {
+		if got := splitList(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitList(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{name: "none"},
+		{
+			name: "config paths",
+			env:  map[string]string{"CONFIG_PATHS": "/etc/stratus"},
+			want: []string{"file"},
+		},
+		{
+			name: "remote repo",
+			env:  map[string]string{"REMOTE_CONFIG_REPO": "https://git.example.com/stratus-config.git"},
+			want: []string{"git"},
+		},
+		{
+			name: "ordered sources",
+			env: map[string]string{
+				"CONFIG_SOURCES":     "s3, file,git",
+				"REMOTE_CONFIG_REPO": "git@git.example.com:stratus-config.git",
+				"CONFIG_S3_BUCKET":   "stratus-config",
+				"CONFIG_S3_ENDPOINT": "http://127.0.0.1:9000",
+			},
+			want: []string{"s3", "file", "git"},
+		},
+		{
+			name: "vault and crd",
+			env:  map[string]string{"CONFIG_SOURCES": "vault,crd", "K8S_API_HOST": "https://127.0.0.1:6443"},
+			want: []string{"vault", "crd"},
+		},
+		{
+			name:    "git without repo",
+			env:     map[string]string{"CONFIG_SOURCES": "git", "REMOTE_CONFIG_REPO": "not a repo"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown source",
+			env:     map[string]string{"CONFIG_SOURCES": "file,consul"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"CONFIG_SOURCES", "CONFIG_PATHS", "REMOTE_CONFIG_REPO", "CONFIG_S3_BUCKET", "CONFIG_S3_ENDPOINT", "K8S_API_HOST"} {
+				setenv(t, k, tt.env[k])
+			}
+			sources, err := newSources()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newSources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, s := range sources {
+				got = append(got, s.Name())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newSources() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSourcesS3Endpoint(t *testing.T) {
+	setenv(t, "CONFIG_SOURCES", "s3")
+	setenv(t, "CONFIG_S3_BUCKET", "stratus-config")
+	setenv(t, "CONFIG_S3_PREFIX", "mappings/")
+	setenv(t, "CONFIG_S3_REGION", "us-east-1")
+	setenv(t, "CONFIG_S3_ENDPOINT", "http://minio.example.com:9000")
+	sources, err := newSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sources[0].(*s3Source)
+	if s.Bucket != "stratus-config" || s.Prefix != "mappings/" {
+		t.Errorf("source = %+v", s)
+	}
+	c := s.client.Config
+	if got := *c.Endpoint; got != "http://minio.example.com:9000" {
+		t.Errorf("endpoint = %q", got)
+	}
+	if c.S3ForcePathStyle == nil || !*c.S3ForcePathStyle {
+		t.Error("path-style requests not forced for the endpoint override")
+	}
+
+	setenv(t, "CONFIG_S3_ENDPOINT", "")
+	sources, err = newSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := sources[0].(*s3Source).client.Config; c.S3ForcePathStyle != nil && *c.S3ForcePathStyle {
+		t.Error("path-style requests forced without an endpoint override")
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "team"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for p, c := range map[string]string{"a.yaml": gcpToAWS, "team/b.yaml": awsToGCP} {
+		if err := ioutil.WriteFile(filepath.Join(dir, p), []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sc, err := (&fileSource{Paths: []string{dir}}).Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(sc) != 2 {
+		t.Errorf("Load() = %v, want 2 mappings", origins(sc))
+	}
+}
+
+func TestMergeSources(t *testing.T) {
+	m := func(src, tgt, origin string) identity.IAMMap {
+		return identity.IAMMap{
+			Source: identity.Identity{ID: src, Provider: identity.ProviderGCP},
+			Target: identity.Identity{ID: tgt, Provider: identity.ProviderAWS},
+			Origin: origin,
+		}
+	}
+	got := mergeSources([][]identity.IAMMap{
+		{m("a", "x", "git"), m("b", "x", "git")},
+		nil,
+		{m("a", "x", "s3"), m("a", "y", "s3")},
+		{m("b", "x", "crd")},
+	})
+	want := []string{"git=x", "git=x", "s3=y"}
+	if o := origins(got); !reflect.DeepEqual(o, want) {
+		t.Errorf("mergeSources() = %v, want %v", o, want)
+	}
+}
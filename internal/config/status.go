@@ -0,0 +1,124 @@
+package config
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	statusMu sync.RWMutex
+	status   Status
+	// maxStaleness is the maximum age of the last successful reload before
+	// the config is considered stale. Zero disables the check.
+	maxStaleness time.Duration
+
+	reloadsMetric        = expvar.NewInt("config_reloads")
+	reloadFailuresMetric = expvar.NewInt("config_reload_failures")
+	lastSuccessMetric    = expvar.NewInt("config_last_success_unix")
+	mappingsMetric       = expvar.NewInt("config_mappings")
+)
+
+// Status describes the state of the config reload loop
+type Status struct {
+	LastAttempt         time.Time `json:"lastAttempt"`
+	LastSuccess         time.Time `json:"lastSuccess"`
+	LastError           string    `json:"lastError,omitempty"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	Mappings            int       `json:"mappings"`
+	Stale               bool      `json:"stale"`
+}
+
+// fetchError is returned when a config source could not be retrieved, as
+// opposed to retrieved but invalid. Fetch errors are retried with backoff.
+type fetchError struct {
+	Source string
+	Err    error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("fetch %s: %v", e.Source, e.Err)
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.Err
+}
+
+// envDuration parses a duration from the environment, returning def if unset
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.WithField("env", name).WithError(err).Error("invalid duration, using default")
+		return def
+	}
+	return d
+}
+
+// recordSuccess records a successful reload
+func recordSuccess(mappings int) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	now := time.Now()
+	status.LastAttempt = now
+	status.LastSuccess = now
+	status.LastError = ""
+	status.ConsecutiveFailures = 0
+	status.Mappings = mappings
+	reloadsMetric.Add(1)
+	lastSuccessMetric.Set(now.Unix())
+	mappingsMetric.Set(int64(mappings))
+}
+
+// recordMappings records the number of active mappings after live source changes
+func recordMappings(mappings int) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	status.Mappings = mappings
+	mappingsMetric.Set(int64(mappings))
+}
+
+// recordFailure records a failed reload and returns the number of consecutive failures
+func recordFailure(err error) int {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	status.LastAttempt = time.Now()
+	status.LastError = err.Error()
+	status.ConsecutiveFailures++
+	reloadsMetric.Add(1)
+	reloadFailuresMetric.Add(1)
+	return status.ConsecutiveFailures
+}
+
+// stale reports whether the config is older than the configured max staleness.
+// The caller must hold statusMu.
+func stale() bool {
+	if maxStaleness <= 0 {
+		return false
+	}
+	return status.LastSuccess.IsZero() || time.Since(status.LastSuccess) > maxStaleness
+}
+
+// Stale reports whether the active config has exceeded CONFIG_MAX_STALENESS.
+// Identity exchanges should be refused while the config is stale.
+func Stale() bool {
+	statusMu.RLock()
+	defer statusMu.RUnlock()
+	return stale()
+}
+
+// CurrentStatus returns a snapshot of the config reload status
+func CurrentStatus() Status {
+	statusMu.RLock()
+	defer statusMu.RUnlock()
+	s := status
+	s.Stale = stale()
+	return s
+}
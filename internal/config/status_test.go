@@ -0,0 +1,117 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// resetStatus sets the reload status and max staleness for the test
+func resetStatus(t *testing.T, s Status, max time.Duration) {
+	t.Helper()
+	statusMu.Lock()
+	oldStatus, oldMax := status, maxStaleness
+	status, maxStaleness = s, max
+	statusMu.Unlock()
+	t.Cleanup(func() {
+		statusMu.Lock()
+		status, maxStaleness = oldStatus, oldMax
+		statusMu.Unlock()
+	})
+}
+
+func TestStale(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		lastSuccess time.Time
+		max         time.Duration
+		want        bool
+	}{
+		{name: "check disabled", max: 0},
+		{name: "check disabled after old reload", lastSuccess: now.Add(-24 * time.Hour), max: 0},
+		{name: "never loaded", max: time.Hour, want: true},
+		{name: "recent reload", lastSuccess: now.Add(-time.Minute), max: time.Hour},
+		{name: "reload older than max", lastSuccess: now.Add(-2 * time.Hour), max: time.Hour, want: true},
+		{name: "negative max", lastSuccess: now.Add(-2 * time.Hour), max: -time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetStatus(t, Status{LastSuccess: tt.lastSuccess}, tt.max)
+			if got := Stale(); got != tt.want {
+				t.Errorf("Stale() = %v, want %v", got, tt.want)
+			}
+			if got := CurrentStatus().Stale; got != tt.want {
+				t.Errorf("CurrentStatus().Stale = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordStatus(t *testing.T) {
+	resetStatus(t, Status{}, time.Hour)
+	reloads, failures := reloadsMetric.Value(), reloadFailuresMetric.Value()
+	steps := []struct {
+		name         string
+		err          error
+		mappings     int
+		wantFailures int
+		wantError    string
+		wantStale    bool
+		wantMappings int
+	}{
+		{name: "first reload fails", err: errors.New("fetch failed"), wantFailures: 1, wantError: "fetch failed", wantStale: true},
+		{name: "second reload fails", err: errors.New("invalid config"), wantFailures: 2, wantError: "invalid config", wantStale: true},
+		{name: "reload succeeds", mappings: 3, wantMappings: 3},
+		{name: "reload fails after success", err: errors.New("fetch failed"), wantFailures: 1, wantError: "fetch failed", wantMappings: 3},
+		{name: "reload recovers", mappings: 2, wantMappings: 2},
+	}
+	for _, st := range steps {
+		if st.err != nil {
+			if n := recordFailure(st.err); n != st.wantFailures {
+				t.Errorf("%s: recordFailure() = %d, want %d", st.name, n, st.wantFailures)
+			}
+		} else {
+			recordSuccess(st.mappings)
+		}
+		s := CurrentStatus()
+		if s.ConsecutiveFailures != st.wantFailures || s.LastError != st.wantError || s.Stale != st.wantStale || s.Mappings != st.wantMappings {
+			t.Errorf("%s: status = %+v", st.name, s)
+		}
+		if s.LastAttempt.IsZero() || s.LastAttempt.Before(s.LastSuccess) {
+			t.Errorf("%s: last attempt %s before last success %s", st.name, s.LastAttempt, s.LastSuccess)
+		}
+	}
+	if got := reloadsMetric.Value() - reloads; got != int64(len(steps)) {
+		t.Errorf("config_reloads increased by %d, want %d", got, len(steps))
+	}
+	if got := reloadFailuresMetric.Value() - failures; got != 3 {
+		t.Errorf("config_reload_failures increased by %d, want 3", got)
+	}
+	if got := mappingsMetric.Value(); got != 2 {
+		t.Errorf("config_mappings = %d, want 2", got)
+	}
+	recordMappings(5)
+	if s := CurrentStatus(); s.Mappings != 5 || s.ConsecutiveFailures != 0 {
+		t.Errorf("status after recordMappings() = %+v", s)
+	}
+}
+
+func TestEnvDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", time.Minute},
+		{"90s", 90 * time.Second},
+		{"0", 0},
+		{"invalid", time.Minute},
+		{"10", time.Minute},
+	}
+	for _, tt := range tests {
+		setenv(t, "CONFIG_TEST_DURATION", tt.value)
+		if got := envDuration("CONFIG_TEST_DURATION", time.Minute); got != tt.want {
+			t.Errorf("envDuration(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
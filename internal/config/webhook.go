@@ -0,0 +1,101 @@
+package config
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrWebhookDisabled is returned when no webhook secret is configured
+	ErrWebhookDisabled = errors.New("config webhook disabled")
+	// ErrWebhookUnauthorized is returned when a webhook signature or token is invalid
+	ErrWebhookUnauthorized = errors.New("invalid webhook signature")
+
+	// reloadCh signals the refresh loop to reload immediately
+	reloadCh = make(chan struct{}, 1)
+)
+
+// pushEvent contains the fields common to GitHub and GitLab push payloads
+type pushEvent struct {
+	Ref string `json:"ref"`
+}
+
+// TriggerReload requests an immediate config reload. Multiple triggers
+// received while a reload is pending are coalesced into a single reload.
+func TriggerReload() {
+	select {
+	case reloadCh <- struct{}{}:
+	default:
+	}
+}
+
+// verifyGitHubSignature checks the X-Hub-Signature-256 HMAC of the body
+func verifyGitHubSignature(secret string, sig string, body []byte) bool {
+	if !strings.HasPrefix(sig, "sha256=") {
+		return false
+	}
+	want, err := hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// HandleWebhook authenticates a GitHub or GitLab push webhook and triggers a
+// reload if the push is for the configured REMOTE_GIT_REF. It returns true if
+// a reload was triggered.
+func HandleWebhook(h http.Header, body []byte) (bool, error) {
+	l := log.WithFields(log.Fields{
+		"action": "HandleWebhook",
+	})
+	l.Info("start")
+	secret := os.Getenv("CONFIG_WEBHOOK_SECRET")
+	if secret == "" {
+		return false, ErrWebhookDisabled
+	}
+	var event string
+	if sig := h.Get("X-Hub-Signature-256"); sig != "" {
+		if !verifyGitHubSignature(secret, sig, body) {
+			l.Error("invalid github signature")
+			return false, ErrWebhookUnauthorized
+		}
+		event = h.Get("X-GitHub-Event")
+	} else if tok := h.Get("X-Gitlab-Token"); tok != "" {
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(secret)) != 1 {
+			l.Error("invalid gitlab token")
+			return false, ErrWebhookUnauthorized
+		}
+		event = h.Get("X-Gitlab-Event")
+	} else {
+		l.Error("no webhook signature")
+		return false, ErrWebhookUnauthorized
+	}
+	l = l.WithField("event", event)
+	if event != "push" && event != "Push Hook" {
+		l.Info("ignoring non-push event")
+		return false, nil
+	}
+	var pe pushEvent
+	if err := json.Unmarshal(body, &pe); err != nil {
+		l.WithError(err).Error("failed to decode push event")
+		return false, err
+	}
+	if ref := os.Getenv("REMOTE_GIT_REF"); ref != "" && pe.Ref != ref {
+		l.WithField("ref", pe.Ref).Info("ignoring push to other ref")
+		return false, nil
+	}
+	l.WithField("ref", pe.Ref).Info("triggering config reload")
+	TriggerReload()
+	return true, nil
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// drainReload clears a pending reload trigger, returning true if there was one
+func drainReload() bool {
+	select {
+	case <-reloadCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// githubSignature returns the X-Hub-Signature-256 header of body
+func githubSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandleWebhook(t *testing.T) {
+	const secret = "webhook-secret"
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	tests := []struct {
+		name       string
+		disabled   bool
+		headers    map[string]string
+		body       []byte
+		wantReload bool
+		wantErr    error
+		wantDecode bool
+	}{
+		{
+			name:       "github push",
+			headers:    map[string]string{"X-Hub-Signature-256": githubSignature(secret, body), "X-GitHub-Event": "push"},
+			wantReload: true,
+		},
+		{
+			name:    "github wrong signature",
+			headers: map[string]string{"X-Hub-Signature-256": githubSignature("other-secret", body), "X-GitHub-Event": "push"},
+			wantErr: ErrWebhookUnauthorized,
+		},
+		{
+			name:    "github signature of another body",
+			headers: map[string]string{"X-Hub-Signature-256": githubSignature(secret, []byte(`{"ref":"refs/heads/dev"}`)), "X-GitHub-Event": "push"},
+			wantErr: ErrWebhookUnauthorized,
+		},
+		{
+			name:    "github signature without sha256 prefix",
+			headers: map[string]string{"X-Hub-Signature-256": githubSignature(secret, body)[len("sha256="):], "X-GitHub-Event": "push"},
+			wantErr: ErrWebhookUnauthorized,
+		},
+		{
+			name:    "github sha1 signature",
+			headers: map[string]string{"X-Hub-Signature-256": "sha1=" + githubSignature(secret, body)[len("sha256="):], "X-GitHub-Event": "push"},
+			wantErr: ErrWebhookUnauthorized,
+		},
+		{
+			name:    "github signature not hex",
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=not-hex", "X-GitHub-Event": "push"},
+			wantErr: ErrWebhookUnauthorized,
+		},
+		{
+			name:    "github empty signature",
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=", "X-GitHub-Event": "push"},
+			wantErr: ErrWebhookUnauthorized,
+		},
+		{
+			name:    "github non-push event",
+			headers: map[string]string{"X-Hub-Signature-256": githubSignature(secret, body), "X-GitHub-Event": "ping"},
+		},
+		{
+			name:    "github push to other ref",
+			headers: map[string]string{"X-Hub-Signature-256": githubSignature(secret, []byte(`{"ref":"refs/heads/dev"}`)), "X-GitHub-Event": "push"},
+			body:    []byte(`{"ref":"refs/heads/dev"}`),
+		},
+		{
+			name:       "github invalid payload",
+			headers:    map[string]string{"X-Hub-Signature-256": githubSignature(secret, []byte("not json")), "X-GitHub-Event": "push"},
+			body:       []byte("not json"),
+			wantDecode: true,
+		},
+		{
+			name:       "gitlab push",
+			headers:    map[string]string{"X-Gitlab-Token": secret, "X-Gitlab-Event": "Push Hook"},
+			wantReload: true,
+		},
+		{
+			name:    "gitlab wrong token",
+			headers: map[string]string{"X-Gitlab-Token": "other-secret", "X-Gitlab-Event": "Push Hook"},
+			wantErr: ErrWebhookUnauthorized,
+		},
+		{
+			name:    "gitlab token prefix",
+			headers: map[string]string{"X-Gitlab-Token": secret[:4], "X-Gitlab-Event": "Push Hook"},
+			wantErr: ErrWebhookUnauthorized,
+		},
+		{
+			name:    "no signature",
+			headers: map[string]string{"X-GitHub-Event": "push"},
+			wantErr: ErrWebhookUnauthorized,
+		},
+		{
+			name:     "disabled",
+			disabled: true,
+			headers:  map[string]string{"X-Gitlab-Token": secret, "X-Gitlab-Event": "Push Hook"},
+			wantErr:  ErrWebhookDisabled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := secret
+			if tt.disabled {
+				s = ""
+			}
+			setenv(t, "CONFIG_WEBHOOK_SECRET", s)
+			setenv(t, "REMOTE_GIT_REF", "refs/heads/main")
+			drainReload()
+			h := http.Header{}
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			b := tt.body
+			if b == nil {
+				b = body
+			}
+			got, err := HandleWebhook(h, b)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("HandleWebhook() error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantDecode:
+				if err == nil {
+					t.Error("HandleWebhook() accepted an invalid payload")
+				}
+			case err != nil:
+				t.Errorf("HandleWebhook() error = %v", err)
+			}
+			if got != tt.wantReload {
+				t.Errorf("HandleWebhook() = %v, want %v", got, tt.wantReload)
+			}
+			if reloaded := drainReload(); reloaded != tt.wantReload {
+				t.Errorf("reload triggered = %v, want %v", reloaded, tt.wantReload)
+			}
+		})
+	}
+}
+
+func TestTriggerReloadCoalesces(t *testing.T) {
+	drainReload()
+	TriggerReload()
+	TriggerReload()
+	if !drainReload() {
+		t.Fatal("TriggerReload() did not trigger a reload")
+	}
+	if drainReload() {
+		t.Error("TriggerReload() queued more than one reload")
+	}
+}
@@ -0,0 +1,118 @@
+package gcpauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/stratus/internal/jwt"
+)
+
+const (
+	// ScopeCloudPlatform is the OAuth scope for Google Cloud APIs
+	ScopeCloudPlatform = "https://www.googleapis.com/auth/cloud-platform"
+	// defaultTokenURL is the Google OAuth token endpoint
+	defaultTokenURL = "https://oauth2.googleapis.com/token"
+)
+
+// TokenSource issues OAuth access tokens for a service account key,
+// caching each token until shortly before it expires
+type TokenSource struct {
+	email    string
+	keyID    string
+	tokenURL string
+	scopes   []string
+	key      []byte
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// tokenURL returns the token endpoint, GCP_TOKEN_URL if set, otherwise the
+// token_uri of the key
+func tokenURL(uri string) string {
+	if u := os.Getenv("GCP_TOKEN_URL"); u != "" {
+		return u
+	}
+	if uri != "" {
+		return uri
+	}
+	return defaultTokenURL
+}
+
+// NewTokenSource returns a TokenSource for a service account JSON key
+func NewTokenSource(key map[string]interface{}, scopes ...string) (*TokenSource, error) {
+	email, _ := key["client_email"].(string)
+	pk, _ := key["private_key"].(string)
+	if email == "" || pk == "" {
+		return nil, errors.New("client_email and private_key required")
+	}
+	kid, _ := key["private_key_id"].(string)
+	uri, _ := key["token_uri"].(string)
+	return &TokenSource{
+		email:    email,
+		keyID:    kid,
+		tokenURL: tokenURL(uri),
+		scopes:   scopes,
+		key:      []byte(pk),
+	}, nil
+}
+
+// Token returns a valid access token
+func (ts *TokenSource) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Now().Add(time.Minute).Before(ts.expiry) {
+		return ts.token, nil
+	}
+	k, err := jwt.ParseRSAPrivateKey(ts.key)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	assertion, err := jwt.SignRS256(map[string]interface{}{
+		"iss":   ts.email,
+		"scope": strings.Join(ts.scopes, " "),
+		"aud":   ts.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}, k, ts.keyID)
+	if err != nil {
+		return "", err
+	}
+	hc := &http.Client{Timeout: 30 * time.Second}
+	res, err := hc.PostForm(ts.tokenURL, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", fmt.Errorf("token request returned %d: %s", res.StatusCode, b)
+	}
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return "", err
+	}
+	if tr.AccessToken == "" {
+		return "", errors.New("no access token returned")
+	}
+	ts.token = tr.AccessToken
+	ts.expiry = now.Add(time.Duration(tr.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
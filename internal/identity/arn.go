@@ -0,0 +1,253 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// verified AWS identity attribute keys
+const (
+	AttrAWSArn         = "aws-arn"
+	AttrAWSRole        = "aws-role"
+	AttrAWSSessionName = "aws-session-name"
+)
+
+var (
+	// awsPartitions are the AWS partitions stratus accepts
+	awsPartitions = map[string]bool{
+		"aws":        true,
+		"aws-cn":     true,
+		"aws-us-gov": true,
+		"aws-iso":    true,
+		"aws-iso-b":  true,
+	}
+	// awsAccountID matches a bare AWS account ID
+	awsAccountID = regexp.MustCompile(`^\d{12}$`)
+)
+
+// principalARN is a parsed AWS IAM or STS principal ARN
+type principalARN struct {
+	Partition string
+	Service   string
+	Account   string
+	// Type is the resource type, such as role, assumed-role, or user
+	Type string
+	// Path is the IAM path of a role or user, which is not included in
+	// assumed-role ARNs
+	Path string
+	// Name is the role or user name
+	Name string
+	// SessionName is the session name of an assumed role
+	SessionName string
+}
+
+// parsePrincipalARN parses an AWS principal ARN
+func parsePrincipalARN(s string) (*principalARN, error) {
+	parts := strings.SplitN(s, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return nil, fmt.Errorf("invalid arn %q", s)
+	}
+	a := &principalARN{
+		Partition: parts[1],
+		Service:   parts[2],
+		Account:   parts[4],
+	}
+	if !awsPartitions[a.Partition] {
+		return nil, fmt.Errorf("unsupported partition %q", a.Partition)
+	}
+	res := strings.Split(parts[5], "/")
+	a.Type = res[0]
+	switch {
+	case a.Service == "sts" && a.Type == "assumed-role":
+		if len(res) != 3 {
+			return nil, fmt.Errorf("invalid assumed-role arn %q", s)
+		}
+		a.Name = res[1]
+		a.SessionName = res[2]
+	case a.Service == "iam" && (a.Type == "role" || a.Type == "user"):
+		if len(res) < 2 || res[len(res)-1] == "" {
+			return nil, fmt.Errorf("invalid %s arn %q", a.Type, s)
+		}
+		a.Name = res[len(res)-1]
+		a.Path = "/" + strings.Join(res[1:len(res)-1], "/")
+		if len(res) > 2 {
+			a.Path += "/"
+		}
+	case a.Service == "iam" && a.Type == "root":
+	default:
+		return nil, fmt.Errorf("unsupported principal arn %q", s)
+	}
+	return a, nil
+}
+
+// isRole returns true if the ARN is a role or a session of a role
+func (a *principalARN) isRole() bool {
+	return a.Type == "role" || a.Type == "assumed-role"
+}
+
+// roleKey returns the index key of the role, ignoring the role path as it
+// is not present in assumed-role ARNs
+func (a *principalARN) roleKey() string {
+	return "role:" + a.Partition + ":" + a.Account + ":" + a.Name
+}
+
+// roleARN returns the path-less IAM ARN of the role
+func (a *principalARN) roleARN() string {
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", a.Partition, a.Account, a.Name)
+}
+
+// accountKey returns the index key of an account in a partition, as account
+// IDs are only unique within a partition
+func accountKey(partition, account string) string {
+	return "account:" + partition + ":" + account
+}
+
+// defaultPartition returns the partition of bare account ID sources, the
+// partition of AWS_REGION if set, otherwise the aws partition
+func defaultPartition() string {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), os.Getenv("AWS_REGION")); ok {
+		return p.ID()
+	}
+	return "aws"
+}
+
+// awsSourceKey returns the index key for a configured AWS source ID. Role ARNs
+// match any session of the role, account IDs and account root ARNs match any
+// principal in the account, and all other ARNs, including assumed-role ARNs,
+// match exactly. Bare account IDs are in the default partition.
+func awsSourceKey(id string) string {
+	if awsAccountID.MatchString(id) {
+		return accountKey(defaultPartition(), id)
+	}
+	a, err := parsePrincipalARN(id)
+	if err == nil && a.Type == "role" {
+		return a.roleKey()
+	}
+	if err == nil && a.Type == "root" {
+		return accountKey(a.Partition, a.Account)
+	}
+	return id
+}
+
+// awsCallerKeys returns the index keys which match a verified AWS caller, in
+// order of specificity
+func awsCallerKeys(id *Identity) []string {
+	arn := id.Attributes[AttrAWSArn]
+	if arn == "" {
+		return []string{id.ID}
+	}
+	keys := []string{arn}
+	if a, err := parsePrincipalARN(arn); err == nil {
+		if a.isRole() {
+			keys = append(keys, a.roleKey())
+		}
+		keys = append(keys, accountKey(a.Partition, a.Account))
+	}
+	return keys
+}
+
+// awsAttributes returns the verified attributes of an AWS caller ARN
+func awsAttributes(arn string) (map[string]string, error) {
+	a, err := parsePrincipalARN(arn)
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string]string{
+		AttrAWSArn:     arn,
+		AttrAWSAccount: a.Account,
+	}
+	if a.isRole() {
+		attrs[AttrAWSRole] = a.roleARN()
+	}
+	if a.SessionName != "" {
+		attrs[AttrAWSSessionName] = a.SessionName
+	}
+	return attrs, nil
+}
+
+// awsExactAttributes returns the attributes of a caller ARN which is not a
+// role, user or root principal, such as a federated user, when it exactly
+// matches the requested ID
+func awsExactAttributes(arn string) map[string]string {
+	attrs := map[string]string{AttrAWSArn: arn}
+	if parts := strings.SplitN(arn, ":", 6); len(parts) == 6 && awsAccountID.MatchString(parts[4]) {
+		attrs[AttrAWSAccount] = parts[4]
+	}
+	return attrs
+}
+
+// awsIDMatches checks if the ID requested by the caller identifies the verified
+// caller ARN, either exactly, as the caller's role, or as the caller's account
+func awsIDMatches(id string, arn string) bool {
+	if id == arn {
+		return true
+	}
+	a, err := parsePrincipalARN(arn)
+	if err != nil {
+		return false
+	}
+	if id == a.Account {
+		return true
+	}
+	r, err := parsePrincipalARN(id)
+	if err != nil {
+		return false
+	}
+	if r.Type == "root" {
+		return r.Partition == a.Partition && r.Account == a.Account
+	}
+	if r.Type != "role" || !a.isRole() {
+		return false
+	}
+	return r.roleKey() == a.roleKey()
+}
+
+// sessionNameMatches checks the caller session name against the pattern
+// configured on a source. An empty pattern matches any caller.
+func sessionNameMatches(pattern string, attrs map[string]string) bool {
+	if pattern == "" {
+		return true
+	}
+	sn, ok := attrs[AttrAWSSessionName]
+	if !ok {
+		return false
+	}
+	m, _ := path.Match(pattern, sn)
+	return m
+}
+
+// validateAWSSource checks a configured AWS source ID and session name pattern
+func validateAWSSource(id *Identity) error {
+	if awsAccountID.MatchString(id.ID) {
+		return validateSessionPattern(id.SessionName)
+	}
+	a, err := parsePrincipalARN(id.ID)
+	if err != nil {
+		// other principal ARNs, such as federated users, match exactly
+		if parts := strings.SplitN(id.ID, ":", 6); len(parts) != 6 || parts[0] != "arn" || !awsPartitions[parts[1]] {
+			return err
+		}
+		if id.SessionName != "" {
+			return errors.New("sessionName requires a role arn or account source")
+		}
+		return nil
+	}
+	if id.SessionName != "" && a.Type != "role" && a.Type != "root" {
+		return errors.New("sessionName requires a role arn or account source")
+	}
+	return validateSessionPattern(id.SessionName)
+}
+
+// validateSessionPattern checks a session name glob pattern is well formed
+func validateSessionPattern(p string) error {
+	if _, err := path.Match(p, ""); err != nil {
+		return fmt.Errorf("invalid sessionName pattern %q", p)
+	}
+	return nil
+}
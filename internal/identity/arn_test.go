@@ -0,0 +1,258 @@
+package identity
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePrincipalARN(t *testing.T) {
+	tests := []struct {
+		arn     string
+		want    *principalARN
+		wantErr bool
+	}{
+		{
+			arn:  "arn:aws:sts::111111111111:assumed-role/ci/build-1",
+			want: &principalARN{Partition: "aws", Service: "sts", Account: "111111111111", Type: "assumed-role", Name: "ci", SessionName: "build-1"},
+		},
+		{
+			arn:  "arn:aws-us-gov:iam::111111111111:role/ci/deploy/stratus",
+			want: &principalARN{Partition: "aws-us-gov", Service: "iam", Account: "111111111111", Type: "role", Path: "/ci/deploy/", Name: "stratus"},
+		},
+		{
+			arn:  "arn:aws-cn:iam::111111111111:user/alice",
+			want: &principalARN{Partition: "aws-cn", Service: "iam", Account: "111111111111", Type: "user", Path: "/", Name: "alice"},
+		},
+		{
+			arn:  "arn:aws:iam::111111111111:root",
+			want: &principalARN{Partition: "aws", Service: "iam", Account: "111111111111", Type: "root"},
+		},
+		{arn: "arn:aws:sts::111111111111:assumed-role/ci", wantErr: true},
+		{arn: "arn:aws:iam::111111111111:role/", wantErr: true},
+		{arn: "arn:aws:sts::111111111111:federated-user/alice", wantErr: true},
+		{arn: "arn:aws-xx:iam::111111111111:role/ci", wantErr: true},
+		{arn: "111111111111", wantErr: true},
+		{arn: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arn, func(t *testing.T) {
+			got, err := parsePrincipalARN(tt.arn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePrincipalARN() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePrincipalARN() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAWSSourceKey(t *testing.T) {
+	tests := []struct {
+		region string
+		id     string
+		want   string
+	}{
+		{"", "111111111111", "account:aws:111111111111"},
+		{"us-gov-west-1", "111111111111", "account:aws-us-gov:111111111111"},
+		{"cn-north-1", "111111111111", "account:aws-cn:111111111111"},
+		{"", "arn:aws-cn:iam::111111111111:root", "account:aws-cn:111111111111"},
+		{"", "arn:aws:iam::111111111111:role/ci/stratus", "role:aws:111111111111:stratus"},
+		{"", "arn:aws:sts::111111111111:assumed-role/stratus/s", "arn:aws:sts::111111111111:assumed-role/stratus/s"},
+		{"", "arn:aws:sts::111111111111:federated-user/alice", "arn:aws:sts::111111111111:federated-user/alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.region+" "+tt.id, func(t *testing.T) {
+			setenv(t, "AWS_REGION", tt.region)
+			if got := awsSourceKey(tt.id); got != tt.want {
+				t.Errorf("awsSourceKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAWSCallerKeys(t *testing.T) {
+	tests := []struct {
+		arn  string
+		want []string
+	}{
+		{
+			"arn:aws:sts::111111111111:assumed-role/stratus/s",
+			[]string{"arn:aws:sts::111111111111:assumed-role/stratus/s", "role:aws:111111111111:stratus", "account:aws:111111111111"},
+		},
+		{
+			"arn:aws-us-gov:iam::111111111111:user/alice",
+			[]string{"arn:aws-us-gov:iam::111111111111:user/alice", "account:aws-us-gov:111111111111"},
+		},
+		{
+			"arn:aws:sts::111111111111:federated-user/alice",
+			[]string{"arn:aws:sts::111111111111:federated-user/alice"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arn, func(t *testing.T) {
+			id := &Identity{ID: tt.arn, Attributes: map[string]string{AttrAWSArn: tt.arn}}
+			if got := awsCallerKeys(id); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("awsCallerKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAWSIDMatches(t *testing.T) {
+	caller := "arn:aws:sts::111111111111:assumed-role/stratus/s"
+	tests := []struct {
+		id   string
+		arn  string
+		want bool
+	}{
+		{caller, caller, true},
+		{"111111111111", caller, true},
+		{"222222222222", caller, false},
+		{"arn:aws:iam::111111111111:role/path/stratus", caller, true},
+		{"arn:aws:iam::111111111111:role/other", caller, false},
+		{"arn:aws-us-gov:iam::111111111111:role/stratus", caller, false},
+		{"arn:aws:iam::111111111111:root", caller, true},
+		{"arn:aws-cn:iam::111111111111:root", caller, false},
+		{"arn:aws:iam::111111111111:user/stratus", caller, false},
+		{"arn:aws:sts::111111111111:federated-user/a", "arn:aws:sts::111111111111:federated-user/a", true},
+		{"111111111111", "arn:aws:sts::111111111111:federated-user/a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id+" "+tt.arn, func(t *testing.T) {
+			if got := awsIDMatches(tt.id, tt.arn); got != tt.want {
+				t.Errorf("awsIDMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAWSAttributes(t *testing.T) {
+	got, err := awsAttributes("arn:aws:sts::111111111111:assumed-role/stratus/build-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		AttrAWSArn:         "arn:aws:sts::111111111111:assumed-role/stratus/build-1",
+		AttrAWSAccount:     "111111111111",
+		AttrAWSRole:        "arn:aws:iam::111111111111:role/stratus",
+		AttrAWSSessionName: "build-1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("awsAttributes() = %v, want %v", got, want)
+	}
+	if _, err := awsAttributes("arn:aws:sts::111111111111:federated-user/a"); err == nil {
+		t.Error("awsAttributes() accepted a federated user")
+	}
+	got = awsExactAttributes("arn:aws:sts::111111111111:federated-user/a")
+	want = map[string]string{
+		AttrAWSArn:     "arn:aws:sts::111111111111:federated-user/a",
+		AttrAWSAccount: "111111111111",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("awsExactAttributes() = %v, want %v", got, want)
+	}
+}
+
+func TestValidateAWSSource(t *testing.T) {
+	tests := []struct {
+		id          string
+		sessionName string
+		wantErr     bool
+	}{
+		{"111111111111", "build-*", false},
+		{"arn:aws:iam::111111111111:role/ci", "build-*", false},
+		{"arn:aws:iam::111111111111:root", "build-*", false},
+		{"arn:aws:iam::111111111111:role/ci", "[", true},
+		{"arn:aws:iam::111111111111:user/alice", "", false},
+		{"arn:aws:iam::111111111111:user/alice", "build-*", true},
+		{"arn:aws:sts::111111111111:federated-user/alice", "", false},
+		{"arn:aws:sts::111111111111:federated-user/alice", "build-*", true},
+		{"arn:aws-xx:iam::111111111111:role/ci", "", true},
+		{"not-an-arn", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id+" "+tt.sessionName, func(t *testing.T) {
+			err := validateAWSSource(&Identity{ID: tt.id, SessionName: tt.sessionName})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateAWSSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSessionNameMatches(t *testing.T) {
+	attrs := map[string]string{AttrAWSSessionName: "build-42"}
+	tests := []struct {
+		pattern string
+		attrs   map[string]string
+		want    bool
+	}{
+		{"", nil, true},
+		{"build-*", attrs, true},
+		{"deploy-*", attrs, false},
+		{"build-*", map[string]string{}, false},
+	}
+	for _, tt := range tests {
+		if got := sessionNameMatches(tt.pattern, tt.attrs); got != tt.want {
+			t.Errorf("sessionNameMatches(%q, %v) = %v, want %v", tt.pattern, tt.attrs, got, tt.want)
+		}
+	}
+}
+
+func TestValidAWS(t *testing.T) {
+	creds := map[string]interface{}{"AccessKeyId": "AKID", "SecretAccessKey": "secret"}
+	tests := []struct {
+		name   string
+		caller string
+		id     string
+		want   bool
+		attrs  map[string]string
+	}{
+		{
+			name:   "role",
+			caller: "arn:aws:sts::111111111111:assumed-role/stratus/s",
+			id:     "arn:aws:iam::111111111111:role/stratus",
+			want:   true,
+			attrs: map[string]string{
+				AttrAWSArn:         "arn:aws:sts::111111111111:assumed-role/stratus/s",
+				AttrAWSAccount:     "111111111111",
+				AttrAWSRole:        "arn:aws:iam::111111111111:role/stratus",
+				AttrAWSSessionName: "s",
+			},
+		},
+		{
+			name:   "other role",
+			caller: "arn:aws:sts::111111111111:assumed-role/stratus/s",
+			id:     "arn:aws:iam::111111111111:role/admin",
+		},
+		{
+			name:   "exact federated user",
+			caller: "arn:aws:sts::111111111111:federated-user/alice",
+			id:     "arn:aws:sts::111111111111:federated-user/alice",
+			want:   true,
+			attrs: map[string]string{
+				AttrAWSArn:     "arn:aws:sts::111111111111:federated-user/alice",
+				AttrAWSAccount: "111111111111",
+			},
+		},
+		{
+			name:   "federated user account",
+			caller: "arn:aws:sts::111111111111:federated-user/alice",
+			id:     "111111111111",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newSTSStub(t, tt.caller)
+			setenv(t, "AWS_STS_ENDPOINT", stub.URL)
+			id := &Identity{ID: tt.id, Provider: ProviderAWS, Region: "us-east-1", Credentials: creds}
+			if got := id.ValidAWS(); got != tt.want {
+				t.Fatalf("ValidAWS() = %v, want %v", got, tt.want)
+			}
+			if tt.want && !reflect.DeepEqual(id.Attributes, tt.attrs) {
+				t.Errorf("Attributes = %v, want %v", id.Attributes, tt.attrs)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package identity
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// assumeRoleProviderName is the provider name reported for assumed role credentials
+const assumeRoleProviderName = "StratusAssumeRoleProvider"
+
+// assumeRoleProvider retrieves credentials with sts:AssumeRole. Unlike
+// stscreds.AssumeRoleProvider, every AssumeRoleInput field can be set,
+// including SourceIdentity.
+type assumeRoleProvider struct {
+	credentials.Expiry
+	client *sts.STS
+	input  sts.AssumeRoleInput
+}
+
+// newAssumeRoleCredentials returns credentials which assume role using client.
+// The session name and duration may be overridden by opts.
+func newAssumeRoleCredentials(client *sts.STS, role string, sessionName string, opts ...func(*sts.AssumeRoleInput)) *credentials.Credentials {
+	p := &assumeRoleProvider{
+		client: client,
+		input: sts.AssumeRoleInput{
+			RoleArn:         aws.String(role),
+			RoleSessionName: aws.String(sessionName),
+			DurationSeconds: aws.Int64(int64(stscreds.DefaultDuration.Seconds())),
+		},
+	}
+	for _, o := range opts {
+		o(&p.input)
+	}
+	return credentials.NewCredentials(p)
+}
+
+// Retrieve assumes the role, returning the session credentials
+func (p *assumeRoleProvider) Retrieve() (credentials.Value, error) {
+	in := p.input
+	out, err := p.client.AssumeRole(&in)
+	if err != nil {
+		return credentials.Value{ProviderName: assumeRoleProviderName}, err
+	}
+	p.SetExpiration(aws.TimeValue(out.Credentials.Expiration), 0)
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(out.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(out.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(out.Credentials.SessionToken),
+		ProviderName:    assumeRoleProviderName,
+	}, nil
+}
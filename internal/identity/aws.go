@@ -1,12 +1,14 @@
 package identity
 
 import (
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/mitchellh/mapstructure"
+	"github.com/robertlestak/stratus/internal/vaultclient"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -15,39 +17,48 @@ type AWSCredentials struct {
 	AccessKeyId     string `json:"AccessKeyId"`
 	SecretAccessKey string `json:"SecretAccessKey"`
 	SessionToken    string `json:"SessionToken"`
-	//Expiration      time.Time `json:"Expiration"`
+	// Expiration is the RFC3339 time the credentials expire, if known
+	Expiration string `json:"Expiration,omitempty" mapstructure:",omitempty"`
 }
 
-// CreateSession creates a new session for the given role and credentials, tracking with the provided id
-func CreateSession(region string, role string, creds *credentials.Credentials, id string) (*session.Session, *aws.Config, error) {
+// CreateSession creates a new session for the given role and credentials, tracking with the provided id.
+// The session uses the cached session for the region and STS endpoint, which is resolved from the
+// deployment config if endpoint is empty. Any opts are applied to the AssumeRole request when a role is given.
+func CreateSession(region string, endpoint string, role string, creds *credentials.Credentials, id string, opts ...func(*sts.AssumeRoleInput)) (*session.Session, *aws.Config, error) {
+	cfg := &aws.Config{
+		Credentials: creds,
+	}
+	ep, err := resolveEndpoint(region, role, endpoint)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"action":    "CreateSession",
+			"requestId": id,
+		}).Printf("%+v", err)
+		return nil, cfg, err
+	}
 	l := log.WithFields(
 		log.Fields{
 			"action":    "CreateSession",
-			"region":    region,
+			"region":    ep.Region,
+			"endpoint":  ep.STS,
 			"role":      role,
 			"requestId": id,
 		},
 	)
 	l.Print("CreateSession")
-	cfg := &aws.Config{
-		Region: aws.String(region),
-	}
-	if creds != nil {
-		cfg.Credentials = creds
-	}
-	var sess *session.Session
-	var err error
-	sess, err = session.NewSession(cfg)
+	sess, err := ep.session()
 	if err != nil {
 		l.Printf("%+v", err)
 		return nil, cfg, err
 	}
 	if role != "" {
 		l.Printf("Using role %s", role)
-		creds := stscreds.NewCredentials(sess, role, func(p *stscreds.AssumeRoleProvider) {
-			p.RoleSessionName = "stratus-" + id
-		})
-		cfg.Credentials = creds
+		client, err := ep.stsClient(creds)
+		if err != nil {
+			l.Printf("%+v", err)
+			return nil, cfg, err
+		}
+		cfg.Credentials = newAssumeRoleCredentials(client, role, "stratus-"+id, opts...)
 	}
 	return sess, cfg, nil
 }
@@ -59,7 +70,7 @@ func stsGetCallerIdentity(region string, role string, creds *credentials.Credent
 		"requestId": id,
 	})
 	l.Info("start")
-	sess, cfg, err := CreateSession(region, role, creds, id)
+	sess, cfg, err := CreateSession(region, "", role, creds, id)
 	if err != nil {
 		l.Errorf("%+v", err)
 		return "", err
@@ -107,23 +118,62 @@ func (id *Identity) ValidAWS() bool {
 		l.Errorf("%+v", err)
 		return false
 	}
-	if id.ID != arn {
+	// the requested id may be the caller arn, or the caller's role or account
+	if !awsIDMatches(id.ID, arn) {
 		l.Printf("ARN mismatch")
 		return false
 	}
+	id.Attributes, err = awsAttributes(arn)
+	if err != nil {
+		if id.ID != arn {
+			l.Errorf("%+v", err)
+			return false
+		}
+		// an exact match needs no parsing to be trusted
+		l.Printf("%+v", err)
+		id.Attributes = awsExactAttributes(arn)
+	}
 	l.Info("id valid")
 	return true
 }
 
-// CreateAWSSession creates a new session using the identity credentials
-func (id *Identity) CreateAWSSession() (map[string]interface{}, error) {
+// CreateAWSSession creates a new session using the identity credentials, scoped by
+// the session parameters if provided and tagged with the validated source identity.
+// If the target has a role chain, each role in the chain is assumed first.
+func (id *Identity) CreateAWSSession(s *AWSSession, src *Identity, vc *vaultclient.VaultClient) (map[string]interface{}, error) {
 	l := log.WithFields(log.Fields{
 		"func":      "CreateAWSSession",
 		"requestId": id.RequestID,
 	})
 	l.Info("CreateAWSSession")
 	var ac AWSCredentials
-	sess, cfg, err := CreateSession(id.Region, id.ID, nil, id.RequestID)
+	tag := s.tagSource(src, id.RequestID)
+	ep, err := resolveEndpoint(id.Region, id.ID, id.AWS.stsEndpoint())
+	if err != nil {
+		l.Printf("%+v", err)
+		return nil, err
+	}
+	creds, err := id.AWS.chainCredentials(ep, id.RequestID, tag)
+	if err != nil {
+		l.Printf("%+v", err)
+		return nil, err
+	}
+	eid, err := id.AWS.externalID(vc)
+	if err != nil {
+		l.Printf("%+v", err)
+		return nil, err
+	}
+	withExternalID := func(in *sts.AssumeRoleInput) {
+		if eid != "" {
+			in.ExternalId = aws.String(eid)
+		}
+	}
+	targetTag := tag
+	if id.AWS.chained() {
+		targetTag = s.tagChainTarget(src, id.RequestID)
+	}
+	opts := []func(*sts.AssumeRoleInput){s.apply, withExternalID, targetTag}
+	sess, cfg, err := CreateSession(ep.Region, ep.STS, id.ID, creds, id.RequestID, opts...)
 	if err != nil {
 		l.Printf("%+v", err)
 		return nil, err
@@ -145,6 +195,9 @@ func (id *Identity) CreateAWSSession() (map[string]interface{}, error) {
 		SecretAccessKey: cd.SecretAccessKey,
 		SessionToken:    cd.SessionToken,
 	}
+	if exp, eerr := cfg.Credentials.ExpiresAt(); eerr == nil {
+		ac.Expiration = exp.UTC().Format(time.RFC3339)
+	}
 	merr := mapstructure.Decode(ac, &id.Credentials)
 	if merr != nil {
 		l.Printf("%+v", merr)
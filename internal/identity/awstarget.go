@@ -0,0 +1,138 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/robertlestak/stratus/internal/vaultclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// vaultRefPrefix marks a value which is read from vault, as vault:<path>#<key>
+const vaultRefPrefix = "vault:"
+
+var (
+	// validExternalID matches the characters AWS allows for an ExternalId
+	validExternalID = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+	// validRoleArn matches an IAM role ARN in any partition
+	validRoleArn = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:role/.+$`)
+)
+
+// awsMaxChainedSessionDuration is the longest session AWS issues for a role
+// assumed with role chaining
+const awsMaxChainedSessionDuration = 3600
+
+// AWSTarget contains the settings used to assume an AWS target role
+type AWSTarget struct {
+	// ExternalID is passed when assuming the target role. It is either a
+	// literal value or a vault reference of the form vault:<path>#<key>.
+	ExternalID string `json:"externalId,omitempty" yaml:"externalId"`
+	// Chain is an ordered list of intermediate role ARNs which are assumed in
+	// turn before the target role
+	Chain []string `json:"chain,omitempty" yaml:"chain"`
+	// STSEndpoint overrides the STS endpoint used to assume the chain and
+	// target roles
+	STSEndpoint string `json:"stsEndpoint,omitempty" yaml:"stsEndpoint"`
+}
+
+// Validate checks the target settings are well formed for the session
+// parameters of the mapping
+func (t *AWSTarget) Validate(s *AWSSession) error {
+	if t == nil {
+		return nil
+	}
+	if t.ExternalID != "" && !strings.HasPrefix(t.ExternalID, vaultRefPrefix) &&
+		(len(t.ExternalID) < 2 || len(t.ExternalID) > 1224 || !validExternalID.MatchString(t.ExternalID)) {
+		return errors.New("invalid externalId")
+	}
+	if strings.HasPrefix(t.ExternalID, vaultRefPrefix) && !strings.Contains(t.ExternalID, "#") {
+		return errors.New("externalId vault reference must be of the form vault:<path>#<key>")
+	}
+	for _, r := range t.Chain {
+		if !validRoleArn.MatchString(r) {
+			return fmt.Errorf("invalid chain role arn %q", r)
+		}
+	}
+	if len(t.Chain) > 0 && s != nil && s.DurationSeconds > awsMaxChainedSessionDuration {
+		return fmt.Errorf("durationSeconds must be at most %d with a role chain", awsMaxChainedSessionDuration)
+	}
+	if t.STSEndpoint != "" {
+		if err := validateEndpoint(t.STSEndpoint); err != nil {
+			return fmt.Errorf("invalid stsEndpoint: %w", err)
+		}
+	}
+	return nil
+}
+
+// externalID resolves the external ID, reading it from vault if required
+func (t *AWSTarget) externalID(vc *vaultclient.VaultClient) (string, error) {
+	if t == nil || t.ExternalID == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(t.ExternalID, vaultRefPrefix) {
+		return t.ExternalID, nil
+	}
+	ref := strings.SplitN(strings.TrimPrefix(t.ExternalID, vaultRefPrefix), "#", 2)
+	if vc == nil {
+		return "", errors.New("vault client required for externalId")
+	}
+	s, err := vc.GetKVSecretRetry(ref[0])
+	if err != nil {
+		return "", err
+	}
+	v, ok := s[ref[1]].(string)
+	if !ok || v == "" {
+		return "", fmt.Errorf("externalId key %q not found", ref[1])
+	}
+	return v, nil
+}
+
+// stsEndpoint returns the STS endpoint override of the target, if any
+func (t *AWSTarget) stsEndpoint() string {
+	if t == nil {
+		return ""
+	}
+	return t.STSEndpoint
+}
+
+// chained returns true if the target role is assumed through a role chain
+func (t *AWSTarget) chained() bool {
+	return t != nil && len(t.Chain) > 0
+}
+
+// chainCredentials assumes each role in the chain in turn, returning the
+// credentials of the last role. The first hop is tagged with tag; transitive
+// tags carry over to the later hops, and AWS rejects them if they are sent
+// again, so the intermediate hops are not tagged.
+func (t *AWSTarget) chainCredentials(ep awsEndpoint, id string, tag func(*sts.AssumeRoleInput)) (*credentials.Credentials, error) {
+	if t == nil || len(t.Chain) == 0 {
+		return nil, nil
+	}
+	var creds *credentials.Credentials
+	for n, r := range t.Chain {
+		log.WithFields(log.Fields{
+			"action":    "chainCredentials",
+			"requestId": id,
+			"hop":       n + 1,
+			"role":      r,
+		}).Info("assuming chain role")
+		client, err := ep.stsClient(creds)
+		if err != nil {
+			return nil, err
+		}
+		var opts []func(*sts.AssumeRoleInput)
+		if n == 0 {
+			opts = append(opts, tag)
+		}
+		creds = newAssumeRoleCredentials(client, r, fmt.Sprintf("stratus-%s-%d", id, n+1), opts...)
+		// retrieve each hop eagerly so a failure reports the hop which failed
+		if _, err := creds.Get(); err != nil {
+			return nil, fmt.Errorf("assume chain role %s: %w", r, err)
+		}
+	}
+	return creds, nil
+}
@@ -0,0 +1,263 @@
+package identity
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, k, v string) {
+	t.Helper()
+	old, ok := os.LookupEnv(k)
+	os.Setenv(k, v)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(k, old)
+		} else {
+			os.Unsetenv(k)
+		}
+	})
+}
+
+// stsStub is a stand-in STS endpoint which records the requests it receives
+type stsStub struct {
+	*httptest.Server
+	// arn is returned by GetCallerIdentity
+	arn string
+
+	mu       sync.Mutex
+	requests []url.Values
+}
+
+// newSTSStub starts an STS stand-in returning arn from GetCallerIdentity
+func newSTSStub(t *testing.T, arn string) *stsStub {
+	t.Helper()
+	setenv(t, "AWS_ACCESS_KEY_ID", "AKIDSTRATUSTEST")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "secret")
+	s := &stsStub{arn: arn}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, r.PostForm)
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "text/xml")
+		switch r.PostForm.Get("Action") {
+		case "AssumeRole":
+			fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult>`+
+				`<Credentials><AccessKeyId>ASIA%d</AccessKeyId><SecretAccessKey>secret</SecretAccessKey>`+
+				`<SessionToken>token</SessionToken><Expiration>2100-01-01T00:00:00Z</Expiration></Credentials>`+
+				`<AssumedRoleUser><Arn>%s</Arn><AssumedRoleId>AROA:session</AssumedRoleId></AssumedRoleUser>`+
+				`</AssumeRoleResult><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></AssumeRoleResponse>`,
+				len(s.requests), r.PostForm.Get("RoleArn"))
+		case "GetCallerIdentity":
+			fmt.Fprintf(w, `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><GetCallerIdentityResult>`+
+				`<Arn>%s</Arn><UserId>AROA:session</UserId><Account>111111111111</Account>`+
+				`</GetCallerIdentityResult><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></GetCallerIdentityResponse>`,
+				s.arn)
+		default:
+			http.Error(w, "unsupported action", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// assumeRoles returns the AssumeRole requests received by the stub
+func (s *stsStub) assumeRoles() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rs []url.Values
+	for _, r := range s.requests {
+		if r.Get("Action") == "AssumeRole" {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+func TestAWSTargetValidate(t *testing.T) {
+	chain := []string{"arn:aws:iam::111111111111:role/hub"}
+	tests := []struct {
+		name    string
+		target  *AWSTarget
+		session *AWSSession
+		wantErr bool
+	}{
+		{"nil", nil, nil, false},
+		{"literal external id", &AWSTarget{ExternalID: "abc-123"}, nil, false},
+		{"max length external id", &AWSTarget{ExternalID: strings.Repeat("a", 1224)}, nil, false},
+		{"long external id", &AWSTarget{ExternalID: strings.Repeat("a", 1225)}, nil, true},
+		{"short external id", &AWSTarget{ExternalID: "a"}, nil, true},
+		{"invalid external id", &AWSTarget{ExternalID: "a b"}, nil, true},
+		{"vault external id", &AWSTarget{ExternalID: "vault:aws/ext#id"}, nil, false},
+		{"vault external id without key", &AWSTarget{ExternalID: "vault:aws/ext"}, nil, true},
+		{"chain", &AWSTarget{Chain: chain}, nil, false},
+		{"gov chain", &AWSTarget{Chain: []string{"arn:aws-us-gov:iam::111111111111:role/hub"}}, nil, false},
+		{"invalid chain arn", &AWSTarget{Chain: []string{"arn:aws:iam::111:role/hub"}}, nil, true},
+		{"chain with hour session", &AWSTarget{Chain: chain}, &AWSSession{DurationSeconds: 3600}, false},
+		{"chain with long session", &AWSTarget{Chain: chain}, &AWSSession{DurationSeconds: 3601}, true},
+		{"long session without chain", &AWSTarget{}, &AWSSession{DurationSeconds: 43200}, false},
+		{"sts endpoint", &AWSTarget{STSEndpoint: "https://sts.example.com"}, nil, false},
+		{"invalid sts endpoint", &AWSTarget{STSEndpoint: "sts.example.com"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.target.Validate(tt.session)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestChainCredentialsTagsFirstHop(t *testing.T) {
+	stub := newSTSStub(t, "")
+	target := &AWSTarget{Chain: []string{
+		"arn:aws:iam::111111111111:role/hub",
+		"arn:aws:iam::222222222222:role/spoke",
+	}}
+	tag := func(in *sts.AssumeRoleInput) {
+		in.Tags = append(in.Tags, &sts.Tag{Key: aws.String("team"), Value: aws.String("a")})
+		in.TransitiveTagKeys = append(in.TransitiveTagKeys, aws.String("team"))
+	}
+	ep := awsEndpoint{Region: "us-east-1", STS: stub.URL}
+	if _, err := target.chainCredentials(ep, "req", tag); err != nil {
+		t.Fatalf("chainCredentials() error = %v", err)
+	}
+	rs := stub.assumeRoles()
+	if len(rs) != 2 {
+		t.Fatalf("got %d AssumeRole requests, want 2", len(rs))
+	}
+	for i, r := range rs {
+		if got, want := r.Get("RoleArn"), target.Chain[i]; got != want {
+			t.Errorf("hop %d RoleArn = %q, want %q", i+1, got, want)
+		}
+		if got, want := r.Get("RoleSessionName"), fmt.Sprintf("stratus-req-%d", i+1); got != want {
+			t.Errorf("hop %d RoleSessionName = %q, want %q", i+1, got, want)
+		}
+	}
+	if rs[0].Get("Tags.member.1.Key") != "team" || rs[0].Get("TransitiveTagKeys.member.1") != "team" {
+		t.Errorf("first hop not tagged: %v", rs[0])
+	}
+	if rs[1].Get("Tags.member.1.Key") != "" || rs[1].Get("TransitiveTagKeys.member.1") != "" {
+		t.Errorf("second hop tagged: %v", rs[1])
+	}
+}
+
+// tags returns the Tags.member.N key=value pairs and the transitive tag keys of
+// an AssumeRole request
+func tags(r url.Values) (tags, transitive []string) {
+	for i := 1; r.Get(fmt.Sprintf("Tags.member.%d.Key", i)) != ""; i++ {
+		tags = append(tags, r.Get(fmt.Sprintf("Tags.member.%d.Key", i))+"="+r.Get(fmt.Sprintf("Tags.member.%d.Value", i)))
+	}
+	for i := 1; r.Get(fmt.Sprintf("TransitiveTagKeys.member.%d", i)) != ""; i++ {
+		transitive = append(transitive, r.Get(fmt.Sprintf("TransitiveTagKeys.member.%d", i)))
+	}
+	return tags, transitive
+}
+
+func TestCreateAWSSessionChainTags(t *testing.T) {
+	src := &Identity{
+		Provider:   ProviderGCP,
+		ID:         "ci@stratus-test.iam.gserviceaccount.com",
+		Attributes: map[string]string{"project": "stratus-test"},
+	}
+	sourceTags := []string{
+		"stratus-source-provider=gcp",
+		"stratus-source-id=ci@stratus-test.iam.gserviceaccount.com",
+		"stratus-request-id=req",
+		"stratus-project=stratus-test",
+	}
+	sourceKeys := []string{"stratus-source-provider", "stratus-source-id", "stratus-request-id", "stratus-project"}
+	static := []string{"env=prod", "team=a"}
+	tests := []struct {
+		name           string
+		sourceTags     bool
+		transitive     bool
+		wantFirst      []string
+		wantTransitive []string
+		wantTarget     []string
+	}{
+		{
+			name:       "static tags",
+			wantFirst:  static,
+			wantTarget: static,
+		},
+		{
+			name:       "source tags",
+			sourceTags: true,
+			wantFirst:  append(append([]string{}, static...), sourceTags...),
+			wantTarget: append(append([]string{}, static...), sourceTags...),
+		},
+		{
+			name:           "transitive source tags",
+			sourceTags:     true,
+			transitive:     true,
+			wantFirst:      append(append([]string{}, static...), sourceTags...),
+			wantTransitive: sourceKeys,
+			wantTarget:     static,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newSTSStub(t, "arn:aws:sts::333333333333:assumed-role/target/stratus-req")
+			setenv(t, "AWS_SESSION_TAGS", fmt.Sprint(tt.sourceTags))
+			id := &Identity{
+				Provider:  ProviderAWS,
+				ID:        "arn:aws:iam::333333333333:role/target",
+				RequestID: "req",
+				Region:    "us-east-1",
+				AWS: &AWSTarget{
+					Chain:       []string{"arn:aws:iam::111111111111:role/hub", "arn:aws:iam::222222222222:role/spoke"},
+					STSEndpoint: stub.URL,
+				},
+			}
+			s := &AWSSession{
+				DurationSeconds: 3600,
+				Tags:            map[string]string{"team": "a", "env": "prod"},
+				TransitiveTags:  tt.transitive,
+			}
+			if _, err := id.CreateAWSSession(s, src, nil); err != nil {
+				t.Fatalf("CreateAWSSession() error = %v", err)
+			}
+			rs := stub.assumeRoles()
+			if len(rs) != 3 {
+				t.Fatalf("got %d AssumeRole requests, want 3", len(rs))
+			}
+			first, transitive := tags(rs[0])
+			if !reflect.DeepEqual(first, tt.wantFirst) || !reflect.DeepEqual(transitive, tt.wantTransitive) {
+				t.Errorf("first hop tags = %v, transitive %v, want %v, transitive %v", first, transitive, tt.wantFirst, tt.wantTransitive)
+			}
+			if hop, _ := tags(rs[1]); hop != nil {
+				t.Errorf("intermediate hop tags = %v, want none", hop)
+			}
+			target := rs[2]
+			if target.Get("RoleArn") != id.ID || target.Get("DurationSeconds") != "3600" {
+				t.Errorf("unexpected target request: %v", target)
+			}
+			got, transitive := tags(target)
+			if !reflect.DeepEqual(got, tt.wantTarget) || transitive != nil {
+				t.Errorf("target tags = %v, transitive %v, want %v", got, transitive, tt.wantTarget)
+			}
+			if target.Get("SourceIdentity") != "" {
+				t.Errorf("target SourceIdentity set again: %q", target.Get("SourceIdentity"))
+			}
+			if wantSI := tt.sourceTags; (rs[0].Get("SourceIdentity") != "") != wantSI {
+				t.Errorf("first hop SourceIdentity = %q", rs[0].Get("SourceIdentity"))
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package identity
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/stratus/internal/jwt"
+)
+
+// Challenge is a single-use nonce which a source signs to prove possession of its key
+type Challenge struct {
+	Nonce     string    `json:"nonce"`
+	Audience  string    `json:"audience"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// challengeClaims are the claims of a signed challenge response
+type challengeClaims struct {
+	Iss   string `json:"iss"`
+	Sub   string `json:"sub"`
+	Aud   string `json:"aud"`
+	Nonce string `json:"nonce"`
+	Iat   int64  `json:"iat"`
+	Exp   int64  `json:"exp"`
+}
+
+var (
+	// challengeKey signs issued nonces. It is generated at startup and never
+	// shared, so a nonce is only accepted by the replica which issued it and
+	// the used nonces it remembers cover every nonce it accepts.
+	challengeKey     []byte
+	challengeKeyOnce sync.Once
+
+	// usedNonces holds the expiry of each nonce which has been used, and
+	// usedExpiry orders them by expiry so expired nonces are dropped without
+	// scanning. Issued nonces are not stored, as their signature and expiry
+	// are verifiable.
+	usedNonces   = make(map[string]time.Time)
+	usedExpiry   nonceHeap
+	usedNoncesMu sync.Mutex
+
+	// ChallengeTable returns the mappings a challenge response is checked
+	// against before its nonce is recorded, so only mapped sources can use
+	// nonces. It is set by the server.
+	ChallengeTable func() *MapTable
+)
+
+// challengeMaxUsed bounds the used nonces tracked until they expire. Responses
+// are refused once the bound is reached rather than forgetting a used nonce.
+const challengeMaxUsed = 100000
+
+// usedNonce is a used nonce value and its expiry
+type usedNonce struct {
+	value string
+	exp   time.Time
+}
+
+// nonceHeap is a min-heap of used nonces ordered by expiry
+type nonceHeap []usedNonce
+
+func (h nonceHeap) Len() int            { return len(h) }
+func (h nonceHeap) Less(i, j int) bool  { return h[i].exp.Before(h[j].exp) }
+func (h nonceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x interface{}) { *h = append(*h, x.(usedNonce)) }
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// challengeSecret returns the nonce signing key
+func challengeSecret() []byte {
+	challengeKeyOnce.Do(func() {
+		challengeKey = make([]byte, 32)
+		if _, err := rand.Read(challengeKey); err != nil {
+			panic(err)
+		}
+	})
+	return challengeKey
+}
+
+// challengeTTL returns how long an issued nonce is valid, CHALLENGE_TTL
+func challengeTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("CHALLENGE_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return time.Minute
+}
+
+// challengeAudience returns the audience a challenge response must be issued for
+func challengeAudience() string {
+	if a := os.Getenv("CHALLENGE_AUDIENCE"); a != "" {
+		return a
+	}
+	return "stratus"
+}
+
+// nonceMAC returns the signature of a nonce value and expiry
+func nonceMAC(v string, exp int64) string {
+	m := hmac.New(sha256.New, challengeSecret())
+	fmt.Fprintf(m, "%s.%d", v, exp)
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// IssueChallenge issues a new single-use nonce. The nonce carries its expiry
+// and is signed with the key of this replica, so issuing one stores nothing
+// and only this replica accepts it.
+func IssueChallenge() (*Challenge, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	exp := time.Now().Add(challengeTTL())
+	v := base64.RawURLEncoding.EncodeToString(b)
+	n := fmt.Sprintf("%s.%d.%s", v, exp.Unix(), nonceMAC(v, exp.Unix()))
+	return &Challenge{Nonce: n, Audience: challengeAudience(), ExpiresAt: exp}, nil
+}
+
+// consumeNonce checks a nonce was issued by stratus and has not expired or
+// been used, and marks it used until it expires
+func consumeNonce(n string) error {
+	parts := strings.Split(n, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed nonce")
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errors.New("malformed nonce")
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(nonceMAC(parts[0], exp))) {
+		return errors.New("invalid nonce")
+	}
+	now := time.Now()
+	if now.After(time.Unix(exp, 0)) {
+		return errors.New("nonce expired")
+	}
+	usedNoncesMu.Lock()
+	defer usedNoncesMu.Unlock()
+	for usedExpiry.Len() > 0 && now.After(usedExpiry[0].exp) {
+		delete(usedNonces, heap.Pop(&usedExpiry).(usedNonce).value)
+	}
+	if _, ok := usedNonces[parts[0]]; ok {
+		return errors.New("nonce already used")
+	}
+	if len(usedNonces) >= challengeMaxUsed {
+		return errors.New("too many challenges in use")
+	}
+	usedNonces[parts[0]] = time.Unix(exp, 0)
+	heap.Push(&usedExpiry, usedNonce{value: parts[0], exp: time.Unix(exp, 0)})
+	return nil
+}
+
+// validChallengeResponse verifies a challenge response JWT signed by the key
+// of the service account email, with the key ID as kid
+func validChallengeResponse(email string, assertion string) error {
+	kid, err := jwt.KeyID(assertion)
+	if err != nil {
+		return err
+	}
+	if kid == "" {
+		return errors.New("kid required")
+	}
+	cert, _, err := gcpCert(email, kid)
+	if err != nil {
+		return err
+	}
+	pk, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("certificate key is not RSA")
+	}
+	var c challengeClaims
+	if err := jwt.VerifyRS256(assertion, pk, &c); err != nil {
+		return err
+	}
+	if c.Iss != email || (c.Sub != "" && c.Sub != email) {
+		return errors.New("issuer does not match service account")
+	}
+	if c.Aud != challengeAudience() {
+		return errors.New("invalid audience")
+	}
+	if c.Exp == 0 || time.Now().After(time.Unix(c.Exp, 0)) {
+		return errors.New("assertion expired")
+	}
+	// the nonce is only consumed once the signature is verified and the source
+	// is mapped, so neither an invalid response nor an unmapped service account
+	// can burn nonces or fill the used nonces
+	if ChallengeTable != nil && len(ChallengeTable().Lookup(&Identity{Provider: ProviderGCP, ID: email})) == 0 {
+		return errors.New("no mapping for source")
+	}
+	return consumeNonce(c.Nonce)
+}
@@ -0,0 +1,118 @@
+package identity
+
+import (
+	"container/heap"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetUsedNonces clears the used nonces for the duration of the test
+func resetUsedNonces(t *testing.T) {
+	reset := func() {
+		usedNoncesMu.Lock()
+		usedNonces = make(map[string]time.Time)
+		usedExpiry = nil
+		usedNoncesMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// fillUsedNonces records n used nonces expiring at exp
+func fillUsedNonces(n int, exp time.Time) {
+	usedNoncesMu.Lock()
+	defer usedNoncesMu.Unlock()
+	for i := 0; i < n; i++ {
+		v := fmt.Sprintf("filled-%d-%d", exp.UnixNano(), i)
+		usedNonces[v] = exp
+		heap.Push(&usedExpiry, usedNonce{value: v, exp: exp})
+	}
+}
+
+// signedNonce returns a nonce for value v expiring at exp, signed with the challenge secret
+func signedNonce(v string, exp time.Time) string {
+	return fmt.Sprintf("%s.%d.%s", v, exp.Unix(), nonceMAC(v, exp.Unix()))
+}
+
+func TestConsumeNonce(t *testing.T) {
+	resetUsedNonces(t)
+	c, err := IssueChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(c.Nonce, ".")
+	future := time.Now().Add(time.Minute)
+	tests := []struct {
+		name    string
+		nonce   string
+		wantErr bool
+	}{
+		{"issued", c.Nonce, false},
+		{"reused", c.Nonce, true},
+		{"reused with another expiry", signedNonce(parts[0], future.Add(time.Second)), true},
+		{"unissued", signedNonce("other", future), false},
+		{"expired", signedNonce("expired", time.Now().Add(-time.Second)), true},
+		{"extended expiry", parts[0] + "." + fmt.Sprint(future.Add(time.Hour).Unix()) + "." + parts[2], true},
+		{"forged mac", "forged." + fmt.Sprint(future.Unix()) + "." + nonceMAC("other", future.Unix()), true},
+		{"malformed", "nonce", true},
+		{"malformed expiry", "v.soon." + nonceMAC("v", 0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := consumeNonce(tt.nonce); (err != nil) != tt.wantErr {
+				t.Errorf("consumeNonce() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIssueChallengeStoresNothing(t *testing.T) {
+	resetUsedNonces(t)
+	for i := 0; i < 1000; i++ {
+		c, err := IssueChallenge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Audience != "stratus" || time.Until(c.ExpiresAt) <= 0 {
+			t.Fatalf("unexpected challenge %+v", c)
+		}
+	}
+	if n := len(usedNonces); n != 0 {
+		t.Errorf("issuing stored %d nonces", n)
+	}
+}
+
+func TestConsumeNonceBounded(t *testing.T) {
+	resetUsedNonces(t)
+	fillUsedNonces(challengeMaxUsed, time.Now().Add(time.Minute))
+	if err := consumeNonce(signedNonce("full", time.Now().Add(time.Minute))); err == nil {
+		t.Fatal("consumeNonce() accepted a nonce beyond the bound")
+	}
+	// expired entries are dropped when a nonce is used
+	resetUsedNonces(t)
+	fillUsedNonces(challengeMaxUsed/2, time.Now().Add(-time.Second))
+	fillUsedNonces(challengeMaxUsed/2, time.Now().Add(time.Minute))
+	if err := consumeNonce(signedNonce("swept", time.Now().Add(time.Minute))); err != nil {
+		t.Fatalf("consumeNonce() error = %v", err)
+	}
+	if n, h := len(usedNonces), usedExpiry.Len(); n != challengeMaxUsed/2+1 || h != n {
+		t.Errorf("%d used nonces and %d expiries remain, want %d", n, h, challengeMaxUsed/2+1)
+	}
+}
+
+func TestConsumeNonceOtherReplica(t *testing.T) {
+	resetUsedNonces(t)
+	c, err := IssueChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another replica signs its nonces with its own key
+	saved := challengeSecret()
+	challengeKey = []byte("another replica")
+	t.Cleanup(func() { challengeKey = saved })
+	if err := consumeNonce(c.Nonce); err == nil {
+		t.Error("consumeNonce() accepted a nonce issued by another replica")
+	}
+}
@@ -0,0 +1,160 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Conditions restrict when a mapping may be used
+type Conditions struct {
+	// NotBefore is the time from which the mapping may be used
+	NotBefore *time.Time `json:"notBefore,omitempty" yaml:"notBefore"`
+	// NotAfter is the time after which the mapping may no longer be used
+	NotAfter *time.Time `json:"notAfter,omitempty" yaml:"notAfter"`
+	// Groups are k8s groups the source must be a member of, all of which are required
+	Groups []string `json:"groups,omitempty" yaml:"groups"`
+	// PodNamePrefixes restrict a k8s source to tokens bound to pods with one of the name prefixes
+	PodNamePrefixes []string `json:"podNamePrefixes,omitempty" yaml:"podNamePrefixes"`
+	// NodeNames restrict a k8s source to tokens bound to pods on one of the nodes
+	NodeNames []string `json:"nodeNames,omitempty" yaml:"nodeNames"`
+}
+
+// Allow checks if the conditions are met at the given time
+func (c *Conditions) Allow(now time.Time) error {
+	if c == nil {
+		return nil
+	}
+	if c.NotBefore != nil && now.Before(*c.NotBefore) {
+		return errors.New("mapping not yet valid")
+	}
+	if c.NotAfter != nil && now.After(*c.NotAfter) {
+		return errors.New("mapping expired")
+	}
+	return nil
+}
+
+// Match checks the verified attributes of the source meet the conditions
+func (c *Conditions) Match(attrs map[string]string) error {
+	if c == nil {
+		return nil
+	}
+	groups := make(map[string]bool)
+	for _, g := range strings.Fields(attrs[AttrK8SGroups]) {
+		groups[g] = true
+	}
+	for _, g := range c.Groups {
+		if !groups[g] {
+			return fmt.Errorf("source not in group %q", g)
+		}
+	}
+	if len(c.PodNamePrefixes) > 0 {
+		pod, ok := attrs[AttrK8SPodName]
+		match := false
+		for _, p := range c.PodNamePrefixes {
+			if ok && strings.HasPrefix(pod, p) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return errors.New("source pod name not allowed")
+		}
+	}
+	if len(c.NodeNames) > 0 {
+		node, ok := attrs[AttrK8SNodeName]
+		match := false
+		for _, n := range c.NodeNames {
+			if ok && node == n {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return errors.New("source node not allowed")
+		}
+	}
+	return nil
+}
+
+// k8sOnly returns true if the conditions can only be met by k8s sources
+func (c *Conditions) k8sOnly() bool {
+	return c != nil && (len(c.Groups) > 0 || len(c.PodNamePrefixes) > 0 || len(c.NodeNames) > 0)
+}
+
+// Validate checks the conditions are well formed
+func (c *Conditions) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.NotBefore != nil && c.NotAfter != nil && !c.NotBefore.Before(*c.NotAfter) {
+		return errors.New("notBefore must be before notAfter")
+	}
+	return nil
+}
+
+// validProvider checks if the provider is supported
+func validProvider(p ProviderName) bool {
+	switch p {
+	case ProviderAWS, ProviderGCP, ProviderK8S:
+		return true
+	}
+	return false
+}
+
+// Validate checks that the mapping is well formed
+func (im *IAMMap) Validate() error {
+	if im.Source.ID == "" || im.Target.ID == "" {
+		return errors.New("source and target id required")
+	}
+	if !validProvider(im.Source.Provider) {
+		return fmt.Errorf("unsupported source provider %q", im.Source.Provider)
+	}
+	if !validProvider(im.Target.Provider) {
+		return fmt.Errorf("unsupported target provider %q", im.Target.Provider)
+	}
+	if im.Source.Provider == ProviderAWS {
+		if err := validateAWSSource(&im.Source); err != nil {
+			return err
+		}
+	} else if im.Source.SessionName != "" {
+		return errors.New("sessionName is only supported for aws sources")
+	}
+	if err := im.Conditions.Validate(); err != nil {
+		return err
+	}
+	if im.Conditions.k8sOnly() && im.Source.Provider != ProviderK8S {
+		return errors.New("groups, podNamePrefixes and nodeNames conditions are only supported for k8s sources")
+	}
+	if im.Session != nil && im.Target.Provider != ProviderAWS {
+		return errors.New("session parameters are only supported for aws targets")
+	}
+	if err := im.Session.Validate(); err != nil {
+		return err
+	}
+	if im.Target.Provider == ProviderAWS && im.Target.Region != "" {
+		if err := checkRegion(im.Target.Region); err != nil {
+			return err
+		}
+	}
+	if im.Target.AWS != nil && im.Target.Provider != ProviderAWS {
+		return errors.New("aws settings are only supported for aws targets")
+	}
+	if err := im.Target.AWS.Validate(im.Session); err != nil {
+		return err
+	}
+	if im.Target.GCP != nil && im.Target.Provider != ProviderGCP {
+		return errors.New("gcp settings are only supported for gcp targets")
+	}
+	if err := im.Target.GCP.Validate(); err != nil {
+		return err
+	}
+	if im.Target.Secret != nil && im.Target.Provider == ProviderAWS {
+		return errors.New("secret settings are only supported for gcp and k8s targets")
+	}
+	if err := im.Target.Secret.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package identity
+
+import "testing"
+
+func TestConditionsMatch(t *testing.T) {
+	pod := map[string]string{
+		AttrK8SNamespace: "ci",
+		AttrK8SGroups:    "system:serviceaccounts system:serviceaccounts:ci",
+		AttrK8SPodName:   "runner-7d9f",
+		AttrK8SNodeName:  "node-a",
+	}
+	unbound := map[string]string{AttrK8SNamespace: "ci", AttrK8SGroups: "system:serviceaccounts"}
+	tests := []struct {
+		name    string
+		c       *Conditions
+		attrs   map[string]string
+		wantErr bool
+	}{
+		{name: "no conditions", attrs: pod},
+		{name: "empty conditions", c: &Conditions{}, attrs: unbound},
+		{name: "all groups", c: &Conditions{Groups: []string{"system:serviceaccounts", "system:serviceaccounts:ci"}}, attrs: pod},
+		{name: "missing group", c: &Conditions{Groups: []string{"system:serviceaccounts", "system:serviceaccounts:ops"}}, attrs: pod, wantErr: true},
+		{name: "group prefix", c: &Conditions{Groups: []string{"system:serviceaccounts:c"}}, attrs: pod, wantErr: true},
+		{name: "no groups", c: &Conditions{Groups: []string{"system:serviceaccounts"}}, attrs: map[string]string{}, wantErr: true},
+		{name: "pod name prefix", c: &Conditions{PodNamePrefixes: []string{"deploy-", "runner-"}}, attrs: pod},
+		{name: "other pod", c: &Conditions{PodNamePrefixes: []string{"deploy-"}}, attrs: pod, wantErr: true},
+		{name: "empty prefix requires a pod", c: &Conditions{PodNamePrefixes: []string{""}}, attrs: unbound, wantErr: true},
+		{name: "token not bound to a pod", c: &Conditions{PodNamePrefixes: []string{"runner-"}}, attrs: unbound, wantErr: true},
+		{name: "node name", c: &Conditions{NodeNames: []string{"node-b", "node-a"}}, attrs: pod},
+		{name: "other node", c: &Conditions{NodeNames: []string{"node-b"}}, attrs: pod, wantErr: true},
+		{name: "node name is not a prefix", c: &Conditions{NodeNames: []string{"node"}}, attrs: pod, wantErr: true},
+		{name: "token without node", c: &Conditions{NodeNames: []string{""}}, attrs: unbound, wantErr: true},
+		{
+			name:  "all conditions",
+			c:     &Conditions{Groups: []string{"system:serviceaccounts:ci"}, PodNamePrefixes: []string{"runner-"}, NodeNames: []string{"node-a"}},
+			attrs: pod,
+		},
+		{
+			name:    "one condition not met",
+			c:       &Conditions{Groups: []string{"system:serviceaccounts:ci"}, PodNamePrefixes: []string{"runner-"}, NodeNames: []string{"node-b"}},
+			attrs:   pod,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.Match(tt.attrs); (err != nil) != tt.wantErr {
+				t.Errorf("Match() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateK8SOnlyConditions(t *testing.T) {
+	target := Identity{ID: "sa@stratus-test.iam.gserviceaccount.com", Provider: ProviderGCP}
+	tests := []struct {
+		name    string
+		source  Identity
+		c       *Conditions
+		wantErr bool
+	}{
+		{"k8s groups", Identity{ID: "system:serviceaccount:ci:runner", Provider: ProviderK8S}, &Conditions{Groups: []string{"system:serviceaccounts"}}, false},
+		{"k8s pod and node", Identity{ID: "system:serviceaccount:ci:runner", Provider: ProviderK8S}, &Conditions{PodNamePrefixes: []string{"runner-"}, NodeNames: []string{"node-a"}}, false},
+		{"gcp groups", Identity{ID: "ci@stratus-test.iam.gserviceaccount.com", Provider: ProviderGCP}, &Conditions{Groups: []string{"ops"}}, true},
+		{"gcp pod name", Identity{ID: "ci@stratus-test.iam.gserviceaccount.com", Provider: ProviderGCP}, &Conditions{PodNamePrefixes: []string{"runner-"}}, true},
+		{"aws node name", Identity{ID: "arn:aws:iam::111111111111:role/ci", Provider: ProviderAWS}, &Conditions{NodeNames: []string{"node-a"}}, true},
+		{"aws empty conditions", Identity{ID: "arn:aws:iam::111111111111:role/ci", Provider: ProviderAWS}, &Conditions{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := &IAMMap{Source: tt.source, Target: target, Conditions: tt.c}
+			if err := im.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+var (
+	// partitionRegions are the regions used for a partition when no region is requested
+	partitionRegions = map[string]string{
+		"aws":        "us-east-1",
+		"aws-cn":     "cn-north-1",
+		"aws-us-gov": "us-gov-west-1",
+		"aws-iso":    "us-iso-east-1",
+		"aws-iso-b":  "us-isob-east-1",
+	}
+
+	// validRegion matches the form of an AWS region name
+	validRegion = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+	// awsSessions caches a session for each endpoint
+	awsSessions   = make(map[awsEndpoint]*session.Session)
+	awsSessionsMu sync.Mutex
+)
+
+// awsMaxSessions bounds the session cache. Endpoints beyond the bound use a
+// new session for each request.
+const awsMaxSessions = 64
+
+// checkRegion returns an error unless region is a region of a known partition
+// or has the form of a region name. The region is used to build endpoint
+// hosts, so a caller supplied region must never reach them unchecked.
+func checkRegion(region string) error {
+	for _, p := range endpoints.DefaultPartitions() {
+		if _, ok := p.Regions()[region]; ok {
+			return nil
+		}
+	}
+	if !validRegion.MatchString(region) {
+		return fmt.Errorf("invalid region %q", region)
+	}
+	return nil
+}
+
+// awsEndpoint identifies the region and STS endpoint used for AWS calls
+type awsEndpoint struct {
+	Region string
+	// STS is the STS endpoint URL. If empty the regional STS endpoint is used.
+	STS string
+}
+
+// defaultRegion returns the region used when none is requested. AWS_REGION is
+// used if set, otherwise the default region of the partition of arn.
+func defaultRegion(arn string) string {
+	if r := os.Getenv("AWS_REGION"); r != "" {
+		return r
+	}
+	if a, err := parsePrincipalARN(arn); err == nil {
+		return partitionRegions[a.Partition]
+	}
+	if parts := strings.SplitN(arn, ":", 3); len(parts) == 3 && partitionRegions[parts[1]] != "" {
+		return partitionRegions[parts[1]]
+	}
+	return partitionRegions["aws"]
+}
+
+// resolveEndpoint returns the endpoint used for region. The STS endpoint is
+// the override if set, otherwise AWS_STS_ENDPOINT, otherwise the FIPS endpoint
+// of the region if AWS_USE_FIPS_ENDPOINT is true. AWS_STS_ENDPOINT may contain
+// a {region} placeholder. If region is empty a default is derived from arn.
+// An invalid region is rejected.
+func resolveEndpoint(region string, arn string, override string) (awsEndpoint, error) {
+	if region == "" {
+		region = defaultRegion(arn)
+	}
+	if err := checkRegion(region); err != nil {
+		return awsEndpoint{}, err
+	}
+	e := awsEndpoint{Region: region, STS: override}
+	if e.STS == "" {
+		e.STS = strings.ReplaceAll(os.Getenv("AWS_STS_ENDPOINT"), "{region}", region)
+	}
+	if e.STS == "" && os.Getenv("AWS_USE_FIPS_ENDPOINT") == "true" {
+		e.STS = fipsEndpoint(region)
+	}
+	return e, nil
+}
+
+// fipsEndpoint returns the STS FIPS endpoint of region in its partition
+func fipsEndpoint(region string) string {
+	suffix := "amazonaws.com"
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		suffix = p.DNSSuffix()
+	}
+	return "https://sts-fips." + region + "." + suffix
+}
+
+// validateEndpoint checks an endpoint override is an absolute http(s) URL
+func validateEndpoint(e string) error {
+	u, err := url.Parse(e)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("endpoint must be an http or https URL")
+	}
+	return nil
+}
+
+// session returns the cached session for the endpoint, creating it if needed
+func (e awsEndpoint) session() (*session.Session, error) {
+	awsSessionsMu.Lock()
+	defer awsSessionsMu.Unlock()
+	if s, ok := awsSessions[e]; ok {
+		return s, nil
+	}
+	cfg := &aws.Config{
+		Region:              aws.String(e.Region),
+		STSRegionalEndpoint: endpoints.RegionalSTSEndpoint,
+	}
+	if e.STS != "" {
+		cfg.Endpoint = aws.String(e.STS)
+	}
+	s, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(awsSessions) < awsMaxSessions {
+		awsSessions[e] = s
+	}
+	return s, nil
+}
+
+// stsClient returns an STS client for the endpoint using creds, or the stratus
+// credentials if creds is nil
+func (e awsEndpoint) stsClient(creds *credentials.Credentials) (*sts.STS, error) {
+	s, err := e.session()
+	if err != nil {
+		return nil, err
+	}
+	if creds == nil {
+		return sts.New(s), nil
+	}
+	return sts.New(s, &aws.Config{Credentials: creds}), nil
+}
@@ -0,0 +1,241 @@
+package identity
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestCheckRegion(t *testing.T) {
+	tests := []struct {
+		region  string
+		wantErr bool
+	}{
+		{"us-east-1", false},
+		{"us-gov-west-1", false},
+		{"cn-north-1", false},
+		{"us-isob-east-1", false},
+		{"ap-southeast-7", false},
+		{"xx-newregion-1", false},
+		{"", true},
+		{"evil.example/#", true},
+		{"evil.example", true},
+		{"us-east-1.evil.example", true},
+		{"us-east-1/", true},
+		{"US-EAST-1", true},
+		{"useast1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.region, func(t *testing.T) {
+			if err := checkRegion(tt.region); (err != nil) != tt.wantErr {
+				t.Errorf("checkRegion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDefaultRegion(t *testing.T) {
+	tests := []struct {
+		arn  string
+		env  string
+		want string
+	}{
+		{"arn:aws:iam::111111111111:role/ci", "", "us-east-1"},
+		{"arn:aws-cn:sts::111111111111:assumed-role/ci/session", "", "cn-north-1"},
+		{"arn:aws-iso-b:iam::111111111111:user/ci", "", "us-isob-east-1"},
+		{"arn:aws-us-gov:iam::111111111111:root", "", "us-gov-west-1"},
+		{"arn:aws-us-gov:iam::111111111111:role/ci", "us-gov-east-1", "us-gov-east-1"},
+		{"arn:aws-unknown:iam::111111111111:role/ci", "", "us-east-1"},
+		{"stratus@stratus-test.iam.gserviceaccount.com", "", "us-east-1"},
+		{"", "eu-west-1", "eu-west-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arn, func(t *testing.T) {
+			setenv(t, "AWS_REGION", tt.env)
+			if got := defaultRegion(tt.arn); got != tt.want {
+				t.Errorf("defaultRegion(%q) = %q, want %q", tt.arn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		wantErr  bool
+	}{
+		{"https://sts.us-east-1.amazonaws.com", false},
+		{"https://vpce-0123.sts.us-east-1.vpce.amazonaws.com/", false},
+		{"http://127.0.0.1:4566", false},
+		{"", true},
+		{"sts.us-east-1.amazonaws.com", true},
+		{"ftp://sts.example.com", true},
+		{"https://", true},
+		{"https://sts example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			if err := validateEndpoint(tt.endpoint); (err != nil) != tt.wantErr {
+				t.Errorf("validateEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateTargetRegion(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider ProviderName
+		region   string
+		endpoint string
+		wantErr  bool
+	}{
+		{name: "no region", provider: ProviderAWS},
+		{name: "region", provider: ProviderAWS, region: "eu-central-2"},
+		{name: "malformed region", provider: ProviderAWS, region: "eu-central-2.evil.example", wantErr: true},
+		{name: "gcp target region is not an aws region", provider: ProviderGCP, region: "europe-west1"},
+		{name: "endpoint override", provider: ProviderAWS, endpoint: "https://sts.eu-central-2.amazonaws.com"},
+		{name: "invalid endpoint override", provider: ProviderAWS, endpoint: "sts.eu-central-2.amazonaws.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := IAMMap{
+				Source: Identity{ID: "stratus@stratus-test.iam.gserviceaccount.com", Provider: ProviderGCP},
+				Target: Identity{ID: "arn:aws:iam::111111111111:role/stratus", Provider: tt.provider, Region: tt.region},
+			}
+			if tt.provider == ProviderGCP {
+				m.Source, m.Target.ID = Identity{ID: "arn:aws:iam::111111111111:role/ci", Provider: ProviderAWS}, "stratus@stratus-test.iam.gserviceaccount.com"
+			}
+			if tt.endpoint != "" {
+				m.Target.AWS = &AWSTarget{STSEndpoint: tt.endpoint}
+			}
+			if err := m.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		region   string
+		arn      string
+		override string
+		env      map[string]string
+		want     awsEndpoint
+		wantErr  bool
+	}{
+		{
+			name:   "region",
+			region: "eu-west-1",
+			want:   awsEndpoint{Region: "eu-west-1"},
+		},
+		{
+			name: "partition default",
+			arn:  "arn:aws-us-gov:iam::111111111111:role/ci",
+			want: awsEndpoint{Region: "us-gov-west-1"},
+		},
+		{
+			name: "deployment default",
+			arn:  "arn:aws-us-gov:iam::111111111111:role/ci",
+			env:  map[string]string{"AWS_REGION": "us-gov-east-1"},
+			want: awsEndpoint{Region: "us-gov-east-1"},
+		},
+		{
+			name:   "template",
+			region: "eu-west-1",
+			env:    map[string]string{"AWS_STS_ENDPOINT": "https://sts.{region}.example.com"},
+			want:   awsEndpoint{Region: "eu-west-1", STS: "https://sts.eu-west-1.example.com"},
+		},
+		{
+			name:     "override",
+			region:   "eu-west-1",
+			override: "https://vpce.example.com",
+			env:      map[string]string{"AWS_STS_ENDPOINT": "https://sts.{region}.example.com"},
+			want:     awsEndpoint{Region: "eu-west-1", STS: "https://vpce.example.com"},
+		},
+		{
+			name:   "fips",
+			region: "us-gov-west-1",
+			env:    map[string]string{"AWS_USE_FIPS_ENDPOINT": "true"},
+			want:   awsEndpoint{Region: "us-gov-west-1", STS: "https://sts-fips.us-gov-west-1.amazonaws.com"},
+		},
+		{
+			name:   "fips china",
+			region: "cn-north-1",
+			env:    map[string]string{"AWS_USE_FIPS_ENDPOINT": "true"},
+			want:   awsEndpoint{Region: "cn-north-1", STS: "https://sts-fips.cn-north-1.amazonaws.com.cn"},
+		},
+		{
+			name:    "template injection",
+			region:  "evil.example/#",
+			env:     map[string]string{"AWS_STS_ENDPOINT": "https://sts.{region}.example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "fips injection",
+			region:  "evil.example/#",
+			env:     map[string]string{"AWS_USE_FIPS_ENDPOINT": "true"},
+			wantErr: true,
+		},
+		{
+			name:    "regional injection",
+			region:  "evil.example/#",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"AWS_REGION", "AWS_STS_ENDPOINT", "AWS_USE_FIPS_ENDPOINT"} {
+				setenv(t, k, tt.env[k])
+			}
+			got, err := resolveEndpoint(tt.region, tt.arn, tt.override)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveEndpoint() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionCacheBounded(t *testing.T) {
+	awsSessionsMu.Lock()
+	saved := awsSessions
+	awsSessions = make(map[awsEndpoint]*session.Session)
+	awsSessionsMu.Unlock()
+	defer func() {
+		awsSessionsMu.Lock()
+		awsSessions = saved
+		awsSessionsMu.Unlock()
+	}()
+	for i := 0; i < awsMaxSessions*2; i++ {
+		e := awsEndpoint{Region: "us-east-1", STS: fmt.Sprintf("https://sts%d.example.com", i)}
+		if _, err := e.session(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(awsSessions); n != awsMaxSessions {
+		t.Errorf("cached %d sessions, want %d", n, awsMaxSessions)
+	}
+}
+
+func TestValidAWSRejectsForgedRegion(t *testing.T) {
+	stub := newSTSStub(t, "arn:aws:iam::111111111111:role/Admin")
+	setenv(t, "AWS_STS_ENDPOINT", stub.URL+"/{region}")
+	id := &Identity{
+		ID:          "arn:aws:iam::111111111111:role/Admin",
+		Provider:    ProviderAWS,
+		Region:      "evil.example/#",
+		Credentials: map[string]interface{}{"AccessKeyId": "AKID", "SecretAccessKey": "secret"},
+	}
+	if id.ValidAWS() {
+		t.Error("ValidAWS() accepted a forged region")
+	}
+	if n := len(stub.requests); n != 0 {
+		t.Errorf("stub received %d requests", n)
+	}
+}
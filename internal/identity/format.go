@@ -0,0 +1,185 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// Format is a credential response format
+type Format string
+
+const (
+	// FormatJSON returns the target credentials as JSON
+	FormatJSON Format = "json"
+	// FormatCredentialProcess returns AWS credentials in the AWS CLI / SDK
+	// credential_process JSON format
+	FormatCredentialProcess Format = "credential_process"
+	// FormatEnv returns AWS credentials as shell environment exports
+	FormatEnv Format = "env"
+	// FormatINI returns AWS credentials as an AWS shared credentials file profile
+	FormatINI Format = "ini"
+)
+
+var (
+	// ErrUnsupportedFormat is returned when a format is unknown or not
+	// supported for the target provider
+	ErrUnsupportedFormat = errors.New("unsupported credential format")
+
+	// validProfile matches the profile names allowed in the ini format
+	validProfile = regexp.MustCompile(`^[\w.-]+$`)
+
+	// formatMediaTypes maps Accept header media types to formats
+	formatMediaTypes = map[string]Format{
+		"application/json":                          FormatJSON,
+		"application/x-aws-credential-process+json": FormatCredentialProcess,
+		"text/x-shellscript":                        FormatEnv,
+		"text/x-ini":                                FormatINI,
+	}
+)
+
+// credentialProcess is the output format of an AWS credential_process
+type credentialProcess struct {
+	Version         int    `json:"Version"`
+	AccessKeyId     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken,omitempty"`
+	Expiration      string `json:"Expiration,omitempty"`
+}
+
+// acceptRange is a media range of an Accept header with its weight
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept returns the media ranges of an Accept header, most preferred
+// first. Ranges of equal weight keep their order, except that a specific
+// media type is preferred over "*/*".
+func parseAccept(accept string) []acceptRange {
+	var rs []acceptRange
+	for _, a := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(a))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		rs = append(rs, acceptRange{mediaType: mt, q: q})
+	}
+	sort.SliceStable(rs, func(i, j int) bool {
+		if rs[i].q != rs[j].q {
+			return rs[i].q > rs[j].q
+		}
+		return rs[i].mediaType != "*/*" && rs[j].mediaType == "*/*"
+	})
+	return rs
+}
+
+// NegotiateFormat selects the response format from the format query
+// parameter, falling back to the Accept header, and defaulting to JSON.
+// Media ranges with q=0 are not acceptable, and "*/*" selects JSON unless
+// JSON is refused.
+func NegotiateFormat(query string, accept string) (Format, error) {
+	if query != "" {
+		switch f := Format(query); f {
+		case FormatJSON, FormatCredentialProcess, FormatEnv, FormatINI:
+			return f, nil
+		}
+		return "", ErrUnsupportedFormat
+	}
+	if accept == "" {
+		return FormatJSON, nil
+	}
+	rs := parseAccept(accept)
+	refused := map[Format]bool{}
+	for _, r := range rs {
+		if f, ok := formatMediaTypes[r.mediaType]; ok && r.q == 0 {
+			refused[f] = true
+		}
+	}
+	for _, r := range rs {
+		if r.q == 0 {
+			break
+		}
+		if r.mediaType == "*/*" && !refused[FormatJSON] {
+			return FormatJSON, nil
+		}
+		if f, ok := formatMediaTypes[r.mediaType]; ok {
+			return f, nil
+		}
+	}
+	return "", ErrUnsupportedFormat
+}
+
+// Supports returns true if the format can be used for the target provider
+func (f Format) Supports(p ProviderName) bool {
+	return f == FormatJSON || p == ProviderAWS
+}
+
+// shellQuote single quotes s for use in a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+// FormatCredentials renders the target credentials in the given format,
+// returning the body and its content type. profile names the profile in
+// the ini format.
+func FormatCredentials(f Format, p ProviderName, c map[string]interface{}, profile string) ([]byte, string, error) {
+	if !f.Supports(p) {
+		return nil, "", ErrUnsupportedFormat
+	}
+	if f == FormatJSON {
+		jd, err := json.Marshal(c)
+		return jd, "application/json", err
+	}
+	var ac AWSCredentials
+	if err := mapstructure.Decode(c, &ac); err != nil {
+		return nil, "", err
+	}
+	var b bytes.Buffer
+	switch f {
+	case FormatCredentialProcess:
+		jd, err := json.Marshal(credentialProcess{
+			Version:         1,
+			AccessKeyId:     ac.AccessKeyId,
+			SecretAccessKey: ac.SecretAccessKey,
+			SessionToken:    ac.SessionToken,
+			Expiration:      ac.Expiration,
+		})
+		return jd, "application/json", err
+	case FormatEnv:
+		fmt.Fprintf(&b, "export AWS_ACCESS_KEY_ID=%s\n", shellQuote(ac.AccessKeyId))
+		fmt.Fprintf(&b, "export AWS_SECRET_ACCESS_KEY=%s\n", shellQuote(ac.SecretAccessKey))
+		fmt.Fprintf(&b, "export AWS_SESSION_TOKEN=%s\n", shellQuote(ac.SessionToken))
+		if ac.Expiration != "" {
+			fmt.Fprintf(&b, "export AWS_CREDENTIAL_EXPIRATION=%s\n", shellQuote(ac.Expiration))
+		}
+		return b.Bytes(), "text/x-shellscript", nil
+	case FormatINI:
+		if profile == "" {
+			profile = "default"
+		}
+		if !validProfile.MatchString(profile) {
+			return nil, "", errors.New("invalid profile name")
+		}
+		fmt.Fprintf(&b, "[%s]\n", profile)
+		fmt.Fprintf(&b, "aws_access_key_id = %s\n", ac.AccessKeyId)
+		fmt.Fprintf(&b, "aws_secret_access_key = %s\n", ac.SecretAccessKey)
+		fmt.Fprintf(&b, "aws_session_token = %s\n", ac.SessionToken)
+		return b.Bytes(), "text/x-ini", nil
+	}
+	return nil, "", ErrUnsupportedFormat
+}
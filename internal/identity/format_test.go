@@ -0,0 +1,63 @@
+package identity
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		accept  string
+		want    Format
+		wantErr bool
+	}{
+		{name: "default", want: FormatJSON},
+		{name: "query", query: "env", want: FormatEnv},
+		{name: "query overrides accept", query: "ini", accept: "application/json", want: FormatINI},
+		{name: "unknown query", query: "yaml", accept: "application/json", wantErr: true},
+		{name: "accept", accept: "text/x-shellscript", want: FormatEnv},
+		{name: "accept with parameters", accept: "application/json; charset=utf-8", want: FormatJSON},
+		{name: "first of equal weight", accept: "text/x-ini, text/x-shellscript", want: FormatINI},
+		{name: "wildcard", accept: "*/*", want: FormatJSON},
+		{name: "specific type before wildcard", accept: "*/*, text/x-ini", want: FormatINI},
+		{name: "higher weight", accept: "text/x-ini;q=0.5, application/x-aws-credential-process+json", want: FormatCredentialProcess},
+		{name: "wildcard with lower weight", accept: "*/*;q=0.1, text/x-shellscript;q=0.8", want: FormatEnv},
+		{name: "wildcard with higher weight", accept: "text/x-shellscript;q=0.2, */*", want: FormatJSON},
+		{name: "q=0 skipped", accept: "text/x-ini;q=0, text/x-shellscript;q=0.1", want: FormatEnv},
+		{name: "wildcard with json refused", accept: "application/json;q=0, */*", wantErr: true},
+		{name: "only refused types", accept: "text/x-ini;q=0", wantErr: true},
+		{name: "invalid weight skipped", accept: "text/x-ini;q=2, text/x-shellscript", want: FormatEnv},
+		{name: "unsupported type", accept: "text/html", wantErr: true},
+		{name: "malformed", accept: ";;", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NegotiateFormat(tt.query, tt.accept)
+			if tt.wantErr {
+				if !errors.Is(err, ErrUnsupportedFormat) {
+					t.Fatalf("NegotiateFormat() error = %v, want ErrUnsupportedFormat", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NegotiateFormat() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("NegotiateFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatSupports(t *testing.T) {
+	for _, f := range []Format{FormatCredentialProcess, FormatEnv, FormatINI} {
+		if !f.Supports(ProviderAWS) || f.Supports(ProviderGCP) || f.Supports(ProviderK8S) {
+			t.Errorf("%s supports AWS only", f)
+		}
+	}
+	if !FormatJSON.Supports(ProviderGCP) {
+		t.Error("json does not support GCP targets")
+	}
+}
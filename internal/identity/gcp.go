@@ -2,11 +2,11 @@ package identity
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
-	"net/http"
+	"os"
+	"strings"
 
-	"github.com/robertlestak/stratus/internal/vaultclient"
+	"github.com/robertlestak/stratus/internal/secretstore"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -22,16 +22,19 @@ type GCPCredentials struct {
 	ProjectID               string `json:"project_id"`
 	TokenURI                string `json:"token_uri"`
 	Type                    string `json:"type"`
+	// Assertion is a challenge response JWT, signed by the service account
+	// key, which is provided instead of the private key
+	Assertion string `json:"assertion"`
 }
 
-// GetGCPSAFromVault returns the GCP ServiceAccount credentials from Vault
-func (id *Identity) GetGCPSAFromVault(vaultClient *vaultclient.VaultClient) (map[string]interface{}, error) {
+// GetGCPSAFromVault returns the GCP ServiceAccount credentials from the secret store
+func (id *Identity) GetGCPSAFromVault(store secretstore.Store) (map[string]interface{}, error) {
 	l := log.WithFields(log.Fields{
 		"func":      "GetGCPSAFromVault",
 		"requestId": id.RequestID,
 	})
 	l.Info("GetGCPSAFromVault")
-	s, serr := vaultClient.GetKVSecretRetry(id.ID)
+	s, serr := id.readSecret(store, id.ID)
 	if serr != nil {
 		l.WithError(serr).Error("GetGCPSAFromVault failed")
 		return s, serr
@@ -67,74 +70,58 @@ func (id *Identity) ValidGCP() bool {
 		l.WithError(jerr).Error("ValidGCP failed")
 		return false
 	}
-	if c.ClientEmail == "" || c.ClientX509CertURL == "" {
-		l.Error("client email and cert required")
-		return false
+	if c.Assertion != "" {
+		// proof of possession, the assertion is verified against the key of the requested id
+		c.ClientEmail = id.ID
+		if err = validChallengeResponse(c.ClientEmail, c.Assertion); err != nil {
+			l.WithError(err).Error("challenge response invalid")
+			return false
+		}
+	} else {
+		if os.Getenv("GCP_REQUIRE_CHALLENGE") == "true" {
+			l.Error("challenge response required")
+			return false
+		}
+		if c.ClientEmail == "" || c.PrivateKeyID == "" {
+			l.Error("client email and private key id required")
+			return false
+		}
+		// ensure that the specified identity ID is the same as the client email
+		if id.ID != c.ClientEmail {
+			l.WithField("id", id.ID).WithField("client_email", c.ClientEmail).Error("id does not match client email")
+			return false
+		}
+		// validate the google cert + key
+		if err = c.Validate(); err != nil {
+			l.WithError(err).Error("validate failed")
+			return false
+		}
 	}
-	// ensure that the specified identity ID is the same as the client email
-	if id.ID != c.ClientEmail {
-		l.WithField("id", id.ID).WithField("client_email", c.ClientEmail).Error("id does not match client email")
-		return false
-	}
-	// validate the google cert + key
-	if c.Validate() != nil {
-		l.WithError(err).Error("validate failed")
-		return false
+	// the project is taken from the verified email rather than the caller supplied project_id
+	if at := strings.LastIndex(c.ClientEmail, "@"); at >= 0 {
+		id.Attributes = map[string]string{
+			AttrGCPProject: strings.TrimSuffix(c.ClientEmail[at+1:], ".iam.gserviceaccount.com"),
+		}
 	}
 	return true
 }
 
-// getClientCert retrieves the public certificate for a GCP Service Account
-func (c *GCPCredentials) getClientCert() (string, error) {
-	l := log.WithFields(log.Fields{
-		"func": "getClientCert",
-	})
-	l.Info("start")
-	hc := &http.Client{}
-	req, err := http.NewRequest("GET", c.ClientX509CertURL, nil)
-	if err != nil {
-		l.WithError(err).Error("getClientCert failed")
-		return "", err
-	}
-	res, rerr := hc.Do(req)
-	if rerr != nil {
-		l.WithError(rerr).Error("getClientCert failed")
-		return "", rerr
-	}
-	defer res.Body.Close()
-	rd := map[string]string{}
-	jerr := json.NewDecoder(res.Body).Decode(&rd)
-	if jerr != nil {
-		l.WithError(jerr).Error("getClientCert failed")
-		return "", jerr
-	}
-	var rv string
-	if r, ok := rd[c.PrivateKeyID]; ok {
-		rv = r
-	}
-	return rv, nil
-}
-
-// Validate validates the GCP ServiceAccount credentials against the GCP Public Key
+// Validate validates the GCP ServiceAccount credentials against the GCP Public Key.
+// The certificate is looked up by client email and key ID, ignoring any cert URL
+// supplied in the credentials.
 func (c *GCPCredentials) Validate() error {
 	l := log.WithFields(log.Fields{
 		"func": "GCPCredentials.Validate",
 	})
 	l.Info("start")
 	// retrieve client cert
-	cc, err := c.getClientCert()
-	if err != nil {
-		l.WithError(err).Error("GCPCredentials.Validate failed")
-		return err
-	}
-	// load public cert and our private key
-	cert, err := tls.X509KeyPair([]byte(cc), []byte(c.PrivateKey))
+	_, cc, err := gcpCert(c.ClientEmail, c.PrivateKeyID)
 	if err != nil {
 		l.WithError(err).Error("GCPCredentials.Validate failed")
 		return err
 	}
-	// parse the loaded certificate
-	_, err = x509.ParseCertificate(cert.Certificate[0])
+	// load public cert and our private key, which fails if they do not match
+	_, err = tls.X509KeyPair([]byte(cc), []byte(c.PrivateKey))
 	if err != nil {
 		l.WithError(err).Error("GCPCredentials.Validate failed")
 		return err
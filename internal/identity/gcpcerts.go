@@ -0,0 +1,167 @@
+package identity
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultGCPCertURL is the Google endpoint publishing service account certificates
+	defaultGCPCertURL = "https://www.googleapis.com/robot/v1/metadata/x509/"
+	// maxGCPCertResponse bounds the size of a certificate response
+	maxGCPCertResponse = 1 << 20
+)
+
+var (
+	// gcpCertCache caches the certificates of each service account until they expire
+	gcpCertCache   = make(map[string]gcpCertEntry)
+	gcpCertCacheMu sync.Mutex
+)
+
+// gcpCertEntry is a cached set of service account certificates, keyed by key ID
+type gcpCertEntry struct {
+	certs   map[string]string
+	expires time.Time
+	// fetched is when the certificates were fetched
+	fetched time.Time
+}
+
+// gcpCertURL returns the certificate URL of a service account. The URL is
+// derived from the verified email and the configured endpoint, GCP_CERT_URL,
+// rather than the URL supplied by the caller.
+func gcpCertURL(email string) string {
+	base := os.Getenv("GCP_CERT_URL")
+	if base == "" {
+		base = defaultGCPCertURL
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + url.PathEscape(email)
+}
+
+// gcpCertTimeout returns the timeout for certificate requests, GCP_CERT_TIMEOUT
+func gcpCertTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("GCP_CERT_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return 5 * time.Second
+}
+
+// gcpCertRefetchInterval returns the minimum time between fetches of the
+// certificates of a service account when a key ID is not found in the cache,
+// GCP_CERT_REFETCH_INTERVAL
+func gcpCertRefetchInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("GCP_CERT_REFETCH_INTERVAL")); err == nil && d >= 0 {
+		return d
+	}
+	return 30 * time.Second
+}
+
+// cacheExpiry returns when a response may no longer be served from cache,
+// honoring Cache-Control max-age and falling back to Expires
+func cacheExpiry(h http.Header, now time.Time) time.Time {
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.TrimSpace(strings.ToLower(d))
+		if d == "no-store" || d == "no-cache" {
+			return now
+		}
+		if strings.HasPrefix(d, "max-age=") {
+			if s, err := strconv.Atoi(strings.TrimPrefix(d, "max-age=")); err == nil {
+				return now.Add(time.Duration(s) * time.Second)
+			}
+		}
+	}
+	if e, err := http.ParseTime(h.Get("Expires")); err == nil {
+		return e
+	}
+	return now
+}
+
+// gcpCerts returns the published certificates of a service account, keyed by
+// key ID. If refetch is true cached certificates are fetched again, unless
+// they were fetched within the refetch interval, so a key created since they
+// were cached is found.
+func gcpCerts(email string, refetch bool) (map[string]string, error) {
+	l := log.WithFields(log.Fields{
+		"func":  "gcpCerts",
+		"email": email,
+	})
+	now := time.Now()
+	gcpCertCacheMu.Lock()
+	e, ok := gcpCertCache[email]
+	if ok && now.Before(e.expires) {
+		if !refetch || now.Sub(e.fetched) < gcpCertRefetchInterval() {
+			gcpCertCacheMu.Unlock()
+			return e.certs, nil
+		}
+		// claim the refetch so concurrent misses do not fetch again
+		e.fetched = now
+		gcpCertCache[email] = e
+	}
+	gcpCertCacheMu.Unlock()
+	l.WithField("refetch", refetch).Info("fetching certificates")
+	hc := &http.Client{Timeout: gcpCertTimeout()}
+	res, err := hc.Get(gcpCertURL(email))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("certificate request returned %d", res.StatusCode)
+	}
+	certs := map[string]string{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxGCPCertResponse)).Decode(&certs); err != nil {
+		return nil, err
+	}
+	gcpCertCacheMu.Lock()
+	gcpCertCache[email] = gcpCertEntry{certs: certs, expires: cacheExpiry(res.Header, now), fetched: now}
+	gcpCertCacheMu.Unlock()
+	return certs, nil
+}
+
+// gcpCert returns the certificate of a service account key, checking it is
+// within its validity window
+func gcpCert(email string, keyID string) (*x509.Certificate, string, error) {
+	certs, err := gcpCerts(email, false)
+	if err != nil {
+		return nil, "", err
+	}
+	cp, ok := certs[keyID]
+	if !ok {
+		// the key may have been created since the certificates were cached
+		if certs, err = gcpCerts(email, true); err != nil {
+			return nil, "", err
+		}
+		cp, ok = certs[keyID]
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("no certificate for key %q", keyID)
+	}
+	b, _ := pem.Decode([]byte(cp))
+	if b == nil {
+		return nil, "", errors.New("invalid certificate")
+	}
+	cert, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, "", fmt.Errorf("certificate for key %q is not valid at %s", keyID, now.UTC().Format(time.RFC3339))
+	}
+	return cert, cp, nil
+}
@@ -0,0 +1,244 @@
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robertlestak/stratus/internal/jwt"
+)
+
+// certStub publishes service account certificates as GCP does
+type certStub struct {
+	*httptest.Server
+	mu      sync.Mutex
+	certs   map[string]map[string]string
+	fetches int
+}
+
+func newCertStub(t *testing.T) *certStub {
+	t.Helper()
+	s := &certStub{certs: make(map[string]map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		certs, ok := s.certs[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		json.NewEncoder(w).Encode(certs)
+	}))
+	t.Cleanup(s.Close)
+	setenv(t, "GCP_CERT_URL", s.URL)
+	gcpCertCacheMu.Lock()
+	gcpCertCache = make(map[string]gcpCertEntry)
+	gcpCertCacheMu.Unlock()
+	return s
+}
+
+// addKey creates a key for the service account, publishing its certificate
+// valid from notBefore to notAfter
+func (s *certStub) addKey(t *testing.T, email, kid string, notBefore, notAfter time.Time) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: email},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.certs[email] == nil {
+		s.certs[email] = make(map[string]string)
+	}
+	s.certs[email][kid] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return key
+}
+
+func (s *certStub) fetchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func TestGCPCertRefetchesOnKeyMiss(t *testing.T) {
+	stub := newCertStub(t)
+	setenv(t, "GCP_CERT_REFETCH_INTERVAL", "200ms")
+	email := "sa@project.iam.gserviceaccount.com"
+	now := time.Now()
+	stub.addKey(t, email, "old", now.Add(-time.Hour), now.Add(time.Hour))
+	if _, _, err := gcpCert(email, "old"); err != nil {
+		t.Fatalf("gcpCert() error = %v", err)
+	}
+	if _, _, err := gcpCert(email, "old"); err != nil || stub.fetchCount() != 1 {
+		t.Fatalf("gcpCert() error = %v after %d fetches, want 1 fetch", err, stub.fetchCount())
+	}
+	// a rotated key is found without waiting for the cache to expire
+	time.Sleep(250 * time.Millisecond)
+	stub.addKey(t, email, "new", now.Add(-time.Hour), now.Add(time.Hour))
+	if _, _, err := gcpCert(email, "new"); err != nil {
+		t.Fatalf("gcpCert() error = %v", err)
+	}
+	if n := stub.fetchCount(); n != 2 {
+		t.Fatalf("%d fetches, want 2", n)
+	}
+	// unknown keys are refetched at most once per interval
+	for i := 0; i < 5; i++ {
+		if _, _, err := gcpCert(email, "unknown"); err == nil {
+			t.Fatal("gcpCert() found an unknown key")
+		}
+	}
+	if n := stub.fetchCount(); n != 2 {
+		t.Errorf("%d fetches, want 2", n)
+	}
+	setenv(t, "GCP_CERT_REFETCH_INTERVAL", "0s")
+	if _, _, err := gcpCert(email, "unknown"); err == nil {
+		t.Fatal("gcpCert() found an unknown key")
+	}
+	if n := stub.fetchCount(); n != 3 {
+		t.Errorf("%d fetches, want 3", n)
+	}
+}
+
+func TestGCPCertValidity(t *testing.T) {
+	stub := newCertStub(t)
+	email := "sa@project.iam.gserviceaccount.com"
+	now := time.Now()
+	stub.addKey(t, email, "valid", now.Add(-time.Hour), now.Add(time.Hour))
+	stub.addKey(t, email, "expired", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	stub.addKey(t, email, "future", now.Add(time.Hour), now.Add(2*time.Hour))
+	tests := []struct {
+		email   string
+		kid     string
+		wantErr bool
+	}{
+		{email, "valid", false},
+		{email, "expired", true},
+		{email, "future", true},
+		{"other@project.iam.gserviceaccount.com", "valid", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.email+" "+tt.kid, func(t *testing.T) {
+			if _, _, err := gcpCert(tt.email, tt.kid); (err != nil) != tt.wantErr {
+				t.Errorf("gcpCert() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Time
+	}{
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=600"}}, now.Add(10 * time.Minute)},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache, max-age=600"}}, now},
+		{"expires", http.Header{"Expires": {"Mon, 01 Jan 2024 01:00:00 GMT"}}, now.Add(time.Hour)},
+		{"none", http.Header{}, now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cacheExpiry(tt.header, now); !got.Equal(tt.want) {
+				t.Errorf("cacheExpiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGCPCertURL(t *testing.T) {
+	setenv(t, "GCP_CERT_URL", "https://certs.example.com/x509")
+	if got, want := gcpCertURL("sa@p.iam.gserviceaccount.com/../x"), "https://certs.example.com/x509/sa@p.iam.gserviceaccount.com%2F..%2Fx"; got != want {
+		t.Errorf("gcpCertURL() = %q, want %q", got, want)
+	}
+}
+
+func TestValidChallengeResponse(t *testing.T) {
+	stub := newCertStub(t)
+	resetUsedNonces(t)
+	email := "sa@project.iam.gserviceaccount.com"
+	now := time.Now()
+	key := stub.addKey(t, email, "kid1", now.Add(-time.Hour), now.Add(time.Hour))
+	other := stub.addKey(t, "other@project.iam.gserviceaccount.com", "kid2", now.Add(-time.Hour), now.Add(time.Hour))
+	respond := func(c challengeClaims, k *rsa.PrivateKey, kid string) string {
+		a, err := jwt.SignRS256(c, k, kid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	claims := func(aud string, exp time.Time) challengeClaims {
+		c, err := IssueChallenge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return challengeClaims{Iss: email, Sub: email, Aud: aud, Nonce: c.Nonce, Iat: now.Unix(), Exp: exp.Unix()}
+	}
+	valid := respond(claims("stratus", now.Add(time.Minute)), key, "kid1")
+	tests := []struct {
+		name      string
+		assertion string
+		wantErr   bool
+	}{
+		{"valid", valid, false},
+		{"replayed", valid, true},
+		{"other audience", respond(claims("other", now.Add(time.Minute)), key, "kid1"), true},
+		{"expired", respond(claims("stratus", now.Add(-time.Minute)), key, "kid1"), true},
+		{"no kid", respond(claims("stratus", now.Add(time.Minute)), key, ""), true},
+		{"unknown kid", respond(claims("stratus", now.Add(time.Minute)), key, "kid3"), true},
+		{"signed by another account", respond(claims("stratus", now.Add(time.Minute)), other, "kid1"), true},
+		{"unissued nonce", respond(challengeClaims{Iss: email, Aud: "stratus", Nonce: "n.1.x", Exp: now.Add(time.Minute).Unix()}, key, "kid1"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validChallengeResponse(email, tt.assertion); (err != nil) != tt.wantErr {
+				t.Errorf("validChallengeResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// a valid response of a source without a mapping does not record its nonce
+	table := NewMapTable([]IAMMap{{
+		Source: Identity{ID: "mapped@project.iam.gserviceaccount.com", Provider: ProviderGCP},
+		Target: Identity{ID: "arn:aws:iam::111111111111:role/stratus", Provider: ProviderAWS},
+	}})
+	ChallengeTable = func() *MapTable { return table }
+	t.Cleanup(func() { ChallengeTable = nil })
+	resetUsedNonces(t)
+	unmapped := respond(claims("stratus", now.Add(time.Minute)), key, "kid1")
+	if err := validChallengeResponse(email, unmapped); err == nil {
+		t.Error("validChallengeResponse() accepted a source without a mapping")
+	}
+	if n := len(usedNonces); n != 0 {
+		t.Errorf("recorded %d nonces of an unmapped source", n)
+	}
+	table = NewMapTable([]IAMMap{{
+		Source: Identity{ID: email, Provider: ProviderGCP},
+		Target: Identity{ID: "arn:aws:iam::111111111111:role/stratus", Provider: ProviderAWS},
+	}})
+	if err := validChallengeResponse(email, unmapped); err != nil {
+		t.Errorf("validChallengeResponse() error = %v once mapped", err)
+	}
+}
@@ -0,0 +1,97 @@
+package identity
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// GCPTarget contains the settings of a GCP target service account
+type GCPTarget struct {
+	// Rotation overrides the default key rotation settings of the target
+	Rotation *KeyRotation `json:"rotation,omitempty" yaml:"rotation"`
+}
+
+// KeyRotation configures automated rotation of a service account key
+type KeyRotation struct {
+	// Disabled excludes the target from key rotation
+	Disabled bool `json:"disabled,omitempty" yaml:"disabled"`
+	// Interval is the age at which the current key is replaced
+	Interval string `json:"interval,omitempty" yaml:"interval"`
+	// GracePeriod is how long old keys remain valid after the current key is created
+	GracePeriod string `json:"gracePeriod,omitempty" yaml:"gracePeriod"`
+}
+
+// RotationDefaults returns the default key rotation interval and grace
+// period, GCP_KEY_ROTATION_INTERVAL (default 720h) and
+// GCP_KEY_ROTATION_GRACE_PERIOD (default 24h)
+func RotationDefaults() (interval, grace time.Duration) {
+	interval, grace = 30*24*time.Hour, 24*time.Hour
+	if d, err := time.ParseDuration(os.Getenv("GCP_KEY_ROTATION_INTERVAL")); err == nil && d > 0 {
+		interval = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("GCP_KEY_ROTATION_GRACE_PERIOD")); err == nil && d >= 0 {
+		grace = d
+	}
+	return interval, grace
+}
+
+// ValidateRotation checks the grace period is shorter than the interval,
+// otherwise old keys would never be deleted
+func ValidateRotation(interval, grace time.Duration) error {
+	if grace >= interval {
+		return fmt.Errorf("rotation gracePeriod %s must be shorter than interval %s", grace, interval)
+	}
+	return nil
+}
+
+// Validate checks the target settings are well formed. The rotation settings
+// are checked once merged with the defaults, as either may be overridden.
+func (t *GCPTarget) Validate() error {
+	if t == nil || t.Rotation == nil {
+		return nil
+	}
+	r := t.Rotation
+	if r.Interval != "" {
+		if d, err := time.ParseDuration(r.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid rotation interval %q", r.Interval)
+		}
+	}
+	if r.GracePeriod != "" {
+		if d, err := time.ParseDuration(r.GracePeriod); err != nil || d < 0 {
+			return fmt.Errorf("invalid rotation gracePeriod %q", r.GracePeriod)
+		}
+	}
+	if r.Disabled {
+		return nil
+	}
+	interval, grace := RotationDefaults()
+	return ValidateRotation(t.RotationInterval(interval), t.RotationGracePeriod(grace))
+}
+
+// RotationEnabled returns false if rotation is disabled for the target
+func (t *GCPTarget) RotationEnabled() bool {
+	return t == nil || t.Rotation == nil || !t.Rotation.Disabled
+}
+
+// RotationInterval returns the rotation interval of the target, or def if unset
+func (t *GCPTarget) RotationInterval(def time.Duration) time.Duration {
+	if t == nil || t.Rotation == nil {
+		return def
+	}
+	if d, err := time.ParseDuration(t.Rotation.Interval); err == nil {
+		return d
+	}
+	return def
+}
+
+// RotationGracePeriod returns the rotation grace period of the target, or def if unset
+func (t *GCPTarget) RotationGracePeriod(def time.Duration) time.Duration {
+	if t == nil || t.Rotation == nil {
+		return def
+	}
+	if d, err := time.ParseDuration(t.Rotation.GracePeriod); err == nil {
+		return d
+	}
+	return def
+}
@@ -0,0 +1,64 @@
+package identity
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGCPTargetValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   *GCPTarget
+		interval string
+		grace    string
+		wantErr  bool
+	}{
+		{name: "nil", target: nil},
+		{name: "defaults", target: &GCPTarget{}},
+		{name: "interval and grace", target: &GCPTarget{Rotation: &KeyRotation{Interval: "168h", GracePeriod: "12h"}}},
+		{name: "interval with default grace", target: &GCPTarget{Rotation: &KeyRotation{Interval: "48h"}}},
+		{name: "interval not longer than default grace", target: &GCPTarget{Rotation: &KeyRotation{Interval: "12h"}}, wantErr: true},
+		{name: "interval equal to default grace", target: &GCPTarget{Rotation: &KeyRotation{Interval: "24h"}}, wantErr: true},
+		{name: "interval with env grace", target: &GCPTarget{Rotation: &KeyRotation{Interval: "12h"}}, grace: "6h"},
+		{name: "grace not shorter than default interval", target: &GCPTarget{Rotation: &KeyRotation{GracePeriod: "720h"}}, wantErr: true},
+		{name: "grace not shorter than env interval", target: &GCPTarget{Rotation: &KeyRotation{GracePeriod: "48h"}}, interval: "48h", wantErr: true},
+		{name: "grace not shorter than interval", target: &GCPTarget{Rotation: &KeyRotation{Interval: "12h", GracePeriod: "12h"}}, wantErr: true},
+		{name: "disabled", target: &GCPTarget{Rotation: &KeyRotation{Disabled: true, Interval: "12h"}}},
+		{name: "invalid interval", target: &GCPTarget{Rotation: &KeyRotation{Interval: "weekly"}}, wantErr: true},
+		{name: "zero interval", target: &GCPTarget{Rotation: &KeyRotation{Interval: "0s"}}, wantErr: true},
+		{name: "negative grace", target: &GCPTarget{Rotation: &KeyRotation{GracePeriod: "-1h"}}, wantErr: true},
+		{name: "zero grace", target: &GCPTarget{Rotation: &KeyRotation{GracePeriod: "0s"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "GCP_KEY_ROTATION_INTERVAL", tt.interval)
+			setenv(t, "GCP_KEY_ROTATION_GRACE_PERIOD", tt.grace)
+			err := tt.target.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRotationDefaults(t *testing.T) {
+	tests := []struct {
+		interval     string
+		grace        string
+		wantInterval time.Duration
+		wantGrace    time.Duration
+	}{
+		{"", "", 720 * time.Hour, 24 * time.Hour},
+		{"168h", "12h", 168 * time.Hour, 12 * time.Hour},
+		{"weekly", "-1h", 720 * time.Hour, 24 * time.Hour},
+		{"0s", "0s", 720 * time.Hour, 0},
+	}
+	for _, tt := range tests {
+		setenv(t, "GCP_KEY_ROTATION_INTERVAL", tt.interval)
+		setenv(t, "GCP_KEY_ROTATION_GRACE_PERIOD", tt.grace)
+		i, g := RotationDefaults()
+		if i != tt.wantInterval || g != tt.wantGrace {
+			t.Errorf("RotationDefaults() with %q, %q = %s, %s, want %s, %s", tt.interval, tt.grace, i, g, tt.wantInterval, tt.wantGrace)
+		}
+	}
+}
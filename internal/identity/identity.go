@@ -2,7 +2,9 @@ package identity
 
 import (
 	"errors"
+	"time"
 
+	"github.com/robertlestak/stratus/internal/secretstore"
 	"github.com/robertlestak/stratus/internal/vaultclient"
 	log "github.com/sirupsen/logrus"
 )
@@ -17,6 +19,18 @@ const (
 	ProviderK8S ProviderName = "k8s"
 )
 
+// verified identity attribute keys
+const (
+	AttrAWSAccount   = "aws-account"
+	AttrGCPProject   = "gcp-project"
+	AttrK8SNamespace = "k8s-namespace"
+	// AttrK8SGroups holds the space separated groups of a k8s source
+	AttrK8SGroups   = "k8s-groups"
+	AttrK8SPodName  = "k8s-pod-name"
+	AttrK8SPodUID   = "k8s-pod-uid"
+	AttrK8SNodeName = "k8s-node-name"
+)
+
 // Identity contains a single identity
 type Identity struct {
 	ID          string                 `json:"id" yaml:"id"`
@@ -24,13 +38,33 @@ type Identity struct {
 	Region      string                 `json:"region" yaml:"region"`
 	Credentials map[string]interface{} `json:"credentials" yaml:"credentials"`
 	RequestID   string                 `json:"request_id" yaml:"-"`
+	// SessionName is a glob pattern which the session name of an AWS
+	// assumed-role source must match
+	SessionName string `json:"-" yaml:"sessionName"`
+	// AWS contains settings used when assuming an AWS target identity
+	AWS *AWSTarget `json:"-" yaml:"aws"`
+	// GCP contains settings of a GCP target identity
+	GCP *GCPTarget `json:"-" yaml:"gcp"`
+	// Secret overrides where GCP and K8S target credentials are read from
+	Secret *SecretRef `json:"-" yaml:"secret"`
+	// Attributes are verified attributes of the identity, populated by the
+	// provider during validation
+	Attributes map[string]string `json:"-" yaml:"-"`
 }
 
 // IAMMap contains a single identity mapping and the corresponding request ID for audit log
 type IAMMap struct {
-	Source    Identity `json:"source" yaml:"source"`
-	Target    Identity `json:"target" yaml:"target"`
-	RequestID string   `json:"requestId"`
+	Source     Identity    `json:"source" yaml:"source"`
+	Target     Identity    `json:"target" yaml:"target"`
+	Conditions *Conditions `json:"-" yaml:"conditions"`
+	Session    *AWSSession `json:"-" yaml:"session"`
+	RequestID  string      `json:"requestId"`
+	// SourceGroup and TargetRoleSet name the group and roleSet the mapping
+	// was expanded from, if any
+	SourceGroup   string `json:"-" yaml:"sourceGroup"`
+	TargetRoleSet string `json:"-" yaml:"targetRoleSet"`
+	// Origin records the config source the mapping was loaded from
+	Origin string `json:"-" yaml:"-"`
 }
 
 // Valid checks the identities validity with the given provider
@@ -57,31 +91,48 @@ func (id *Identity) Valid() bool {
 // FindIDinMap returns the IAMMap for the given source identity
 // this assumes validation has already been performed and the Source identity
 // has the right to assume the Target identity
-func (im *IAMMap) FindIDinMap(iamMap []IAMMap) (*IAMMap, error) {
-	for _, iam := range iamMap {
-		if im.Source.ID == iam.Source.ID && im.Target.ID == iam.Target.ID {
-			log.Printf("found identity %+v", iam)
-			return &iam, nil
+func (im *IAMMap) FindIDinMap(t *MapTable) (*IAMMap, error) {
+	for _, iam := range t.Lookup(&im.Source) {
+		if im.Target.ID != iam.Target.ID {
+			continue
+		}
+		if !sessionNameMatches(iam.Source.SessionName, im.Source.Attributes) {
+			continue
+		}
+		if err := iam.Conditions.Allow(time.Now()); err != nil {
+			log.WithField("origin", iam.Origin).Printf("%+v", err)
+			continue
+		}
+		if err := iam.Conditions.Match(im.Source.Attributes); err != nil {
+			log.WithField("origin", iam.Origin).Printf("%+v", err)
+			continue
 		}
+		log.WithFields(log.Fields{
+			"origin":     iam.Origin,
+			"group":      iam.SourceGroup,
+			"roleSet":    iam.TargetRoleSet,
+			"attributes": im.Source.Attributes,
+		}).Printf("found identity %+v", iam)
+		return &iam, nil
 	}
 	return nil, errors.New("identity not found")
 }
 
 // GetCredentials returns the target credentials for the given source identity
 // this performs no vlaidation and assumes the source identity has the right to
-// assume the target identity
-func (im *IAMMap) GetCredentials(vc *vaultclient.VaultClient) (map[string]interface{}, error) {
+// assume the target identity. GCP and K8S target secrets are read from store.
+func (im *IAMMap) GetCredentials(vc *vaultclient.VaultClient, store secretstore.Store) (map[string]interface{}, error) {
 	l := log.WithFields(log.Fields{
 		"func":      "getCredentials",
 		"requestId": im.RequestID,
 	})
 	l.Printf("start")
 	if im.Target.Provider == ProviderGCP {
-		return im.Target.GetGCPSAFromVault(vc)
+		return im.Target.GetGCPSAFromVault(store)
 	} else if im.Target.Provider == ProviderAWS {
-		return im.Target.CreateAWSSession()
+		return im.Target.CreateAWSSession(im.Session, &im.Source, vc)
 	} else if im.Target.Provider == ProviderK8S {
-		return im.Target.GetK8SSSAFromVault(vc)
+		return im.Target.GetK8SSSAFromVault(store)
 	}
 	return nil, errors.New("provider not supported")
 }
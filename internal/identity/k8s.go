@@ -2,17 +2,20 @@ package identity
 
 import (
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
-	"github.com/robertlestak/stratus/internal/vaultclient"
+	"github.com/robertlestak/stratus/internal/jwt"
+	"github.com/robertlestak/stratus/internal/secretstore"
 	log "github.com/sirupsen/logrus"
-	"k8s.io/api/authentication/v1beta1"
+	authv1 "k8s.io/api/authentication/v1"
 )
 
 // K8SIdentity is the identity for a k8s cluster
@@ -24,15 +27,20 @@ type K8SIdentity struct {
 	ClusterHost     string `json:"clusterHost"`
 	ClusterCA       string `json:"clusterCA"`
 	ValidationToken string `json:"validationToken"`
+	// Issuer is the service account token issuer of the cluster, discovered
+	// from the cluster if unset
+	Issuer string `json:"issuer"`
+	// Legacy marks a cluster which only serves the v1beta1 TokenReview API
+	Legacy bool `json:"legacy"`
 }
 
-// GetValidation retrieves the validateion SA token from vault
-func (k *K8SIdentity) GetValidation(cluster string, vaultClient *vaultclient.VaultClient) error {
+// GetValidation retrieves the validateion SA token from the secret store
+func (k *K8SIdentity) GetValidation(cluster string, store secretstore.Store) error {
 	l := log.WithFields(log.Fields{
 		"cluster": cluster,
 	})
 	l.Info("GetValidationToken")
-	s, serr := vaultClient.GetKVSecretRetry(k.ClusterName + "/validation")
+	s, serr := store.Get(k.ClusterName+"/validation", 0)
 	if serr != nil {
 		l.WithError(serr).Error("GetGCPSAFromVault failed")
 		return serr
@@ -45,62 +53,89 @@ func (k *K8SIdentity) GetValidation(cluster string, vaultClient *vaultclient.Vau
 	return nil
 }
 
-// Validate validates the k8s identity against the k8s api
-func (k *K8SIdentity) Validate() (*v1beta1.TokenReview, error) {
+// k8sAudience returns the audience callers' tokens must be issued for, K8S_TOKEN_AUDIENCE
+func k8sAudience() string {
+	if a := os.Getenv("K8S_TOKEN_AUDIENCE"); a != "" {
+		return a
+	}
+	return "stratus"
+}
+
+// legacyCluster returns true if the cluster is listed in K8S_LEGACY_CLUSTERS,
+// and only serves the v1beta1 TokenReview API
+func legacyCluster(name string) bool {
+	for _, c := range strings.Split(os.Getenv("K8S_LEGACY_CLUSTERS"), ",") {
+		if strings.TrimSpace(c) == name && name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAudience returns true if aud is in auds
+func hasAudience(auds []string, aud string) bool {
+	for _, a := range auds {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate validates the k8s identity against the k8s api. The token must be
+// issued for the stratus audience. Legacy clusters are reviewed with the
+// v1beta1 API, which has the same schema as v1.
+func (k *K8SIdentity) Validate() (*authv1.TokenReview, error) {
 	l := log.WithFields(log.Fields{
 		"cluster":   k.ClusterName,
 		"namespace": k.Namespace,
 		"sa":        k.SA,
 	})
 	l.Info("Validate")
-	trr := &v1beta1.TokenReview{}
-	gerr := k.GetValidation(k.ClusterName, vaultclient.Client)
+	trr := &authv1.TokenReview{}
+	cluster, gerr := Clusters.get(k.ClusterName)
 	if gerr != nil {
 		l.WithError(gerr).Error("GetValidationToken failed")
 		return trr, gerr
 	}
-	caCertPool := x509.NewCertPool()
-	sDec, berr := base64.StdEncoding.DecodeString(k.ClusterCA)
-	if berr != nil {
-		l.Error(berr)
-		return trr, berr
-	}
-	caCertPool.AppendCertsFromPEM(sDec)
-	c := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs: caCertPool,
-			},
-		},
+	version := "v1"
+	if cluster.status.Legacy {
+		version = "v1beta1"
 	}
-	tr := &v1beta1.TokenReview{
-		Spec: v1beta1.TokenReviewSpec{
-			Token: k.JWT,
+	aud := k8sAudience()
+	tr := &authv1.TokenReview{
+		Spec: authv1.TokenReviewSpec{
+			Token:     k.JWT,
+			Audiences: []string{aud},
 		},
 	}
+	tr.APIVersion = "authentication.k8s.io/" + version
+	tr.Kind = "TokenReview"
 	b, err := json.Marshal(tr)
 	if err != nil {
 		l.Error(err)
 		return trr, err
 	}
-	req, err := http.NewRequest("POST", k.ClusterHost+"/apis/authentication.k8s.io/v1beta1/tokenreviews", bytes.NewBuffer(b))
+	req, err := http.NewRequest("POST", cluster.status.Host+"/apis/authentication.k8s.io/"+version+"/tokenreviews", bytes.NewBuffer(b))
 	if err != nil {
 		l.Error(err)
 		return trr, err
 	}
-	tDec, berr := base64.StdEncoding.DecodeString(k.ValidationToken)
-	if berr != nil {
-		l.Error(berr)
-		return trr, berr
-	}
-	req.Header.Add("Authorization", "Bearer "+string(tDec))
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.Do(req)
+	resp, err := cluster.do(req)
 	if err != nil {
+		Clusters.setHealth(k.ClusterName, err)
 		l.Error(err)
 		return trr, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("tokenreview returned %d", resp.StatusCode)
+		Clusters.setHealth(k.ClusterName, err)
+		l.Error(err)
+		return trr, err
+	}
+	Clusters.setHealth(k.ClusterName, nil)
 	err = json.NewDecoder(resp.Body).Decode(trr)
 	if err != nil {
 		l.Error(err)
@@ -110,6 +145,11 @@ func (k *K8SIdentity) Validate() (*v1beta1.TokenReview, error) {
 		l.Error("Token not authenticated")
 		return trr, errors.New("token not authenticated")
 	}
+	// tokens issued for other audiences must not be accepted
+	if !hasAudience(trr.Status.Audiences, aud) {
+		l.Error("Token audience invalid")
+		return trr, errors.New("token not issued for stratus audience")
+	}
 	return trr, nil
 }
 
@@ -137,6 +177,20 @@ func (id *Identity) ValidK8S() bool {
 		l.Error("JWT is empty")
 		return false
 	}
+	if k8screds.ClusterName == "" {
+		// infer the cluster from the token issuer, the cluster still validates the token
+		var c struct {
+			Iss string `json:"iss"`
+		}
+		if err := jwt.ParseUnverified(k8screds.JWT, &c); err != nil {
+			l.WithError(err).Error("clusterName not set and token not parsed")
+			return false
+		}
+		if k8screds.ClusterName, err = Clusters.byIssuer(c.Iss); err != nil {
+			l.WithError(err).Error("clusterName not set and not inferred from token issuer")
+			return false
+		}
+	}
 	k := &K8SIdentity{
 		ClusterName: k8screds.ClusterName,
 		Namespace:   k8screds.Namespace,
@@ -152,11 +206,38 @@ func (id *Identity) ValidK8S() bool {
 		l.Error("Username does not match")
 		return false
 	}
+	id.Attributes = k8sAttributes(tr.Status.User)
 	return true
 }
 
-// GetK8SSSAFromVault retrieves the configured k8s SSA from vault
-func (id *Identity) GetK8SSSAFromVault(vaultClient *vaultclient.VaultClient) (map[string]interface{}, error) {
+// k8sExtraAttributes maps TokenReview user extra keys to attribute keys
+var k8sExtraAttributes = map[string]string{
+	"authentication.kubernetes.io/pod-name":  AttrK8SPodName,
+	"authentication.kubernetes.io/pod-uid":   AttrK8SPodUID,
+	"authentication.kubernetes.io/node-name": AttrK8SNodeName,
+}
+
+// k8sAttributes returns the verified attributes of a reviewed token: the
+// namespace, groups, and the pod and node the token is bound to, if any
+func k8sAttributes(u authv1.UserInfo) map[string]string {
+	attrs := make(map[string]string)
+	// service account usernames are of the form system:serviceaccount:<namespace>:<name>
+	if parts := strings.Split(u.Username, ":"); len(parts) == 4 && parts[1] == "serviceaccount" {
+		attrs[AttrK8SNamespace] = parts[2]
+	}
+	if len(u.Groups) > 0 {
+		attrs[AttrK8SGroups] = strings.Join(u.Groups, " ")
+	}
+	for k, a := range k8sExtraAttributes {
+		if v := u.Extra[k]; len(v) > 0 {
+			attrs[a] = v[0]
+		}
+	}
+	return attrs
+}
+
+// GetK8SSSAFromVault retrieves the configured k8s SSA from the secret store
+func (id *Identity) GetK8SSSAFromVault(store secretstore.Store) (map[string]interface{}, error) {
 	l := log.WithFields(log.Fields{
 		"action": "GetK8SSSAFromVault",
 	})
@@ -171,11 +252,32 @@ func (id *Identity) GetK8SSSAFromVault(vaultClient *vaultclient.VaultClient) (ma
 		l.WithError(err).Error("Failed to decode credentials")
 		return nil, err
 	}
-	s, serr := vaultClient.GetKVSecretRetry(k8screds.ClusterName + "/" + id.ID)
+	s, serr := id.readSecret(store, k8screds.ClusterName+"/"+id.ID)
 	if serr != nil {
 		l.WithError(serr).Error("GetK8SSSAFromVault failed")
 		return s, serr
 	}
-	id.Credentials = s
+	// copy the secret, as the store may return a cached map
+	id.Credentials = copyCredentials(s)
+	if t, ok := s["jwt"].(string); ok {
+		if exp, ok := tokenExpiration(t); ok {
+			id.Credentials["Expiration"] = exp.UTC().Format(time.RFC3339)
+		}
+	}
 	return id.Credentials, nil
 }
+
+// tokenExpiration returns the expiry of a service account token, which may be
+// base64 encoded as stored from the token secret. Legacy tokens do not expire.
+func tokenExpiration(t string) (time.Time, bool) {
+	if dec, err := base64.StdEncoding.DecodeString(t); err == nil {
+		t = string(dec)
+	}
+	var c struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := jwt.ParseUnverified(t, &c); err != nil || c.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(c.Exp, 0), true
+}
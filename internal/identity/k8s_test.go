@@ -0,0 +1,325 @@
+package identity
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/robertlestak/stratus/internal/secretstore"
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+// mapStore is a read-only secret store returning the same map on every read,
+// as a caching store would
+type mapStore map[string]map[string]interface{}
+
+func (m mapStore) Get(path string, version int) (map[string]interface{}, error) {
+	s, ok := m[path]
+	if !ok {
+		return nil, secretstore.ErrNotFound
+	}
+	return s, nil
+}
+
+// unsignedToken returns a JWT with the given claims JSON and no signature
+func unsignedToken(claims string) string {
+	return "e30." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig"
+}
+
+func TestGetK8SSSAFromVault(t *testing.T) {
+	tests := []struct {
+		name    string
+		jwt     string
+		wantExp string
+	}{
+		{"bound token", unsignedToken(`{"exp":4102444800}`), "2100-01-01T00:00:00Z"},
+		{"base64 encoded token", base64.StdEncoding.EncodeToString([]byte(unsignedToken(`{"exp":4102444800}`))), "2100-01-01T00:00:00Z"},
+		{"legacy token", unsignedToken(`{"sub":"system:serviceaccount:default:ci"}`), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := map[string]interface{}{"jwt": tt.jwt}
+			store := mapStore{"dev/system:serviceaccount:default:ci": secret}
+			id := &Identity{
+				ID:          "system:serviceaccount:default:ci",
+				Provider:    ProviderK8S,
+				Credentials: map[string]interface{}{"clusterName": "dev"},
+			}
+			c, err := id.GetK8SSSAFromVault(store)
+			if err != nil {
+				t.Fatalf("GetK8SSSAFromVault() error = %v", err)
+			}
+			if c["jwt"] != tt.jwt {
+				t.Errorf("jwt = %v", c["jwt"])
+			}
+			exp, ok := c["Expiration"]
+			if tt.wantExp == "" && ok || tt.wantExp != "" && exp != tt.wantExp {
+				t.Errorf("Expiration = %v, want %q", exp, tt.wantExp)
+			}
+			if _, ok := c["expiration"]; ok {
+				t.Error("credentials contain a lowercase expiration")
+			}
+			if len(secret) != 1 {
+				t.Errorf("stored secret modified: %v", secret)
+			}
+		})
+	}
+}
+
+// reviewStub is a stand-in cluster API answering TokenReviews with status,
+// recording the path and body of the last review
+type reviewStub struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	status authv1.TokenReviewStatus
+	code   int
+	path   string
+	review authv1.TokenReview
+}
+
+// newReviewStub registers a cluster served by the stub as the only cluster
+func newReviewStub(t *testing.T, name string, legacy bool) *reviewStub {
+	t.Helper()
+	s := &reviewStub{code: http.StatusCreated}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer validator" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&s.review)
+		tr := s.review
+		tr.Status = s.status
+		w.WriteHeader(s.code)
+		json.NewEncoder(w).Encode(tr)
+	}))
+	t.Cleanup(s.Close)
+	saved := Clusters
+	t.Cleanup(func() { Clusters = saved })
+	Clusters = &ClusterRegistry{clusters: map[string]*k8sCluster{
+		name: {
+			status: ClusterStatus{Name: name, Host: s.URL, Legacy: legacy, Healthy: true},
+			token:  "validator",
+			client: s.Client(),
+		},
+	}}
+	return s
+}
+
+func TestK8SValidateTokenReview(t *testing.T) {
+	tests := []struct {
+		name        string
+		legacy      bool
+		audience    string
+		status      authv1.TokenReviewStatus
+		code        int
+		wantPath    string
+		wantVersion string
+		wantAud     string
+		wantErr     string
+	}{
+		{
+			name:        "v1",
+			status:      authv1.TokenReviewStatus{Authenticated: true, Audiences: []string{"stratus"}},
+			wantPath:    "/apis/authentication.k8s.io/v1/tokenreviews",
+			wantVersion: "authentication.k8s.io/v1",
+			wantAud:     "stratus",
+		},
+		{
+			name:        "legacy cluster uses v1beta1",
+			legacy:      true,
+			status:      authv1.TokenReviewStatus{Authenticated: true, Audiences: []string{"stratus"}},
+			wantPath:    "/apis/authentication.k8s.io/v1beta1/tokenreviews",
+			wantVersion: "authentication.k8s.io/v1beta1",
+			wantAud:     "stratus",
+		},
+		{
+			name:        "configured audience",
+			audience:    "stratus.example.com",
+			status:      authv1.TokenReviewStatus{Authenticated: true, Audiences: []string{"api", "stratus.example.com"}},
+			wantPath:    "/apis/authentication.k8s.io/v1/tokenreviews",
+			wantVersion: "authentication.k8s.io/v1",
+			wantAud:     "stratus.example.com",
+		},
+		{
+			name:        "other audience",
+			status:      authv1.TokenReviewStatus{Authenticated: true, Audiences: []string{"https://kubernetes.default.svc"}},
+			wantPath:    "/apis/authentication.k8s.io/v1/tokenreviews",
+			wantVersion: "authentication.k8s.io/v1",
+			wantAud:     "stratus",
+			wantErr:     "not issued for stratus audience",
+		},
+		{
+			name:        "no audiences",
+			legacy:      true,
+			status:      authv1.TokenReviewStatus{Authenticated: true},
+			wantPath:    "/apis/authentication.k8s.io/v1beta1/tokenreviews",
+			wantVersion: "authentication.k8s.io/v1beta1",
+			wantAud:     "stratus",
+			wantErr:     "not issued for stratus audience",
+		},
+		{
+			name:        "not authenticated",
+			status:      authv1.TokenReviewStatus{Error: "token expired"},
+			wantPath:    "/apis/authentication.k8s.io/v1/tokenreviews",
+			wantVersion: "authentication.k8s.io/v1",
+			wantAud:     "stratus",
+			wantErr:     "not authenticated",
+		},
+		{
+			name:        "review not served",
+			code:        http.StatusNotFound,
+			wantPath:    "/apis/authentication.k8s.io/v1/tokenreviews",
+			wantVersion: "authentication.k8s.io/v1",
+			wantAud:     "stratus",
+			wantErr:     "tokenreview returned 404",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "K8S_TOKEN_AUDIENCE", tt.audience)
+			stub := newReviewStub(t, "dev", tt.legacy)
+			stub.status = tt.status
+			if tt.code != 0 {
+				stub.code = tt.code
+			}
+			_, err := (&K8SIdentity{ClusterName: "dev", JWT: "caller-jwt"}).Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+			if stub.path != tt.wantPath || stub.review.APIVersion != tt.wantVersion || stub.review.Kind != "TokenReview" {
+				t.Errorf("review %s %s %s, want %s %s", stub.path, stub.review.APIVersion, stub.review.Kind, tt.wantPath, tt.wantVersion)
+			}
+			if spec := stub.review.Spec; spec.Token != "caller-jwt" || len(spec.Audiences) != 1 || spec.Audiences[0] != tt.wantAud {
+				t.Errorf("review spec = %+v, want audience %s", spec, tt.wantAud)
+			}
+			if healthy := Clusters.Status()[0].Healthy; healthy != (tt.code == 0) {
+				t.Errorf("cluster healthy = %v", healthy)
+			}
+		})
+	}
+}
+
+func TestValidK8S(t *testing.T) {
+	const user = "system:serviceaccount:ci:runner"
+	tests := []struct {
+		name  string
+		id    string
+		creds map[string]interface{}
+		want  bool
+	}{
+		{"valid", user, map[string]interface{}{"clusterName": "dev", "jwt": "caller-jwt"}, true},
+		{"other user", "system:serviceaccount:ci:deploy", map[string]interface{}{"clusterName": "dev", "jwt": "caller-jwt"}, false},
+		{"no jwt", user, map[string]interface{}{"clusterName": "dev"}, false},
+		{"unknown cluster", user, map[string]interface{}{"clusterName": "prod", "jwt": "caller-jwt"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "K8S_TOKEN_AUDIENCE", "")
+			stub := newReviewStub(t, "dev", false)
+			stub.status = authv1.TokenReviewStatus{
+				Authenticated: true,
+				Audiences:     []string{"stratus"},
+				User:          authv1.UserInfo{Username: user, Groups: []string{"system:serviceaccounts"}},
+			}
+			// unregistered clusters are looked up in an empty store
+			Clusters.store = mapStore{}
+			id := &Identity{ID: tt.id, Provider: ProviderK8S, Credentials: tt.creds}
+			if got := id.ValidK8S(); got != tt.want {
+				t.Fatalf("ValidK8S() = %v, want %v", got, tt.want)
+			}
+			if tt.want && id.Attributes[AttrK8SNamespace] != "ci" {
+				t.Errorf("attributes = %v", id.Attributes)
+			}
+		})
+	}
+}
+
+func TestLegacyCluster(t *testing.T) {
+	tests := []struct {
+		env  string
+		name string
+		want bool
+	}{
+		{"", "dev", false},
+		{"dev", "dev", true},
+		{"prod, dev ", "dev", true},
+		{"development", "dev", false},
+		{",", "", false},
+	}
+	for _, tt := range tests {
+		setenv(t, "K8S_LEGACY_CLUSTERS", tt.env)
+		if got := legacyCluster(tt.name); got != tt.want {
+			t.Errorf("legacyCluster(%q) with %q = %v, want %v", tt.name, tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestK8SAttributes(t *testing.T) {
+	tests := []struct {
+		name string
+		user authv1.UserInfo
+		want map[string]string
+	}{
+		{
+			name: "bound pod token",
+			user: authv1.UserInfo{
+				Username: "system:serviceaccount:ci:runner",
+				Groups:   []string{"system:serviceaccounts", "system:serviceaccounts:ci"},
+				Extra: map[string]authv1.ExtraValue{
+					"authentication.kubernetes.io/pod-name":  {"runner-7d9f"},
+					"authentication.kubernetes.io/pod-uid":   {"0b1c2d3e"},
+					"authentication.kubernetes.io/node-name": {"node-a"},
+				},
+			},
+			want: map[string]string{
+				AttrK8SNamespace: "ci",
+				AttrK8SGroups:    "system:serviceaccounts system:serviceaccounts:ci",
+				AttrK8SPodName:   "runner-7d9f",
+				AttrK8SPodUID:    "0b1c2d3e",
+				AttrK8SNodeName:  "node-a",
+			},
+		},
+		{
+			name: "legacy token without pod binding",
+			user: authv1.UserInfo{Username: "system:serviceaccount:ci:runner", Groups: []string{"system:serviceaccounts"}},
+			want: map[string]string{AttrK8SNamespace: "ci", AttrK8SGroups: "system:serviceaccounts"},
+		},
+		{
+			name: "empty and unknown extras",
+			user: authv1.UserInfo{
+				Username: "system:serviceaccount:ci:runner",
+				Extra: map[string]authv1.ExtraValue{
+					"authentication.kubernetes.io/pod-name": {},
+					"example.com/team":                      {"ops"},
+				},
+			},
+			want: map[string]string{AttrK8SNamespace: "ci"},
+		},
+		{
+			name: "user account",
+			user: authv1.UserInfo{Username: "alice", Groups: []string{"ops"}},
+			want: map[string]string{AttrK8SGroups: "ops"},
+		},
+		{
+			name: "malformed service account",
+			user: authv1.UserInfo{Username: "system:serviceaccount:ci"},
+			want: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := k8sAttributes(tt.user); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("k8sAttributes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package identity
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/stratus/internal/secretstore"
+	log "github.com/sirupsen/logrus"
+)
+
+// Clusters is the registry of k8s clusters which sources are validated against
+var Clusters = &ClusterRegistry{clusters: make(map[string]*k8sCluster)}
+
+// ClusterStatus reports the state of a registered cluster
+type ClusterStatus struct {
+	Name        string    `json:"name"`
+	Host        string    `json:"host"`
+	Issuer      string    `json:"issuer,omitempty"`
+	Legacy      bool      `json:"legacy"`
+	Healthy     bool      `json:"healthy"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastRefresh time.Time `json:"lastRefresh"`
+}
+
+// k8sCluster holds the validator client of a cluster
+type k8sCluster struct {
+	status ClusterStatus
+	// ca is the decoded CA of the cluster, used to detect when the client must be rebuilt
+	ca     string
+	token  string
+	client *http.Client
+}
+
+// ClusterRegistry holds a validator client for each k8s cluster. Clusters are
+// declared in K8S_CLUSTERS or discovered from vault, and are refreshed
+// periodically. Clusters which are not yet registered are loaded on first use.
+type ClusterRegistry struct {
+	mu       sync.RWMutex
+	clusters map[string]*k8sCluster
+	store    secretstore.Store
+}
+
+// Run registers and refreshes the clusters on each K8S_CLUSTER_REFRESH_INTERVAL,
+// reading their validation secrets from store
+func (r *ClusterRegistry) Run(store secretstore.Store) {
+	l := log.WithFields(log.Fields{
+		"action": "ClusterRegistry.Run",
+	})
+	r.mu.Lock()
+	r.store = store
+	r.mu.Unlock()
+	every, err := time.ParseDuration(os.Getenv("K8S_CLUSTER_REFRESH_INTERVAL"))
+	if err != nil || every <= 0 {
+		every = 5 * time.Minute
+	}
+	for {
+		l.Info("start")
+		names, err := r.names()
+		if err != nil {
+			l.WithError(err).Error("failed to discover clusters")
+		}
+		for _, n := range names {
+			if _, err := r.refresh(n); err != nil {
+				l.WithField("cluster", n).WithError(err).Error("failed to refresh cluster")
+			}
+		}
+		l.WithField("clusters", len(names)).Info("end")
+		time.Sleep(every)
+	}
+}
+
+// secrets returns the secret store of the registry, or the default store
+func (r *ClusterRegistry) secrets() secretstore.Store {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.store != nil {
+		return r.store
+	}
+	return secretstore.Default
+}
+
+// names returns the declared and discovered cluster names, along with the
+// clusters already registered. Clusters are discovered from the secret store
+// when K8S_CLUSTER_DISCOVERY is true, as the keys at the root of the store
+// prefix which contain a validation secret.
+func (r *ClusterRegistry) names() ([]string, error) {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(n string) {
+		if n != "" && !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	for _, n := range strings.Split(os.Getenv("K8S_CLUSTERS"), ",") {
+		add(strings.TrimSpace(n))
+	}
+	r.mu.RLock()
+	for n := range r.clusters {
+		add(n)
+	}
+	r.mu.RUnlock()
+	if os.Getenv("K8S_CLUSTER_DISCOVERY") != "true" {
+		return names, nil
+	}
+	store := r.secrets()
+	if store == nil {
+		return names, errors.New("secret store not initialized")
+	}
+	keys, err := secretstore.List(store, "")
+	if err != nil {
+		return names, err
+	}
+	for _, k := range keys {
+		if !strings.HasSuffix(k, "/") {
+			continue
+		}
+		sub, err := secretstore.List(store, k)
+		if err != nil {
+			continue
+		}
+		for _, s := range sub {
+			if s == "validation" {
+				add(strings.TrimSuffix(k, "/"))
+			}
+		}
+	}
+	return names, nil
+}
+
+// refresh reloads the validation secret of a cluster, rebuilding its client
+// if the CA changed, and checks the health of the cluster API
+func (r *ClusterRegistry) refresh(name string) (*k8sCluster, error) {
+	store := r.secrets()
+	if store == nil {
+		return nil, errors.New("secret store not initialized")
+	}
+	v := &K8SIdentity{ClusterName: name}
+	if err := v.GetValidation(name, store); err != nil {
+		r.setError(name, err)
+		return nil, err
+	}
+	ca, err := base64.StdEncoding.DecodeString(v.ClusterCA)
+	if err != nil {
+		r.setError(name, err)
+		return nil, err
+	}
+	token, err := base64.StdEncoding.DecodeString(v.ValidationToken)
+	if err != nil {
+		r.setError(name, err)
+		return nil, err
+	}
+	r.mu.RLock()
+	prev := r.clusters[name]
+	r.mu.RUnlock()
+	c := &k8sCluster{
+		ca:    string(ca),
+		token: string(token),
+		status: ClusterStatus{
+			Name:        name,
+			Host:        v.ClusterHost,
+			Issuer:      v.Issuer,
+			Legacy:      v.Legacy || legacyCluster(name),
+			LastRefresh: time.Now(),
+		},
+	}
+	if prev != nil && prev.ca == c.ca {
+		// keep the pooled connections of the existing client
+		c.client = prev.client
+	} else {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		c.client = &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig:     &tls.Config{RootCAs: pool},
+				MaxIdleConnsPerHost: 10,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+	if c.status.Issuer == "" {
+		if prev != nil && prev.status.Issuer != "" {
+			c.status.Issuer = prev.status.Issuer
+		} else if iss, err := c.discoverIssuer(); err == nil {
+			c.status.Issuer = iss
+		}
+	}
+	if err := c.checkHealth(); err != nil {
+		c.status.LastError = err.Error()
+	} else {
+		c.status.Healthy = true
+	}
+	r.mu.Lock()
+	r.clusters[name] = c
+	r.mu.Unlock()
+	return c, nil
+}
+
+// setError records a failed refresh of a cluster
+func (r *ClusterRegistry) setError(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.clusters[name]; ok {
+		c.status.Healthy = false
+		c.status.LastError = err.Error()
+	}
+}
+
+// setHealth records the outcome of a request to a cluster
+func (r *ClusterRegistry) setHealth(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.clusters[name]
+	if !ok {
+		return
+	}
+	c.status.Healthy = err == nil
+	c.status.LastError = ""
+	if err != nil {
+		c.status.LastError = err.Error()
+	}
+}
+
+// get returns the registered cluster, loading it from vault if it is not registered
+func (r *ClusterRegistry) get(name string) (*k8sCluster, error) {
+	if name == "" {
+		return nil, errors.New("cluster name required")
+	}
+	r.mu.RLock()
+	c, ok := r.clusters[name]
+	r.mu.RUnlock()
+	if ok {
+		return c, nil
+	}
+	return r.refresh(name)
+}
+
+// byIssuer returns the name of the cluster with the given token issuer. Clusters
+// may share an issuer, such as the default https://kubernetes.default.svc.cluster.local,
+// in which case the cluster is ambiguous and an error is returned.
+func (r *ClusterRegistry) byIssuer(iss string) (string, error) {
+	if iss == "" {
+		return "", errors.New("token has no issuer")
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var names []string
+	for n, c := range r.clusters {
+		if c.status.Issuer == iss {
+			names = append(names, n)
+		}
+	}
+	switch len(names) {
+	case 0:
+		return "", fmt.Errorf("no cluster with issuer %q", iss)
+	case 1:
+		return names[0], nil
+	}
+	sort.Strings(names)
+	return "", fmt.Errorf("issuer %q is shared by clusters %s, clusterName required", iss, strings.Join(names, ", "))
+}
+
+// Status returns the status of each registered cluster
+func (r *ClusterRegistry) Status() []ClusterStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	st := make([]ClusterStatus, 0, len(r.clusters))
+	for _, c := range r.clusters {
+		st = append(st, c.status)
+	}
+	return st
+}
+
+// do sends an authenticated request to the cluster API
+func (c *k8sCluster) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	return c.client.Do(req)
+}
+
+// discoverIssuer returns the service account token issuer of the cluster
+func (c *k8sCluster) discoverIssuer() (string, error) {
+	req, err := http.NewRequest("GET", c.status.Host+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("issuer discovery returned %d", res.StatusCode)
+	}
+	var d struct {
+		Issuer string `json:"issuer"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		return "", err
+	}
+	return d.Issuer, nil
+}
+
+// checkHealth checks the cluster API is ready
+func (c *k8sCluster) checkHealth() error {
+	req, err := http.NewRequest("GET", c.status.Host+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("readyz returned %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package identity
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestByIssuer(t *testing.T) {
+	const shared = "https://kubernetes.default.svc.cluster.local"
+	r := &ClusterRegistry{clusters: map[string]*k8sCluster{
+		"prod-a": {status: ClusterStatus{Name: "prod-a", Issuer: shared}},
+		"prod-b": {status: ClusterStatus{Name: "prod-b", Issuer: shared}},
+		"eks":    {status: ClusterStatus{Name: "eks", Issuer: "https://oidc.eks.us-east-1.amazonaws.com/id/ABC"}},
+		"new":    {status: ClusterStatus{Name: "new"}},
+	}}
+	tests := []struct {
+		iss     string
+		want    string
+		wantErr bool
+	}{
+		{"https://oidc.eks.us-east-1.amazonaws.com/id/ABC", "eks", false},
+		{shared, "", true},
+		{"https://other.example.com", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.iss, func(t *testing.T) {
+			got, err := r.byIssuer(tt.iss)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("byIssuer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("byIssuer() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidK8SAmbiguousIssuer(t *testing.T) {
+	const shared = "https://kubernetes.default.svc.cluster.local"
+	saved := Clusters
+	defer func() { Clusters = saved }()
+	Clusters = &ClusterRegistry{clusters: map[string]*k8sCluster{
+		"prod-a": {status: ClusterStatus{Name: "prod-a", Issuer: shared}},
+		"prod-b": {status: ClusterStatus{Name: "prod-b", Issuer: shared}},
+	}}
+	enc := base64.RawURLEncoding.EncodeToString
+	token := enc([]byte(`{"alg":"RS256"}`)) + "." + enc([]byte(`{"iss":"`+shared+`"}`)) + ".sig"
+	id := &Identity{
+		ID:          "system:serviceaccount:ci:runner",
+		Provider:    ProviderK8S,
+		Credentials: map[string]interface{}{"jwt": token},
+	}
+	if id.ValidK8S() {
+		t.Error("ValidK8S() accepted a token with an ambiguous issuer")
+	}
+}
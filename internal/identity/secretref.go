@@ -0,0 +1,56 @@
+package identity
+
+import (
+	"errors"
+
+	"github.com/robertlestak/stratus/internal/secretstore"
+)
+
+// SecretRef overrides where the credentials of a target are read from
+type SecretRef struct {
+	// Path is the secret path, relative to the store prefix, or to the root
+	// of the store if it starts with "/"
+	Path string `json:"path,omitempty" yaml:"path"`
+	// Version pins the secret version to read. The latest version is read if 0.
+	Version int `json:"version,omitempty" yaml:"version"`
+}
+
+// Validate checks the secret reference is well formed
+func (r *SecretRef) Validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.Version < 0 {
+		return errors.New("secret version must be positive")
+	}
+	return nil
+}
+
+// path returns the override path, or def if none is set
+func (r *SecretRef) path(def string) string {
+	if r == nil || r.Path == "" {
+		return def
+	}
+	return r.Path
+}
+
+// version returns the pinned version, or 0 for the latest version
+func (r *SecretRef) version() int {
+	if r == nil {
+		return 0
+	}
+	return r.Version
+}
+
+// SecretPath returns the path the target's credentials are read from
+func (id *Identity) SecretPath(def string) string {
+	return id.Secret.path(def)
+}
+
+// readSecret reads the target's credentials from the store, at def unless overridden
+func (id *Identity) readSecret(store secretstore.Store, def string) (map[string]interface{}, error) {
+	if store == nil {
+		return nil, errors.New("secret store not initialized")
+	}
+	return store.Get(id.Secret.path(def), id.Secret.version())
+}
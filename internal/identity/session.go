@@ -0,0 +1,253 @@
+package identity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// AWS limits on AssumeRole session parameters
+const (
+	awsMinSessionDuration = 900
+	awsMaxSessionDuration = 43200
+	awsMaxPolicyLength    = 2048
+	awsMaxPolicyArns      = 10
+)
+
+// AWSSession contains the AssumeRole parameters used when a mapping issues
+// an AWS session, allowing the session to be scoped down per source
+type AWSSession struct {
+	// DurationSeconds is the session duration. Defaults to 15 minutes.
+	DurationSeconds int64 `json:"durationSeconds,omitempty" yaml:"durationSeconds"`
+	// Policy is an inline session policy, either as a JSON string or YAML
+	Policy interface{} `json:"policy,omitempty" yaml:"policy"`
+	// PolicyArns are managed policies used as session policies
+	PolicyArns []string `json:"policyArns,omitempty" yaml:"policyArns"`
+	// Tags are static session tags added to every session issued by the mapping
+	Tags map[string]string `json:"tags,omitempty" yaml:"tags"`
+	// TransitiveTags marks the source session tags as transitive, so they
+	// persist when the session is used to assume further roles
+	TransitiveTags bool `json:"transitiveTags,omitempty" yaml:"transitiveTags"`
+
+	// policyJSON is the normalized inline policy, set by Validate
+	policyJSON string
+}
+
+// yamlToJSON converts YAML decoded values into values which can be encoded as JSON
+func yamlToJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprint(k)] = yamlToJSON(v)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = yamlToJSON(t[i])
+		}
+		return t
+	}
+	return v
+}
+
+// Validate checks the session parameters are within AWS limits and
+// normalizes the inline policy to compact JSON
+func (s *AWSSession) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.DurationSeconds != 0 && (s.DurationSeconds < awsMinSessionDuration || s.DurationSeconds > awsMaxSessionDuration) {
+		return fmt.Errorf("durationSeconds must be between %d and %d", awsMinSessionDuration, awsMaxSessionDuration)
+	}
+	if len(s.PolicyArns) > awsMaxPolicyArns {
+		return fmt.Errorf("at most %d policyArns are allowed", awsMaxPolicyArns)
+	}
+	for _, a := range s.PolicyArns {
+		if !strings.HasPrefix(a, "arn:") || !strings.Contains(a, ":policy/") {
+			return fmt.Errorf("invalid policy arn %q", a)
+		}
+	}
+	if err := s.validateTags(); err != nil {
+		return err
+	}
+	s.policyJSON = ""
+	if s.Policy == nil {
+		return nil
+	}
+	var p interface{}
+	if ps, ok := s.Policy.(string); ok {
+		if err := json.Unmarshal([]byte(ps), &p); err != nil {
+			return fmt.Errorf("invalid session policy: %w", err)
+		}
+	} else {
+		p = yamlToJSON(s.Policy)
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return errors.New("session policy must be an object")
+	}
+	jd, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("invalid session policy: %w", err)
+	}
+	if len(jd) > awsMaxPolicyLength {
+		return fmt.Errorf("session policy exceeds %d characters", awsMaxPolicyLength)
+	}
+	s.policyJSON = string(jd)
+	return nil
+}
+
+// apply sets the session parameters on an AssumeRole request
+func (s *AWSSession) apply(in *sts.AssumeRoleInput) {
+	if s == nil {
+		return
+	}
+	if s.DurationSeconds != 0 {
+		in.DurationSeconds = aws.Int64(s.DurationSeconds)
+	}
+	if s.policyJSON != "" {
+		in.Policy = aws.String(s.policyJSON)
+	}
+	for _, a := range s.PolicyArns {
+		in.PolicyArns = append(in.PolicyArns, &sts.PolicyDescriptorType{Arn: aws.String(a)})
+	}
+}
+
+// sessionTagPrefix prefixes the keys of session tags set by stratus
+const sessionTagPrefix = "stratus-"
+
+// awsMaxStaticTags is the number of static tags allowed per mapping, leaving
+// room within the AWS limit of 50 session tags for the source tags
+const awsMaxStaticTags = 40
+
+var (
+	// invalidTagChars matches characters not allowed in session tag keys and values
+	invalidTagChars = regexp.MustCompile(`[^\p{L}\p{Z}\p{N}_.:/=+\-@]`)
+	// invalidSourceIdentityChars matches characters not allowed in a SourceIdentity
+	invalidSourceIdentityChars = regexp.MustCompile(`[^\w+=,.@-]`)
+)
+
+// sourceTagsEnabled returns true if source session tags and SourceIdentity
+// should be set. The target role trust policy must allow sts:TagSession and
+// sts:SetSourceIdentity.
+func sourceTagsEnabled() bool {
+	return os.Getenv("AWS_SESSION_TAGS") == "true"
+}
+
+// truncate shortens s to at most n characters
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// sessionTag returns a session tag with the value sanitized to AWS constraints
+func sessionTag(k, v string) *sts.Tag {
+	return &sts.Tag{
+		Key:   aws.String(k),
+		Value: aws.String(truncate(invalidTagChars.ReplaceAllString(v, "_"), 256)),
+	}
+}
+
+// sourceIdentity returns the source identity ID sanitized to AWS SourceIdentity constraints
+func sourceIdentity(id string) string {
+	si := truncate(invalidSourceIdentityChars.ReplaceAllString(id, "-"), 64)
+	for len(si) < 2 {
+		si += "-"
+	}
+	return si
+}
+
+// validateTags checks static session tags are within AWS limits
+func (s *AWSSession) validateTags() error {
+	if len(s.Tags) > awsMaxStaticTags {
+		return fmt.Errorf("at most %d session tags are allowed", awsMaxStaticTags)
+	}
+	for k, v := range s.Tags {
+		if k == "" || len(k) > 128 || invalidTagChars.MatchString(k) {
+			return fmt.Errorf("invalid session tag key %q", k)
+		}
+		if strings.HasPrefix(strings.ToLower(k), sessionTagPrefix) {
+			return fmt.Errorf("session tag key %q uses reserved prefix %q", k, sessionTagPrefix)
+		}
+		if len(v) > 256 || invalidTagChars.MatchString(v) {
+			return fmt.Errorf("invalid session tag value for %q", k)
+		}
+	}
+	return nil
+}
+
+// sessionTags returns the static tags of the session, sorted by key, and the
+// tags derived from the validated source identity if source tags are enabled
+func (s *AWSSession) sessionTags(src *Identity, requestID string) (static, source []*sts.Tag) {
+	if s != nil {
+		keys := make([]string, 0, len(s.Tags))
+		for k := range s.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			static = append(static, &sts.Tag{Key: aws.String(k), Value: aws.String(s.Tags[k])})
+		}
+	}
+	if src == nil || !sourceTagsEnabled() {
+		return static, nil
+	}
+	source = []*sts.Tag{
+		sessionTag(sessionTagPrefix+"source-provider", string(src.Provider)),
+		sessionTag(sessionTagPrefix+"source-id", src.ID),
+		sessionTag(sessionTagPrefix+"request-id", requestID),
+	}
+	keys := make([]string, 0, len(src.Attributes))
+	for k := range src.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		source = append(source, sessionTag(sessionTagPrefix+k, src.Attributes[k]))
+	}
+	return static, source
+}
+
+// tagSource returns an AssumeRole option which sets the SourceIdentity and
+// session tags from the validated source identity, along with the static tags
+// of the session. With a role chain it is applied to the first hop.
+func (s *AWSSession) tagSource(src *Identity, requestID string) func(*sts.AssumeRoleInput) {
+	return func(in *sts.AssumeRoleInput) {
+		static, source := s.sessionTags(src, requestID)
+		in.Tags = append(in.Tags, static...)
+		if source == nil {
+			return
+		}
+		in.SourceIdentity = aws.String(sourceIdentity(src.ID))
+		in.Tags = append(in.Tags, source...)
+		if s != nil && s.TransitiveTags {
+			for _, t := range source {
+				in.TransitiveTagKeys = append(in.TransitiveTagKeys, t.Key)
+			}
+		}
+	}
+}
+
+// tagChainTarget returns an AssumeRole option which tags the target role
+// assumed from the last hop of a role chain. Transitive tags set on the first
+// hop carry over and AWS rejects them if they are sent again, so only the
+// static tags and the source tags which are not transitive are set. The
+// SourceIdentity also carries over and is not set again.
+func (s *AWSSession) tagChainTarget(src *Identity, requestID string) func(*sts.AssumeRoleInput) {
+	return func(in *sts.AssumeRoleInput) {
+		static, source := s.sessionTags(src, requestID)
+		in.Tags = append(in.Tags, static...)
+		if s == nil || !s.TransitiveTags {
+			in.Tags = append(in.Tags, source...)
+		}
+	}
+}
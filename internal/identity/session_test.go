@@ -0,0 +1,297 @@
+package identity
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestAWSSessionValidate(t *testing.T) {
+	arns := func(n int) []string {
+		var a []string
+		for i := 0; i < n; i++ {
+			a = append(a, "arn:aws:iam::aws:policy/ReadOnlyAccess")
+		}
+		return a
+	}
+	tests := []struct {
+		name       string
+		session    *AWSSession
+		wantPolicy string
+		wantErr    string
+	}{
+		{name: "nil session"},
+		{name: "empty session", session: &AWSSession{}},
+		{name: "minimum duration", session: &AWSSession{DurationSeconds: 900}},
+		{name: "maximum duration", session: &AWSSession{DurationSeconds: 43200}},
+		{name: "duration too short", session: &AWSSession{DurationSeconds: 899}, wantErr: "durationSeconds must be between 900 and 43200"},
+		{name: "duration too long", session: &AWSSession{DurationSeconds: 43201}, wantErr: "durationSeconds must be between 900 and 43200"},
+		{name: "negative duration", session: &AWSSession{DurationSeconds: -1}, wantErr: "durationSeconds"},
+		{name: "policy arns", session: &AWSSession{PolicyArns: arns(10)}},
+		{name: "too many policy arns", session: &AWSSession{PolicyArns: arns(11)}, wantErr: "at most 10 policyArns"},
+		{name: "invalid policy arn", session: &AWSSession{PolicyArns: []string{"arn:aws:iam::aws:role/x"}}, wantErr: "invalid policy arn"},
+		{
+			name:       "json policy",
+			session:    &AWSSession{Policy: `{ "Version": "2012-10-17", "Statement": [] }`},
+			wantPolicy: `{"Statement":[],"Version":"2012-10-17"}`,
+		},
+		{name: "invalid json policy", session: &AWSSession{Policy: `{"Version":`}, wantErr: "invalid session policy"},
+		{name: "policy not an object", session: &AWSSession{Policy: `["s3:GetObject"]`}, wantErr: "session policy must be an object"},
+		{
+			name:    "policy too long",
+			session: &AWSSession{Policy: `{"Sid":"` + strings.Repeat("a", 2048) + `"}`},
+			wantErr: "session policy exceeds 2048 characters",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.session.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if tt.session != nil && tt.session.policyJSON != tt.wantPolicy {
+				t.Errorf("policy = %s, want %s", tt.session.policyJSON, tt.wantPolicy)
+			}
+		})
+	}
+}
+
+func TestAWSSessionYAMLPolicy(t *testing.T) {
+	var s AWSSession
+	in := `
+durationSeconds: 1800
+policy:
+  Version: "2012-10-17"
+  Statement:
+  - Effect: Allow
+    Action: ["s3:GetObject"]
+    Resource: "*"
+`
+	if err := yaml.Unmarshal([]byte(in), &s); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	want := `{"Statement":[{"Action":["s3:GetObject"],"Effect":"Allow","Resource":"*"}],"Version":"2012-10-17"}`
+	if s.policyJSON != want {
+		t.Errorf("policy = %s, want %s", s.policyJSON, want)
+	}
+	// a policy removed on reload is not kept from the previous validation
+	s.Policy = nil
+	if err := s.Validate(); err != nil || s.policyJSON != "" {
+		t.Errorf("Validate() without policy = %v, policy %q", err, s.policyJSON)
+	}
+}
+
+func TestAWSSessionApply(t *testing.T) {
+	tests := []struct {
+		name         string
+		session      *AWSSession
+		wantDuration int64
+		wantPolicy   string
+		wantArns     int
+	}{
+		{name: "nil session keeps the default duration", wantDuration: 900},
+		{name: "unset duration keeps the default", session: &AWSSession{}, wantDuration: 900},
+		{name: "duration", session: &AWSSession{DurationSeconds: 3600}, wantDuration: 3600},
+		{
+			name:         "policy and arns",
+			session:      &AWSSession{Policy: `{"Version":"2012-10-17"}`, PolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}},
+			wantDuration: 900,
+			wantPolicy:   `{"Version":"2012-10-17"}`,
+			wantArns:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.session.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			in := &sts.AssumeRoleInput{DurationSeconds: aws.Int64(900)}
+			tt.session.apply(in)
+			if got := aws.Int64Value(in.DurationSeconds); got != tt.wantDuration {
+				t.Errorf("DurationSeconds = %d, want %d", got, tt.wantDuration)
+			}
+			if got := aws.StringValue(in.Policy); got != tt.wantPolicy {
+				t.Errorf("Policy = %s, want %s", got, tt.wantPolicy)
+			}
+			if len(in.PolicyArns) != tt.wantArns {
+				t.Errorf("PolicyArns = %v, want %d", in.PolicyArns, tt.wantArns)
+			}
+		})
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	many := map[string]string{}
+	for i := 0; i < 41; i++ {
+		many[fmt.Sprintf("tag%d", i)] = "v"
+	}
+	tests := []struct {
+		name    string
+		tags    map[string]string
+		wantErr string
+	}{
+		{name: "none"},
+		{name: "valid", tags: map[string]string{"team": "platform", "cost-center": "a1:b2/c_3=d+e@f.g"}},
+		{name: "too many", tags: many, wantErr: "at most 40 session tags"},
+		{name: "empty key", tags: map[string]string{"": "v"}, wantErr: "invalid session tag key"},
+		{name: "long key", tags: map[string]string{strings.Repeat("k", 129): "v"}, wantErr: "invalid session tag key"},
+		{name: "invalid key", tags: map[string]string{"team!": "v"}, wantErr: "invalid session tag key"},
+		{name: "reserved prefix", tags: map[string]string{"Stratus-Team": "v"}, wantErr: "reserved prefix"},
+		{name: "long value", tags: map[string]string{"team": strings.Repeat("v", 257)}, wantErr: "invalid session tag value"},
+		{name: "invalid value", tags: map[string]string{"team": "a;b"}, wantErr: "invalid session tag value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&AWSSession{Tags: tt.tags}).Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSessionTagSanitized(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"system:serviceaccount:default:ci", "system:serviceaccount:default:ci"},
+		{"a;b,c*d", "a_b_c_d"},
+		{strings.Repeat("v", 300), strings.Repeat("v", 256)},
+	}
+	for _, tt := range tests {
+		if got := aws.StringValue(sessionTag("k", tt.value).Value); got != tt.want {
+			t.Errorf("sessionTag(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSourceIdentity(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"arn:aws:iam::123456789012:role/ci", "arn-aws-iam--123456789012-role-ci"},
+		{"sa@stratus-test.iam.gserviceaccount.com", "sa@stratus-test.iam.gserviceaccount.com"},
+		{"a", "a-"},
+		{"", "--"},
+		{strings.Repeat("a", 70), strings.Repeat("a", 64)},
+	}
+	for _, tt := range tests {
+		if got := sourceIdentity(tt.id); got != tt.want {
+			t.Errorf("sourceIdentity(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestSessionTags(t *testing.T) {
+	src := &Identity{
+		ID:         "arn:aws:iam::123456789012:role/ci",
+		Provider:   ProviderAWS,
+		Attributes: map[string]string{"account": "123456789012", "arn": "arn:aws:iam::123456789012:role/ci"},
+	}
+	s := &AWSSession{Tags: map[string]string{"team": "platform", "env": "dev"}}
+	tests := []struct {
+		name           string
+		session        *AWSSession
+		enabled        bool
+		transitive     bool
+		target         bool
+		wantTags       []string
+		wantTransitive []string
+		wantSourceID   string
+	}{
+		{name: "nil session disabled"},
+		{name: "static tags sorted", session: s, wantTags: []string{"env=dev", "team=platform"}},
+		{
+			name:    "source tags",
+			session: s,
+			enabled: true,
+			wantTags: []string{
+				"env=dev", "team=platform",
+				"stratus-source-provider=aws", "stratus-source-id=arn:aws:iam::123456789012:role/ci", "stratus-request-id=req-1",
+				"stratus-account=123456789012", "stratus-arn=arn:aws:iam::123456789012:role/ci",
+			},
+			wantSourceID: "arn-aws-iam--123456789012-role-ci",
+		},
+		{
+			name:    "source tags without session",
+			enabled: true,
+			wantTags: []string{
+				"stratus-source-provider=aws", "stratus-source-id=arn:aws:iam::123456789012:role/ci", "stratus-request-id=req-1",
+				"stratus-account=123456789012", "stratus-arn=arn:aws:iam::123456789012:role/ci",
+			},
+			wantSourceID: "arn-aws-iam--123456789012-role-ci",
+		},
+		{
+			name:    "transitive source tags",
+			session: &AWSSession{TransitiveTags: true},
+			enabled: true,
+			wantTags: []string{
+				"stratus-source-provider=aws", "stratus-source-id=arn:aws:iam::123456789012:role/ci", "stratus-request-id=req-1",
+				"stratus-account=123456789012", "stratus-arn=arn:aws:iam::123456789012:role/ci",
+			},
+			wantTransitive: []string{"stratus-source-provider", "stratus-source-id", "stratus-request-id", "stratus-account", "stratus-arn"},
+			wantSourceID:   "arn-aws-iam--123456789012-role-ci",
+		},
+		{
+			name:    "chain target",
+			session: s,
+			enabled: true,
+			target:  true,
+			wantTags: []string{
+				"env=dev", "team=platform",
+				"stratus-source-provider=aws", "stratus-source-id=arn:aws:iam::123456789012:role/ci", "stratus-request-id=req-1",
+				"stratus-account=123456789012", "stratus-arn=arn:aws:iam::123456789012:role/ci",
+			},
+		},
+		{
+			name:     "chain target with transitive tags",
+			session:  &AWSSession{Tags: map[string]string{"team": "platform"}, TransitiveTags: true},
+			enabled:  true,
+			target:   true,
+			wantTags: []string{"team=platform"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "AWS_SESSION_TAGS", fmt.Sprint(tt.enabled))
+			opt := tt.session.tagSource(src, "req-1")
+			if tt.target {
+				opt = tt.session.tagChainTarget(src, "req-1")
+			}
+			var in sts.AssumeRoleInput
+			opt(&in)
+			var got []string
+			for _, tag := range in.Tags {
+				got = append(got, aws.StringValue(tag.Key)+"="+aws.StringValue(tag.Value))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.wantTags, ",") {
+				t.Errorf("tags = %v, want %v", got, tt.wantTags)
+			}
+			var transitive []string
+			for _, k := range in.TransitiveTagKeys {
+				transitive = append(transitive, aws.StringValue(k))
+			}
+			if strings.Join(transitive, ",") != strings.Join(tt.wantTransitive, ",") {
+				t.Errorf("transitive tags = %v, want %v", transitive, tt.wantTransitive)
+			}
+			if got := aws.StringValue(in.SourceIdentity); got != tt.wantSourceID {
+				t.Errorf("SourceIdentity = %q, want %q", got, tt.wantSourceID)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package identity
+
+// mapKey indexes an IAMMap by its source provider and source ID
+type mapKey struct {
+	Provider ProviderName
+	ID       string
+}
+
+// MapTable is an immutable, indexed set of IAMMaps. Once built with NewMapTable
+// it is never modified, so it can be shared between goroutines and swapped out
+// wholesale when the configuration is reloaded.
+type MapTable struct {
+	maps  []IAMMap
+	index map[mapKey][]int
+}
+
+// NewMapTable builds an indexed table from the given IAMMaps
+func NewMapTable(maps []IAMMap) *MapTable {
+	t := &MapTable{
+		maps:  make([]IAMMap, len(maps)),
+		index: make(map[mapKey][]int, len(maps)),
+	}
+	for i, m := range maps {
+		t.maps[i] = m.copy()
+		k := mapKey{Provider: m.Source.Provider, ID: sourceKey(&m.Source)}
+		t.index[k] = append(t.index[k], i)
+	}
+	return t
+}
+
+// Len returns the number of IAMMaps in the table
+func (t *MapTable) Len() int {
+	if t == nil {
+		return 0
+	}
+	return len(t.maps)
+}
+
+// Targets returns the distinct target identities of the given provider, one
+// for each secret path of a target. If a target and secret path are used by
+// several mappings, the first mapping's settings are used.
+func (t *MapTable) Targets(p ProviderName) []Identity {
+	if t == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var ids []Identity
+	for _, m := range t.maps {
+		if m.Target.Provider != p {
+			continue
+		}
+		k := m.Target.ID + "\x00" + m.Target.SecretPath(m.Target.ID)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		ids = append(ids, m.copy().Target)
+	}
+	return ids
+}
+
+// sourceKey returns the index key of a configured source identity
+func sourceKey(id *Identity) string {
+	if id.Provider == ProviderAWS {
+		return awsSourceKey(id.ID)
+	}
+	return id.ID
+}
+
+// callerKeys returns the index keys which match a validated source identity
+func callerKeys(id *Identity) []string {
+	if id.Provider == ProviderAWS {
+		return awsCallerKeys(id)
+	}
+	return []string{id.ID}
+}
+
+// Lookup returns copies of the IAMMaps which may match the given validated
+// source identity, most specific first
+func (t *MapTable) Lookup(src *Identity) []IAMMap {
+	if t == nil {
+		return nil
+	}
+	var ms []IAMMap
+	for _, k := range callerKeys(src) {
+		for _, i := range t.index[mapKey{Provider: src.Provider, ID: k}] {
+			ms = append(ms, t.maps[i].copy())
+		}
+	}
+	return ms
+}
+
+// copy returns a deep copy of the IAMMap which shares no maps, slices or
+// settings with the original, so callers can freely modify the result
+func (im IAMMap) copy() IAMMap {
+	im.Source = im.Source.copy()
+	im.Target = im.Target.copy()
+	im.Conditions = im.Conditions.copy()
+	im.Session = im.Session.copy()
+	return im
+}
+
+// copy returns a deep copy of the identity
+func (id Identity) copy() Identity {
+	id.Credentials = copyCredentials(id.Credentials)
+	if id.AWS != nil {
+		aws := *id.AWS
+		aws.Chain = copyStrings(aws.Chain)
+		id.AWS = &aws
+	}
+	if id.GCP != nil {
+		gcp := *id.GCP
+		if gcp.Rotation != nil {
+			r := *gcp.Rotation
+			gcp.Rotation = &r
+		}
+		id.GCP = &gcp
+	}
+	if id.Secret != nil {
+		secret := *id.Secret
+		id.Secret = &secret
+	}
+	if id.Attributes != nil {
+		attrs := make(map[string]string, len(id.Attributes))
+		for k, v := range id.Attributes {
+			attrs[k] = v
+		}
+		id.Attributes = attrs
+	}
+	return id
+}
+
+// copy returns a deep copy of the conditions
+func (c *Conditions) copy() *Conditions {
+	if c == nil {
+		return nil
+	}
+	nc := *c
+	if c.NotBefore != nil {
+		t := *c.NotBefore
+		nc.NotBefore = &t
+	}
+	if c.NotAfter != nil {
+		t := *c.NotAfter
+		nc.NotAfter = &t
+	}
+	nc.Groups = copyStrings(c.Groups)
+	nc.PodNamePrefixes = copyStrings(c.PodNamePrefixes)
+	nc.NodeNames = copyStrings(c.NodeNames)
+	return &nc
+}
+
+// copy returns a deep copy of the session parameters
+func (s *AWSSession) copy() *AWSSession {
+	if s == nil {
+		return nil
+	}
+	ns := *s
+	ns.Policy = copyValue(s.Policy)
+	ns.PolicyArns = copyStrings(s.PolicyArns)
+	if s.Tags != nil {
+		ns.Tags = make(map[string]string, len(s.Tags))
+		for k, v := range s.Tags {
+			ns.Tags[k] = v
+		}
+	}
+	return &ns
+}
+
+// copyStrings returns a copy of a string slice
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+// copyCredentials returns a copy of a credentials map, including any nested
+// maps and slices
+func copyCredentials(c map[string]interface{}) map[string]interface{} {
+	if c == nil {
+		return nil
+	}
+	nc := make(map[string]interface{}, len(c))
+	for k, v := range c {
+		nc[k] = copyValue(v)
+	}
+	return nc
+}
+
+// copyValue returns a copy of a decoded JSON or YAML value, copying maps and
+// slices recursively
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return copyCredentials(t)
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(t))
+		for k, v := range t {
+			m[k] = copyValue(v)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i := range t {
+			s[i] = copyValue(t[i])
+		}
+		return s
+	}
+	return v
+}
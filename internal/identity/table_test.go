@@ -0,0 +1,204 @@
+package identity
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTargets(t *testing.T) {
+	const sa = "sa@stratus-test.iam.gserviceaccount.com"
+	src := Identity{ID: "arn:aws:iam::123456789012:role/ci", Provider: ProviderAWS}
+	gcp := func(id, path string) IAMMap {
+		m := IAMMap{Source: src, Target: Identity{ID: id, Provider: ProviderGCP}}
+		if path != "" {
+			m.Target.Secret = &SecretRef{Path: path}
+		}
+		return m
+	}
+	tbl := NewMapTable([]IAMMap{
+		gcp(sa, ""),
+		gcp(sa, "ci/sa"),
+		gcp(sa, ""),
+		gcp(sa, sa),
+		gcp("other@stratus-test.iam.gserviceaccount.com", "ci/sa"),
+		{Source: src, Target: Identity{ID: "arn:aws:iam::123456789012:role/stratus", Provider: ProviderAWS}},
+	})
+	var got []string
+	for _, id := range tbl.Targets(ProviderGCP) {
+		got = append(got, id.ID+"="+id.SecretPath(id.ID))
+	}
+	want := []string{
+		sa + "=" + sa,
+		sa + "=ci/sa",
+		"other@stratus-test.iam.gserviceaccount.com=ci/sa",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Targets() = %v, want %v", got, want)
+	}
+	if got := (*MapTable)(nil).Targets(ProviderGCP); got != nil {
+		t.Errorf("Targets() of a nil table = %v", got)
+	}
+}
+
+func TestSourceKey(t *testing.T) {
+	setenv(t, "AWS_REGION", "")
+	tests := []struct {
+		id   Identity
+		want string
+	}{
+		{Identity{ID: "arn:aws:iam::111111111111:role/ci", Provider: ProviderAWS}, "role:aws:111111111111:ci"},
+		{Identity{ID: "111111111111", Provider: ProviderAWS}, "account:aws:111111111111"},
+		{Identity{ID: "sa@stratus-test.iam.gserviceaccount.com", Provider: ProviderGCP}, "sa@stratus-test.iam.gserviceaccount.com"},
+		{Identity{ID: "111111111111", Provider: ProviderGCP}, "111111111111"},
+		{Identity{ID: "system:serviceaccount:default:ci", Provider: ProviderK8S}, "system:serviceaccount:default:ci"},
+	}
+	for _, tt := range tests {
+		if got := sourceKey(&tt.id); got != tt.want {
+			t.Errorf("sourceKey(%s %s) = %q, want %q", tt.id.Provider, tt.id.ID, got, tt.want)
+		}
+	}
+}
+
+func TestMapTableLookup(t *testing.T) {
+	setenv(t, "AWS_REGION", "")
+	mapping := func(p ProviderName, src, target string) IAMMap {
+		return IAMMap{
+			Source: Identity{ID: src, Provider: p},
+			Target: Identity{ID: target, Provider: ProviderGCP},
+		}
+	}
+	tbl := NewMapTable([]IAMMap{
+		mapping(ProviderAWS, "111111111111", "account"),
+		mapping(ProviderAWS, "arn:aws:iam::111111111111:role/ci", "role"),
+		mapping(ProviderAWS, "arn:aws:sts::111111111111:assumed-role/ci/build", "session"),
+		mapping(ProviderAWS, "arn:aws:iam::111111111111:role/ci", "role-2"),
+		mapping(ProviderAWS, "arn:aws-us-gov:iam::111111111111:root", "gov-account"),
+		mapping(ProviderGCP, "sa@stratus-test.iam.gserviceaccount.com", "gcp"),
+		mapping(ProviderK8S, "system:serviceaccount:default:ci", "k8s"),
+	})
+	if tbl.Len() != 7 {
+		t.Errorf("Len() = %d, want 7", tbl.Len())
+	}
+	aws := func(arn string) *Identity {
+		return &Identity{ID: arn, Provider: ProviderAWS, Attributes: map[string]string{AttrAWSArn: arn}}
+	}
+	tests := []struct {
+		name   string
+		caller *Identity
+		want   []string
+	}{
+		{"role session, most specific first", aws("arn:aws:sts::111111111111:assumed-role/ci/build"), []string{"session", "role", "role-2", "account"}},
+		{"other session of the role", aws("arn:aws:sts::111111111111:assumed-role/ci/deploy"), []string{"role", "role-2", "account"}},
+		{"other role of the account", aws("arn:aws:sts::111111111111:assumed-role/ops/s"), []string{"account"}},
+		{"user of the account", aws("arn:aws:iam::111111111111:user/alice"), []string{"account"}},
+		{"same account in another partition", aws("arn:aws-us-gov:iam::111111111111:user/alice"), []string{"gov-account"}},
+		{"other account", aws("arn:aws:sts::222222222222:assumed-role/ci/build"), nil},
+		{"aws caller without verified arn", &Identity{ID: "arn:aws:iam::111111111111:role/ci", Provider: ProviderAWS}, nil},
+		{"gcp", &Identity{ID: "sa@stratus-test.iam.gserviceaccount.com", Provider: ProviderGCP}, []string{"gcp"}},
+		{"gcp id under another provider", &Identity{ID: "sa@stratus-test.iam.gserviceaccount.com", Provider: ProviderK8S}, nil},
+		{"k8s", &Identity{ID: "system:serviceaccount:default:ci", Provider: ProviderK8S}, []string{"k8s"}},
+		{"k8s other namespace", &Identity{ID: "system:serviceaccount:dev:ci", Provider: ProviderK8S}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, m := range tbl.Lookup(tt.caller) {
+				got = append(got, m.Target.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lookup() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	var nilTable *MapTable
+	if nilTable.Len() != 0 || nilTable.Lookup(aws("arn:aws:iam::111111111111:user/alice")) != nil {
+		t.Error("nil table is not empty")
+	}
+}
+
+// testMapping returns a mapping with every optional setting populated
+func testMapping() IAMMap {
+	notAfter := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	return IAMMap{
+		Source: Identity{
+			ID:          "system:serviceaccount:default:ci",
+			Provider:    ProviderK8S,
+			Credentials: map[string]interface{}{"clusterName": "dev", "extra": map[string]interface{}{"k": "v"}},
+		},
+		Target: Identity{
+			ID:          "arn:aws:iam::123456789012:role/stratus",
+			Provider:    ProviderAWS,
+			Credentials: map[string]interface{}{"list": []interface{}{"a"}},
+			AWS:         &AWSTarget{ExternalID: "ext-id", Chain: []string{"arn:aws:iam::123456789012:role/hop"}},
+			GCP:         &GCPTarget{Rotation: &KeyRotation{Interval: "24h"}},
+			Secret:      &SecretRef{Path: "ci/sa", Version: 2},
+			Attributes:  map[string]string{AttrK8SNamespace: "default"},
+		},
+		Conditions: &Conditions{
+			NotAfter:        &notAfter,
+			Groups:          []string{"system:serviceaccounts"},
+			PodNamePrefixes: []string{"ci-"},
+			NodeNames:       []string{"node-a"},
+		},
+		Session: &AWSSession{
+			Policy:     map[interface{}]interface{}{"Statement": []interface{}{map[interface{}]interface{}{"Effect": "Allow"}}},
+			PolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+			Tags:       map[string]string{"team": "ci"},
+		},
+	}
+}
+
+// mutateMapping changes every nested setting of the mapping in place
+func mutateMapping(m IAMMap) {
+	m.Source.Credentials["clusterName"] = "prod"
+	m.Source.Credentials["extra"].(map[string]interface{})["k"] = "changed"
+	m.Target.Credentials["list"].([]interface{})[0] = "changed"
+	m.Target.AWS.ExternalID = "changed"
+	m.Target.AWS.Chain[0] = "changed"
+	m.Target.GCP.Rotation.Interval = "1h"
+	m.Target.Secret.Path = "changed"
+	m.Target.Attributes[AttrK8SNamespace] = "changed"
+	*m.Conditions.NotAfter = time.Time{}
+	m.Conditions.Groups[0] = "changed"
+	m.Conditions.PodNamePrefixes[0] = "changed"
+	m.Conditions.NodeNames[0] = "changed"
+	m.Session.Policy.(map[interface{}]interface{})["Statement"].([]interface{})[0].(map[interface{}]interface{})["Effect"] = "Deny"
+	m.Session.PolicyArns[0] = "changed"
+	m.Session.Tags["team"] = "changed"
+}
+
+func TestMapTableCopiesMaps(t *testing.T) {
+	src := &Identity{ID: "system:serviceaccount:default:ci", Provider: ProviderK8S}
+	tests := []struct {
+		name   string
+		mutate func(maps []IAMMap, tbl *MapTable)
+	}{
+		{"input changed after building", func(maps []IAMMap, tbl *MapTable) {
+			maps[0].Target.ID = "changed"
+			mutateMapping(maps[0])
+		}},
+		{"lookup result changed", func(maps []IAMMap, tbl *MapTable) {
+			ms := tbl.Lookup(src)
+			ms[0].Target.ID = "changed"
+			mutateMapping(ms[0])
+		}},
+		{"target changed", func(maps []IAMMap, tbl *MapTable) {
+			ids := tbl.Targets(ProviderAWS)
+			ids[0].AWS.Chain[0] = "changed"
+			ids[0].Secret.Path = "changed"
+			ids[0].Credentials["list"].([]interface{})[0] = "changed"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maps := []IAMMap{testMapping()}
+			tbl := NewMapTable(maps)
+			tt.mutate(maps, tbl)
+			ms := tbl.Lookup(src)
+			if len(ms) != 1 || !reflect.DeepEqual(ms[0], testMapping()) {
+				t.Errorf("Lookup() after change = %+v", ms)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"strings"
+)
+
+// header is the JOSE header of a JWT
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// encodeSegment base64url encodes a JWT segment without padding
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// SignRS256 returns a compact RS256 signed JWT for the given claims
+func SignRS256(claims interface{}, key *rsa.PrivateKey, kid string) (string, error) {
+	hd, err := json.Marshal(header{Alg: "RS256", Typ: "JWT", Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	cd, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signing := encodeSegment(hd) + "." + encodeSegment(cd)
+	h := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return signing + "." + encodeSegment(sig), nil
+}
+
+// ParseRSAPrivateKey parses a PEM encoded PKCS1 or PKCS8 RSA private key
+func ParseRSAPrivateKey(pd []byte) (*rsa.PrivateKey, error) {
+	b, _ := pem.Decode(pd)
+	if b == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(b.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not RSA")
+	}
+	return rk, nil
+}
+
+// ParseUnverified decodes the claims of a compact JWT into claims without
+// verifying its signature. The claims must not be trusted unless the token
+// is verified by other means.
+func ParseUnverified(token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed jwt")
+	}
+	cd, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(cd, claims)
+}
+
+// parseHeader decodes the JOSE header of a compact JWT
+func parseHeader(token string) (header, []string, error) {
+	var hd header
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return hd, nil, errors.New("malformed jwt")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil {
+		return hd, nil, err
+	}
+	if err := json.Unmarshal(b, &hd); err != nil {
+		return hd, nil, err
+	}
+	return hd, parts, nil
+}
+
+// KeyID returns the kid header of a compact JWT without verifying it
+func KeyID(token string) (string, error) {
+	hd, _, err := parseHeader(token)
+	if err != nil {
+		return "", err
+	}
+	return hd.Kid, nil
+}
+
+// VerifyRS256 verifies the RS256 signature of a compact JWT with key and
+// decodes its claims into claims. Registered claims such as exp are not
+// checked and must be validated by the caller.
+func VerifyRS256(token string, key *rsa.PublicKey, claims interface{}) error {
+	hd, parts, err := parseHeader(token)
+	if err != nil {
+		return err
+	}
+	if hd.Alg != "RS256" {
+		return errors.New("unsupported jwt alg " + hd.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig); err != nil {
+		return errors.New("invalid jwt signature")
+	}
+	return ParseUnverified(token, claims)
+}
@@ -0,0 +1,117 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+type testClaims struct {
+	Iss   string `json:"iss"`
+	Nonce string `json:"nonce"`
+}
+
+func newKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestVerifyRS256(t *testing.T) {
+	key, other := newKey(t), newKey(t)
+	token, err := SignRS256(testClaims{Iss: "sa@example.iam.gserviceaccount.com", Nonce: "n"}, key, "kid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"admin@example.iam.gserviceaccount.com","nonce":"n"}`))
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	tests := []struct {
+		name    string
+		token   string
+		key     *rsa.PublicKey
+		wantErr bool
+	}{
+		{"valid", token, &key.PublicKey, false},
+		{"other key", token, &other.PublicKey, true},
+		{"tampered claims", parts[0] + "." + forged + "." + parts[2], &key.PublicKey, true},
+		{"alg none", none + "." + parts[1] + ".", &key.PublicKey, true},
+		{"missing signature", parts[0] + "." + parts[1], &key.PublicKey, true},
+		{"bad encoding", parts[0] + "." + parts[1] + ".!", &key.PublicKey, true},
+		{"empty", "", &key.PublicKey, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c testClaims
+			err := VerifyRS256(tt.token, tt.key, &c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyRS256() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (c.Iss != "sa@example.iam.gserviceaccount.com" || c.Nonce != "n") {
+				t.Errorf("claims = %+v", c)
+			}
+		})
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	key := newKey(t)
+	for _, kid := range []string{"kid1", ""} {
+		token, err := SignRS256(testClaims{}, key, kid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := KeyID(token); err != nil || got != kid {
+			t.Errorf("KeyID() = %q, %v, want %q", got, err, kid)
+		}
+	}
+	if _, err := KeyID("a.b"); err == nil {
+		t.Error("KeyID() accepted a malformed token")
+	}
+}
+
+func TestParseRSAPrivateKey(t *testing.T) {
+	key := newKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		pem     []byte
+		wantErr bool
+	}{
+		{"pkcs1", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), false},
+		{"pkcs8", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), false},
+		{"ecdsa", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecPKCS8}), true},
+		{"not pem", []byte("key"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRSAPrivateKey(tt.pem)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRSAPrivateKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !got.Equal(key) {
+				t.Error("ParseRSAPrivateKey() returned another key")
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package rotator
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// defaultLeaseName is the Lease used to elect the rotator in-cluster
+	defaultLeaseName = "stratus-key-rotator"
+
+	inClusterTokenPath     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAPath        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	inClusterNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// leaseLock elects a single rotator among the stratus replicas with a
+// Kubernetes Lease. The holder renews the lease on every check, and another
+// replica takes it over once it has not been renewed for its duration.
+type leaseLock struct {
+	host      string
+	token     string
+	client    *http.Client
+	namespace string
+	name      string
+	// holder identifies this replica
+	holder string
+	// duration is how long the lease is held without being renewed
+	duration time.Duration
+}
+
+// newLeaseLock returns the lease lock selected by GCP_KEY_ROTATION_LEASE, as
+// <namespace>/<name> or <name> in the pod namespace. In-cluster the lease
+// defaults to stratus-key-rotator, and "none" disables the lock, in which
+// case nil is returned and rotation must be enabled on a single replica only.
+func newLeaseLock(duration time.Duration) (*leaseLock, error) {
+	v := os.Getenv("GCP_KEY_ROTATION_LEASE")
+	inCluster := os.Getenv("KUBERNETES_SERVICE_HOST") != ""
+	if v == "none" || (v == "" && !inCluster) {
+		return nil, nil
+	}
+	if !inCluster {
+		return nil, errors.New("GCP_KEY_ROTATION_LEASE requires running in kubernetes")
+	}
+	if v == "" {
+		v = defaultLeaseName
+	}
+	ll := &leaseLock{
+		host:     "https://" + os.Getenv("KUBERNETES_SERVICE_HOST") + ":" + os.Getenv("KUBERNETES_SERVICE_PORT"),
+		name:     v,
+		duration: duration,
+	}
+	if i := strings.Index(v, "/"); i >= 0 {
+		ll.namespace, ll.name = v[:i], v[i+1:]
+	}
+	if ll.namespace == "" {
+		ll.namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if ll.namespace == "" {
+		ns, err := ioutil.ReadFile(inClusterNamespacePath)
+		if err != nil {
+			return nil, err
+		}
+		ll.namespace = strings.TrimSpace(string(ns))
+	}
+	if ll.namespace == "" || ll.name == "" {
+		return nil, fmt.Errorf("invalid GCP_KEY_ROTATION_LEASE %q", v)
+	}
+	ll.holder = os.Getenv("POD_NAME")
+	if ll.holder == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		ll.holder = h
+	}
+	td, err := ioutil.ReadFile(inClusterTokenPath)
+	if err != nil {
+		return nil, err
+	}
+	ll.token = strings.TrimSpace(string(td))
+	ca, err := ioutil.ReadFile(inClusterCAPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	ll.client = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: pool,
+			},
+		},
+	}
+	return ll, nil
+}
+
+// leasesPath returns the API path of the Lease collection
+func (ll *leaseLock) leasesPath() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + ll.namespace + "/leases"
+}
+
+// do sends an authenticated request to the API server, decoding the response
+// into out if the request succeeds. It returns the response status.
+func (ll *leaseLock) do(method, path string, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, ll.host+path, body)
+	if err != nil {
+		return 0, err
+	}
+	if ll.token != "" {
+		req.Header.Set("Authorization", "Bearer "+ll.token)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := ll.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		if out == nil {
+			return res.StatusCode, nil
+		}
+		return res.StatusCode, json.NewDecoder(res.Body).Decode(out)
+	case http.StatusNotFound, http.StatusConflict:
+		return res.StatusCode, nil
+	default:
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return res.StatusCode, fmt.Errorf("%s %s returned %d: %s", method, path, res.StatusCode, b)
+	}
+}
+
+// acquire takes or renews the lease, returning true if this replica holds it.
+// Updates carry the resource version read, so only one of several replicas
+// racing for an expired lease succeeds.
+func (ll *leaseLock) acquire() (bool, error) {
+	now := metav1.NewMicroTime(time.Now())
+	secs := int32(ll.duration / time.Second)
+	var lease coordinationv1.Lease
+	code, err := ll.do(http.MethodGet, ll.leasesPath()+"/"+ll.name, nil, &lease)
+	if err != nil {
+		return false, err
+	}
+	if code == http.StatusNotFound {
+		lease = coordinationv1.Lease{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"},
+			ObjectMeta: metav1.ObjectMeta{Name: ll.name, Namespace: ll.namespace},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &ll.holder,
+				LeaseDurationSeconds: &secs,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		code, err = ll.do(http.MethodPost, ll.leasesPath(), &lease, nil)
+		return code == http.StatusCreated || code == http.StatusOK, err
+	}
+	held := lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == ll.holder
+	if !held && !ll.expired(&lease) {
+		return false, nil
+	}
+	if !held {
+		var transitions int32
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions
+		}
+		transitions++
+		lease.Spec.HolderIdentity = &ll.holder
+		lease.Spec.AcquireTime = &now
+		lease.Spec.LeaseTransitions = &transitions
+	}
+	lease.Spec.LeaseDurationSeconds = &secs
+	lease.Spec.RenewTime = &now
+	code, err = ll.do(http.MethodPut, ll.leasesPath()+"/"+ll.name, &lease, nil)
+	return code == http.StatusOK, err
+}
+
+// expired returns true if the lease has not been renewed within its duration
+func (ll *leaseLock) expired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" || lease.Spec.RenewTime == nil {
+		return true
+	}
+	d := ll.duration
+	if lease.Spec.LeaseDurationSeconds != nil {
+		d = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	return time.Now().After(lease.Spec.RenewTime.Add(d))
+}
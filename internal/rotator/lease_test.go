@@ -0,0 +1,203 @@
+package rotator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// leaseStub is a stand-in API server holding a single Lease, rejecting
+// updates which do not carry the current resource version
+type leaseStub struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	lease *coordinationv1.Lease
+	rv    int
+}
+
+func newLeaseStub(t *testing.T) *leaseStub {
+	t.Helper()
+	s := &leaseStub{}
+	const path = "/apis/coordination.k8s.io/v1/namespaces/stratus/leases"
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer sa-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == path+"/stratus-key-rotator":
+			if s.lease == nil {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(s.lease)
+		case r.Method == http.MethodPost && r.URL.Path == path:
+			if s.lease != nil {
+				http.Error(w, "already exists", http.StatusConflict)
+				return
+			}
+			s.store(w, r, http.StatusCreated)
+		case r.Method == http.MethodPut && r.URL.Path == path+"/stratus-key-rotator":
+			var l coordinationv1.Lease
+			json.NewDecoder(r.Body).Decode(&l)
+			if s.lease == nil || l.ResourceVersion != s.lease.ResourceVersion {
+				http.Error(w, "conflict", http.StatusConflict)
+				return
+			}
+			s.lease = &l
+			s.bump(w, http.StatusOK)
+		default:
+			http.Error(w, "unsupported request", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// store saves the lease in the request body
+func (s *leaseStub) store(w http.ResponseWriter, r *http.Request, code int) {
+	var l coordinationv1.Lease
+	json.NewDecoder(r.Body).Decode(&l)
+	s.lease = &l
+	s.bump(w, code)
+}
+
+// bump assigns a new resource version to the lease and returns it
+func (s *leaseStub) bump(w http.ResponseWriter, code int) {
+	s.rv++
+	s.lease.ResourceVersion = strconv.Itoa(s.rv)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(s.lease)
+}
+
+// holder returns the holder of the lease
+func (s *leaseStub) holder() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lease == nil || s.lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *s.lease.Spec.HolderIdentity
+}
+
+func (s *leaseStub) newLock(holder string) *leaseLock {
+	return &leaseLock{
+		host:      s.URL,
+		token:     "sa-token",
+		client:    s.Client(),
+		namespace: "stratus",
+		name:      "stratus-key-rotator",
+		holder:    holder,
+		duration:  time.Minute,
+	}
+}
+
+func TestLeaseLock(t *testing.T) {
+	stub := newLeaseStub(t)
+	a, b := stub.newLock("stratus-a"), stub.newLock("stratus-b")
+
+	acquire := func(ll *leaseLock, want bool) {
+		t.Helper()
+		got, err := ll.acquire()
+		if err != nil {
+			t.Fatalf("%s acquire() error = %v", ll.holder, err)
+		}
+		if got != want {
+			t.Fatalf("%s acquire() = %v, want %v", ll.holder, got, want)
+		}
+	}
+	acquire(a, true)
+	acquire(b, false)
+	// the holder renews the lease
+	acquire(a, true)
+	acquire(b, false)
+	if got := stub.holder(); got != "stratus-a" {
+		t.Fatalf("holder = %q, want stratus-a", got)
+	}
+
+	// another replica takes over once the lease has not been renewed
+	stub.mu.Lock()
+	old := metav1.NewMicroTime(time.Now().Add(-2 * time.Minute))
+	stub.lease.Spec.RenewTime = &old
+	stub.mu.Unlock()
+	acquire(b, true)
+	acquire(a, false)
+	if got := stub.holder(); got != "stratus-b" {
+		t.Fatalf("holder = %q, want stratus-b", got)
+	}
+	if n := stub.lease.Spec.LeaseTransitions; n == nil || *n != 1 {
+		t.Errorf("leaseTransitions = %v, want 1", n)
+	}
+}
+
+func TestLeaseLockConflict(t *testing.T) {
+	stub := newLeaseStub(t)
+	a, b := stub.newLock("stratus-a"), stub.newLock("stratus-b")
+	if ok, err := a.acquire(); !ok || err != nil {
+		t.Fatalf("acquire() = %v, %v", ok, err)
+	}
+	stub.mu.Lock()
+	old := metav1.NewMicroTime(time.Now().Add(-2 * time.Minute))
+	stub.lease.Spec.RenewTime = &old
+	stub.mu.Unlock()
+
+	// both replicas see the expired lease, only the first update succeeds
+	var la, lb coordinationv1.Lease
+	if _, err := a.do(http.MethodGet, a.leasesPath()+"/"+a.name, nil, &la); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.do(http.MethodGet, b.leasesPath()+"/"+b.name, nil, &lb); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.acquire(); !ok || err != nil {
+		t.Fatalf("acquire() = %v, %v", ok, err)
+	}
+	la.Spec.HolderIdentity = &a.holder
+	if code, err := a.do(http.MethodPut, a.leasesPath()+"/"+a.name, &la, nil); err != nil || code != http.StatusConflict {
+		t.Errorf("stale update = %d, %v, want conflict", code, err)
+	}
+	if got := stub.holder(); got != "stratus-b" {
+		t.Errorf("holder = %q, want stratus-b", got)
+	}
+}
+
+func TestNewLeaseLock(t *testing.T) {
+	tests := []struct {
+		name      string
+		lease     string
+		inCluster bool
+		wantNil   bool
+		wantErr   bool
+	}{
+		{"outside kubernetes", "", false, true, false},
+		{"disabled", "none", true, true, false},
+		{"configured outside kubernetes", "stratus/rotator", false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "GCP_KEY_ROTATION_LEASE", tt.lease)
+			host := ""
+			if tt.inCluster {
+				host = "10.0.0.1"
+			}
+			setenv(t, "KUBERNETES_SERVICE_HOST", host)
+			ll, err := newLeaseLock(time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newLeaseLock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (ll == nil) != tt.wantNil {
+				t.Errorf("newLeaseLock() = %v, want nil %v", ll, tt.wantNil)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package rotator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/robertlestak/stratus/internal/gcpauth"
+	"github.com/robertlestak/stratus/internal/identity"
+	"github.com/robertlestak/stratus/internal/secretstore"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultIAMURL is the base URL of the GCP IAM API
+const defaultIAMURL = "https://iam.googleapis.com"
+
+// iamKey is a service account key returned by the IAM API
+type iamKey struct {
+	Name           string `json:"name"`
+	ValidAfterTime string `json:"validAfterTime"`
+	PrivateKeyData string `json:"privateKeyData"`
+	KeyType        string `json:"keyType"`
+}
+
+// id returns the key ID, the last segment of the key name
+func (k iamKey) id() string {
+	return k.Name[strings.LastIndex(k.Name, "/")+1:]
+}
+
+// created returns the time the key became valid
+func (k iamKey) created() time.Time {
+	t, _ := time.Parse(time.RFC3339, k.ValidAfterTime)
+	return t
+}
+
+// Rotator rotates the keys of GCP target service accounts, storing the
+// current key at the secret store path the target is read from
+type Rotator struct {
+	store   secretstore.Store
+	targets func() []identity.Identity
+	hc      *http.Client
+	// iamURL is the base URL of the IAM API, GCP_IAM_URL
+	iamURL string
+	// dryRun logs the rotations which would be made without making them
+	dryRun bool
+	// interval and gracePeriod are the defaults for targets which do not set them
+	interval    time.Duration
+	gracePeriod time.Duration
+	// every is how often targets are checked, GCP_KEY_ROTATION_CHECK_INTERVAL
+	every time.Duration
+	// lock elects the replica which rotates keys, if set
+	lock locker
+}
+
+// locker elects a single replica to rotate keys
+type locker interface {
+	// acquire returns true if this replica holds the lock
+	acquire() (bool, error)
+}
+
+// envDuration returns the duration from the named env var, or def if unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// New returns a Rotator for the targets, configured from the environment.
+// The store must support writes.
+func New(targets func() []identity.Identity, store secretstore.Store) (*Rotator, error) {
+	u := os.Getenv("GCP_IAM_URL")
+	if u == "" {
+		u = defaultIAMURL
+	}
+	interval, grace := identity.RotationDefaults()
+	if err := identity.ValidateRotation(interval, grace); err != nil {
+		return nil, err
+	}
+	r := &Rotator{
+		store:       store,
+		targets:     targets,
+		hc:          &http.Client{Timeout: 30 * time.Second},
+		iamURL:      strings.TrimSuffix(u, "/"),
+		dryRun:      os.Getenv("GCP_KEY_ROTATION_DRY_RUN") == "true",
+		interval:    interval,
+		gracePeriod: grace,
+		every:       envDuration("GCP_KEY_ROTATION_CHECK_INTERVAL", time.Hour),
+	}
+	// the lease outlives a missed check, so it only moves to another
+	// replica once the holder has stopped renewing it
+	ll, err := newLeaseLock(2*r.every + time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if ll != nil {
+		r.lock = ll
+	}
+	return r, nil
+}
+
+// Run checks every target on each GCP_KEY_ROTATION_CHECK_INTERVAL, rotating
+// keys which are due. Targets are only checked while this replica holds the
+// lock, if set.
+func (r *Rotator) Run() {
+	l := log.WithFields(log.Fields{
+		"action": "rotator.Run",
+		"dryRun": r.dryRun,
+	})
+	if r.lock == nil {
+		l.Warn("no rotation lease, rotation must only be enabled on a single replica")
+	}
+	for {
+		r.check()
+		time.Sleep(r.every)
+	}
+}
+
+// check rotates the keys of all targets if this replica holds the lock
+func (r *Rotator) check() {
+	l := log.WithFields(log.Fields{
+		"action": "rotator.check",
+		"dryRun": r.dryRun,
+	})
+	if r.lock != nil {
+		ok, err := r.lock.acquire()
+		if err != nil {
+			l.WithError(err).Error("failed to acquire rotation lease")
+			return
+		}
+		if !ok {
+			l.Info("rotation lease held by another replica")
+			return
+		}
+	}
+	l.Info("start")
+	for _, t := range r.targets() {
+		if !t.GCP.RotationEnabled() {
+			continue
+		}
+		if err := r.Rotate(t); err != nil {
+			l.WithField("target", t.ID).WithError(err).Error("key rotation failed")
+		}
+	}
+	l.Info("end")
+}
+
+// rotationSuffix is appended to a target's secret path to give the path where
+// the key replaced by the last rotation is recorded
+const rotationSuffix = ".rotation"
+
+// rotationRecord records the key a rotation replaced, so only that key is
+// deleted once the grace period has passed. Keys stratus did not create are
+// never deleted.
+type rotationRecord struct {
+	// Current is the key the rotation stored
+	Current string `json:"current_key_id"`
+	// Replaced is the key the rotation replaced, empty once it is deleted
+	Replaced string `json:"replaced_key_id"`
+}
+
+// Rotate creates a new key for the target if the current key is older than
+// the rotation interval, recording the key it replaced. Once the current key
+// is older than the grace period, the replaced key is deleted.
+func (r *Rotator) Rotate(t identity.Identity) error {
+	l := log.WithFields(log.Fields{
+		"action": "rotator.Rotate",
+		"target": t.ID,
+		"dryRun": r.dryRun,
+	})
+	if t.Secret != nil && t.Secret.Version != 0 {
+		l.Info("secret version pinned, skipping rotation")
+		return nil
+	}
+	interval := t.GCP.RotationInterval(r.interval)
+	grace := t.GCP.RotationGracePeriod(r.gracePeriod)
+	if err := identity.ValidateRotation(interval, grace); err != nil {
+		return err
+	}
+	path := t.SecretPath(t.ID)
+	l = l.WithField("path", path)
+	cur, err := r.store.Get(path, 0)
+	if err != nil {
+		return err
+	}
+	ts, err := r.tokenSource(cur)
+	if err != nil {
+		return err
+	}
+	keys, err := r.listKeys(ts, t.ID)
+	if err != nil {
+		return err
+	}
+	curID, _ := cur["private_key_id"].(string)
+	var current *iamKey
+	for i := range keys {
+		if keys[i].id() == curID {
+			current = &keys[i]
+		}
+	}
+	if current == nil || time.Since(current.created()) >= interval {
+		l.WithField("currentKey", curID).Info("rotating key")
+		if r.dryRun {
+			return nil
+		}
+		nk, err := r.createKey(ts, t.ID)
+		if err != nil {
+			return err
+		}
+		kd, err := base64.StdEncoding.DecodeString(nk.PrivateKeyData)
+		if err != nil {
+			return err
+		}
+		data := map[string]interface{}{}
+		if err := json.Unmarshal(kd, &data); err != nil {
+			return err
+		}
+		if err := secretstore.Put(r.store, path, data); err != nil {
+			return fmt.Errorf("store key %s: %w", nk.id(), err)
+		}
+		l.WithField("newKey", nk.id()).Info("rotated key")
+		// without a record the replaced key is kept rather than deleted
+		rec := rotationRecord{Current: nk.id()}
+		if current != nil {
+			rec.Replaced = curID
+		}
+		if err := r.putRecord(path, rec); err != nil {
+			return fmt.Errorf("record rotation of %s: %w", curID, err)
+		}
+		return nil
+	}
+	if time.Since(current.created()) < grace {
+		return nil
+	}
+	rec, err := r.getRecord(path)
+	if err != nil {
+		return err
+	}
+	if rec.Current != curID || rec.Replaced == "" {
+		return nil
+	}
+	for _, k := range keys {
+		if k.id() != rec.Replaced {
+			continue
+		}
+		l.WithField("key", k.id()).Info("deleting replaced key")
+		if r.dryRun {
+			return nil
+		}
+		if err := r.do(ts, http.MethodDelete, r.iamURL+"/v1/"+k.Name, nil, nil); err != nil {
+			return fmt.Errorf("delete key %s: %w", k.id(), err)
+		}
+	}
+	if r.dryRun {
+		return nil
+	}
+	rec.Replaced = ""
+	return r.putRecord(path, rec)
+}
+
+// getRecord returns the rotation record of the secret path, which is empty if
+// no rotation has been recorded
+func (r *Rotator) getRecord(path string) (rotationRecord, error) {
+	var rec rotationRecord
+	data, err := r.store.Get(path+rotationSuffix, 0)
+	if errors.Is(err, secretstore.ErrNotFound) {
+		return rec, nil
+	} else if err != nil {
+		return rec, err
+	}
+	rec.Current, _ = data["current_key_id"].(string)
+	rec.Replaced, _ = data["replaced_key_id"].(string)
+	return rec, nil
+}
+
+// putRecord stores the rotation record of the secret path
+func (r *Rotator) putRecord(path string, rec rotationRecord) error {
+	return secretstore.Put(r.store, path+rotationSuffix, map[string]interface{}{
+		"current_key_id":  rec.Current,
+		"replaced_key_id": rec.Replaced,
+	})
+}
+
+// tokenSource returns the credentials used to call the IAM API. These are the
+// key stored at GCP_KEY_ROTATION_CREDENTIALS in the secret store if set,
+// otherwise the target's current key.
+func (r *Rotator) tokenSource(cur map[string]interface{}) (*gcpauth.TokenSource, error) {
+	key := cur
+	if p := os.Getenv("GCP_KEY_ROTATION_CREDENTIALS"); p != "" {
+		var err error
+		if key, err = r.store.Get(p, 0); err != nil {
+			return nil, err
+		}
+	}
+	return gcpauth.NewTokenSource(key, gcpauth.ScopeCloudPlatform)
+}
+
+// keysURL returns the IAM API keys collection URL of a service account
+func (r *Rotator) keysURL(email string) string {
+	return r.iamURL + "/v1/projects/-/serviceAccounts/" + url.PathEscape(email) + "/keys"
+}
+
+// listKeys returns the user managed keys of a service account
+func (r *Rotator) listKeys(ts *gcpauth.TokenSource, email string) ([]iamKey, error) {
+	var res struct {
+		Keys []iamKey `json:"keys"`
+	}
+	if err := r.do(ts, http.MethodGet, r.keysURL(email)+"?keyTypes=USER_MANAGED", nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Keys, nil
+}
+
+// createKey creates a new JSON key for a service account
+func (r *Rotator) createKey(ts *gcpauth.TokenSource, email string) (*iamKey, error) {
+	k := &iamKey{}
+	err := r.do(ts, http.MethodPost, r.keysURL(email), map[string]string{
+		"privateKeyType": "TYPE_GOOGLE_CREDENTIALS_FILE",
+		"keyAlgorithm":   "KEY_ALG_RSA_2048",
+	}, k)
+	if err != nil {
+		return nil, err
+	}
+	if k.PrivateKeyData == "" {
+		return nil, errors.New("no private key returned")
+	}
+	return k, nil
+}
+
+// do calls the IAM API, decoding the response into out if set
+func (r *Rotator) do(ts *gcpauth.TokenSource, method string, u string, in interface{}, out interface{}) error {
+	tok, err := ts.Token()
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := r.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s returned %d: %s", method, u, res.StatusCode, b)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
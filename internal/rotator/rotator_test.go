@@ -0,0 +1,338 @@
+package rotator
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robertlestak/stratus/internal/identity"
+	"github.com/robertlestak/stratus/internal/secretstore"
+)
+
+const testEmail = "stratus@stratus-test.iam.gserviceaccount.com"
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, k, v string) {
+	t.Helper()
+	old, ok := os.LookupEnv(k)
+	os.Setenv(k, v)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(k, old)
+		} else {
+			os.Unsetenv(k)
+		}
+	})
+}
+
+// memStore is a writable in-memory secret store
+type memStore struct {
+	mu      sync.Mutex
+	secrets map[string]map[string]interface{}
+}
+
+func (m *memStore) Get(path string, version int) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.secrets[path]
+	if !ok {
+		return nil, secretstore.ErrNotFound
+	}
+	return s, nil
+}
+
+func (m *memStore) Put(path string, data map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.secrets[path] = data
+	return nil
+}
+
+// iamStub is a stand-in IAM API and OAuth token endpoint holding the user
+// managed keys of a service account
+type iamStub struct {
+	*httptest.Server
+	pem string
+
+	mu       sync.Mutex
+	keys     []iamKey
+	created  int
+	deleted  []string
+	requests int
+}
+
+// testKeyPEM is an RSA key used to sign token requests
+var testKeyPEM = func() string {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}))
+}()
+
+func newIAMStub(t *testing.T) *iamStub {
+	t.Helper()
+	s := &iamStub{pem: testKeyPEM}
+	keysPath := "/v1/projects/-/serviceAccounts/" + testEmail + "/keys"
+	// keys are deleted by their full name
+	keyPrefix := "/v1/projects/stratus-test/serviceAccounts/" + testEmail + "/keys/"
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"access_token":"iam-token","expires_in":3600}`))
+			return
+		}
+		s.requests++
+		if r.Header.Get("Authorization") != "Bearer iam-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == keysPath:
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+		case r.Method == http.MethodPost && r.URL.Path == keysPath:
+			s.created++
+			id := fmt.Sprintf("new%d", s.created)
+			k := s.key(id, time.Now())
+			kd, _ := json.Marshal(s.secret(id))
+			k.PrivateKeyData = base64.StdEncoding.EncodeToString(kd)
+			s.keys = append(s.keys, k)
+			json.NewEncoder(w).Encode(k)
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, keyPrefix):
+			id := strings.TrimPrefix(r.URL.Path, keyPrefix)
+			s.deleted = append(s.deleted, id)
+			w.Write([]byte(`{}`))
+		default:
+			http.Error(w, "unsupported request", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(s.Close)
+	setenv(t, "GCP_TOKEN_URL", s.URL+"/token")
+	return s
+}
+
+// key returns an IAM key with id created at c
+func (s *iamStub) key(id string, c time.Time) iamKey {
+	return iamKey{
+		Name:           "projects/stratus-test/serviceAccounts/" + testEmail + "/keys/" + id,
+		ValidAfterTime: c.UTC().Format(time.RFC3339),
+		KeyType:        "USER_MANAGED",
+	}
+}
+
+// secret returns the JSON key of id
+func (s *iamStub) secret(id string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":           "service_account",
+		"client_email":   testEmail,
+		"private_key_id": id,
+		"private_key":    s.pem,
+	}
+}
+
+func TestRotate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		keys        map[string]time.Duration
+		current     string
+		record      *rotationRecord
+		rotation    *identity.KeyRotation
+		dryRun      bool
+		wantCreated int
+		wantDeleted []string
+		wantRecord  *rotationRecord
+		wantErr     bool
+	}{
+		{
+			name:    "fresh key",
+			keys:    map[string]time.Duration{"cur": time.Hour},
+			current: "cur",
+		},
+		{
+			name:        "key older than interval",
+			keys:        map[string]time.Duration{"cur": 31 * 24 * time.Hour},
+			current:     "cur",
+			wantCreated: 1,
+			wantRecord:  &rotationRecord{Current: "new1", Replaced: "cur"},
+		},
+		{
+			name:        "stored key not found",
+			keys:        map[string]time.Duration{"other": time.Hour},
+			current:     "cur",
+			wantCreated: 1,
+			wantRecord:  &rotationRecord{Current: "new1"},
+		},
+		{
+			name:        "replaced key after grace period",
+			keys:        map[string]time.Duration{"old": 31 * 24 * time.Hour, "other": 40 * 24 * time.Hour, "cur": 48 * time.Hour},
+			current:     "cur",
+			record:      &rotationRecord{Current: "cur", Replaced: "old"},
+			wantDeleted: []string{"old"},
+			wantRecord:  &rotationRecord{Current: "cur"},
+		},
+		{
+			name:       "old keys after grace period without record",
+			keys:       map[string]time.Duration{"old": 40 * 24 * time.Hour, "cur": 48 * time.Hour},
+			current:    "cur",
+			wantRecord: &rotationRecord{},
+		},
+		{
+			name:       "record of another key",
+			keys:       map[string]time.Duration{"old": 40 * 24 * time.Hour, "cur": 48 * time.Hour},
+			current:    "cur",
+			record:     &rotationRecord{Current: "prev", Replaced: "old"},
+			wantRecord: &rotationRecord{Current: "prev", Replaced: "old"},
+		},
+		{
+			name:       "replaced key within grace period",
+			keys:       map[string]time.Duration{"old": 40 * 24 * time.Hour, "cur": time.Hour},
+			current:    "cur",
+			record:     &rotationRecord{Current: "cur", Replaced: "old"},
+			wantRecord: &rotationRecord{Current: "cur", Replaced: "old"},
+		},
+		{
+			name:       "dry run after grace period",
+			keys:       map[string]time.Duration{"old": 40 * 24 * time.Hour, "cur": 48 * time.Hour},
+			current:    "cur",
+			record:     &rotationRecord{Current: "cur", Replaced: "old"},
+			dryRun:     true,
+			wantRecord: &rotationRecord{Current: "cur", Replaced: "old"},
+		},
+		{
+			name:        "target interval",
+			keys:        map[string]time.Duration{"cur": 2 * time.Hour},
+			current:     "cur",
+			rotation:    &identity.KeyRotation{Interval: "1h", GracePeriod: "30m"},
+			wantCreated: 1,
+		},
+		{
+			name:    "dry run",
+			keys:    map[string]time.Duration{"old": 40 * 24 * time.Hour, "cur": 31 * 24 * time.Hour},
+			current: "cur",
+			dryRun:  true,
+		},
+		{
+			name:     "grace period not shorter than merged interval",
+			keys:     map[string]time.Duration{"cur": time.Hour},
+			current:  "cur",
+			rotation: &identity.KeyRotation{Interval: "12h"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newIAMStub(t)
+			for id, age := range tt.keys {
+				stub.keys = append(stub.keys, stub.key(id, now.Add(-age)))
+			}
+			store := &memStore{secrets: map[string]map[string]interface{}{}}
+			target := identity.Identity{ID: testEmail, Provider: identity.ProviderGCP}
+			if tt.rotation != nil {
+				target.GCP = &identity.GCPTarget{Rotation: tt.rotation}
+			}
+			path := target.SecretPath(target.ID)
+			store.secrets[path] = stub.secret(tt.current)
+			if tt.record != nil {
+				store.secrets[path+rotationSuffix] = map[string]interface{}{
+					"current_key_id":  tt.record.Current,
+					"replaced_key_id": tt.record.Replaced,
+				}
+			}
+			r := &Rotator{
+				store:       store,
+				hc:          http.DefaultClient,
+				iamURL:      stub.URL,
+				dryRun:      tt.dryRun,
+				interval:    30 * 24 * time.Hour,
+				gracePeriod: 24 * time.Hour,
+			}
+			err := r.Rotate(target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Rotate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if stub.created != tt.wantCreated {
+				t.Errorf("created %d keys, want %d", stub.created, tt.wantCreated)
+			}
+			if fmt.Sprint(stub.deleted) != fmt.Sprint(tt.wantDeleted) {
+				t.Errorf("deleted %v, want %v", stub.deleted, tt.wantDeleted)
+			}
+			stored, _ := store.secrets[path]["private_key_id"].(string)
+			want := tt.current
+			if tt.wantCreated > 0 {
+				want = "new1"
+			}
+			if stored != want {
+				t.Errorf("stored key %q, want %q", stored, want)
+			}
+			if tt.wantRecord != nil {
+				rec, err := r.getRecord(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rec != *tt.wantRecord {
+					t.Errorf("rotation record = %+v, want %+v", rec, *tt.wantRecord)
+				}
+			}
+		})
+	}
+}
+
+// fixedLock is a locker which is always or never held
+type fixedLock bool
+
+func (f fixedLock) acquire() (bool, error) {
+	return bool(f), nil
+}
+
+func TestCheckRequiresLock(t *testing.T) {
+	stub := newIAMStub(t)
+	stub.keys = []iamKey{stub.key("cur", time.Now().Add(-31*24*time.Hour))}
+	target := identity.Identity{ID: testEmail, Provider: identity.ProviderGCP}
+	store := &memStore{secrets: map[string]map[string]interface{}{
+		target.SecretPath(target.ID): stub.secret("cur"),
+	}}
+	r := &Rotator{
+		store:       store,
+		targets:     func() []identity.Identity { return []identity.Identity{target} },
+		hc:          http.DefaultClient,
+		iamURL:      stub.URL,
+		interval:    30 * 24 * time.Hour,
+		gracePeriod: 24 * time.Hour,
+		lock:        fixedLock(false),
+	}
+	r.check()
+	if stub.requests != 0 || stub.created != 0 {
+		t.Fatalf("rotated without the lock: %d requests, %d keys created", stub.requests, stub.created)
+	}
+	r.lock = fixedLock(true)
+	r.check()
+	if stub.created != 1 {
+		t.Errorf("created %d keys with the lock, want 1", stub.created)
+	}
+}
+
+func TestNewRejectsDefaultGraceAtLeastInterval(t *testing.T) {
+	setenv(t, "GCP_KEY_ROTATION_LEASE", "none")
+	setenv(t, "GCP_KEY_ROTATION_INTERVAL", "24h")
+	setenv(t, "GCP_KEY_ROTATION_GRACE_PERIOD", "24h")
+	if _, err := New(nil, nil); err == nil {
+		t.Error("New() accepted a grace period equal to the interval")
+	}
+	setenv(t, "GCP_KEY_ROTATION_GRACE_PERIOD", "12h")
+	if _, err := New(nil, nil); err != nil {
+		t.Errorf("New() error = %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package secretstore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// parseAgeIdentities parses the AGE-SECRET-KEY-1 lines of an identity file,
+// ignoring comments and blank lines
+func parseAgeIdentities(s string) ([]age.Identity, error) {
+	ids, err := age.ParseIdentities(strings.NewReader(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid age identity: %w", err)
+	}
+	return ids, nil
+}
+
+// ageDecrypt decrypts an age file, which may be armored, with the identities
+func ageDecrypt(in []byte, ids []age.Identity) ([]byte, error) {
+	var r io.Reader = bufio.NewReader(bytes.NewReader(bytes.TrimSpace(in)))
+	if bytes.HasPrefix(bytes.TrimSpace(in), []byte(armor.Header)) {
+		r = armor.NewReader(r)
+	}
+	d, err := age.Decrypt(r, ids...)
+	if err != nil {
+		return nil, err
+	}
+	out, err := ioutil.ReadAll(d)
+	if err != nil {
+		return nil, errors.New("age payload decryption failed")
+	}
+	return out, nil
+}
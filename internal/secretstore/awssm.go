@@ -0,0 +1,144 @@
+package secretstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	log "github.com/sirupsen/logrus"
+)
+
+// AWSSecretsManager reads secrets from AWS Secrets Manager. Each secret is a
+// JSON object stored as the secret string, named by its path below the prefix.
+type AWSSecretsManager struct {
+	client *secretsmanager.SecretsManager
+	prefix string
+}
+
+// NewAWSSecretsManager returns an AWS Secrets Manager store using the default
+// AWS credentials, in SECRET_STORE_AWS_REGION if set
+func NewAWSSecretsManager() (*AWSSecretsManager, error) {
+	cfg := &aws.Config{}
+	if r := os.Getenv("SECRET_STORE_AWS_REGION"); r != "" {
+		cfg.Region = aws.String(r)
+	}
+	if e := os.Getenv("SECRET_STORE_AWS_ENDPOINT"); e != "" {
+		cfg.Endpoint = aws.String(e)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &AWSSecretsManager{
+		client: secretsmanager.New(sess),
+		prefix: prefix("stratus/"),
+	}, nil
+}
+
+// awsNotFound maps a missing secret to ErrNotFound
+func awsNotFound(err error) error {
+	if ae, ok := err.(awserr.Error); ok && ae.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
+
+// Get returns the secret at path. Secrets Manager versions are not numbered,
+// so only the current version can be read.
+func (s *AWSSecretsManager) Get(path string, version int) (map[string]interface{}, error) {
+	l := log.WithFields(log.Fields{
+		"action": "AWSSecretsManager.Get",
+		"path":   path,
+	})
+	l.Info("start")
+	if version != 0 {
+		return nil, fmt.Errorf("secret versions: %w", ErrUnsupported)
+	}
+	out, err := s.client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name(s.prefix, path)),
+	})
+	if err != nil {
+		l.Printf("%+v", err)
+		return nil, awsNotFound(err)
+	}
+	b := out.SecretBinary
+	if out.SecretString != nil {
+		b = []byte(*out.SecretString)
+	}
+	data := map[string]interface{}{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("secret %s is not a JSON object: %w", path, err)
+	}
+	return data, nil
+}
+
+// Put writes the secret at path, creating the secret if it does not exist
+func (s *AWSSecretsManager) Put(path string, data map[string]interface{}) error {
+	l := log.WithFields(log.Fields{
+		"action": "AWSSecretsManager.Put",
+		"path":   path,
+	})
+	l.Info("start")
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	n := name(s.prefix, path)
+	_, err = s.client.PutSecretValue(&secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(n),
+		SecretString: aws.String(string(b)),
+	})
+	if err = awsNotFound(err); !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	_, err = s.client.CreateSecret(&secretsmanager.CreateSecretInput{
+		Name:         aws.String(n),
+		SecretString: aws.String(string(b)),
+	})
+	return err
+}
+
+// List lists the keys under path. Secrets whose name continues past the next
+// "/" are returned as sub-paths.
+func (s *AWSSecretsManager) List(path string) ([]string, error) {
+	p := name(s.prefix, path)
+	if p != "" && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	in := &secretsmanager.ListSecretsInput{}
+	if p != "" {
+		in.Filters = []*secretsmanager.Filter{{
+			Key:    aws.String(secretsmanager.FilterNameStringTypeName),
+			Values: []*string{aws.String(p)},
+		}}
+	}
+	seen := make(map[string]bool)
+	var keys []string
+	err := s.client.ListSecretsPages(in, func(out *secretsmanager.ListSecretsOutput, last bool) bool {
+		for _, e := range out.SecretList {
+			n := aws.StringValue(e.Name)
+			if !strings.HasPrefix(n, p) {
+				continue
+			}
+			k := strings.TrimPrefix(n, p)
+			if i := strings.Index(k, "/"); i >= 0 {
+				k = k[:i+1]
+			}
+			if k != "" && !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+		return true
+	})
+	return keys, err
+}
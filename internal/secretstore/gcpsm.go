@@ -0,0 +1,255 @@
+package secretstore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertlestak/stratus/internal/gcpauth"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultGCPSecretManagerURL is the base URL of the GCP Secret Manager API
+	defaultGCPSecretManagerURL = "https://secretmanager.googleapis.com"
+	// defaultGCEMetadataHost is the GCE metadata server
+	defaultGCEMetadataHost = "metadata.google.internal"
+)
+
+// GCPSecretManager reads secrets from GCP Secret Manager. Each secret is a
+// JSON object stored as the secret payload. Secret IDs may only contain
+// letters, digits, "-" and "_", so "_" is escaped as "__" and any other byte
+// of the path as "_" followed by its two hex digits, keeping IDs unique.
+type GCPSecretManager struct {
+	project string
+	prefix  string
+	baseURL string
+	hc      *http.Client
+	token   func() (string, error)
+}
+
+// NewGCPSecretManager returns a GCP Secret Manager store for the project
+// SECRET_STORE_GCP_PROJECT. The API is called with the service account key
+// at SECRET_STORE_GCP_CREDENTIALS or GOOGLE_APPLICATION_CREDENTIALS if set,
+// otherwise with the instance service account from the metadata server.
+func NewGCPSecretManager() (*GCPSecretManager, error) {
+	p := os.Getenv("SECRET_STORE_GCP_PROJECT")
+	if p == "" {
+		return nil, errors.New("SECRET_STORE_GCP_PROJECT required")
+	}
+	u := os.Getenv("SECRET_STORE_GCP_URL")
+	if u == "" {
+		u = defaultGCPSecretManagerURL
+	}
+	s := &GCPSecretManager{
+		project: p,
+		prefix:  prefix("stratus/"),
+		baseURL: strings.TrimSuffix(u, "/"),
+		hc:      &http.Client{Timeout: 30 * time.Second},
+	}
+	f := os.Getenv("SECRET_STORE_GCP_CREDENTIALS")
+	if f == "" {
+		f = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if f == "" {
+		s.token = (&metadataToken{hc: s.hc}).Token
+		return s, nil
+	}
+	fd, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	key := map[string]interface{}{}
+	if err := json.Unmarshal(fd, &key); err != nil {
+		return nil, err
+	}
+	ts, err := gcpauth.NewTokenSource(key, gcpauth.ScopeCloudPlatform)
+	if err != nil {
+		return nil, err
+	}
+	s.token = ts.Token
+	return s, nil
+}
+
+// secretID returns the secret ID of path
+func (s *GCPSecretManager) secretID(path string) string {
+	n := name(s.prefix, path)
+	var b strings.Builder
+	for i := 0; i < len(n); i++ {
+		c := n[i]
+		switch {
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-':
+			b.WriteByte(c)
+		case c == '_':
+			b.WriteString("__")
+		default:
+			fmt.Fprintf(&b, "_%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// secretURL returns the API URL of the secret at path
+func (s *GCPSecretManager) secretURL(path string) string {
+	return s.baseURL + "/v1/projects/" + url.PathEscape(s.project) + "/secrets/" + s.secretID(path)
+}
+
+// do sends an authenticated API request, decoding the response into out
+func (s *GCPSecretManager) do(method, u string, in, out interface{}) error {
+	t, err := s.token()
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+t)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, u)
+	}
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("secret manager returned %d: %s", res.StatusCode, b)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// secretPayload is the payload of a secret version
+type secretPayload struct {
+	Payload struct {
+		Data string `json:"data"`
+	} `json:"payload"`
+}
+
+// Get returns the secret at path, the latest version if version is 0
+func (s *GCPSecretManager) Get(path string, version int) (map[string]interface{}, error) {
+	l := log.WithFields(log.Fields{
+		"action": "GCPSecretManager.Get",
+		"path":   path,
+	})
+	l.Info("start")
+	v := "latest"
+	if version != 0 {
+		v = strconv.Itoa(version)
+	}
+	var p secretPayload
+	if err := s.do(http.MethodGet, s.secretURL(path)+"/versions/"+v+":access", nil, &p); err != nil {
+		l.Printf("%+v", err)
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(p.Payload.Data)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("secret %s is not a JSON object: %w", path, err)
+	}
+	return data, nil
+}
+
+// Put adds a new version of the secret at path, creating the secret if it does not exist
+func (s *GCPSecretManager) Put(path string, data map[string]interface{}) error {
+	l := log.WithFields(log.Fields{
+		"action": "GCPSecretManager.Put",
+		"path":   path,
+	})
+	l.Info("start")
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var p secretPayload
+	p.Payload.Data = base64.StdEncoding.EncodeToString(b)
+	err = s.do(http.MethodPost, s.secretURL(path)+":addVersion", p, nil)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	create := s.baseURL + "/v1/projects/" + url.PathEscape(s.project) + "/secrets?secretId=" + url.QueryEscape(s.secretID(path))
+	if err := s.do(http.MethodPost, create, map[string]interface{}{
+		"replication": map[string]interface{}{
+			"automatic": map[string]interface{}{},
+		},
+	}, nil); err != nil {
+		return err
+	}
+	return s.do(http.MethodPost, s.secretURL(path)+":addVersion", p, nil)
+}
+
+// metadataToken issues access tokens for the instance service account from
+// the metadata server, GCE_METADATA_HOST if set
+type metadataToken struct {
+	hc *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// Token returns a valid access token
+func (m *metadataToken) Token() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != "" && time.Now().Add(time.Minute).Before(m.expiry) {
+		return m.token, nil
+	}
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = defaultGCEMetadataHost
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := m.hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %d", res.StatusCode)
+	}
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return "", err
+	}
+	if tr.AccessToken == "" {
+		return "", errors.New("no access token returned")
+	}
+	m.token = tr.AccessToken
+	m.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	return m.token, nil
+}
@@ -0,0 +1,104 @@
+package secretstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/robertlestak/stratus/internal/vaultclient"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNotFound is returned when a secret does not exist
+	ErrNotFound = errors.New("secret not found")
+	// ErrUnsupported is returned when a store does not support an operation
+	ErrUnsupported = errors.New("not supported by secret store")
+
+	// Default is the store target secrets are read from
+	Default Store
+)
+
+// Store reads target secrets, such as GCP keys and k8s service account tokens.
+// Paths are relative to the prefix of the store, or to its root if they
+// start with "/".
+type Store interface {
+	// Get returns the secret at path. A version of 0 reads the latest version.
+	Get(path string, version int) (map[string]interface{}, error)
+}
+
+// Writer is a Store which can write secrets, creating a new version
+type Writer interface {
+	Store
+	Put(path string, data map[string]interface{}) error
+}
+
+// Lister is a Store which can list the keys under a path. Keys ending in "/"
+// are sub-paths.
+type Lister interface {
+	Store
+	List(path string) ([]string, error)
+}
+
+// Put writes a secret to the store if it supports writes
+func Put(s Store, path string, data map[string]interface{}) error {
+	w, ok := s.(Writer)
+	if !ok {
+		return fmt.Errorf("write: %w", ErrUnsupported)
+	}
+	return w.Put(path, data)
+}
+
+// List lists the keys under a path if the store supports listing
+func List(s Store, path string) ([]string, error) {
+	ls, ok := s.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("list: %w", ErrUnsupported)
+	}
+	return ls.List(path)
+}
+
+// prefix returns the SECRET_STORE_PREFIX, or def if unset, with a trailing slash
+func prefix(def string) string {
+	p, ok := os.LookupEnv("SECRET_STORE_PREFIX")
+	if !ok {
+		p = def
+	}
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+// name returns the full name of the secret at path within prefix. Paths
+// starting with "/" are relative to the root of the store.
+func name(prefix, path string) string {
+	if strings.HasPrefix(path, "/") {
+		return strings.TrimPrefix(path, "/")
+	}
+	return prefix + path
+}
+
+// FromEnv returns the store selected by SECRET_STORE: vault (default), aws,
+// gcp or sops. The vault store uses vc.
+func FromEnv(vc *vaultclient.VaultClient) (Store, error) {
+	l := log.WithFields(log.Fields{
+		"action": "secretstore.FromEnv",
+		"store":  os.Getenv("SECRET_STORE"),
+	})
+	l.Info("start")
+	switch os.Getenv("SECRET_STORE") {
+	case "", "vault":
+		return &Vault{Client: vc}, nil
+	case "aws":
+		return NewAWSSecretsManager()
+	case "gcp":
+		return NewGCPSecretManager()
+	case "sops":
+		return NewSOPS()
+	default:
+		return nil, fmt.Errorf("unknown secret store %q", os.Getenv("SECRET_STORE"))
+	}
+}
@@ -0,0 +1,378 @@
+package secretstore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, k, v string) {
+	t.Helper()
+	old, ok := os.LookupEnv(k)
+	os.Setenv(k, v)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(k, old)
+		} else {
+			os.Unsetenv(k)
+		}
+	})
+}
+
+// unsetenv unsets an environment variable for the duration of the test
+func unsetenv(t *testing.T, k string) {
+	t.Helper()
+	setenv(t, k, "")
+	os.Unsetenv(k)
+}
+
+func TestPrefix(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		set   bool
+		want  string
+	}{
+		{"unset", "", false, "stratus/"},
+		{"empty", "", true, ""},
+		{"slashes", "/team/stratus/", true, "team/stratus/"},
+		{"no slash", "stratus-dev", true, "stratus-dev/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "SECRET_STORE_PREFIX", tt.value)
+			if !tt.set {
+				unsetenv(t, "SECRET_STORE_PREFIX")
+			}
+			if got := prefix("stratus/"); got != tt.want {
+				t.Errorf("prefix() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   string
+	}{
+		{"stratus/", "gcp/key", "stratus/gcp/key"},
+		{"stratus/", "/shared/key", "shared/key"},
+		{"", "gcp/key", "gcp/key"},
+	}
+	for _, tt := range tests {
+		if got := name(tt.prefix, tt.path); got != tt.want {
+			t.Errorf("name(%q, %q) = %q, want %q", tt.prefix, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		store   string
+		want    string
+		wantErr bool
+	}{
+		{"", "*secretstore.Vault", false},
+		{"vault", "*secretstore.Vault", false},
+		{"sops", "*secretstore.SOPS", false},
+		{"aws", "*secretstore.AWSSecretsManager", false},
+		{"gcp", "*secretstore.GCPSecretManager", false},
+		{"consul", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.store, func(t *testing.T) {
+			setenv(t, "SECRET_STORE", tt.store)
+			setenv(t, "SECRET_STORE_SOPS_DIR", "testdata/sops")
+			setenv(t, "SOPS_AGE_KEY_FILE", "testdata/sops/age.key")
+			setenv(t, "SECRET_STORE_AWS_REGION", "us-east-1")
+			setenv(t, "SECRET_STORE_GCP_PROJECT", "stratus-test")
+			setenv(t, "SECRET_STORE_GCP_CREDENTIALS", "")
+			setenv(t, "GOOGLE_APPLICATION_CREDENTIALS", "")
+			s, err := FromEnv(nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FromEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := reflect.TypeOf(s); !tt.wantErr && got.String() != tt.want {
+				t.Errorf("FromEnv() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// awsStub is a stand-in Secrets Manager endpoint holding secrets in memory
+type awsStub struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	secrets map[string]string
+}
+
+func newAWSStub(t *testing.T) *awsStub {
+	t.Helper()
+	setenv(t, "AWS_ACCESS_KEY_ID", "AKIDSTRATUSTEST")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "secret")
+	s := &awsStub{secrets: map[string]string{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			SecretId     string
+			Name         string
+			SecretString string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		notFound := func() {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"not found"}`))
+		}
+		switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "secretsmanager.") {
+		case "GetSecretValue":
+			v, ok := s.secrets[in.SecretId]
+			if !ok {
+				notFound()
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"Name": in.SecretId, "SecretString": v})
+		case "PutSecretValue":
+			if _, ok := s.secrets[in.SecretId]; !ok {
+				notFound()
+				return
+			}
+			s.secrets[in.SecretId] = in.SecretString
+			w.Write([]byte(`{}`))
+		case "CreateSecret":
+			s.secrets[in.Name] = in.SecretString
+			w.Write([]byte(`{}`))
+		case "ListSecrets":
+			var list []map[string]string
+			for n := range s.secrets {
+				list = append(list, map[string]string{"Name": n})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"SecretList": list})
+		default:
+			http.Error(w, "unsupported action", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestAWSSecretsManager(t *testing.T) {
+	stub := newAWSStub(t)
+	stub.secrets["stratus/gcp/key"] = `{"type":"service_account"}`
+	stub.secrets["stratus/k8s/dev/token"] = `{"token":"t"}`
+	stub.secrets["other/key"] = `{}`
+	stub.secrets["stratus/invalid"] = `not json`
+	setenv(t, "SECRET_STORE_AWS_REGION", "us-east-1")
+	setenv(t, "SECRET_STORE_AWS_ENDPOINT", stub.URL)
+	unsetenv(t, "SECRET_STORE_PREFIX")
+	s, err := NewAWSSecretsManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Get("gcp/key", 0)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got["type"] != "service_account" {
+		t.Errorf("Get() = %v", got)
+	}
+	if _, err := s.Get("/other/key", 0); err != nil {
+		t.Errorf("Get() of a root path error = %v", err)
+	}
+	if _, err := s.Get("missing", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() error = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Get("gcp/key", 2); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Get() of a version error = %v, want ErrUnsupported", err)
+	}
+	if _, err := s.Get("invalid", 0); err == nil {
+		t.Error("Get() accepted a secret which is not a JSON object")
+	}
+
+	if err := Put(s, "gcp/key", map[string]interface{}{"type": "rotated"}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := Put(s, "gcp/new", map[string]interface{}{"type": "created"}); err != nil {
+		t.Fatalf("Put() of a new secret error = %v", err)
+	}
+	for n, want := range map[string]string{"stratus/gcp/key": `{"type":"rotated"}`, "stratus/gcp/new": `{"type":"created"}`} {
+		if got := stub.secrets[n]; got != want {
+			t.Errorf("secret %s = %s, want %s", n, got, want)
+		}
+	}
+
+	keys, err := List(s, "")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	sort.Strings(keys)
+	if want := []string{"gcp/", "invalid", "k8s/"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("List() = %v, want %v", keys, want)
+	}
+	keys, err = List(s, "gcp")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	sort.Strings(keys)
+	if want := []string{"key", "new"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("List(gcp) = %v, want %v", keys, want)
+	}
+}
+
+// gcpStub is a stand-in metadata server and Secret Manager API holding
+// secret versions in memory
+type gcpStub struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	versions map[string][]string
+}
+
+func newGCPStub(t *testing.T) *gcpStub {
+	t.Helper()
+	s := &gcpStub{versions: map[string][]string{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token" {
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				http.Error(w, "missing header", http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`{"access_token":"metadata-token","expires_in":3600}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer metadata-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		p := strings.TrimPrefix(r.URL.Path, "/v1/projects/stratus-test/secrets")
+		switch {
+		case r.Method == http.MethodPost && p == "":
+			s.versions[r.URL.Query().Get("secretId")] = []string{}
+			w.Write([]byte(`{}`))
+		case r.Method == http.MethodPost && strings.HasSuffix(p, ":addVersion"):
+			id := strings.TrimSuffix(strings.TrimPrefix(p, "/"), ":addVersion")
+			if _, ok := s.versions[id]; !ok {
+				http.NotFound(w, r)
+				return
+			}
+			var in secretPayload
+			b, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(b, &in)
+			s.versions[id] = append(s.versions[id], in.Payload.Data)
+			w.Write([]byte(`{}`))
+		case r.Method == http.MethodGet && strings.HasSuffix(p, ":access"):
+			parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(p, "/"), ":access"), "/versions/")
+			vs := s.versions[parts[0]]
+			i := len(vs) - 1
+			if parts[1] != "latest" {
+				i = int(parts[1][0]-'0') - 1
+			}
+			if i < 0 || i >= len(vs) {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"payload": map[string]string{"data": vs[i]}})
+		default:
+			http.Error(w, "unsupported request", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestGCPSecretManager(t *testing.T) {
+	stub := newGCPStub(t)
+	setenv(t, "SECRET_STORE_GCP_PROJECT", "stratus-test")
+	setenv(t, "SECRET_STORE_GCP_URL", stub.URL)
+	setenv(t, "SECRET_STORE_GCP_CREDENTIALS", "")
+	setenv(t, "GOOGLE_APPLICATION_CREDENTIALS", "")
+	setenv(t, "GCE_METADATA_HOST", strings.TrimPrefix(stub.URL, "http://"))
+	unsetenv(t, "SECRET_STORE_PREFIX")
+	s, err := NewGCPSecretManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ path, want string }{
+		{"gcp/sa@project.iam.gserviceaccount.com", "stratus_2Fgcp_2Fsa_40project_2Eiam_2Egserviceaccount_2Ecom"},
+		{"a/b", "stratus_2Fa_2Fb"},
+		{"a.b", "stratus_2Fa_2Eb"},
+		{"a_b", "stratus_2Fa__b"},
+		{"a_2Fb", "stratus_2Fa__2Fb"},
+		{"key-1", "stratus_2Fkey-1"},
+	} {
+		if got := s.secretID(tt.path); got != tt.want {
+			t.Errorf("secretID(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	if _, err := s.Get("gcp/key", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() error = %v, want ErrNotFound", err)
+	}
+	if err := s.Put("gcp/key", map[string]interface{}{"v": "1"}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := s.Put("gcp/key", map[string]interface{}{"v": "2"}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if n := len(stub.versions["stratus_2Fgcp_2Fkey"]); n != 2 {
+		t.Fatalf("got %d versions, want 2", n)
+	}
+	tests := []struct {
+		version int
+		want    string
+	}{
+		{0, "2"},
+		{1, "1"},
+		{2, "2"},
+	}
+	for _, tt := range tests {
+		got, err := s.Get("gcp/key", tt.version)
+		if err != nil {
+			t.Fatalf("Get(%d) error = %v", tt.version, err)
+		}
+		if got["v"] != tt.want {
+			t.Errorf("Get(%d) = %v, want v=%s", tt.version, got, tt.want)
+		}
+	}
+	if _, err := s.Get("gcp/key", 3); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() of a missing version error = %v, want ErrNotFound", err)
+	}
+	// paths which differ only in escaped characters are distinct secrets
+	for _, p := range []string{"a/b", "a.b", "a_b"} {
+		if err := s.Put(p, map[string]interface{}{"v": p}); err != nil {
+			t.Fatalf("Put(%s) error = %v", p, err)
+		}
+	}
+	for _, p := range []string{"a/b", "a.b", "a_b"} {
+		if got, err := s.Get(p, 0); err != nil || got["v"] != p {
+			t.Errorf("Get(%s) = %v, %v, want v=%s", p, got, err, p)
+		}
+	}
+	stub.versions["stratus_2Finvalid"] = []string{base64.StdEncoding.EncodeToString([]byte("not json"))}
+	if _, err := s.Get("invalid", 0); err == nil {
+		t.Error("Get() accepted a secret which is not a JSON object")
+	}
+	if _, err := List(s, ""); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("List() error = %v, want ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,321 @@
+package secretstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// sopsExtensions are the file extensions tried for a secret path, in order
+var sopsExtensions = []string{".yaml", ".yml", ".json"}
+
+// sopsValue matches a sops encrypted value
+var sopsValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.*),tag:(.*),type:(.*)\]$`)
+
+// sopsMACOnlyEncryptedInit is written to the mac hash first when the mac only
+// covers encrypted values, the sha256 of "sops"
+var sopsMACOnlyEncryptedInit = []byte{
+	0x8a, 0x3f, 0xd2, 0xad, 0x54, 0xce, 0x66, 0x52, 0x7b, 0x10, 0x34, 0xf3, 0xd1, 0x47, 0xbe, 0x0b,
+	0x0b, 0x97, 0x5b, 0x3b, 0xf4, 0x4f, 0x72, 0xc6, 0xfd, 0xad, 0xec, 0x81, 0x76, 0xf2, 0x7d, 0x69,
+}
+
+// SOPS reads secrets from a local directory of sops files encrypted for age.
+// The secret at path is the file path.yaml, path.yml or path.json in the
+// directory. It is intended for small deployments and local development.
+type SOPS struct {
+	dir string
+	ids []age.Identity
+}
+
+// NewSOPS returns a sops store for SECRET_STORE_SOPS_DIR, decrypting with
+// the age identities in SOPS_AGE_KEY_FILE or SOPS_AGE_KEY
+func NewSOPS() (*SOPS, error) {
+	dir := os.Getenv("SECRET_STORE_SOPS_DIR")
+	if dir == "" {
+		return nil, errors.New("SECRET_STORE_SOPS_DIR required")
+	}
+	keys := os.Getenv("SOPS_AGE_KEY")
+	if f := os.Getenv("SOPS_AGE_KEY_FILE"); f != "" {
+		fd, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		keys += "\n" + string(fd)
+	}
+	ids, err := parseAgeIdentities(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &SOPS{dir: dir, ids: ids}, nil
+}
+
+// file returns the file of the secret at path, which must be within the directory
+func (s *SOPS) file(path string) (string, error) {
+	p := filepath.Join(s.dir, filepath.FromSlash(filepath.Clean("/"+path)))
+	for _, ext := range sopsExtensions {
+		if _, err := os.Stat(p + ext); err == nil {
+			return p + ext, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrNotFound, path)
+}
+
+// Get returns the decrypted secret at path. Files are not versioned.
+func (s *SOPS) Get(path string, version int) (map[string]interface{}, error) {
+	l := log.WithFields(log.Fields{
+		"action": "SOPS.Get",
+		"path":   path,
+	})
+	l.Info("start")
+	if version != 0 {
+		return nil, fmt.Errorf("secret versions: %w", ErrUnsupported)
+	}
+	f, err := s.file(path)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.decrypt(fd)
+	if err != nil {
+		l.Printf("%+v", err)
+		return nil, fmt.Errorf("decrypt %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// List lists the secrets and sub-directories under path
+func (s *SOPS) List(path string) ([]string, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(s.dir, filepath.FromSlash(filepath.Clean("/"+path))))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, fi := range fis {
+		n := fi.Name()
+		if fi.IsDir() {
+			keys = append(keys, n+"/")
+			continue
+		}
+		for _, ext := range sopsExtensions {
+			if strings.HasSuffix(n, ext) {
+				keys = append(keys, strings.TrimSuffix(n, ext))
+				break
+			}
+		}
+	}
+	return keys, nil
+}
+
+// sopsMetadata is the sops metadata of an encrypted file
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+	LastModified string `yaml:"lastmodified"`
+	MAC          string `yaml:"mac"`
+	// MACOnlyEncrypted excludes unencrypted values from the mac
+	MACOnlyEncrypted bool `yaml:"mac_only_encrypted"`
+}
+
+// decrypt decrypts a sops file. The data key is decrypted with the age
+// identities, each value is decrypted with the data key, and the file mac
+// is verified. YAML is a superset of JSON, so both formats are parsed as YAML,
+// which preserves the key order the mac is computed in.
+func (s *SOPS) decrypt(fd []byte) (map[string]interface{}, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(fd, &doc); err != nil {
+		return nil, err
+	}
+	var meta sopsMetadata
+	var tree yaml.MapSlice
+	for _, item := range doc {
+		if item.Key == "sops" {
+			b, err := yaml.Marshal(item.Value)
+			if err != nil {
+				return nil, err
+			}
+			if err := yaml.Unmarshal(b, &meta); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		tree = append(tree, item)
+	}
+	if len(meta.Age) == 0 {
+		return nil, errors.New("file is not encrypted for age")
+	}
+	var key []byte
+	for _, a := range meta.Age {
+		k, err := ageDecrypt([]byte(a.Enc), s.ids)
+		if err == nil {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return nil, errors.New("no age identity can decrypt the data key")
+	}
+	w := &sopsWalker{key: key, hash: sha512.New(), onlyEncrypted: meta.MACOnlyEncrypted}
+	if meta.MACOnlyEncrypted {
+		w.hash.Write(sopsMACOnlyEncryptedInit)
+	}
+	out, err := w.walk(tree, nil)
+	if err != nil {
+		return nil, err
+	}
+	mac, err := sopsDecryptValue(meta.MAC, key, meta.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("mac: %w", err)
+	}
+	if fmt.Sprintf("%X", w.hash.Sum(nil)) != mac {
+		return nil, errors.New("mac mismatch")
+	}
+	m, ok := out.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("secret is not an object")
+	}
+	return m, nil
+}
+
+// sopsWalker decrypts the values of a tree with the data key
+type sopsWalker struct {
+	key           []byte
+	hash          hash.Hash
+	onlyEncrypted bool
+}
+
+// walk decrypts the values of a tree, writing each value to the mac hash in
+// order. The additional data of a value is its path of keys, each followed
+// by ":".
+func (w *sopsWalker) walk(v interface{}, path []string) (interface{}, error) {
+	switch t := v.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{}, len(t))
+		for _, item := range t {
+			k := fmt.Sprint(item.Key)
+			d, err := w.walk(item.Value, append(path[:len(path):len(path)], k))
+			if err != nil {
+				return nil, err
+			}
+			m[k] = d
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			d, err := w.walk(e, path)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = d
+		}
+		return l, nil
+	case string:
+		if !sopsValue.MatchString(t) {
+			w.plain(t)
+			return t, nil
+		}
+		p, err := sopsDecryptValue(t, w.key, strings.Join(path, ":")+":")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", strings.Join(path, "."), err)
+		}
+		w.hash.Write([]byte(p))
+		return sopsTyped(t, p)
+	case nil:
+		return nil, nil
+	default:
+		w.plain(sopsString(t))
+		return t, nil
+	}
+}
+
+// plain writes an unencrypted value to the mac hash, unless the mac only
+// covers encrypted values
+func (w *sopsWalker) plain(v string) {
+	if !w.onlyEncrypted {
+		w.hash.Write([]byte(v))
+	}
+}
+
+// sopsString formats an unencrypted value as sops does for the mac
+func sopsString(v interface{}) string {
+	switch t := v.(type) {
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		if t {
+			return "True"
+		}
+		return "False"
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// sopsDecryptValue decrypts an ENC[AES256_GCM,...] value with the data key
+func sopsDecryptValue(v string, key []byte, aad string) (string, error) {
+	m := sopsValue.FindStringSubmatch(v)
+	if m == nil {
+		return "", errors.New("invalid encrypted value")
+	}
+	data, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		return "", err
+	}
+	iv, err := base64.StdEncoding.DecodeString(m[2])
+	if err != nil {
+		return "", err
+	}
+	tag, err := base64.StdEncoding.DecodeString(m[3])
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", err
+	}
+	p, err := gcm.Open(nil, iv, append(data, tag...), []byte(aad))
+	if err != nil {
+		return "", errors.New("value decryption failed")
+	}
+	return string(p), nil
+}
+
+// sopsTyped converts a decrypted value to the type recorded with it
+func sopsTyped(enc, p string) (interface{}, error) {
+	switch sopsValue.FindStringSubmatch(enc)[4] {
+	case "int":
+		return strconv.Atoi(p)
+	case "float":
+		return strconv.ParseFloat(p, 64)
+	case "bool":
+		return strconv.ParseBool(p)
+	default:
+		return p, nil
+	}
+}
@@ -0,0 +1,214 @@
+package secretstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v2"
+)
+
+// The files in testdata/sops were encrypted with sops 3.13.3 for the age
+// identity in testdata/sops/age.key. mac-only-encrypted.yaml was encrypted
+// with mac_only_encrypted set. The files in testdata/sops/tampered are copies
+// of gcp/key.yaml with an unencrypted value changed (mac-mismatch.yaml) and
+// the ciphertext of an encrypted value changed (value.yaml).
+
+// newTestSOPS returns a sops store for testdata/sops
+func newTestSOPS(t *testing.T) *SOPS {
+	t.Helper()
+	setenv(t, "SECRET_STORE_SOPS_DIR", filepath.Join("testdata", "sops"))
+	setenv(t, "SOPS_AGE_KEY_FILE", filepath.Join("testdata", "sops", "age.key"))
+	setenv(t, "SOPS_AGE_KEY", "")
+	s, err := NewSOPS()
+	if err != nil {
+		t.Fatalf("NewSOPS() error = %v", err)
+	}
+	return s
+}
+
+// gcpKey is the plaintext of testdata/sops/gcp/key.yaml
+var gcpKey = map[string]interface{}{
+	"type":           "service_account",
+	"project_id":     "stratus-test",
+	"private_key_id": "0123456789abcdef",
+	"port":           8443,
+	"ratio":          0.5,
+	"enabled":        true,
+	"scopes": []interface{}{
+		"https://www.googleapis.com/auth/cloud-platform",
+		"https://www.googleapis.com/auth/iam",
+	},
+	"nested": map[string]interface{}{
+		"client_email": "stratus@stratus-test.iam.gserviceaccount.com",
+		"client_id":    "1234567890",
+	},
+	"owner_unencrypted":    "platform-team",
+	"public_unencrypted":   false,
+	"replicas_unencrypted": 3,
+}
+
+func TestSOPSGet(t *testing.T) {
+	s := newTestSOPS(t)
+	tests := []struct {
+		path    string
+		version int
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{path: "gcp/key", want: gcpKey},
+		{path: "/gcp/key", want: gcpKey},
+		{path: "mac-only-encrypted", want: gcpKey},
+		{
+			path: "token",
+			want: map[string]interface{}{
+				"token":     "k8s-service-account-token",
+				"namespace": "stratus",
+				"expires":   3600,
+			},
+		},
+		{path: "gcp/key", version: 1, wantErr: "not supported"},
+		{path: "gcp/missing", wantErr: "secret not found"},
+		{path: "../sops/gcp/key", wantErr: "secret not found"},
+		{path: "../../secretstore", wantErr: "secret not found"},
+		{path: "tampered/mac-mismatch", wantErr: "mac mismatch"},
+		{path: "tampered/value", wantErr: "port: value decryption failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := s.Get(tt.path, tt.version)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Get() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Get() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSOPSGetNotFound(t *testing.T) {
+	s := newTestSOPS(t)
+	if _, err := s.Get("gcp/missing", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSOPSWrongIdentity(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "SECRET_STORE_SOPS_DIR", filepath.Join("testdata", "sops"))
+	setenv(t, "SOPS_AGE_KEY_FILE", "")
+	setenv(t, "SOPS_AGE_KEY", id.String())
+	s, err := NewSOPS()
+	if err != nil {
+		t.Fatalf("NewSOPS() error = %v", err)
+	}
+	if _, err := s.Get("gcp/key", 0); err == nil || !strings.Contains(err.Error(), "no age identity") {
+		t.Errorf("Get() error = %v, want no age identity", err)
+	}
+}
+
+func TestSOPSList(t *testing.T) {
+	s := newTestSOPS(t)
+	got, err := s.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{"gcp/", "mac-only-encrypted", "tampered/", "token"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+	if got, err := s.List("missing"); err != nil || got != nil {
+		t.Errorf("List(missing) = %v, %v, want nil", got, err)
+	}
+}
+
+func TestNewSOPS(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		dir     string
+		key     string
+		wantErr bool
+	}{
+		{"identity", "testdata", id.String(), false},
+		{"identity with comments", "testdata", "# created: now\n\n" + id.String() + "\n", false},
+		{"no dir", "", id.String(), true},
+		{"no identity", "testdata", "", true},
+		{"invalid identity", "testdata", "AGE-SECRET-KEY-1INVALID", true},
+		{"recipient", "testdata", id.Recipient().String(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "SECRET_STORE_SOPS_DIR", tt.dir)
+			setenv(t, "SOPS_AGE_KEY_FILE", "")
+			setenv(t, "SOPS_AGE_KEY", tt.key)
+			if _, err := NewSOPS(); (err != nil) != tt.wantErr {
+				t.Errorf("NewSOPS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAgeDecryptArmored(t *testing.T) {
+	ids, err := parseAgeIdentities(readFixture(t, "sops/age.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		SOPS sopsMetadata `yaml:"sops"`
+	}
+	if err := yaml.Unmarshal([]byte(readFixture(t, "sops/gcp/key.yaml")), &doc); err != nil {
+		t.Fatal(err)
+	}
+	enc := doc.SOPS.Age[0].Enc
+	if !strings.HasPrefix(enc, "-----BEGIN AGE ENCRYPTED FILE-----") {
+		t.Fatalf("data key is not armored: %q", enc)
+	}
+	key, err := ageDecrypt([]byte(enc), ids)
+	if err != nil {
+		t.Fatalf("ageDecrypt() error = %v", err)
+	}
+	if len(key) != 32 {
+		t.Errorf("got a %d byte data key, want 32", len(key))
+	}
+	// change the first character of the last line of the armored payload
+	lines := strings.Split(strings.TrimSpace(enc), "\n")
+	last := lines[len(lines)-2]
+	c := "A"
+	if strings.HasPrefix(last, "A") {
+		c = "B"
+	}
+	lines[len(lines)-2] = c + last[1:]
+	if _, err := ageDecrypt([]byte(strings.Join(lines, "\n")), ids); err == nil {
+		t.Error("ageDecrypt() accepted a tampered payload")
+	}
+}
+
+// readFixture returns the contents of a file in testdata
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", filepath.FromSlash(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,62 @@
+package secretstore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/robertlestak/stratus/internal/vaultclient"
+)
+
+// Vault reads secrets from the vault kv secrets engine
+type Vault struct {
+	// Client is the vault client, the global client if nil
+	Client *vaultclient.VaultClient
+}
+
+// client returns the vault client of the store
+func (v *Vault) client() (*vaultclient.VaultClient, error) {
+	if v.Client != nil {
+		return v.Client, nil
+	}
+	if vaultclient.Client != nil {
+		return vaultclient.Client, nil
+	}
+	return nil, errors.New("vault client not initialized")
+}
+
+// notFound maps vault's not found error to ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, vaultclient.ErrSecretNotFound) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
+
+// Get returns the secret at path
+func (v *Vault) Get(path string, version int) (map[string]interface{}, error) {
+	vc, err := v.client()
+	if err != nil {
+		return nil, err
+	}
+	s, err := vc.GetKVSecretVersionRetry(path, version)
+	return s, notFound(err)
+}
+
+// Put writes the secret at path
+func (v *Vault) Put(path string, data map[string]interface{}) error {
+	vc, err := v.client()
+	if err != nil {
+		return err
+	}
+	return vc.PutKVSecretRetry(path, data)
+}
+
+// List lists the keys under path
+func (v *Vault) List(path string) ([]string, error) {
+	vc, err := v.client()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := vc.ListKVSecretsRetry(path)
+	return keys, notFound(err)
+}
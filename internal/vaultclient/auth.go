@@ -0,0 +1,315 @@
+package vaultclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/robertlestak/stratus/internal/jwt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// AuthAppRole logs in with a role ID and secret ID read from files
+	AuthAppRole = "approle"
+	// AuthAWS logs in with a signed sts:GetCallerIdentity request
+	AuthAWS = "aws"
+	// AuthGCP logs in with a service account JWT (iam) or instance identity token (gce)
+	AuthGCP = "gcp"
+	// AuthCert logs in with the client TLS certificate
+	AuthCert = "cert"
+	// AuthAgent reads the token from a Vault Agent token sink file
+	AuthAgent = "agent"
+
+	// defaultGCEMetadataHost is the GCE metadata server
+	defaultGCEMetadataHost = "metadata.google.internal"
+)
+
+// authMount returns the mount path of the auth method. Unrecognized auth
+// methods are the mount path of a JWT style auth method.
+func (vc *VaultClient) authMount() string {
+	if vc.AuthMount != "" {
+		return strings.Trim(vc.AuthMount, "/")
+	}
+	return vc.AuthMethod
+}
+
+// readFile returns the trimmed contents of a file
+func readFile(f string) (string, error) {
+	fd, err := ioutil.ReadFile(f)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(fd)), nil
+}
+
+// loginData returns the login request of the auth method
+func (vc *VaultClient) loginData() (map[string]interface{}, error) {
+	switch vc.AuthMethod {
+	case AuthAppRole:
+		return vc.appRoleLogin()
+	case AuthAWS:
+		return vc.awsLogin()
+	case AuthGCP:
+		return vc.gcpLogin()
+	case AuthCert:
+		d := map[string]interface{}{}
+		if vc.Role != "" {
+			d["name"] = vc.Role
+		}
+		return d, nil
+	default:
+		return map[string]interface{}{
+			"role": vc.Role,
+			"jwt":  vc.KubeToken,
+		}, nil
+	}
+}
+
+// appRoleLogin returns an approle login request. The role ID is read from
+// RoleIDFile, or is Role if unset. The secret ID is read from SecretIDFile
+// if set. Both files are read on every login so they can be rotated.
+func (vc *VaultClient) appRoleLogin() (map[string]interface{}, error) {
+	roleID := vc.Role
+	if vc.RoleIDFile != "" {
+		r, err := readFile(vc.RoleIDFile)
+		if err != nil {
+			return nil, err
+		}
+		roleID = r
+	}
+	if roleID == "" {
+		return nil, errors.New("approle role id required")
+	}
+	d := map[string]interface{}{
+		"role_id": roleID,
+	}
+	if vc.SecretIDFile != "" {
+		s, err := readFile(vc.SecretIDFile)
+		if err != nil {
+			return nil, err
+		}
+		d["secret_id"] = s
+	}
+	return d, nil
+}
+
+// awsSTSEndpoint returns the STS endpoint of the login request for region:
+// AWSSTSEndpoint if set, otherwise AWS_STS_ENDPOINT with any {region}
+// placeholder replaced, otherwise the FIPS endpoint of the region if
+// AWS_USE_FIPS_ENDPOINT is true. An empty endpoint is the SDK default.
+func (vc *VaultClient) awsSTSEndpoint(region string) string {
+	if vc.AWSSTSEndpoint != "" {
+		return vc.AWSSTSEndpoint
+	}
+	if e := os.Getenv("AWS_STS_ENDPOINT"); e != "" {
+		return strings.ReplaceAll(e, "{region}", region)
+	}
+	if os.Getenv("AWS_USE_FIPS_ENDPOINT") == "true" {
+		suffix := "amazonaws.com"
+		if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+			suffix = p.DNSSuffix()
+		}
+		return "https://sts-fips." + region + "." + suffix
+	}
+	return ""
+}
+
+// awsLogin returns an aws iam login request, a sts:GetCallerIdentity request
+// signed with the default AWS credentials. Without AWSRegion the request is
+// sent to the global STS endpoint, which is the vault default; with AWSRegion
+// it is sent to the regional endpoint, so vault must set sts_region and
+// sts_endpoint to match.
+func (vc *VaultClient) awsLogin() (map[string]interface{}, error) {
+	region := vc.AWSRegion
+	cfg := &aws.Config{
+		Region:              aws.String(region),
+		STSRegionalEndpoint: endpoints.RegionalSTSEndpoint,
+	}
+	if region == "" {
+		region = "us-east-1"
+		cfg.Region = aws.String(region)
+		cfg.STSRegionalEndpoint = endpoints.LegacySTSEndpoint
+	}
+	if e := vc.awsSTSEndpoint(region); e != "" {
+		cfg.Endpoint = aws.String(e)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	req, _ := sts.New(sess).GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	if vc.AWSHeaderValue != "" {
+		req.HTTPRequest.Header.Add("X-Vault-AWS-IAM-Server-ID", vc.AWSHeaderValue)
+	}
+	if err := req.Sign(); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(req.HTTPRequest.Body)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := json.Marshal(req.HTTPRequest.Header)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"role":                    vc.Role,
+		"iam_http_request_method": req.HTTPRequest.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(req.HTTPRequest.URL.String())),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+		"iam_request_body":        base64.StdEncoding.EncodeToString(body),
+	}, nil
+}
+
+// gcpLogin returns a gcp login request. The gce type uses the instance
+// identity token from the metadata server, the iam type (default) signs a
+// JWT with the service account key in GCPCredentials.
+func (vc *VaultClient) gcpLogin() (map[string]interface{}, error) {
+	aud := "vault/" + vc.Role
+	var t string
+	var err error
+	switch vc.GCPAuthType {
+	case "gce":
+		t, err = gceIdentityToken("http://" + aud)
+	case "", "iam":
+		t, err = vc.gcpSignedJWT(aud)
+	default:
+		err = fmt.Errorf("unsupported gcp auth type %q", vc.GCPAuthType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"role": vc.Role,
+		"jwt":  t,
+	}, nil
+}
+
+// gcpSignedJWT signs a short lived JWT for aud with the service account key
+func (vc *VaultClient) gcpSignedJWT(aud string) (string, error) {
+	f := vc.GCPCredentials
+	if f == "" {
+		f = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if f == "" {
+		return "", errors.New("gcp credentials file required")
+	}
+	fd, err := ioutil.ReadFile(f)
+	if err != nil {
+		return "", err
+	}
+	var key struct {
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		PrivateKeyID string `json:"private_key_id"`
+	}
+	if err := json.Unmarshal(fd, &key); err != nil {
+		return "", err
+	}
+	k, err := jwt.ParseRSAPrivateKey([]byte(key.PrivateKey))
+	if err != nil {
+		return "", err
+	}
+	return jwt.SignRS256(map[string]interface{}{
+		"sub": key.ClientEmail,
+		"aud": aud,
+		"exp": time.Now().Add(time.Minute * 10).Unix(),
+	}, k, key.PrivateKeyID)
+}
+
+// gceIdentityToken returns the identity token of the instance service account
+// for aud from the metadata server, GCE_METADATA_HOST if set
+func gceIdentityToken(aud string) (string, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = defaultGCEMetadataHost
+	}
+	u := "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/identity?" + url.Values{
+		"audience": {aud},
+		"format":   {"full"},
+	}.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	hc := &http.Client{Timeout: 10 * time.Second}
+	res, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %d", res.StatusCode)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readTokenFile sets the token from the Vault Agent token sink file
+func (vc *VaultClient) readTokenFile() (string, error) {
+	if vc.TokenFile == "" {
+		return "", errors.New("token file required")
+	}
+	t, err := readFile(vc.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	if t == "" {
+		return "", errors.New("token file is empty")
+	}
+	vc.Token = t
+	vc.Client.SetToken(t)
+	vc.setAuth(nil)
+	return t, nil
+}
+
+// watchTokenFile reloads the token when the Vault Agent token sink file
+// changes. The agent renews and replaces the token.
+func (vc *VaultClient) watchTokenFile(interval time.Duration) {
+	l := log.WithFields(log.Fields{
+		"vaultAddr": vc.VaultAddr,
+		"action":    "vault.watchTokenFile",
+		"file":      vc.TokenFile,
+	})
+	l.Info("start")
+	var mod time.Time
+	for {
+		fi, err := os.Stat(vc.TokenFile)
+		if err != nil {
+			l.Printf("%+v", err)
+			recordRenewalFailure(err)
+		} else if !fi.ModTime().Equal(mod) {
+			if _, err := vc.NewToken(); err != nil {
+				l.Printf("%+v", err)
+				recordRenewalFailure(err)
+			} else {
+				mod = fi.ModTime()
+				l.Info("token reloaded")
+			}
+		}
+		if auth, err := vc.tokenSecret(); err != nil {
+			l.Printf("%+v", err)
+			recordRenewalFailure(err)
+		} else {
+			recordLookup(vc.AuthMethod, auth.Auth.Renewable, time.Duration(auth.Auth.LeaseDuration)*time.Second)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,306 @@
+package vaultclient
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/robertlestak/stratus/internal/jwt"
+)
+
+// writeFile writes content to name in the test directory, returning its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(f, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// login creates the client of vc against the stub, which logs in
+func login(t *testing.T, stub *vaultStub, vc *VaultClient) {
+	t.Helper()
+	resetTokenStatus(t)
+	setenv(t, "LOCAL", "")
+	setenv(t, "VAULT_ADDR", stub.URL)
+	vc.VaultAddr = stub.URL
+	if _, err := vc.NewClient(); err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if vc.Token != "s.login" || vc.Client.Token() != "s.login" {
+		t.Errorf("token = %q, want the login token", vc.Token)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		vc       *VaultClient
+		kubeJWT  string
+		wantPath string
+		wantBody map[string]interface{}
+	}{
+		{
+			name: "approle files",
+			vc: &VaultClient{
+				AuthMethod:   AuthAppRole,
+				RoleIDFile:   "role-id\n",
+				SecretIDFile: "secret-id\n",
+			},
+			wantPath: "/v1/auth/approle/login",
+			wantBody: map[string]interface{}{"role_id": "role-id", "secret_id": "secret-id"},
+		},
+		{
+			name:     "approle role without secret id",
+			vc:       &VaultClient{AuthMethod: AuthAppRole, AuthMount: "/ci-approle/", Role: "role-id"},
+			wantPath: "/v1/auth/ci-approle/login",
+			wantBody: map[string]interface{}{"role_id": "role-id"},
+		},
+		{
+			name:     "cert with role",
+			vc:       &VaultClient{AuthMethod: AuthCert, Role: "web"},
+			wantPath: "/v1/auth/cert/login",
+			wantBody: map[string]interface{}{"name": "web"},
+		},
+		{
+			name:     "cert without role",
+			vc:       &VaultClient{AuthMethod: AuthCert, AuthMount: "tls"},
+			wantPath: "/v1/auth/tls/login",
+			wantBody: map[string]interface{}{},
+		},
+		{
+			name:     "kubernetes",
+			vc:       &VaultClient{AuthMethod: "kubernetes", Role: "stratus"},
+			kubeJWT:  "kube-jwt",
+			wantPath: "/v1/auth/kubernetes/login",
+			wantBody: map[string]interface{}{"role": "stratus", "jwt": "kube-jwt"},
+		},
+		{
+			name:     "jwt style mount",
+			vc:       &VaultClient{AuthMethod: "k8s-dev", Role: "stratus"},
+			kubeJWT:  "kube-jwt",
+			wantPath: "/v1/auth/k8s-dev/login",
+			wantBody: map[string]interface{}{"role": "stratus", "jwt": "kube-jwt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newVaultStub(t)
+			if tt.vc.RoleIDFile != "" {
+				tt.vc.RoleIDFile = writeFile(t, "role-id", tt.vc.RoleIDFile)
+			}
+			if tt.vc.SecretIDFile != "" {
+				tt.vc.SecretIDFile = writeFile(t, "secret-id", tt.vc.SecretIDFile)
+			}
+			kt := ""
+			if tt.kubeJWT != "" {
+				kt = writeFile(t, "token", tt.kubeJWT)
+			}
+			setenv(t, "KUBE_TOKEN", kt)
+			login(t, stub, tt.vc)
+			if n := stub.count("/v1/auth/"); n != 1 || stub.count(tt.wantPath) != 1 {
+				t.Fatalf("requests = %v, want one login at %s", stub.requests, tt.wantPath)
+			}
+			if got := stub.body(tt.wantPath); !reflect.DeepEqual(got, tt.wantBody) {
+				t.Errorf("login body = %v, want %v", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestLoginAppRoleMissingRoleID(t *testing.T) {
+	vc := &VaultClient{AuthMethod: AuthAppRole}
+	if _, err := vc.loginData(); err == nil {
+		t.Error("loginData() accepted approle without a role id")
+	}
+	vc.RoleIDFile = filepath.Join(t.TempDir(), "missing")
+	if _, err := vc.loginData(); err == nil {
+		t.Error("loginData() accepted a missing role id file")
+	}
+}
+
+func TestLoginAWS(t *testing.T) {
+	tests := []struct {
+		name       string
+		region     string
+		endpoint   string
+		envSTS     string
+		fips       bool
+		wantURL    string
+		wantRegion string
+	}{
+		{name: "default", wantURL: "https://sts.amazonaws.com", wantRegion: "us-east-1"},
+		{name: "region", region: "eu-west-1", wantURL: "https://sts.eu-west-1.amazonaws.com", wantRegion: "eu-west-1"},
+		{name: "endpoint", region: "eu-west-1", endpoint: "https://vpce-1.sts.eu-west-1.vpce.amazonaws.com", wantURL: "https://vpce-1.sts.eu-west-1.vpce.amazonaws.com", wantRegion: "eu-west-1"},
+		{name: "sts endpoint env", region: "us-west-2", envSTS: "https://sts.{region}.example.com", wantURL: "https://sts.us-west-2.example.com", wantRegion: "us-west-2"},
+		{name: "endpoint before env", region: "us-west-2", endpoint: "https://sts.internal", envSTS: "https://sts.{region}.example.com", wantURL: "https://sts.internal", wantRegion: "us-west-2"},
+		{name: "fips", region: "us-gov-west-1", fips: true, wantURL: "https://sts-fips.us-gov-west-1.amazonaws.com", wantRegion: "us-gov-west-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+			setenv(t, "AWS_SECRET_ACCESS_KEY", "secret")
+			setenv(t, "AWS_SESSION_TOKEN", "")
+			setenv(t, "AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+			setenv(t, "AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+			setenv(t, "AWS_STS_REGIONAL_ENDPOINTS", "")
+			setenv(t, "AWS_STS_ENDPOINT", tt.envSTS)
+			fips := "false"
+			if tt.fips {
+				fips = "true"
+			}
+			setenv(t, "AWS_USE_FIPS_ENDPOINT", fips)
+			setenv(t, "KUBE_TOKEN", "")
+			stub := newVaultStub(t)
+			login(t, stub, &VaultClient{
+				AuthMethod:     AuthAWS,
+				Role:           "stratus",
+				AWSRegion:      tt.region,
+				AWSSTSEndpoint: tt.endpoint,
+				AWSHeaderValue: "vault.example.com",
+			})
+			body := stub.body("/v1/auth/aws/login")
+			if body == nil {
+				t.Fatalf("requests = %v, want a login at /v1/auth/aws/login", stub.requests)
+			}
+			decode := func(k string) string {
+				s, _ := body[k].(string)
+				b, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					t.Fatalf("%s: %v", k, err)
+				}
+				return string(b)
+			}
+			if body["role"] != "stratus" || body["iam_http_request_method"] != http.MethodPost {
+				t.Errorf("login body = %v", body)
+			}
+			if got := strings.TrimSuffix(decode("iam_request_url"), "/"); got != tt.wantURL {
+				t.Errorf("iam_request_url = %s, want %s", got, tt.wantURL)
+			}
+			if got, err := url.ParseQuery(decode("iam_request_body")); err != nil || got.Get("Action") != "GetCallerIdentity" {
+				t.Errorf("iam_request_body = %v", got)
+			}
+			var headers http.Header
+			if err := json.Unmarshal([]byte(decode("iam_request_headers")), &headers); err != nil {
+				t.Fatal(err)
+			}
+			if got := headers.Get("X-Vault-AWS-IAM-Server-ID"); got != "vault.example.com" {
+				t.Errorf("X-Vault-AWS-IAM-Server-ID = %q", got)
+			}
+			if auth := headers.Get("Authorization"); !strings.Contains(auth, "/"+tt.wantRegion+"/sts/aws4_request") {
+				t.Errorf("Authorization = %q, want it signed for %s", auth, tt.wantRegion)
+			}
+		})
+	}
+}
+
+// testServiceAccountKey returns a service account key file for email
+func testServiceAccountKey(t *testing.T, email string) (string, *rsa.PrivateKey) {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+	kd, _ := json.Marshal(map[string]string{
+		"client_email":   email,
+		"private_key":    string(kp),
+		"private_key_id": "key-1",
+	})
+	return writeFile(t, "key.json", string(kd)), k
+}
+
+func TestLoginGCPIAM(t *testing.T) {
+	const email = "stratus@stratus-test.iam.gserviceaccount.com"
+	f, k := testServiceAccountKey(t, email)
+	setenv(t, "KUBE_TOKEN", "")
+	stub := newVaultStub(t)
+	login(t, stub, &VaultClient{AuthMethod: AuthGCP, AuthMount: "gcp-prod", Role: "stratus", GCPCredentials: f})
+	body := stub.body("/v1/auth/gcp-prod/login")
+	if body == nil || body["role"] != "stratus" {
+		t.Fatalf("login body = %v", body)
+	}
+	tok, _ := body["jwt"].(string)
+	var claims struct {
+		Sub string `json:"sub"`
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+	}
+	if err := jwt.VerifyRS256(tok, &k.PublicKey, &claims); err != nil {
+		t.Fatalf("jwt not signed with the service account key: %v", err)
+	}
+	if claims.Sub != email || claims.Aud != "vault/stratus" || claims.Exp == 0 {
+		t.Errorf("jwt claims = %+v", claims)
+	}
+	if kid, _ := jwt.KeyID(tok); kid != "key-1" {
+		t.Errorf("jwt kid = %q, want key-1", kid)
+	}
+}
+
+func TestLoginGCE(t *testing.T) {
+	var query url.Values
+	md := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/identity" || r.Header.Get("Metadata-Flavor") != "Google" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.Query()
+		w.Write([]byte("gce-identity-token\n"))
+	}))
+	t.Cleanup(md.Close)
+	setenv(t, "GCE_METADATA_HOST", strings.TrimPrefix(md.URL, "http://"))
+	setenv(t, "KUBE_TOKEN", "")
+	stub := newVaultStub(t)
+	login(t, stub, &VaultClient{AuthMethod: AuthGCP, Role: "stratus", GCPAuthType: "gce"})
+	want := map[string]interface{}{"role": "stratus", "jwt": "gce-identity-token"}
+	if got := stub.body("/v1/auth/gcp/login"); !reflect.DeepEqual(got, want) {
+		t.Errorf("login body = %v, want %v", got, want)
+	}
+	if query.Get("audience") != "http://vault/stratus" || query.Get("format") != "full" {
+		t.Errorf("identity token query = %v", query)
+	}
+}
+
+func TestLoginGCPUnsupportedType(t *testing.T) {
+	vc := &VaultClient{AuthMethod: AuthGCP, Role: "stratus", GCPAuthType: "iap"}
+	if _, err := vc.loginData(); err == nil {
+		t.Error("loginData() accepted an unsupported gcp auth type")
+	}
+}
+
+func TestLoginAgentTokenFile(t *testing.T) {
+	setenv(t, "KUBE_TOKEN", "")
+	stub := newVaultStub(t)
+	resetTokenStatus(t)
+	setenv(t, "LOCAL", "")
+	vc := &VaultClient{VaultAddr: stub.URL, AuthMethod: AuthAgent, TokenFile: writeFile(t, "token", "s.agent\n")}
+	if _, err := vc.NewClient(); err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if vc.Token != "s.agent" || vc.Client.Token() != "s.agent" {
+		t.Errorf("token = %q, want the token file contents", vc.Token)
+	}
+	if n := stub.count("/v1/auth/"); n != 0 {
+		t.Errorf("got %d vault requests, want none", n)
+	}
+
+	empty := &VaultClient{VaultAddr: stub.URL, AuthMethod: AuthAgent, TokenFile: writeFile(t, "empty", "\n")}
+	if _, err := empty.NewClient(); err == nil {
+		t.Error("NewClient() accepted an empty token file")
+	}
+	if _, err := (&VaultClient{AuthMethod: AuthAgent}).readTokenFile(); err == nil {
+		t.Error("readTokenFile() accepted no token file")
+	}
+}
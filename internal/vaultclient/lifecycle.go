@@ -0,0 +1,326 @@
+package vaultclient
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrSecretNotFound is returned when a secret does not exist, or the requested version has no data
+	ErrSecretNotFound = errors.New("secret not found")
+	// ErrPermissionDenied is returned when the token is valid but not permitted to access a path
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrAuthExpired is returned when the token is no longer valid and a new login is required
+	ErrAuthExpired = errors.New("vault token expired or revoked")
+	// errStaticToken is recorded when a static token can not be renewed, as
+	// it can not be replaced by logging in
+	errStaticToken = errors.New("static vault token can not be renewed or replaced")
+
+	tokenMu     sync.RWMutex
+	tokenStatus TokenStatus
+
+	loginsMetric          = expvar.NewInt("vault_logins")
+	renewalsMetric        = expvar.NewInt("vault_token_renewals")
+	renewalFailuresMetric = expvar.NewInt("vault_token_renewal_failures")
+	tokenExpiryMetric     = expvar.NewInt("vault_token_expiry_unix")
+)
+
+// TokenStatus describes the state of the stratus vault token
+type TokenStatus struct {
+	AuthMethod      string    `json:"authMethod"`
+	Renewable       bool      `json:"renewable"`
+	ExpiresAt       time.Time `json:"expiresAt,omitempty"`
+	TTL             string    `json:"ttl"`
+	LastCheck       time.Time `json:"lastCheck,omitempty"`
+	LastLogin       time.Time `json:"lastLogin,omitempty"`
+	LastRenewal     time.Time `json:"lastRenewal,omitempty"`
+	LastError       string    `json:"lastError,omitempty"`
+	RenewalFailures int       `json:"renewalFailures"`
+	Healthy         bool      `json:"healthy"`
+}
+
+// CurrentTokenStatus returns a snapshot of the vault token status. The token
+// is healthy once it has been checked and while it has not expired, tokens
+// without an expiry do not expire.
+func CurrentTokenStatus() TokenStatus {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	s := tokenStatus
+	s.Healthy = !s.LastCheck.IsZero()
+	if !s.ExpiresAt.IsZero() {
+		ttl := time.Until(s.ExpiresAt).Round(time.Second)
+		s.TTL = ttl.String()
+		s.Healthy = s.Healthy && ttl > 0
+	}
+	return s
+}
+
+// recordToken records a valid token with its ttl. The caller must hold tokenMu.
+func recordToken(method string, renewable bool, ttl time.Duration) {
+	now := time.Now()
+	tokenStatus.AuthMethod = method
+	tokenStatus.Renewable = renewable
+	tokenStatus.ExpiresAt = time.Time{}
+	if ttl > 0 {
+		tokenStatus.ExpiresAt = now.Add(ttl)
+	}
+	tokenStatus.LastCheck = now
+	tokenStatus.LastError = ""
+	tokenStatus.RenewalFailures = 0
+	tokenExpiryMetric.Set(tokenStatus.ExpiresAt.Unix())
+}
+
+// recordLookup records the ttl of the current token
+func recordLookup(method string, renewable bool, ttl time.Duration) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	recordToken(method, renewable, ttl)
+}
+
+// recordLogin records a new token created by a login
+func recordLogin(method string, renewable bool, ttl time.Duration) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	recordToken(method, renewable, ttl)
+	tokenStatus.LastLogin = tokenStatus.LastCheck
+	loginsMetric.Add(1)
+}
+
+// recordRenewal records a renewal of the current token
+func recordRenewal(method string, ttl time.Duration) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	recordToken(method, true, ttl)
+	tokenStatus.LastRenewal = tokenStatus.LastCheck
+	renewalsMetric.Add(1)
+}
+
+// recordRenewalFailure records a failed renewal or login and returns the number of consecutive failures
+func recordRenewalFailure(err error) int {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	tokenStatus.LastError = err.Error()
+	tokenStatus.RenewalFailures++
+	renewalFailuresMetric.Add(1)
+	return tokenStatus.RenewalFailures
+}
+
+// tokenExpired reports whether the token is known to have expired
+func tokenExpired() bool {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	return !tokenStatus.ExpiresAt.IsZero() && time.Now().After(tokenStatus.ExpiresAt)
+}
+
+// classifyError maps a vault error to ErrSecretNotFound, ErrPermissionDenied or ErrAuthExpired.
+// Vault returns 403 both for expired tokens and for paths outside the token's policies,
+// so the token is looked up to tell the two apart. Other errors are returned unchanged.
+func (vc *VaultClient) classifyError(err error) error {
+	var re *api.ResponseError
+	if !errors.As(err, &re) {
+		return err
+	}
+	switch re.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %v", ErrSecretNotFound, err)
+	case http.StatusForbidden, http.StatusUnauthorized:
+		if tokenExpired() {
+			return fmt.Errorf("%w: %v", ErrAuthExpired, err)
+		}
+		if _, lerr := vc.Client.Auth().Token().LookupSelf(); lerr != nil {
+			if errors.As(lerr, &re) && (re.StatusCode == http.StatusForbidden || re.StatusCode == http.StatusUnauthorized) {
+				return fmt.Errorf("%w: %v", ErrAuthExpired, err)
+			}
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrPermissionDenied, err)
+	}
+	return err
+}
+
+// tokenSecret returns the auth secret of the current token, looking up the
+// token if it was not created by a login
+func (vc *VaultClient) tokenSecret() (*api.Secret, error) {
+	vc.authMu.Lock()
+	auth := vc.auth
+	vc.authMu.Unlock()
+	if auth != nil && auth.Auth != nil {
+		return auth, nil
+	}
+	s, err := vc.Client.Auth().Token().LookupSelf()
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errors.New("token lookup returned no data")
+	}
+	ttl, err := s.TokenTTL()
+	if err != nil {
+		return nil, err
+	}
+	renewable, err := s.TokenIsRenewable()
+	if err != nil {
+		return nil, err
+	}
+	return &api.Secret{
+		Auth: &api.SecretAuth{
+			ClientToken:   vc.Client.Token(),
+			Renewable:     renewable,
+			LeaseDuration: int(ttl.Seconds()),
+		},
+	}, nil
+}
+
+// envDuration parses a duration from the environment, returning def if unset
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.WithField("env", name).WithError(err).Error("invalid duration, using default")
+		return def
+	}
+	return d
+}
+
+// Run keeps the vault token valid. Renewable tokens are renewed by a lifetime
+// watcher before they expire, and a new token is created by logging in again
+// once the token can no longer be renewed. Tokens which are not renewable are
+// replaced shortly before they expire. Tokens from a Vault Agent sink are
+// reloaded when the sink file changes. A static LOCAL token can not be
+// replaced, so once it can not be renewed it is reported unhealthy and
+// checked again with backoff.
+func (vc *VaultClient) Run() {
+	l := log.WithFields(log.Fields{
+		"vaultAddr": vc.VaultAddr,
+		"action":    "vault.Run",
+	})
+	l.Info("start")
+	check := envDuration("VAULT_TOKEN_CHECK_INTERVAL", time.Minute*5)
+	retry := envDuration("VAULT_TOKEN_RETRY_INTERVAL", time.Second*10)
+	if vc.AuthMethod == AuthAgent {
+		// the agent renews the token, reload it when the sink file changes
+		vc.watchTokenFile(envDuration("VAULT_TOKEN_FILE_INTERVAL", time.Second*10))
+		return
+	}
+	for {
+		auth, err := vc.tokenSecret()
+		if err != nil {
+			l.Printf("%+v", err)
+			vc.reauthenticate(err, retry)
+			continue
+		}
+		ttl := time.Duration(auth.Auth.LeaseDuration) * time.Second
+		recordLookup(vc.authMethodName(), auth.Auth.Renewable, ttl)
+		switch {
+		case ttl == 0:
+			// the token does not expire, check it is still valid periodically
+			time.Sleep(check)
+			vc.setAuth(nil)
+		case !auth.Auth.Renewable:
+			// replace the token once two thirds of its ttl has passed
+			time.Sleep(ttl * 2 / 3)
+			vc.reauthenticate(nil, retry)
+		default:
+			vc.watch(auth)
+			vc.reauthenticate(nil, retry)
+		}
+	}
+}
+
+// watch renews the token until it can no longer be renewed
+func (vc *VaultClient) watch(auth *api.Secret) {
+	l := log.WithFields(log.Fields{
+		"vaultAddr": vc.VaultAddr,
+		"action":    "vault.watch",
+	})
+	w, err := vc.Client.NewLifetimeWatcher(&api.LifetimeWatcherInput{
+		Secret: auth,
+	})
+	if err != nil {
+		l.Printf("%+v", err)
+		recordRenewalFailure(err)
+		return
+	}
+	go w.Start()
+	defer w.Stop()
+	for {
+		select {
+		case err := <-w.DoneCh():
+			if err != nil {
+				l.Printf("token renewal failed: %v", err)
+				recordRenewalFailure(err)
+				return
+			}
+			l.Info("token reached its max ttl")
+			return
+		case r := <-w.RenewCh():
+			if r.Secret != nil && r.Secret.Auth != nil {
+				l.Info("token renewed")
+				recordRenewal(vc.authMethodName(), time.Duration(r.Secret.Auth.LeaseDuration)*time.Second)
+			}
+		}
+	}
+}
+
+// retryWait returns the wait before retry n, growing linearly up to 30 times retry
+func retryWait(retry time.Duration, n int) time.Duration {
+	wait := retry * time.Duration(n)
+	if max := retry * 30; wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// reauthenticate creates a new token, retrying with backoff until it succeeds.
+// cause is recorded as a failure if set. A static token can not be replaced,
+// so the failure is recorded and the token is looked up again after the
+// backoff, leaving it unhealthy once it has expired.
+func (vc *VaultClient) reauthenticate(cause error, retry time.Duration) {
+	l := log.WithFields(log.Fields{
+		"vaultAddr": vc.VaultAddr,
+		"action":    "vault.reauthenticate",
+	})
+	if vc.staticToken() {
+		err := errStaticToken
+		if cause != nil {
+			err = fmt.Errorf("%w: %v", errStaticToken, cause)
+		}
+		n := recordRenewalFailure(err)
+		l.Printf("%v (%d)", err, n)
+		// look the token up again after the backoff rather than reusing
+		// the cached auth secret
+		vc.setAuth(nil)
+		time.Sleep(retryWait(retry, n))
+		return
+	}
+	if cause != nil {
+		recordRenewalFailure(cause)
+	}
+	for {
+		if _, err := vc.NewToken(); err != nil {
+			n := recordRenewalFailure(err)
+			l.Printf("login failed (%d): %v", n, err)
+			time.Sleep(retryWait(retry, n))
+			continue
+		}
+		return
+	}
+}
+
+// setAuth sets the auth secret of the current token
+func (vc *VaultClient) setAuth(s *api.Secret) {
+	vc.authMu.Lock()
+	defer vc.authMu.Unlock()
+	vc.auth = s
+}
@@ -0,0 +1,162 @@
+package vaultclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, k, v string) {
+	t.Helper()
+	old, ok := os.LookupEnv(k)
+	os.Setenv(k, v)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(k, old)
+		} else {
+			os.Unsetenv(k)
+		}
+	})
+}
+
+// vaultStub is a stand-in Vault server which accepts every login, rejects
+// every token, and records the requests it receives by path
+type vaultStub struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests map[string]int
+	// bodies are the decoded bodies of the last request to each path
+	bodies map[string]map[string]interface{}
+}
+
+func newVaultStub(t *testing.T) *vaultStub {
+	t.Helper()
+	s := &vaultStub{requests: map[string]int{}, bodies: map[string]map[string]interface{}{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		s.bodies[r.URL.Path] = body
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/login") {
+			w.Write([]byte(`{"auth":{"client_token":"s.login","renewable":true,"lease_duration":3600}}`))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// body returns the decoded body of the last request to path
+func (s *vaultStub) body(path string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bodies[path]
+}
+
+// count returns the number of requests with a path starting with prefix
+func (s *vaultStub) count(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for p, c := range s.requests {
+		if strings.HasPrefix(p, prefix) {
+			n += c
+		}
+	}
+	return n
+}
+
+// resetTokenStatus clears the recorded token status for the test
+func resetTokenStatus(t *testing.T) {
+	tokenMu.Lock()
+	tokenStatus = TokenStatus{}
+	tokenMu.Unlock()
+	t.Cleanup(func() {
+		tokenMu.Lock()
+		tokenStatus = TokenStatus{}
+		tokenMu.Unlock()
+	})
+}
+
+func TestRetryWait(t *testing.T) {
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{5, 5 * time.Second},
+		{30, 30 * time.Second},
+		{100, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := retryWait(time.Second, tt.n); got != tt.want {
+			t.Errorf("retryWait(1s, %d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestReauthenticateStaticTokenBacksOff(t *testing.T) {
+	stub := newVaultStub(t)
+	resetTokenStatus(t)
+	setenv(t, "LOCAL", "true")
+	setenv(t, "VAULT_ADDR", stub.URL)
+	vc := &VaultClient{VaultAddr: stub.URL, AuthMethod: "kubernetes", Token: "s.static"}
+	if _, err := vc.NewClient(); err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	logins := loginsMetric.Value()
+
+	retry := 10 * time.Millisecond
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := vc.tokenSecret()
+		if err == nil {
+			t.Fatal("tokenSecret() accepted a rejected token")
+		}
+		vc.reauthenticate(err, retry)
+	}
+	// the waits grow with each consecutive failure: 1, 2 and 3 times retry
+	if elapsed := time.Since(start); elapsed < 6*retry {
+		t.Errorf("reauthenticate waited %s, want at least %s", elapsed, 6*retry)
+	}
+	if n := stub.count("/v1/auth/token/lookup-self"); n != 3 {
+		t.Errorf("got %d token lookups, want 3", n)
+	}
+	if n := stub.count("/v1/auth/kubernetes"); n != 0 {
+		t.Errorf("got %d logins with a static token", n)
+	}
+	if got := loginsMetric.Value(); got != logins {
+		t.Errorf("vault_logins = %d, want %d", got, logins)
+	}
+	s := CurrentTokenStatus()
+	if s.Healthy {
+		t.Error("status healthy with a rejected static token")
+	}
+	if s.RenewalFailures != 3 || !strings.Contains(s.LastError, errStaticToken.Error()) {
+		t.Errorf("status = %+v, want 3 static token failures", s)
+	}
+}
+
+func TestAuthMethodName(t *testing.T) {
+	vc := &VaultClient{AuthMethod: "kubernetes", Token: "s.login"}
+	if got := vc.authMethodName(); got != "kubernetes" {
+		t.Errorf("authMethodName() = %q, want kubernetes", got)
+	}
+	vc.static = true
+	if got := vc.authMethodName(); got != "token" {
+		t.Errorf("authMethodName() with a static token = %q, want token", got)
+	}
+}
@@ -5,26 +5,126 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/hashicorp/vault/api"
 )
 
+const (
+	// defaultKVMount is the kv secrets engine mount used if none is configured
+	defaultKVMount = "devops"
+	// defaultKVPath is the path prefix for stratus secrets used if none is configured
+	defaultKVPath = "stratus-dev/"
+)
+
 var (
 	Client *VaultClient
 )
 
+// mount returns the kv mount of the client
+func (vc *VaultClient) mount() string {
+	if vc.Mount == "" {
+		return defaultKVMount
+	}
+	return strings.Trim(vc.Mount, "/")
+}
+
+// prefix returns the path prefix of the client with a trailing slash
+func (vc *VaultClient) prefix() string {
+	p := vc.Path
+	if p == "" {
+		p = defaultKVPath
+	}
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+// kvV1 returns true if the mount is a kv version 1 engine
+func (vc *VaultClient) kvV1() bool {
+	return vc.KVVersion == 1
+}
+
+// relPath returns the path of secret s within the mount. Paths starting with
+// "/" are relative to the root of the mount rather than the prefix.
+func (vc *VaultClient) relPath(s string) string {
+	if strings.HasPrefix(s, "/") {
+		return strings.TrimPrefix(s, "/")
+	}
+	return vc.prefix() + s
+}
+
+// kvDataPath returns the full kv data path for the secret s
+func (vc *VaultClient) kvDataPath(s string) string {
+	if vc.kvV1() {
+		return vc.mount() + "/" + vc.relPath(s)
+	}
+	return vc.mount() + "/data/" + vc.relPath(s)
+}
+
+// kvMetadataPath returns the full kv path used to list the secret s
+func (vc *VaultClient) kvMetadataPath(s string) string {
+	if vc.kvV1() {
+		return vc.mount() + "/" + vc.relPath(s)
+	}
+	return vc.mount() + "/metadata/" + vc.relPath(s)
+}
+
 // VaultClient is a single self-contained vault client
 type VaultClient struct {
 	VaultAddr  string      `yaml:"vaultAddr"`
 	CIDR       string      `yaml:"cidr"`
 	AuthMethod string      `yaml:"authMethod"`
 	Role       string      `yaml:"role"`
-	Path       string      `yaml:"path"`
+	Path       string      `yaml:"path"`      // kv path prefix within Mount
+	Mount      string      `yaml:"mount"`     // kv secrets engine mount
+	KVVersion  int         `yaml:"kvVersion"` // kv engine version, 1 or 2 (default)
 	KubeToken  string      // auto-filled
 	Client     *api.Client // auto-filled
 	Token      string      // auto-filled
+
+	// AuthMount is the mount path of the auth method, AuthMethod if unset
+	AuthMount string `yaml:"authMount"`
+	// Namespace is the vault enterprise namespace
+	Namespace string `yaml:"namespace"`
+	// CACert, ClientCert and ClientKey are paths to PEM files used for TLS
+	CACert        string `yaml:"caCert"`
+	ClientCert    string `yaml:"clientCert"`
+	ClientKey     string `yaml:"clientKey"`
+	TLSServerName string `yaml:"tlsServerName"`
+	TLSSkipVerify bool   `yaml:"tlsSkipVerify"`
+	// RoleIDFile and SecretIDFile contain the approle role and secret IDs
+	RoleIDFile   string `yaml:"roleIdFile"`
+	SecretIDFile string `yaml:"secretIdFile"`
+	// AWSRegion is the region of the signed sts request, us-east-1 if unset
+	AWSRegion string `yaml:"awsRegion"`
+	// AWSSTSEndpoint is the endpoint of the signed sts request, which must
+	// match the sts_endpoint of the vault aws auth config
+	AWSSTSEndpoint string `yaml:"awsStsEndpoint"`
+	// AWSHeaderValue is sent as the X-Vault-AWS-IAM-Server-ID header
+	AWSHeaderValue string `yaml:"awsHeaderValue"`
+	// GCPAuthType is iam (default) or gce
+	GCPAuthType string `yaml:"gcpAuthType"`
+	// GCPCredentials is the path of the service account key for gcp iam auth,
+	// GOOGLE_APPLICATION_CREDENTIALS if unset
+	GCPCredentials string `yaml:"gcpCredentials"`
+	// TokenFile is the Vault Agent token sink file
+	TokenFile string `yaml:"tokenFile"`
+
+	// auth is the auth secret of the last login, used to renew the token
+	auth   *api.Secret
+	authMu sync.Mutex
+	// static is set if Token was given in LOCAL mode and is used instead of logging in
+	static bool
+	// loginMu serializes logins
+	loginMu sync.Mutex
 }
 
 // NewClients creates and returns a new vault client with a valid token or error
@@ -34,8 +134,24 @@ func (vc *VaultClient) NewClient() (*api.Client, error) {
 		"action":    "vault.NewClient",
 	})
 	l.Printf("vault.NewClient")
-	config := &api.Config{
-		Address: vc.VaultAddr,
+	config := api.DefaultConfig()
+	if config.Error != nil {
+		l.Printf("vault.NewClient error: %v\n", config.Error)
+		return nil, config.Error
+	}
+	config.Address = vc.VaultAddr
+	if vc.CACert != "" || vc.ClientCert != "" || vc.TLSServerName != "" || vc.TLSSkipVerify {
+		terr := config.ConfigureTLS(&api.TLSConfig{
+			CACert:        vc.CACert,
+			ClientCert:    vc.ClientCert,
+			ClientKey:     vc.ClientKey,
+			TLSServerName: vc.TLSServerName,
+			Insecure:      vc.TLSSkipVerify,
+		})
+		if terr != nil {
+			l.Printf("vault.NewClient error: %v\n", terr)
+			return nil, terr
+		}
 	}
 	var err error
 	vc.Client, err = api.NewClient(config)
@@ -43,6 +159,9 @@ func (vc *VaultClient) NewClient() (*api.Client, error) {
 		l.Printf("vault.NewClient error: %v\n", err)
 		return vc.Client, err
 	}
+	if vc.Namespace != "" {
+		vc.Client.SetNamespace(vc.Namespace)
+	}
 	if os.Getenv("KUBE_TOKEN") != "" {
 		l.Printf("vault.NewClient using KUBE_TOKEN")
 		fd, err := ioutil.ReadFile(os.Getenv("KUBE_TOKEN"))
@@ -52,6 +171,9 @@ func (vc *VaultClient) NewClient() (*api.Client, error) {
 		}
 		vc.KubeToken = string(fd)
 	}
+	// a token set in LOCAL mode is used instead of logging in. Login sets
+	// Token as well, so this is decided once before the first token.
+	vc.static = os.Getenv("LOCAL") != "" && vc.Token != ""
 	_, terr := vc.NewToken()
 	if terr != nil {
 		l.Printf("vault.NewClient error: %v\n", terr)
@@ -61,7 +183,9 @@ func (vc *VaultClient) NewClient() (*api.Client, error) {
 	return vc.Client, err
 }
 
-// Login creates a vault token with the k8s auth provider
+// Login creates a vault token with the configured auth method. Unrecognized
+// auth methods are the mount path of a JWT style auth method, such as the k8s
+// auth provider. With the agent auth method the token is read from the sink file.
 func (vc *VaultClient) Login() (string, error) {
 	l := log.WithFields(log.Fields{
 		"vaultAddr":  vc.VaultAddr,
@@ -70,22 +194,46 @@ func (vc *VaultClient) Login() (string, error) {
 		"authMethod": vc.AuthMethod,
 	})
 	l.Printf("vault.Login")
-	options := map[string]interface{}{
-		"role": vc.Role,
-		"jwt":  vc.KubeToken,
+	if vc.AuthMethod == AuthAgent {
+		return vc.readTokenFile()
 	}
-	path := fmt.Sprintf("auth/%s/login", vc.AuthMethod)
+	options, err := vc.loginData()
+	if err != nil {
+		l.Printf("vault.Login(%s) error: %v\n", vc.AuthMethod, err)
+		return "", err
+	}
+	path := fmt.Sprintf("auth/%s/login", vc.authMount())
 	secret, err := vc.Client.Logical().Write(path, options)
 	if err != nil {
 		l.Printf("vault.Login(%s) error: %v\n", vc.AuthMethod, err)
 		return "", err
 	}
+	if secret == nil || secret.Auth == nil {
+		l.Printf("vault.Login(%s) error: no auth returned\n", vc.AuthMethod)
+		return "", errors.New("login returned no auth")
+	}
 	vc.Token = secret.Auth.ClientToken
 	l.Printf("vault.Login(%s) success\n", vc.AuthMethod)
 	vc.Client.SetToken(vc.Token)
+	vc.setAuth(secret)
+	recordLogin(vc.AuthMethod, secret.Auth.Renewable, time.Duration(secret.Auth.LeaseDuration)*time.Second)
 	return vc.Token, nil
 }
 
+// staticToken returns true if the client uses the token it was given in LOCAL
+// mode, which can not be replaced by logging in
+func (vc *VaultClient) staticToken() bool {
+	return vc.static
+}
+
+// authMethodName returns the auth method reported in the token status
+func (vc *VaultClient) authMethodName() string {
+	if vc.staticToken() {
+		return "token"
+	}
+	return vc.AuthMethod
+}
+
 // NewToken generate a new token for session. If LOCAL env var is set and the token is as well, the login is
 // skipped and the token is used instead.
 func (vc *VaultClient) NewToken() (string, error) {
@@ -94,17 +242,26 @@ func (vc *VaultClient) NewToken() (string, error) {
 		"action":    "vault.NewToken",
 	})
 	l.Printf("vault.NewToken")
-	if os.Getenv("LOCAL") != "" && vc.Token != "" {
+	vc.loginMu.Lock()
+	defer vc.loginMu.Unlock()
+	if vc.staticToken() {
 		l.Printf("vault.NewToken using local token")
 		vc.Client.SetToken(vc.Token)
+		vc.setAuth(nil)
 		return vc.Token, nil
 	}
 	l.Printf("vault.NewToken calling Login")
 	return vc.Login()
 }
 
-// GetKVSecret retrieves a kv secret from vault
+// GetKVSecret retrieves the latest version of a kv secret from vault
 func (vc *VaultClient) GetKVSecret(s string) (map[string]interface{}, error) {
+	return vc.GetKVSecretVersion(s, 0)
+}
+
+// GetKVSecretVersion retrieves a kv secret from vault. If version is not 0
+// that version of the secret is read, which requires kv version 2.
+func (vc *VaultClient) GetKVSecretVersion(s string, version int) (map[string]interface{}, error) {
 	l := log.WithFields(log.Fields{
 		"vaultAddr": vc.VaultAddr,
 		"action":    "vault.GetKVSecret",
@@ -115,23 +272,48 @@ func (vc *VaultClient) GetKVSecret(s string) (map[string]interface{}, error) {
 		l.Printf("vault.GetKVSecret error: secret path is empty")
 		return secrets, errors.New("secret path required")
 	}
-	s = "devops/data/stratus-dev/" + s
-	secret, err := vc.Client.Logical().Read(s)
+	if version != 0 && vc.kvV1() {
+		return secrets, errors.New("secret versions require kv version 2")
+	}
+	s = vc.kvDataPath(s)
+	var secret *api.Secret
+	var err error
+	if version != 0 {
+		secret, err = vc.Client.Logical().ReadWithData(s, map[string][]string{
+			"version": {strconv.Itoa(version)},
+		})
+	} else {
+		secret, err = vc.Client.Logical().Read(s)
+	}
 	if err != nil {
 		l.Printf("vault.GetKVSecret(%s) c.Read error: %v\n", s, err)
-		return secrets, err
+		return secrets, vc.classifyError(err)
 	}
 	if secret == nil || secret.Data == nil {
 		l.Printf("vault.GetKVSecret(%s) error: secret is nil\n", s)
-		return nil, errors.New("secret not found")
+		return nil, ErrSecretNotFound
 	}
 	l.Printf("vault.GetKVSecret(%s) success\n", s)
-	return secret.Data["data"].(map[string]interface{}), nil
+	if vc.kvV1() {
+		return secret.Data, nil
+	}
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		// deleted and destroyed versions have no data
+		return nil, ErrSecretNotFound
+	}
+	return data, nil
 }
 
-// GetKVSecretRetry will login and retry secret access on failure
-// to gracefully handle token expiration
+// GetKVSecretRetry will login and retry secret access if the token has
+// expired. Other errors, such as a missing secret, are returned without retrying.
 func (vc *VaultClient) GetKVSecretRetry(s string) (map[string]interface{}, error) {
+	return vc.GetKVSecretVersionRetry(s, 0)
+}
+
+// GetKVSecretVersionRetry will login and retry versioned secret access if
+// the token has expired
+func (vc *VaultClient) GetKVSecretVersionRetry(s string, version int) (map[string]interface{}, error) {
 	l := log.WithFields(log.Fields{
 		"vaultAddr": vc.VaultAddr,
 		"action":    "vault.GetKVSecretRetry",
@@ -139,20 +321,120 @@ func (vc *VaultClient) GetKVSecretRetry(s string) (map[string]interface{}, error
 	l.Printf("vault.GetKVSecretRetry")
 	var sec map[string]interface{}
 	var err error
-	sec, err = vc.GetKVSecret(s)
-	if err != nil {
+	sec, err = vc.GetKVSecretVersion(s, version)
+	if errors.Is(err, ErrAuthExpired) {
 		l.Printf("vault.GetKVSecretRetry(%s) error: %v\n", s, err)
 		_, terr := vc.NewToken()
 		if terr != nil {
 			l.Printf("vault.GetKVSecretRetry(%s) error: %v\n", s, terr)
 			return sec, terr
 		}
-		sec, err = vc.GetKVSecret(s)
-		if err != nil {
-			l.Printf("vault.GetKVSecretRetry(%s) error: %v\n", s, err)
-			return sec, err
-		}
+		sec, err = vc.GetKVSecretVersion(s, version)
+	}
+	if err != nil {
+		l.Printf("vault.GetKVSecretRetry(%s) error: %v\n", s, err)
+		return sec, err
 	}
 	l.Printf("vault.GetKVSecretRetry(%s) success\n", s)
 	return sec, err
 }
+
+// PutKVSecret writes a kv secret to vault, creating a new version
+func (vc *VaultClient) PutKVSecret(s string, data map[string]interface{}) error {
+	l := log.WithFields(log.Fields{
+		"vaultAddr": vc.VaultAddr,
+		"action":    "vault.PutKVSecret",
+	})
+	l.Printf("vault.PutKVSecret")
+	if s == "" {
+		l.Printf("vault.PutKVSecret error: secret path is empty")
+		return errors.New("secret path required")
+	}
+	s = vc.kvDataPath(s)
+	body := map[string]interface{}{
+		"data": data,
+	}
+	if vc.kvV1() {
+		body = data
+	}
+	_, err := vc.Client.Logical().Write(s, body)
+	if err != nil {
+		l.Printf("vault.PutKVSecret(%s) c.Write error: %v\n", s, err)
+		return vc.classifyError(err)
+	}
+	l.Printf("vault.PutKVSecret(%s) success\n", s)
+	return nil
+}
+
+// PutKVSecretRetry will login and retry the write if the token has expired
+func (vc *VaultClient) PutKVSecretRetry(s string, data map[string]interface{}) error {
+	l := log.WithFields(log.Fields{
+		"vaultAddr": vc.VaultAddr,
+		"action":    "vault.PutKVSecretRetry",
+	})
+	l.Printf("vault.PutKVSecretRetry")
+	if err := vc.PutKVSecret(s, data); errors.Is(err, ErrAuthExpired) {
+		l.Printf("vault.PutKVSecretRetry(%s) error: %v\n", s, err)
+		if _, terr := vc.NewToken(); terr != nil {
+			l.Printf("vault.PutKVSecretRetry(%s) error: %v\n", s, terr)
+			return terr
+		}
+		return vc.PutKVSecret(s, data)
+	} else if err != nil {
+		l.Printf("vault.PutKVSecretRetry(%s) error: %v\n", s, err)
+		return err
+	}
+	return nil
+}
+
+// ListKVSecrets lists the keys under a kv path in vault. Keys ending in "/"
+// are sub-paths.
+func (vc *VaultClient) ListKVSecrets(s string) ([]string, error) {
+	l := log.WithFields(log.Fields{
+		"vaultAddr": vc.VaultAddr,
+		"action":    "vault.ListKVSecrets",
+	})
+	l.Printf("vault.ListKVSecrets")
+	var keys []string
+	s = vc.kvMetadataPath(s)
+	secret, err := vc.Client.Logical().List(s)
+	if err != nil {
+		l.Printf("vault.ListKVSecrets(%s) c.List error: %v\n", s, err)
+		return keys, vc.classifyError(err)
+	}
+	if secret == nil || secret.Data == nil {
+		l.Printf("vault.ListKVSecrets(%s) no keys\n", s)
+		return keys, nil
+	}
+	ks, ok := secret.Data["keys"].([]interface{})
+	if !ok {
+		return keys, errors.New("invalid list response")
+	}
+	for _, k := range ks {
+		if ks, ok := k.(string); ok {
+			keys = append(keys, ks)
+		}
+	}
+	l.Printf("vault.ListKVSecrets(%s) success\n", s)
+	return keys, nil
+}
+
+// ListKVSecretsRetry will login and retry the list if the token has expired
+func (vc *VaultClient) ListKVSecretsRetry(s string) ([]string, error) {
+	l := log.WithFields(log.Fields{
+		"vaultAddr": vc.VaultAddr,
+		"action":    "vault.ListKVSecretsRetry",
+	})
+	l.Printf("vault.ListKVSecretsRetry")
+	keys, err := vc.ListKVSecrets(s)
+	if errors.Is(err, ErrAuthExpired) {
+		l.Printf("vault.ListKVSecretsRetry(%s) error: %v\n", s, err)
+		_, terr := vc.NewToken()
+		if terr != nil {
+			l.Printf("vault.ListKVSecretsRetry(%s) error: %v\n", s, terr)
+			return keys, terr
+		}
+		return vc.ListKVSecrets(s)
+	}
+	return keys, err
+}
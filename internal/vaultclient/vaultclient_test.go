@@ -0,0 +1,80 @@
+package vaultclient
+
+import "testing"
+
+func TestKVPaths(t *testing.T) {
+	tests := []struct {
+		name         string
+		vc           *VaultClient
+		secret       string
+		wantData     string
+		wantMetadata string
+	}{
+		{
+			name:         "defaults",
+			vc:           &VaultClient{},
+			secret:       "ci/sa",
+			wantData:     "devops/data/stratus-dev/ci/sa",
+			wantMetadata: "devops/metadata/stratus-dev/ci/sa",
+		},
+		{
+			name:         "kv v2 explicit",
+			vc:           &VaultClient{Mount: "secret", Path: "stratus", KVVersion: 2},
+			secret:       "ci/sa",
+			wantData:     "secret/data/stratus/ci/sa",
+			wantMetadata: "secret/metadata/stratus/ci/sa",
+		},
+		{
+			name:         "kv v1",
+			vc:           &VaultClient{Mount: "kv", Path: "stratus", KVVersion: 1},
+			secret:       "ci/sa",
+			wantData:     "kv/stratus/ci/sa",
+			wantMetadata: "kv/stratus/ci/sa",
+		},
+		{
+			name:         "slashes trimmed",
+			vc:           &VaultClient{Mount: "/secret/", Path: "/teams/stratus/"},
+			secret:       "ci/sa",
+			wantData:     "secret/data/teams/stratus/ci/sa",
+			wantMetadata: "secret/metadata/teams/stratus/ci/sa",
+		},
+		{
+			name:         "empty prefix",
+			vc:           &VaultClient{Mount: "secret", Path: "/"},
+			secret:       "ci/sa",
+			wantData:     "secret/data/ci/sa",
+			wantMetadata: "secret/metadata/ci/sa",
+		},
+		{
+			name:         "path from mount root",
+			vc:           &VaultClient{Mount: "secret", Path: "stratus"},
+			secret:       "/shared/sa",
+			wantData:     "secret/data/shared/sa",
+			wantMetadata: "secret/metadata/shared/sa",
+		},
+		{
+			name:         "kv v1 path from mount root",
+			vc:           &VaultClient{Mount: "kv", Path: "stratus", KVVersion: 1},
+			secret:       "/shared/sa",
+			wantData:     "kv/shared/sa",
+			wantMetadata: "kv/shared/sa",
+		},
+		{
+			name:         "list prefix",
+			vc:           &VaultClient{Mount: "secret", Path: "stratus"},
+			secret:       "",
+			wantData:     "secret/data/stratus/",
+			wantMetadata: "secret/metadata/stratus/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.vc.kvDataPath(tt.secret); got != tt.wantData {
+				t.Errorf("kvDataPath(%q) = %q, want %q", tt.secret, got, tt.wantData)
+			}
+			if got := tt.vc.kvMetadataPath(tt.secret); got != tt.wantMetadata {
+				t.Errorf("kvMetadataPath(%q) = %q, want %q", tt.secret, got, tt.wantMetadata)
+			}
+		})
+	}
+}
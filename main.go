@@ -3,15 +3,24 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"expvar"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/robertlestak/stratus/internal/admission"
+	"github.com/robertlestak/stratus/internal/agent"
 	"github.com/robertlestak/stratus/internal/config"
 	"github.com/robertlestak/stratus/internal/identity"
+	"github.com/robertlestak/stratus/internal/rotator"
+	"github.com/robertlestak/stratus/internal/secretstore"
 	"github.com/robertlestak/stratus/internal/vaultclient"
 	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
 )
 
 // newRequestID returns a uuid
@@ -48,6 +57,24 @@ func handleIdentityRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, jerr.Error(), http.StatusBadRequest)
 		return
 	}
+	// select the response format before performing the exchange
+	format, ferr := identity.NegotiateFormat(r.URL.Query().Get("format"), r.Header.Get("Accept"))
+	if ferr == nil && !format.Supports(mm.Target.Provider) {
+		ferr = identity.ErrUnsupportedFormat
+	}
+	if ferr != nil {
+		l.Printf("%+v", ferr)
+		w.Header().Add("x-request-id", mm.RequestID)
+		http.Error(w, ferr.Error(), http.StatusNotAcceptable)
+		return
+	}
+	// refuse exchanges if the config has not been refreshed within the max staleness
+	if config.Stale() {
+		l.Error("config is stale, refusing exchange")
+		w.Header().Add("x-request-id", mm.RequestID)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	// check if source is valid with its cloud provider
 	if !mm.Source.Valid() {
 		l.Errorf("%+v", errors.New("invalid source identity"))
@@ -55,8 +82,12 @@ func handleIdentityRequest(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	l.WithFields(log.Fields{
+		"source":     mm.Source.ID,
+		"attributes": mm.Source.Attributes,
+	}).Info("source validated")
 	// find matching config block for source and target
-	i, ierr := mm.FindIDinMap(config.IdMaps)
+	i, ierr := mm.FindIDinMap(config.Table())
 	if ierr != nil {
 		l.Printf("%+v", ierr)
 		w.Header().Add("x-request-id", mm.RequestID)
@@ -64,21 +95,26 @@ func handleIdentityRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// config block was found and returned clean from config, re-add request id and source credentials
+	i.RequestID = mm.RequestID
 	i.Source.RequestID = mm.RequestID
 	i.Target.RequestID = mm.RequestID
 	i.Source.Credentials = mm.Source.Credentials
-	mm.Target.Credentials = i.Target.Credentials
-	// retrieve the credentials for the target identity
-	c, cerr := mm.GetCredentials(vaultclient.Client)
+	i.Source.Attributes = mm.Source.Attributes
+	if i.Target.Region == "" {
+		i.Target.Region = mm.Target.Region
+	}
+	// retrieve the credentials for the target identity using the config block,
+	// so per-mapping settings apply rather than anything supplied by the caller
+	c, cerr := i.GetCredentials(vaultclient.Client, secretstore.Default)
 	if cerr != nil {
 		l.Printf("%+v", cerr)
 		w.Header().Add("x-request-id", mm.RequestID)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	// return target credentials to the client
+	// return target credentials to the client in the requested format
 	i.Target.Credentials = c
-	jd, jerr := json.Marshal(i.Target.Credentials)
+	jd, ct, jerr := identity.FormatCredentials(format, i.Target.Provider, i.Target.Credentials, r.URL.Query().Get("profile"))
 	if jerr != nil {
 		l.Printf("%+v", jerr)
 		w.Header().Add("x-request-id", mm.RequestID)
@@ -86,34 +122,272 @@ func handleIdentityRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Add("x-request-id", mm.RequestID)
+	w.Header().Set("Content-Type", ct)
+	w.Write(jd)
+}
+
+// handleStatus returns the config reload status
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"func": "handleStatus",
+	})
+	st := config.CurrentStatus()
+	jd, jerr := json.Marshal(st)
+	if jerr != nil {
+		l.Printf("%+v", jerr)
+		http.Error(w, jerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if st.Stale {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(jd)
+}
+
+// handleClusterStatus returns the status of the registered k8s clusters
+func handleClusterStatus(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"func": "handleClusterStatus",
+	})
+	jd, jerr := json.Marshal(identity.Clusters.Status())
+	if jerr != nil {
+		l.Printf("%+v", jerr)
+		http.Error(w, jerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(jd)
 }
 
-// init initializes the application
-func init() {
+// handleVaultStatus returns the status of the stratus vault token
+func handleVaultStatus(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"func": "handleVaultStatus",
+	})
+	if vaultclient.Client == nil {
+		http.Error(w, "vault not configured", http.StatusNotFound)
+		return
+	}
+	st := vaultclient.CurrentTokenStatus()
+	jd, jerr := json.Marshal(st)
+	if jerr != nil {
+		l.Printf("%+v", jerr)
+		http.Error(w, jerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !st.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(jd)
+}
+
+// handleChallenge issues a single-use nonce for a source to sign
+func handleChallenge(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"func": "handleChallenge",
+	})
+	c, err := identity.IssueChallenge()
+	if err != nil {
+		l.Printf("%+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jd, jerr := json.Marshal(c)
+	if jerr != nil {
+		l.Printf("%+v", jerr)
+		http.Error(w, jerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(jd)
+}
+
+// handleConfigWebhook handles git push webhooks which trigger a config reload
+func handleConfigWebhook(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"func": "handleConfigWebhook",
+	})
+	l.Info("start")
+	defer r.Body.Close()
+	body, berr := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 5<<20))
+	if berr != nil {
+		l.Printf("%+v", berr)
+		http.Error(w, berr.Error(), http.StatusBadRequest)
+		return
+	}
+	triggered, err := config.HandleWebhook(r.Header, body)
+	switch {
+	case errors.Is(err, config.ErrWebhookDisabled):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, config.ErrWebhookUnauthorized):
+		w.WriteHeader(http.StatusUnauthorized)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case triggered:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAdmission handles mutating admission reviews in webhook mode
+func handleAdmission(w http.ResponseWriter, r *http.Request) {
+	l := log.WithFields(log.Fields{
+		"func": "handleAdmission",
+	})
+	defer r.Body.Close()
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 5<<20)).Decode(&review); err != nil {
+		l.Printf("%+v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jd, jerr := json.Marshal(admission.Review(&review, admission.ConfigFromEnv()))
+	if jerr != nil {
+		l.Printf("%+v", jerr)
+		http.Error(w, jerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jd)
+}
+
+// runWebhook runs the mutating admission webhook which injects the stratus agent
+func runWebhook() {
+	l := log.WithFields(log.Fields{
+		"func": "runWebhook",
+	})
+	l.Info("start")
+	r := mux.NewRouter()
+	r.HandleFunc("/mutate", handleAdmission).Methods("POST")
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8443"
+	}
+	l.Fatal(http.ListenAndServeTLS(":"+port, os.Getenv("WEBHOOK_TLS_CERT"), os.Getenv("WEBHOOK_TLS_KEY"), r))
+}
+
+// runAgent runs the in-pod credential agent
+func runAgent() {
+	l := log.WithFields(log.Fields{
+		"func": "runAgent",
+	})
+	if err := agent.FromEnv().Run(os.Getenv("STRATUS_AGENT_ONCE") == "true"); err != nil {
+		l.Fatal(err)
+	}
+}
+
+// vaultRequired returns true if the server uses vault, as the secret store,
+// as a config source, or to read externalId references if VAULT_ADDR is set
+func vaultRequired() bool {
+	switch os.Getenv("SECRET_STORE") {
+	case "", "vault":
+		return true
+	}
+	for _, s := range strings.Split(os.Getenv("CONFIG_SOURCES"), ",") {
+		if strings.TrimSpace(s) == "vault" {
+			return true
+		}
+	}
+	return os.Getenv("VAULT_ADDR") != ""
+}
+
+// initServer initializes the stratus server
+func initServer() {
 	// create vault client from environment
 	c := &vaultclient.VaultClient{
-		VaultAddr:  os.Getenv("VAULT_ADDR"),
-		Token:      os.Getenv("VAULT_TOKEN"),
-		Role:       os.Getenv("VAULT_ROLE"),
-		AuthMethod: os.Getenv("VAULT_AUTH_METHOD"),
+		VaultAddr:      os.Getenv("VAULT_ADDR"),
+		Token:          os.Getenv("VAULT_TOKEN"),
+		Role:           os.Getenv("VAULT_ROLE"),
+		AuthMethod:     os.Getenv("VAULT_AUTH_METHOD"),
+		Mount:          os.Getenv("VAULT_KV_MOUNT"),
+		Path:           os.Getenv("VAULT_KV_PATH"),
+		AuthMount:      os.Getenv("VAULT_AUTH_MOUNT"),
+		Namespace:      os.Getenv("VAULT_NAMESPACE"),
+		CACert:         os.Getenv("VAULT_CACERT"),
+		ClientCert:     os.Getenv("VAULT_CLIENT_CERT"),
+		ClientKey:      os.Getenv("VAULT_CLIENT_KEY"),
+		TLSServerName:  os.Getenv("VAULT_TLS_SERVER_NAME"),
+		TLSSkipVerify:  os.Getenv("VAULT_SKIP_VERIFY") == "true",
+		RoleIDFile:     os.Getenv("VAULT_ROLE_ID_FILE"),
+		SecretIDFile:   os.Getenv("VAULT_SECRET_ID_FILE"),
+		AWSRegion:      os.Getenv("VAULT_AWS_REGION"),
+		AWSSTSEndpoint: os.Getenv("VAULT_AWS_STS_ENDPOINT"),
+		AWSHeaderValue: os.Getenv("VAULT_AWS_HEADER_VALUE"),
+		GCPAuthType:    os.Getenv("VAULT_GCP_AUTH_TYPE"),
+		GCPCredentials: os.Getenv("VAULT_GCP_CREDENTIALS"),
+		TokenFile:      os.Getenv("VAULT_TOKEN_FILE"),
+	}
+	if v := os.Getenv("VAULT_KV_VERSION"); v != "" {
+		kv, err := strconv.Atoi(v)
+		if err != nil || (kv != 1 && kv != 2) {
+			log.Fatalf("invalid VAULT_KV_VERSION %q", v)
+		}
+		c.KVVersion = kv
 	}
-	// initialize global vault client
-	_, err := c.NewClient()
+	// initialize global vault client if vault is used
+	if vaultRequired() {
+		if _, err := c.NewClient(); err != nil {
+			log.Fatal(err)
+		}
+		// renew the vault token, logging in again when it can no longer be renewed
+		go vaultclient.Client.Run()
+	}
+	// select the store target secrets are read from
+	store, err := secretstore.FromEnv(vaultclient.Client)
 	if err != nil {
 		log.Fatal(err)
 	}
+	secretstore.Default = store
 	// monitor git repo, pull changes, and update config on changes
 	go config.RefreshSyncConfigs()
+	// register and refresh the k8s clusters used to validate sources
+	go identity.Clusters.Run(store)
+	// only record challenge nonces of sources which have a mapping
+	identity.ChallengeTable = config.Table
+	// rotate the keys of GCP targets in the secret store
+	if os.Getenv("GCP_KEY_ROTATION") == "true" {
+		rot, err := rotator.New(func() []identity.Identity {
+			return config.Table().Targets(identity.ProviderGCP)
+		}, store)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go rot.Run()
+	}
 }
 
-// main is the entry point for the application
+// main is the entry point for the application. The first argument selects the
+// mode: the stratus server (default), the admission webhook, or the agent.
 func main() {
 	l := log.WithFields(log.Fields{
 		"func": "main",
 	})
 	l.Info("start")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "webhook":
+			runWebhook()
+			return
+		case "agent":
+			runAgent()
+			return
+		case "server":
+		default:
+			l.Fatalf("unknown mode %q", os.Args[1])
+		}
+	}
+	initServer()
 	r := mux.NewRouter()
 	r.HandleFunc("/", handleIdentityRequest).Methods("POST")
+	r.HandleFunc("/status", handleStatus).Methods("GET")
+	r.HandleFunc("/status/clusters", handleClusterStatus).Methods("GET")
+	r.HandleFunc("/status/vault", handleVaultStatus).Methods("GET")
+	r.HandleFunc("/challenge", handleChallenge).Methods("POST")
+	r.HandleFunc("/webhook/config", handleConfigWebhook).Methods("POST")
+	r.Handle("/debug/vars", expvar.Handler()).Methods("GET")
 	http.ListenAndServe(":"+os.Getenv("PORT"), r)
 }
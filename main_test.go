@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVaultRequired(t *testing.T) {
+	tests := []struct {
+		name    string
+		store   string
+		sources string
+		addr    string
+		want    bool
+	}{
+		{"default store", "", "", "", true},
+		{"vault store", "vault", "", "", true},
+		{"sops store", "sops", "file", "", false},
+		{"aws store", "aws", "git,s3", "", false},
+		{"vault config source", "sops", "file, vault", "", true},
+		{"vault addr for externalId", "gcp", "", "https://vault.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range map[string]string{
+				"SECRET_STORE":   tt.store,
+				"CONFIG_SOURCES": tt.sources,
+				"VAULT_ADDR":     tt.addr,
+			} {
+				old, ok := os.LookupEnv(k)
+				os.Setenv(k, v)
+				defer func(k string) {
+					if ok {
+						os.Setenv(k, old)
+					} else {
+						os.Unsetenv(k)
+					}
+				}(k)
+			}
+			if got := vaultRequired(); got != tt.want {
+				t.Errorf("vaultRequired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleIdentityRequestNotAcceptable(t *testing.T) {
+	const gcpTarget = `{"source":{"id":"arn:aws:iam::123456789012:role/ci","provider":"aws"},` +
+		`"target":{"id":"sa@stratus-test.iam.gserviceaccount.com","provider":"gcp"}}`
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+	}{
+		{"unknown format", "?format=yaml", ""},
+		{"format unsupported for target", "?format=env", ""},
+		{"unsupported accept", "", "text/html"},
+		{"refused accept", "", "application/json;q=0"},
+		{"accept unsupported for target", "", "text/x-ini, */*;q=0.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/"+tt.query, strings.NewReader(gcpTarget))
+			r.Header.Set("x-request-id", "test")
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			handleIdentityRequest(w, r)
+			if w.Code != http.StatusNotAcceptable {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusNotAcceptable)
+			}
+			if got := w.Header().Get("x-request-id"); got != "test" {
+				t.Errorf("x-request-id = %q", got)
+			}
+		})
+	}
+}